@@ -1,13 +1,21 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/joho/godotenv"
+	"github.com/leroysb/go_kubernetes/internal/api/idempotency"
 	"github.com/leroysb/go_kubernetes/internal/api/routes"
 	"github.com/leroysb/go_kubernetes/internal/database"
+	"github.com/leroysb/go_kubernetes/internal/inventory"
+	"github.com/leroysb/go_kubernetes/internal/notifications"
+	"github.com/leroysb/go_kubernetes/internal/outbox"
+	"github.com/leroysb/go_kubernetes/internal/payments"
+	"github.com/leroysb/go_kubernetes/internal/webhooks"
 )
 
 func main() {
@@ -21,6 +29,31 @@ func main() {
 	// Connect to database
 	database.ConnectDB()
 
+	// Retry webhook deliveries interrupted by the last shutdown
+	go webhooks.Resume()
+
+	// Publish domain events recorded in the outbox
+	bus := outbox.NewBus()
+	bus.Subscribe(webhooks.EventOrderCreated, func(ctx context.Context, event outbox.Event) error {
+		return notifications.SendOrderReceipt(event.AggregateID)
+	})
+	bus.Subscribe(webhooks.EventOrderRefunded, func(ctx context.Context, event outbox.Event) error {
+		return notifications.SendRefundNotice(event.AggregateID)
+	})
+	bus.Subscribe(webhooks.EventProductRestocked, func(ctx context.Context, event outbox.Event) error {
+		return notifications.SendBackInStock(event.AggregateID)
+	})
+	go outbox.NewRelay(bus, outbox.WebhookSink{}).Run(context.Background())
+
+	// Settle M-Pesa payments whose callback never arrived
+	go payments.Run(context.Background(), 30*time.Second)
+
+	// Forget idempotency keys once they expire
+	go idempotency.Run(context.Background(), time.Hour)
+
+	// Report stock changed outside the inventory ledger
+	go inventory.Run(context.Background(), time.Hour)
+
 	// Initialize Fiber app
 	app := fiber.New()
 
@@ -14,7 +14,6 @@ import (
 )
 
 var requiredScope = os.Getenv("requiredScope")
-var hydraAdminUrl = os.Getenv("hydraAdminUrl")
 
 // HydraClientResponse communicates with the Hydra admin API to create a new OAuth2 client
 func GetAccessToken() (string, error) {
@@ -134,7 +133,7 @@ func introspectToken(accessToken string) (*TokenInfo, error) {
 	formData.Set("scope", requiredScope)
 
 	// Create the HTTP request
-	req, err := http.NewRequest("POST", hydraAdminUrl, strings.NewReader(formData.Encode()))
+	req, err := http.NewRequest("POST", os.Getenv("hydraAdminUrl"), strings.NewReader(formData.Encode()))
 	if err != nil {
 		fmt.Println("Error creating introspection request:", err)
 		return nil, err
@@ -209,3 +208,23 @@ func AuthMiddleware(next fiber.Handler) fiber.Handler {
 		return c.Next()
 	}
 }
+
+// AdminOnly guards the admin API. Besides being valid, the access token must carry the scope named
+// by ADMIN_SCOPE, and without one configured the admin API is closed
+func AdminOnly(c *fiber.Ctx) error {
+	authHeader := c.Get("Authorization")
+	if authHeader == "" || !strings.HasPrefix(authHeader, "Bearer ") {
+		return c.Status(http.StatusUnauthorized).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+
+	tokenInfo, err := introspectToken(strings.TrimPrefix(authHeader, "Bearer "))
+	if err != nil || !tokenInfo.Active {
+		return c.Status(http.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid token"})
+	}
+
+	adminScope := os.Getenv("ADMIN_SCOPE")
+	if adminScope == "" || !hasScope(tokenInfo.Scope, adminScope) {
+		return c.Status(http.StatusForbidden).JSON(fiber.Map{"error": "Insufficient scope"})
+	}
+	return c.Next()
+}
@@ -0,0 +1,439 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/leroysb/go_kubernetes/internal/database"
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// cartLine is an item of the cart priced as the catalogue is now. PriceChanged tells the unit price
+// differs from AddedPrice, the price when the item was added. Available is how many are in stock and
+// Removed tells the product, or its variant, is no longer sold. Error says why an item can no longer
+// be bought, and such items are left out of the cart's totals
+type cartLine struct {
+	ID           uint          `json:"id"`
+	ProductID    uint          `json:"product_id"`
+	VariantID    *uint         `json:"variant_id"`
+	Name         string        `json:"name"`
+	SKU          string        `json:"sku,omitempty"`
+	Quantity     int           `json:"quantity"`
+	UnitPrice    models.Money  `json:"unit_price"`
+	AddedPrice   *models.Money `json:"added_price,omitempty"`
+	PriceChanged bool          `json:"price_changed"`
+	Available    int           `json:"available"`
+	Removed      bool          `json:"removed"`
+	Discount     models.Money  `json:"discount"`
+	Subtotal     models.Money  `json:"subtotal"`
+	Tax          models.Money  `json:"tax"`
+	Amount       models.Money  `json:"amount"`
+	Error        string        `json:"error,omitempty"`
+}
+
+// cartSummary is a cart with its items and totals, tax included in Total. Valid is false while an
+// item has an Error, and that item cannot be ordered until it is changed or removed
+type cartSummary struct {
+	ID        uint         `json:"id"`
+	Valid     bool         `json:"valid"`
+	Items     []cartLine   `json:"items"`
+	Coupon    string       `json:"coupon,omitempty"`
+	Discount  models.Money `json:"discount"`
+	Subtotal  models.Money `json:"subtotal"`
+	Tax       models.Money `json:"tax"`
+	Total     models.Money `json:"total"`
+	ExpiresAt *time.Time   `json:"expires_at"`
+}
+
+// cartOwner finds the cart a request is for: the logged in customer's, or the guest's named by the
+// cart token sent with the request. With create, a cart is started when there is none, and nil is
+// returned otherwise
+type cartOwner func(c *fiber.Ctx, db *gorm.DB, create bool) (*models.Cart, error)
+
+// customerCart is the cartOwner of the logged in customer
+func customerCart(c *fiber.Ctx, db *gorm.DB, create bool) (*models.Cart, error) {
+	user := c.Locals("user").(*models.Customer)
+	return activeCart(db, user.ID, create)
+}
+
+// activeCart returns the customer's active cart, expiring it first if it has been left too long.
+// When there is none, a new one is started if create is set and nil is returned otherwise
+func activeCart(db *gorm.DB, customerID uint, create bool) (*models.Cart, error) {
+	var cart models.Cart
+	err := db.Where("customer_id = ? AND status = ?", customerID, models.CartActive).First(&cart).Error
+	if err == nil {
+		err = expireCart(db, &cart)
+	}
+	if err == nil {
+		return &cart, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	if !create {
+		return nil, nil
+	}
+
+	cart = models.Cart{CustomerID: &customerID, Status: models.CartActive, ExpiresAt: time.Now().Add(models.CartTTL())}
+	created := db.Clauses(clause.OnConflict{DoNothing: true}).Omit(clause.Associations).Create(&cart)
+	if created.Error != nil {
+		return nil, created.Error
+	}
+	if created.RowsAffected == 0 {
+		// Another request started a cart for the customer first
+		return activeCart(db, customerID, false)
+	}
+	return &cart, nil
+}
+
+// expireCart marks a cart expired once it has been left past its expiry, returning
+// gorm.ErrRecordNotFound so the caller starts afresh
+func expireCart(db *gorm.DB, cart *models.Cart) error {
+	if !cart.ExpiresAt.Before(time.Now()) {
+		return nil
+	}
+	if err := db.Model(cart).Update("status", models.CartExpired).Error; err != nil {
+		return err
+	}
+	return gorm.ErrRecordNotFound
+}
+
+// touchCart pushes back the expiry of a cart that was just changed
+func touchCart(db *gorm.DB, cart *models.Cart) error {
+	cart.ExpiresAt = time.Now().Add(models.CartTTL())
+	return db.Model(cart).Update("expires_at", cart.ExpiresAt).Error
+}
+
+// cartItems returns the items of the cart in the order they were added
+func cartItems(db *gorm.DB, cart *models.Cart) ([]models.CartItem, error) {
+	items := []models.CartItem{}
+	err := db.Where("cart_id = ?", cart.ID).Order("id").Find(&items).Error
+	return items, err
+}
+
+// summarizeCart prices the cart as the catalogue is now, taking off the coupon applied to it while
+// the coupon is still valid. A nil cart is summarized as an empty one
+func summarizeCart(db *gorm.DB, cart *models.Cart) (*cartSummary, error) {
+	summary := &cartSummary{Valid: true, Items: []cartLine{}, Discount: models.NewMoney(0), Subtotal: models.NewMoney(0), Tax: models.NewMoney(0), Total: models.NewMoney(0)}
+	if cart == nil {
+		return summary, nil
+	}
+	summary.ID = cart.ID
+	summary.ExpiresAt = &cart.ExpiresAt
+
+	promotion, err := cartPromotion(db, cart)
+	if err != nil {
+		return nil, err
+	}
+	if promotion != nil && cart.CustomerID != nil {
+		if err := checkPromotion(db, promotion, *cart.CustomerID, time.Now()); err != nil {
+			if !isCouponError(err) {
+				return nil, err
+			}
+			promotion = nil
+		} else {
+			summary.Coupon = promotion.Code
+		}
+	}
+
+	items, err := cartItems(db, cart)
+	if err != nil {
+		return nil, err
+	}
+	// Items are resolved first, as the coupon's minimum and a fixed amount depend on all of them
+	summary.Items = make([]cartLine, len(items))
+	var resolved []*orderLine
+	var quantities []int
+	var positions []int
+	for i, item := range items {
+		entry := cartLine{ID: item.ID, ProductID: item.ProductID, VariantID: item.VariantID, Quantity: item.Quantity}
+		if item.AddedPrice.Amount != 0 {
+			entry.AddedPrice = &item.AddedPrice
+		}
+		line, err := resolveLine(db, item.ProductID, item.VariantID)
+		if err != nil {
+			switch {
+			case errors.Is(err, gorm.ErrRecordNotFound):
+				entry.Error = "Product not found"
+			case errors.Is(err, errVariantRequired), errors.Is(err, errVariantNotFound), errors.Is(err, errProductDeleted):
+				entry.Error = err.Error()
+			default:
+				return nil, err
+			}
+			entry.Removed = true
+			summary.Valid = false
+		} else {
+			resolved, quantities, positions = append(resolved, line), append(quantities, item.Quantity), append(positions, i)
+		}
+		summary.Items[i] = entry
+	}
+
+	discounts := make([]models.Money, len(resolved))
+	if promotion != nil {
+		if discounts, _, err = couponDiscounts(db, promotion, resolved, quantities); err != nil {
+			return nil, err
+		}
+	}
+
+	for n, line := range resolved {
+		entry := &summary.Items[positions[n]]
+		entry.Name = line.Product.Name
+		if line.Variant != nil {
+			entry.SKU = line.Variant.SKU
+		}
+		entry.UnitPrice = line.UnitPrice
+		entry.Available = line.Available
+		entry.PriceChanged = entry.AddedPrice != nil && *entry.AddedPrice != line.UnitPrice
+
+		var priced models.Order
+		line.charge(&priced, entry.Quantity, discounts[n])
+		entry.Discount, entry.Subtotal, entry.Tax, entry.Amount = priced.Discount, priced.Subtotal, priced.Tax, priced.Amount
+
+		if line.Available < entry.Quantity {
+			entry.Error = "Product not available"
+			summary.Valid = false
+		} else {
+			summary.Discount.Amount += entry.Discount.Amount
+			summary.Subtotal.Amount += entry.Subtotal.Amount
+			summary.Tax.Amount += entry.Tax.Amount
+			summary.Total.Amount += entry.Amount.Amount
+		}
+	}
+	return summary, nil
+}
+
+// takeFromCart takes quantity items of an ordered line out of the customer's cart, removing the item
+// once none of it is left. Nothing is taken when the line is not in the cart
+func takeFromCart(tx *gorm.DB, customerID uint, line *orderLine, quantity int) error {
+	cart, err := activeCart(tx, customerID, false)
+	if err != nil || cart == nil {
+		return err
+	}
+	items, err := cartItems(tx, cart)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		if item.ProductID != line.Product.ID || !sameVariant(item.VariantID, line.Variant) {
+			continue
+		}
+		if item.Quantity <= quantity {
+			return tx.Unscoped().Delete(&item).Error
+		}
+		return tx.Model(&item).Update("quantity", item.Quantity-quantity).Error
+	}
+	return nil
+}
+
+// sendCart responds with the cart of the owner
+func sendCart(c *fiber.Ctx, owner cartOwner) error {
+	cart, err := owner(c, database.DB.Db, false)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+	summary, err := summarizeCart(database.DB.Db, cart)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+	return c.JSON(summary)
+}
+
+// GetCart returns the customer's cart with its items and totals at today's prices
+func GetCart(c *fiber.Ctx) error {
+	return sendCart(c, customerCart)
+}
+
+// AddCartItem puts a product, or one of its variants, in the customer's cart, starting a cart if
+// they have none. Adding one that is already there adds to its quantity
+func AddCartItem(c *fiber.Ctx) error {
+	return addCartItem(c, customerCart)
+}
+
+// UpdateCartItem changes the quantity of an item of the customer's cart
+func UpdateCartItem(c *fiber.Ctx) error {
+	return updateCartItem(c, customerCart)
+}
+
+// DeleteCartItem takes an item out of the customer's cart
+func DeleteCartItem(c *fiber.Ctx) error {
+	return deleteCartItem(c, customerCart)
+}
+
+func addCartItem(c *fiber.Ctx, owner cartOwner) error {
+	var body models.CartItem
+	if err := c.BodyParser(&body); err != nil {
+		if _, ok := err.(*json.UnmarshalTypeError); ok {
+			if strings.Contains(err.Error(), "product_id") {
+				return c.Status(400).JSON(fiber.Map{"error": "Missing product_id of type int"})
+			}
+			if strings.Contains(err.Error(), "quantity") {
+				return c.Status(400).JSON(fiber.Map{"error": "Missing quantity of type int"})
+			}
+		}
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	if body.ProductID <= 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "Missing product_id"})
+	}
+
+	if body.Quantity <= 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "Missing quantity"})
+	}
+
+	// Retrieve product, and variant if one was chosen, from the database
+	line, err := resolveLine(database.DB.Db, body.ProductID, body.VariantID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(400).JSON(fiber.Map{"error": "Product not found"})
+		}
+		if errors.Is(err, errVariantRequired) || errors.Is(err, errVariantNotFound) || errors.Is(err, errProductDeleted) {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	err = database.DB.Db.Transaction(func(tx *gorm.DB) error {
+		return putInCart(c, tx, owner, line, body.Quantity)
+	})
+	if err != nil {
+		if errors.Is(err, errOutOfStock) {
+			return c.Status(400).JSON(fiber.Map{"error": "Product not available"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	return sendCart(c, owner)
+}
+
+// putInCart adds quantity of the line to the owner's cart, starting a cart if there is none, and
+// fails with errOutOfStock when the cart would then hold more than is in stock
+func putInCart(c *fiber.Ctx, tx *gorm.DB, owner cartOwner, line *orderLine, quantity int) error {
+	cart, err := owner(c, tx, true)
+	if err != nil {
+		return err
+	}
+
+	var variantID *uint
+	if line.Variant != nil {
+		variantID = &line.Variant.ID
+	}
+	item, err := findCartLine(tx, cart, line.Product.ID, variantID)
+	if err != nil {
+		return err
+	}
+	item.Quantity += quantity
+	item.AddedPrice = line.UnitPrice
+	if line.Available < item.Quantity {
+		return errOutOfStock
+	}
+	if err := tx.Save(item).Error; err != nil {
+		return err
+	}
+	return touchCart(tx, cart)
+}
+
+// findCartLine returns the item of the cart for the product and variant, or a new empty one
+func findCartLine(db *gorm.DB, cart *models.Cart, productID uint, variantID *uint) (*models.CartItem, error) {
+	item := models.CartItem{CartID: cart.ID, ProductID: productID, VariantID: variantID}
+	query := db.Where("cart_id = ? AND product_id = ?", cart.ID, productID)
+	if variantID == nil {
+		query = query.Where("variant_id IS NULL")
+	} else {
+		query = query.Where("variant_id = ?", *variantID)
+	}
+	if err := query.First(&item).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// findCartItem loads an item of the owner's cart by the id in the path
+func findCartItem(c *fiber.Ctx, owner cartOwner) (*models.Cart, *models.CartItem, error) {
+	cart, err := owner(c, database.DB.Db, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cart == nil {
+		return nil, nil, gorm.ErrRecordNotFound
+	}
+
+	var item models.CartItem
+	if err := database.DB.Db.Where("cart_id = ?", cart.ID).First(&item, c.Params("id")).Error; err != nil {
+		return nil, nil, err
+	}
+	return cart, &item, nil
+}
+
+func updateCartItem(c *fiber.Ctx, owner cartOwner) error {
+	var body struct {
+		Quantity int `json:"quantity"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	if body.Quantity <= 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "Missing quantity"})
+	}
+
+	cart, item, err := findCartItem(c, owner)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(404).JSON(fiber.Map{"error": "Cart item not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	line, err := resolveLine(database.DB.Db, item.ProductID, item.VariantID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(400).JSON(fiber.Map{"error": "Product not found"})
+		}
+		if errors.Is(err, errVariantRequired) || errors.Is(err, errVariantNotFound) || errors.Is(err, errProductDeleted) {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+	if line.Available < body.Quantity {
+		return c.Status(400).JSON(fiber.Map{"error": "Product not available"})
+	}
+
+	err = database.DB.Db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(item).Update("quantity", body.Quantity).Error; err != nil {
+			return err
+		}
+		return touchCart(tx, cart)
+	})
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	return sendCart(c, owner)
+}
+
+func deleteCartItem(c *fiber.Ctx, owner cartOwner) error {
+	cart, item, err := findCartItem(c, owner)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(404).JSON(fiber.Map{"error": "Cart item not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	err = database.DB.Db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Delete(item).Error; err != nil {
+			return err
+		}
+		return touchCart(tx, cart)
+	})
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	return sendCart(c, owner)
+}
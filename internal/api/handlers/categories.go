@@ -0,0 +1,270 @@
+package handlers
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/leroysb/go_kubernetes/internal/database"
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"gorm.io/gorm"
+)
+
+type categoryRequest struct {
+	Name     string `json:"name"`
+	ParentID *uint  `json:"parent_id"`
+}
+
+// categoryWithDescendants returns the id of a category followed by the ids of all its subcategories
+func categoryWithDescendants(db *gorm.DB, id uint) ([]uint, error) {
+	ids := []uint{id}
+	level := []uint{id}
+	for len(level) > 0 {
+		var children []uint
+		if err := db.Model(&models.Category{}).Where("parent_id IN ?", level).Pluck("id", &children).Error; err != nil {
+			return nil, err
+		}
+		ids = append(ids, children...)
+		level = children
+	}
+	return ids, nil
+}
+
+// validateParent checks that parentID exists and would not make the category its own ancestor
+func validateParent(categoryID uint, parentID *uint) error {
+	if parentID == nil {
+		return nil
+	}
+
+	var parent models.Category
+	if err := database.DB.Db.First(&parent, *parentID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errors.New("Parent category not found")
+		}
+		return err
+	}
+
+	if categoryID == 0 {
+		return nil
+	}
+	descendants, err := categoryWithDescendants(database.DB.Db, categoryID)
+	if err != nil {
+		return err
+	}
+	for _, id := range descendants {
+		if id == *parentID {
+			return errors.New("Category cannot be moved under itself or a subcategory")
+		}
+	}
+	return nil
+}
+
+// GetCategories returns the category tree
+func GetCategories(c *fiber.Ctx) error {
+	var categories []models.Category
+	if err := database.DB.Db.Order("name").Find(&categories).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	// Group categories by parent, with the roots under id 0, then nest them from the roots down
+	children := make(map[uint][]models.Category)
+	for _, category := range categories {
+		var parentID uint
+		if category.ParentID != nil {
+			parentID = *category.ParentID
+		}
+		children[parentID] = append(children[parentID], category)
+	}
+
+	var build func(parentID uint) []models.Category
+	build = func(parentID uint) []models.Category {
+		level := children[parentID]
+		for i := range level {
+			level[i].Children = build(level[i].ID)
+		}
+		return level
+	}
+
+	tree := build(0)
+	if tree == nil {
+		tree = []models.Category{}
+	}
+	return c.JSON(tree)
+}
+
+// GetCategory returns a category with its direct subcategories
+func GetCategory(c *fiber.Ctx) error {
+	var category models.Category
+	if err := database.DB.Db.Preload("Children").First(&category, c.Params("id")).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(404).JSON(fiber.Map{"error": "Category not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+	return c.JSON(category)
+}
+
+// CreateCategory creates a category, optionally under a parent
+func CreateCategory(c *fiber.Ctx) error {
+	var req categoryRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "Missing name"})
+	}
+
+	if err := validateParent(0, req.ParentID); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	category := models.Category{Name: req.Name, ParentID: req.ParentID}
+	if err := database.DB.Db.Create(&category).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	return c.Status(201).JSON(category)
+}
+
+// UpdateCategory renames a category or moves it under another parent
+func UpdateCategory(c *fiber.Ctx) error {
+	var category models.Category
+	if err := database.DB.Db.First(&category, c.Params("id")).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(404).JSON(fiber.Map{"error": "Category not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	var req categoryRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "Missing name"})
+	}
+
+	if err := validateParent(category.ID, req.ParentID); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	category.Name = req.Name
+	category.ParentID = req.ParentID
+	if err := database.DB.Db.Select("name", "parent_id").Updates(&category).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	return c.JSON(category)
+}
+
+// DeleteCategory deletes a category. Its subcategories move up to its parent and its products are unlinked
+func DeleteCategory(c *fiber.Ctx) error {
+	var category models.Category
+	if err := database.DB.Db.First(&category, c.Params("id")).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(404).JSON(fiber.Map{"error": "Category not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	err := database.DB.Db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.Category{}).Where("parent_id = ?", category.ID).Update("parent_id", category.ParentID).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&category).Association("Products").Clear(); err != nil {
+			return err
+		}
+		return tx.Delete(&category).Error
+	})
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	return c.SendStatus(204)
+}
+
+// GetCategoryProducts returns a page of the products in a category and its subcategories
+func GetCategoryProducts(c *fiber.Ctx) error {
+	var category models.Category
+	if err := database.DB.Db.First(&category, c.Params("id")).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(404).JSON(fiber.Map{"error": "Category not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	search, err := parseProductSearch(c)
+	if errors.Is(err, errSearchLookup) {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	if search.CategoryIDs, err = categoryWithDescendants(database.DB.Db, category.ID); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	return listProducts(c, search)
+}
+
+// SetProductCategories replaces the categories a product belongs to
+func SetProductCategories(c *fiber.Ctx) error {
+	var body struct {
+		CategoryIDs []uint `json:"category_ids"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	var product models.Product
+	if err := database.DB.Db.First(&product, c.Params("id")).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(404).JSON(fiber.Map{"error": "Product not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	var categories []models.Category
+	if len(body.CategoryIDs) > 0 {
+		if err := database.DB.Db.Where("id IN ?", body.CategoryIDs).Find(&categories).Error; err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+		}
+		if len(categories) != len(uniqueIDs(body.CategoryIDs)) {
+			return c.Status(400).JSON(fiber.Map{"error": "Category not found"})
+		}
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- database.DB.Db.Model(&product).Association("Categories").Replace(categories)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+		}
+		product.Categories = categories
+		return c.JSON(product)
+	case <-time.After(5 * time.Second):
+		return c.Status(500).JSON(fiber.Map{"error": "Timeout"})
+	}
+}
+
+func uniqueIDs(ids []uint) []uint {
+	seen := make(map[uint]bool, len(ids))
+	var unique []uint
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	return unique
+}
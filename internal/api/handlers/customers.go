@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"net/mail"
 	"strings"
 	"time"
 
@@ -12,11 +13,17 @@ import (
 	"github.com/leroysb/go_kubernetes/internal/api/auth"
 	"github.com/leroysb/go_kubernetes/internal/database"
 	"github.com/leroysb/go_kubernetes/internal/database/models"
-	"github.com/leroysb/go_kubernetes/internal/sms"
+	"github.com/leroysb/go_kubernetes/internal/inventory"
+	"github.com/leroysb/go_kubernetes/internal/notifications"
+	"github.com/leroysb/go_kubernetes/internal/outbox"
 	"github.com/leroysb/go_kubernetes/internal/utils"
+	"github.com/leroysb/go_kubernetes/internal/webhooks"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
+var errOutOfStock = errors.New("product not available")
+
 // CreateCustomer creates a new customer
 func CreateCustomer(c *fiber.Ctx) error {
 	customer := new(models.Customer)
@@ -33,6 +40,9 @@ func CreateCustomer(c *fiber.Ctx) error {
 			if strings.Contains(err.Error(), "password") {
 				return c.Status(400).JSON(fiber.Map{"error": "Missing password of type string"})
 			}
+			if strings.Contains(err.Error(), "email") {
+				return c.Status(400).JSON(fiber.Map{"error": "Invalid email of type string"})
+			}
 		}
 		if strings.Contains(err.Error(), "unexpected end of JSON input") {
 			return c.Status(400).JSON(fiber.Map{"error": "Invalid JSON input"})
@@ -55,6 +65,13 @@ func CreateCustomer(c *fiber.Ctx) error {
 		return c.Status(400).JSON(fiber.Map{"error": "Missing password"})
 	}
 
+	// Email is optional, but must be a bare address when given
+	if customer.Email != "" {
+		if address, err := mail.ParseAddress(customer.Email); err != nil || address.Address != customer.Email {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid email"})
+		}
+	}
+
 	// Hash the password
 	hashedPassword := utils.HashPassword(customer.Password)
 	customer.Password = string(hashedPassword)
@@ -76,7 +93,10 @@ func CreateCustomer(c *fiber.Ctx) error {
 	}()
 
 	go func() {
-		sms.SendSMS(customer.Phone, "Welcome to our go_kubernetes platform")
+		notifications.Notify(customer, notifications.EventSignup, notifications.Message{
+			Subject: "Welcome to go_kubernetes",
+			Text:    "Welcome to our go_kubernetes platform",
+		})
 	}()
 
 	// return c.Status(200).JSON(customer)
@@ -139,6 +159,14 @@ func Login(c *fiber.Ctx) error {
 		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
 	}
 
+	// Bring along what the customer put in their cart before logging in. Login still succeeds if
+	// that fails, and the guest cart is kept so it can be merged next time
+	if err := mergeGuestCart(c, user.ID); err != nil {
+		fmt.Println("Error merging guest cart:", err)
+	} else if requestCartToken(c) != "" {
+		c.ClearCookie(CartTokenCookie)
+	}
+
 	// Set the access token in the response headers
 	c.Set("Authorization", "Bearer "+accessToken)
 
@@ -160,12 +188,11 @@ func Logout(c *fiber.Ctx) error {
 	return nil
 }
 
-func CreateCart(c *fiber.Ctx) error {
-	order := new(models.Order)
-
-	// Set the customer_id from the authorized user
+func CreateOrder(c *fiber.Ctx) error {
+	// Retrieve user information from the context
 	user := c.Locals("user").(*models.Customer)
-	order.CustomerID = user.ID
+
+	order := new(models.Order)
 
 	// Error check fields
 	if err := c.BodyParser(order); err != nil {
@@ -173,9 +200,6 @@ func CreateCart(c *fiber.Ctx) error {
 			if strings.Contains(err.Error(), "product_id") {
 				return c.Status(400).JSON(fiber.Map{"error": "Missing product_id of type int"})
 			}
-			if strings.Contains(err.Error(), "quantity") {
-				return c.Status(400).JSON(fiber.Map{"error": "Missing quantity of type int"})
-			}
 		}
 		// return c.Status(400).SendString(err.Error())
 		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
@@ -189,163 +213,97 @@ func CreateCart(c *fiber.Ctx) error {
 		return c.Status(400).JSON(fiber.Map{"error": "Missing quantity"})
 	}
 
-	// Retrieve product from the database
-	var product models.Product
-	if err := database.DB.Db.Where("id = ?", order.ProductID).First(&product).Error; err != nil {
+	// Where the order ships to, if given, lets it be sent from the nearest warehouse
+	var shipTo struct {
+		Location *inventory.Location `json:"ship_to"`
+	}
+	if err := c.BodyParser(&shipTo); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid ship_to"})
+	}
+
+	// Retrieve product, and variant if one was chosen, from the database
+	line, err := resolveLine(database.DB.Db, order.ProductID, order.VariantID)
+	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			return c.Status(400).JSON(fiber.Map{"error": "Product not found"})
 		}
+		if errors.Is(err, errVariantRequired) || errors.Is(err, errVariantNotFound) || errors.Is(err, errProductDeleted) {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
 		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
 	}
+	product := line.Product
 
 	// check if product is available
-	if product.Stock < order.Quantity {
+	if line.Available < order.Quantity {
 		return c.Status(400).JSON(fiber.Map{"error": "Product not available"})
 	}
 
-	// Set the product_id and amount
-	order.ProductID = product.ID
-	order.Amount = order.Quantity * product.Price
-
-	// Set the time and status
-	order.Status = "cart"
-
-	// Create the order in a goroutine
-	go func() {
-		if err := database.DB.Db.Create(&order).Error; err != nil {
-			// Handle error in goroutine
-			// fmt.Println("Error creating order:", err)
-			c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
-			return
-		}
-	}()
-
-	return c.Status(200).JSON(order)
-}
-
-func GetCart(c *fiber.Ctx) error {
-	// Retrieve user information from the context
-	user := c.Locals("user").(*models.Customer)
-
-	// Retrieve cart items from the database
-	var cartItems []models.Cart
-	if err := database.DB.Db.Table("orders").Select("product_id, quantity").Where("customer_id = ? AND status = ?", user.ID, "cart").Scan(&cartItems).Error; err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
-	}
-
-	// Return cart items
-	return c.JSON(cartItems)
-}
-
-func UpdateCart(c *fiber.Ctx) error {
-	// Retrieve user information from the context
-	user := c.Locals("user").(*models.Customer)
-
-	// Retrieve product_id and quantity from the request
-	var cartItem models.Cart
-	if err := c.BodyParser(&cartItem); err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
-	}
-
-	// Retrieve the order from the database
-	var order models.Order
-	if err := database.DB.Db.Where("id = ? AND customer_id = ? AND status = ?", c.Params("id"), user.ID, "cart").First(&order).Error; err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return c.Status(400).JSON(fiber.Map{"error": "Order not found"})
+	// The coupon applied to the cart, if it covers this product, is taken off before tax
+	discount, promotion, err := checkoutDiscount(user.ID, line, order.Quantity)
+	if err != nil {
+		if isCouponError(err) {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
 		}
 		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
 	}
 
-	// Update the order in the database
-	if err := database.DB.Db.Model(&order).Updates(models.Order{Quantity: cartItem.Quantity}).Error; err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	// Set the customer_id, product_id and amounts
+	order.CustomerID = user.ID
+	order.ProductID = product.ID
+	order.PromotionID = nil
+	if promotion != nil {
+		order.PromotionID = &promotion.ID
 	}
+	line.charge(order, order.Quantity, discount)
 
-	return c.Status(200).JSON(order)
-}
-
-func DeleteCart(c *fiber.Ctx) error {
-	// Retrieve user information from the context
-	user := c.Locals("user").(*models.Customer)
+	// Set the time and status
+	order.Time = time.Now().Format("2006-01-02 15:04:05")
+	order.Status = "ordered"
 
-	// Retrieve the order from the database
-	var order models.Order
-	if err := database.DB.Db.Where("id = ? AND customer_id = ? AND status = ?", c.Params("id"), user.ID, "cart").First(&order).Error; err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return c.Status(400).JSON(fiber.Map{"error": "Order not found"})
+	// Create the order, reduce the stock and record the resulting events in one transaction.
+	// The outbox relay publishes the events, including the receipt notification, after commit
+	previousStock := product.Stock
+	err = database.DB.Db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit(clause.Associations).Create(order).Error; err != nil {
+			return err
 		}
-		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
-	}
 
-	// Delete the order from the database
-	if err := database.DB.Db.Delete(&order).Error; err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
-	}
-
-	return c.Status(200).JSON(fiber.Map{"message": "Order deleted"})
-}
-
-func CreateOrder(c *fiber.Ctx) error {
-	// Retrieve user information from the context
-	user := c.Locals("user").(*models.Customer)
+		sale := models.StockMovement{Reference: fmt.Sprintf("order:%d", order.ID), Actor: stockActor(c)}
+		if err := reserveStock(tx, line, order, shipTo.Location, sale); err != nil {
+			return err
+		}
+		product = line.Product
 
-	order := new(models.Order)
+		// What was ordered is taken out of the cart, and the rest of it is left to buy later
+		if err := takeFromCart(tx, user.ID, line, order.Quantity); err != nil {
+			return err
+		}
 
-	// Error check fields
-	if err := c.BodyParser(order); err != nil {
-		if _, ok := err.(*json.UnmarshalTypeError); ok {
-			if strings.Contains(err.Error(), "product_id") {
-				return c.Status(400).JSON(fiber.Map{"error": "Missing product_id of type int"})
+		if order.PromotionID != nil {
+			if err := redeemPromotion(tx, *order.PromotionID, user.ID); err != nil {
+				return err
 			}
 		}
-		// return c.Status(400).SendString(err.Error())
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
-	}
 
-	if order.ProductID <= 0 {
-		return c.Status(400).JSON(fiber.Map{"error": "Missing product_id"})
-	}
-
-	// Retrieve product from the database
-	var product models.Product
-	if err := database.DB.Db.Where("id = ?", order.ProductID).First(&product).Error; err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return c.Status(400).JSON(fiber.Map{"error": "Product not found"})
+		if err := outbox.Write(tx, webhooks.EventOrderCreated, "order", order.ID, order); err != nil {
+			return err
 		}
-		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
-	}
-
-	// check if product is available
-	if product.Stock < order.Quantity {
-		return c.Status(400).JSON(fiber.Map{"error": "Product not available"})
-	}
-
-	// Set the product_id and amount
-	order.ProductID = product.ID
-	order.Amount = order.Quantity * product.Price
-
-	// Set the time and status
-	order.Time = time.Now().Format("2006-01-02 15:04:05")
-	order.Status = "ordered"
 
-	// Create the order in a goroutine
-	go func() {
-		if err := database.DB.Db.Create(&order).Error; err != nil {
-			// Handle error in goroutine
-			fmt.Println("Error creating order:", err)
-			c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
-			return
+		if webhooks.LowStockCrossed(previousStock, product.Stock) {
+			return outbox.Write(tx, webhooks.EventProductStockLow, "product", product.ID, fiber.Map{"product": product, "threshold": webhooks.LowStockThreshold()})
 		}
-	}()
-
-	go func() {
-		sms.SendSMS(user.Phone, "Order successful")
-	}()
-
-	// reduce the stock of the product
-	product.Stock -= order.Quantity
-	if err := database.DB.Db.Model(&product).Updates(models.Product{Stock: product.Stock}).Error; err != nil {
-		fmt.Println("Error updating product stock:", err)
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, errOutOfStock) {
+			return c.Status(400).JSON(fiber.Map{"error": "Product not available"})
+		}
+		if isCouponError(err) {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		fmt.Println("Error creating order:", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
 	}
 
 	return c.Status(200).JSON(order)
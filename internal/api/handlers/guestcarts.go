@@ -0,0 +1,218 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/leroysb/go_kubernetes/internal/database"
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// CartTokenHeader and CartTokenCookie carry the token of a guest's cart. Either may be sent, and
+// both are set on every response about a guest cart
+const (
+	CartTokenHeader = "X-Cart-Token"
+	CartTokenCookie = "cart_token"
+)
+
+var (
+	fallbackCartKey     []byte
+	fallbackCartKeyOnce sync.Once
+)
+
+// cartTokenKey is the key guest cart tokens are signed with, from CART_TOKEN_SECRET. Without it a
+// random key is made for the process, so guest carts are lost when the server restarts
+func cartTokenKey() []byte {
+	if secret := os.Getenv("CART_TOKEN_SECRET"); secret != "" {
+		return []byte(secret)
+	}
+	fallbackCartKeyOnce.Do(func() {
+		fallbackCartKey = make([]byte, 32)
+		if _, err := rand.Read(fallbackCartKey); err != nil {
+			log.Fatalf("Error generating cart token key: %v", err)
+		}
+		log.Println("CART_TOKEN_SECRET is not set, guest carts will not survive a restart")
+	})
+	return fallbackCartKey
+}
+
+func signCart(id string) string {
+	mac := hmac.New(sha256.New, cartTokenKey())
+	mac.Write([]byte(id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// cartToken returns the token naming a guest cart, its id followed by the id's signature
+func cartToken(cart *models.Cart) string {
+	id := strconv.FormatUint(uint64(cart.ID), 10)
+	return id + "." + signCart(id)
+}
+
+// parseCartToken returns the id of the cart a token names, or false when it was not signed by us
+func parseCartToken(token string) (uint, bool) {
+	id, signature, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(signCart(id))) {
+		return 0, false
+	}
+	cartID, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return uint(cartID), true
+}
+
+// requestCartToken returns the cart token sent with the request, preferring the header to the cookie
+func requestCartToken(c *fiber.Ctx) string {
+	if token := c.Get(CartTokenHeader); token != "" {
+		return token
+	}
+	return c.Cookies(CartTokenCookie)
+}
+
+// setCartToken hands the guest the token of their cart, for as long as the cart is kept
+func setCartToken(c *fiber.Ctx, cart *models.Cart) {
+	token := cartToken(cart)
+	c.Set(CartTokenHeader, token)
+	c.Cookie(&fiber.Cookie{
+		Name:     CartTokenCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  cart.ExpiresAt,
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+}
+
+// findGuestCart loads the active guest cart named by the request's token, expiring it first if it
+// has been left too long. A missing or forged token finds no cart
+func findGuestCart(c *fiber.Ctx, db *gorm.DB) (*models.Cart, error) {
+	cartID, ok := parseCartToken(requestCartToken(c))
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	var cart models.Cart
+	err := db.Where("customer_id IS NULL AND status = ?", models.CartActive).First(&cart, cartID).Error
+	if err == nil {
+		err = expireCart(db, &cart)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &cart, nil
+}
+
+// guestCart is the cartOwner of a visitor who has not logged in
+func guestCart(c *fiber.Ctx, db *gorm.DB, create bool) (*models.Cart, error) {
+	cart, err := findGuestCart(c, db)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	if cart == nil {
+		if !create {
+			return nil, nil
+		}
+		cart = &models.Cart{Status: models.CartActive, ExpiresAt: time.Now().Add(models.CartTTL())}
+		if err := db.Omit(clause.Associations).Create(cart).Error; err != nil {
+			return nil, err
+		}
+	}
+	setCartToken(c, cart)
+	return cart, nil
+}
+
+// GetGuestCart returns the cart of a visitor who has not logged in, named by their cart token
+func GetGuestCart(c *fiber.Ctx) error {
+	return sendCart(c, guestCart)
+}
+
+// AddGuestCartItem puts a product in a guest's cart, starting one and handing back its token when
+// the request has none
+func AddGuestCartItem(c *fiber.Ctx) error {
+	return addCartItem(c, guestCart)
+}
+
+// UpdateGuestCartItem changes the quantity of an item of a guest's cart
+func UpdateGuestCartItem(c *fiber.Ctx) error {
+	return updateCartItem(c, guestCart)
+}
+
+// DeleteGuestCartItem takes an item out of a guest's cart
+func DeleteGuestCartItem(c *fiber.Ctx) error {
+	return deleteCartItem(c, guestCart)
+}
+
+// mergeGuestCart moves the guest cart of the request, if any, to the customer who has just logged in.
+// A customer without an active cart takes the guest cart over whole. Otherwise the guest's items are
+// added to the customer's cart: items that can no longer be bought are dropped, the quantities of an
+// item in both carts are added up to what is in stock, though never below what the customer already
+// had, and the customer's coupon is kept. The guest cart is then marked merged
+func mergeGuestCart(c *fiber.Ctx, customerID uint) error {
+	return database.DB.Db.Transaction(func(tx *gorm.DB) error {
+		guest, err := findGuestCart(c, tx)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil
+			}
+			return err
+		}
+
+		cart, err := activeCart(tx, customerID, false)
+		if err != nil {
+			return err
+		}
+		if cart == nil {
+			return tx.Model(guest).Updates(map[string]any{
+				"customer_id": customerID,
+				"expires_at":  time.Now().Add(models.CartTTL()),
+			}).Error
+		}
+
+		items, err := cartItems(tx, guest)
+		if err != nil {
+			return err
+		}
+		for _, guestItem := range items {
+			line, err := resolveLine(tx, guestItem.ProductID, guestItem.VariantID)
+			if err != nil {
+				if errors.Is(err, gorm.ErrRecordNotFound) || errors.Is(err, errVariantRequired) ||
+					errors.Is(err, errVariantNotFound) || errors.Is(err, errProductDeleted) {
+					continue
+				}
+				return err
+			}
+
+			item, err := findCartLine(tx, cart, guestItem.ProductID, guestItem.VariantID)
+			if err != nil {
+				return err
+			}
+			quantity := min(item.Quantity+guestItem.Quantity, line.Available)
+			if quantity <= item.Quantity {
+				continue
+			}
+			if item.ID == 0 {
+				item.AddedPrice = guestItem.AddedPrice
+			}
+			item.Quantity = quantity
+			if err := tx.Save(item).Error; err != nil {
+				return err
+			}
+		}
+
+		if err := tx.Model(guest).Update("status", models.CartMerged).Error; err != nil {
+			return err
+		}
+		return touchCart(tx, cart)
+	})
+}
@@ -0,0 +1,279 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/leroysb/go_kubernetes/internal/database"
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"github.com/leroysb/go_kubernetes/internal/imaging"
+	"github.com/leroysb/go_kubernetes/internal/storage"
+	"gorm.io/gorm"
+)
+
+const thumbnailSize = 320
+
+// maxImageSize is the largest upload accepted, from IMAGE_MAX_BYTES. It defaults to 2 MiB, which
+// leaves room for the multipart envelope under the 4 MiB request body limit
+func maxImageSize() int64 {
+	if size, err := strconv.ParseInt(os.Getenv("IMAGE_MAX_BYTES"), 10, 64); err == nil && size > 0 {
+		return size
+	}
+	return 2 << 20
+}
+
+// maxImagePixels is the most pixels an upload may have, from IMAGE_MAX_PIXELS. It defaults to 25
+// megapixels, as decoding takes 4 bytes a pixel however well the file compresses
+func maxImagePixels() int {
+	if pixels, err := strconv.Atoi(os.Getenv("IMAGE_MAX_PIXELS")); err == nil && pixels > 0 {
+		return pixels
+	}
+	return 25_000_000
+}
+
+// orderImages sorts preloaded images by their position
+func orderImages(db *gorm.DB) *gorm.DB {
+	return db.Order("position, id")
+}
+
+// attachImages loads the images of a page of products in one query
+func attachImages(products []models.Product) error {
+	if len(products) == 0 {
+		return nil
+	}
+
+	ids := make([]uint, len(products))
+	for i, product := range products {
+		ids[i] = product.ID
+	}
+
+	var images []models.ProductImage
+	if err := orderImages(database.DB.Db).Where("product_id IN ?", ids).Find(&images).Error; err != nil {
+		return err
+	}
+
+	byProduct := make(map[uint][]models.ProductImage)
+	for _, image := range images {
+		byProduct[image.ProductID] = append(byProduct[image.ProductID], image)
+	}
+	for i := range products {
+		products[i].Images = byProduct[products[i].ID]
+	}
+	return nil
+}
+
+func randomName() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// deleteObjects removes stored files, logging the ones that could not be removed
+func deleteObjects(ctx context.Context, store storage.Storage, keys ...string) {
+	for _, key := range keys {
+		if err := store.Delete(ctx, key); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			log.Printf("Error deleting stored file %s: %v", key, err)
+		}
+	}
+}
+
+// GetProductImages returns the images of a product in display order
+func GetProductImages(c *fiber.Ctx) error {
+	var product models.Product
+	if err := database.DB.Db.Preload("Images", orderImages).First(&product, c.Params("id")).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(404).JSON(fiber.Map{"error": "Product not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	if product.Images == nil {
+		product.Images = []models.ProductImage{}
+	}
+	return c.JSON(product.Images)
+}
+
+// UploadProductImage stores the JPEG, PNG or GIF sent in the image form field along with a
+// thumbnail, and adds it after the product's other images
+func UploadProductImage(c *fiber.Ctx) error {
+	var product models.Product
+	if err := database.DB.Db.First(&product, c.Params("id")).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(404).JSON(fiber.Map{"error": "Product not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	header, err := c.FormFile("image")
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Missing image"})
+	}
+
+	limit := maxImageSize()
+	if header.Size > limit {
+		return c.Status(413).JSON(fiber.Map{"error": fmt.Sprintf("Image must not be larger than %d bytes", limit)})
+	}
+
+	file, err := header.Open()
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid image"})
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, limit+1))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid image"})
+	}
+	if int64(len(data)) > limit {
+		return c.Status(413).JSON(fiber.Map{"error": fmt.Sprintf("Image must not be larger than %d bytes", limit)})
+	}
+
+	// The content type is sniffed from the data rather than trusted from the upload
+	pixels := maxImagePixels()
+	img, err := imaging.Decode(data, pixels)
+	if err != nil {
+		if errors.Is(err, imaging.ErrUnsupportedType) {
+			return c.Status(415).JSON(fiber.Map{"error": "Image must be a JPEG, PNG or GIF"})
+		}
+		if errors.Is(err, imaging.ErrTooManyPixels) {
+			return c.Status(413).JSON(fiber.Map{"error": fmt.Sprintf("Image must not have more than %d pixels", pixels)})
+		}
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid image"})
+	}
+
+	thumbnail, thumbnailType, err := img.Thumbnail(thumbnailSize)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	name, err := randomName()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	image := models.ProductImage{
+		ProductID:    product.ID,
+		Key:          fmt.Sprintf("products/%d/%s%s", product.ID, name, imaging.ContentTypes[img.ContentType]),
+		ThumbnailKey: fmt.Sprintf("products/%d/%s_thumb%s", product.ID, name, imaging.ContentTypes[thumbnailType]),
+		ContentType:  img.ContentType,
+		Size:         len(data),
+		Width:        img.Width,
+		Height:       img.Height,
+	}
+
+	store := storage.Default()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := store.Put(ctx, image.Key, data, image.ContentType); err != nil {
+		log.Printf("Error storing image for product %d: %v", product.ID, err)
+		return c.Status(502).JSON(fiber.Map{"error": "Image storage unavailable"})
+	}
+	if err := store.Put(ctx, image.ThumbnailKey, thumbnail, thumbnailType); err != nil {
+		log.Printf("Error storing thumbnail for product %d: %v", product.ID, err)
+		deleteObjects(ctx, store, image.Key)
+		return c.Status(502).JSON(fiber.Map{"error": "Image storage unavailable"})
+	}
+
+	err = database.DB.Db.Transaction(func(tx *gorm.DB) error {
+		var last *int
+		if err := tx.Model(&models.ProductImage{}).Where("product_id = ?", product.ID).Select("MAX(position)").Scan(&last).Error; err != nil {
+			return err
+		}
+		if last != nil {
+			image.Position = *last + 1
+		}
+		return tx.Create(&image).Error
+	})
+	if err != nil {
+		deleteObjects(ctx, store, image.Key, image.ThumbnailKey)
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	image.SetURLs(store)
+	return c.Status(201).JSON(image)
+}
+
+// ReorderProductImages sets the display order of a product's images. image_ids must list every
+// image of the product exactly once
+func ReorderProductImages(c *fiber.Ctx) error {
+	var body struct {
+		ImageIDs []uint `json:"image_ids"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	var product models.Product
+	if err := database.DB.Db.Preload("Images", orderImages).First(&product, c.Params("id")).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(404).JSON(fiber.Map{"error": "Product not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	byID := make(map[uint]models.ProductImage, len(product.Images))
+	for _, image := range product.Images {
+		byID[image.ID] = image
+	}
+	if len(body.ImageIDs) != len(byID) || len(uniqueIDs(body.ImageIDs)) != len(byID) {
+		return c.Status(400).JSON(fiber.Map{"error": "image_ids must list every image of the product once"})
+	}
+
+	ordered := make([]models.ProductImage, len(body.ImageIDs))
+	for i, id := range body.ImageIDs {
+		image, ok := byID[id]
+		if !ok {
+			return c.Status(400).JSON(fiber.Map{"error": "Image not found"})
+		}
+		image.Position = i
+		ordered[i] = image
+	}
+
+	err := database.DB.Db.Transaction(func(tx *gorm.DB) error {
+		for _, image := range ordered {
+			if err := tx.Model(&models.ProductImage{}).Where("id = ?", image.ID).Update("position", image.Position).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	return c.JSON(ordered)
+}
+
+// DeleteProductImage deletes an image of a product along with its stored files
+func DeleteProductImage(c *fiber.Ctx) error {
+	var image models.ProductImage
+	if err := database.DB.Db.Where("product_id = ?", c.Params("id")).First(&image, c.Params("image_id")).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(404).JSON(fiber.Map{"error": "Image not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	// The files go once the row is gone, so a failed delete never leaves an image pointing nowhere
+	if err := database.DB.Db.Unscoped().Delete(&image).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	deleteObjects(ctx, storage.Default(), image.Key, image.ThumbnailKey)
+
+	return c.SendStatus(204)
+}
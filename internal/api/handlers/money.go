@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/leroysb/go_kubernetes/internal/currency"
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"github.com/leroysb/go_kubernetes/internal/tax"
+)
+
+// checkPrice refuses prices that are not positive or not in the store currency. Prices are kept
+// and charged in the store currency only; other currencies are for display
+func checkPrice(price models.Money) error {
+	if price.Amount <= 0 {
+		return errors.New("Price must be positive")
+	}
+	if price.Currency != currency.Base() {
+		return errors.New("Price must be in the store currency " + currency.Base())
+	}
+	return nil
+}
+
+// checkTaxClass refuses unknown tax classes. Products without one are in the standard class
+func checkTaxClass(product *models.Product) error {
+	if product.TaxClass == "" {
+		product.TaxClass = tax.Standard
+	}
+	if !tax.Valid(product.TaxClass) {
+		return errors.New("Invalid tax_class, expected standard, zero_rated or exempt")
+	}
+	return nil
+}
+
+// displayCurrency reads the ?currency a client wants prices shown in. It is empty when none was
+// asked for, and an error when there is no rate for it
+func displayCurrency(c *fiber.Ctx) (string, error) {
+	code := strings.ToUpper(strings.TrimSpace(c.Query("currency")))
+	if code == "" {
+		return "", nil
+	}
+	if _, ok := currency.Rate(code); !ok {
+		return "", errors.New("Unsupported currency " + code)
+	}
+	return code, nil
+}
+
+// setDisplayPrices fills in the display price of each product in the currency, if one was asked for
+func setDisplayPrices(products []models.Product, code string) error {
+	if code == "" {
+		return nil
+	}
+	for i := range products {
+		price, err := products[i].Price.Convert(code)
+		if err != nil {
+			return err
+		}
+		products[i].DisplayPrice = &price
+	}
+	return nil
+}
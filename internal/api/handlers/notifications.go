@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log"
+	"os"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"github.com/leroysb/go_kubernetes/internal/notifications"
+	"github.com/leroysb/go_kubernetes/internal/sms"
+)
+
+type notificationSettings struct {
+	SMSOptOut   *bool                      `json:"sms_opt_out,omitempty"`
+	Preferences map[string]map[string]bool `json:"preferences"`
+}
+
+// GetNotificationPreferences returns the notification preferences of the currently authorized user
+func GetNotificationPreferences(c *fiber.Ctx) error {
+	user := c.Locals("user").(*models.Customer)
+
+	prefs, err := notifications.Preferences(user.ID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	return c.JSON(notificationSettings{SMSOptOut: &user.SMSOptOut, Preferences: prefs})
+}
+
+// UpdateNotificationPreferences updates the notification preferences of the currently authorized user
+func UpdateNotificationPreferences(c *fiber.Ctx) error {
+	user := c.Locals("user").(*models.Customer)
+
+	var settings notificationSettings
+	if err := c.BodyParser(&settings); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	if err := notifications.SetPreferences(user.ID, settings.Preferences); err != nil {
+		if errors.Is(err, notifications.ErrUnknownEvent) || errors.Is(err, notifications.ErrUnknownChannel) {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	if settings.SMSOptOut != nil {
+		if err := notifications.SetSMSOptOut(user.Phone, *settings.SMSOptOut); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+		}
+		user.SMSOptOut = *settings.SMSOptOut
+	}
+
+	return GetNotificationPreferences(c)
+}
+
+// inboundSMSAllowed checks the token of a message forwarded by the SMS gateway. Africa's Talking
+// does not sign what it forwards, so the callback URL given to it must carry SMS_CALLBACK_TOKEN as
+// ?token=. Without a token set every message is refused, as anyone could otherwise opt a number out
+func inboundSMSAllowed(c *fiber.Ctx) bool {
+	token := os.Getenv("SMS_CALLBACK_TOKEN")
+	if token == "" {
+		log.Println("SMS_CALLBACK_TOKEN is not set, refusing inbound SMS")
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(c.Query("token")), []byte(token)) == 1
+}
+
+// InboundSMS handles messages forwarded by the SMS gateway and applies STOP/START keywords
+func InboundSMS(c *fiber.Ctx) error {
+	if !inboundSMSAllowed(c) {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+
+	from := c.FormValue("from")
+	text := c.FormValue("text")
+
+	if from == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "Missing from"})
+	}
+
+	switch {
+	case sms.IsOptOut(text):
+		if err := notifications.SetSMSOptOut(from, true); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+		}
+		log.Printf("SMS opt-out received from %s", from)
+	case sms.IsOptIn(text):
+		if err := notifications.SetSMSOptOut(from, false); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+		}
+		log.Printf("SMS opt-in received from %s", from)
+	}
+
+	return c.SendStatus(200)
+}
@@ -1,46 +1,47 @@
 package handlers
 
 import (
-	"strconv"
+	"errors"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/leroysb/go_kubernetes/internal/database"
 	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"github.com/leroysb/go_kubernetes/internal/inventory"
+	"github.com/leroysb/go_kubernetes/internal/outbox"
+	"github.com/leroysb/go_kubernetes/internal/webhooks"
+	"gorm.io/gorm"
 )
 
-// GetOrders returns all orders with pagination
-func GetOrders(c *fiber.Ctx) error {
-	page := c.Query("page")
-	if page == "" {
-		page = "1"
-	}
+// orderStatuses are the statuses an order can be moved to after it is placed
+var orderStatuses = []string{"ordered", "paid", "shipped", "delivered", "cancelled"}
+
+var errOrderStatusChanged = errors.New("Order status was changed by another request")
 
-	// Convert page to integer
-	pageNum, err := strconv.Atoi(page)
+// GetOrders returns a page of paid orders, newest first
+func GetOrders(c *fiber.Ctx) error {
+	pager, err := parsePaginator(c, "id", true)
 	if err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid page number"})
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
 	}
 
-	// Calculate offset and limit for pagination
-	offset := (pageNum - 1) * 20
-	limit := 20
-
 	// Fetch orders from database in a goroutine
-	var orders []models.Order
+	var page Page
 	done := make(chan bool)
 	go func() {
-		if err := database.DB.Db.Offset(offset).Limit(limit).Find(&orders).Where("status = ?", "paid").Error; err != nil {
-			done <- false
-		} else {
-			done <- true
-		}
+		var err error
+		page, err = paginate(pager, func() *gorm.DB {
+			return database.DB.Db.Model(&models.Order{}).Where("status = ?", "paid")
+		}, func(order models.Order) (any, uint) {
+			return nil, order.ID
+		})
+		done <- err == nil
 	}()
 
 	select {
 	case success := <-done:
 		if success {
-			return c.Status(200).JSON(orders)
+			return sendPage(c, page)
 		} else {
 			return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
 		}
@@ -48,3 +49,80 @@ func GetOrders(c *fiber.Ctx) error {
 		return c.Status(500).JSON(fiber.Map{"error": "Timeout"})
 	}
 }
+
+// UpdateOrderStatus moves an order to a new status and emits order.status_changed. Cancelling an
+// order that has not shipped puts its items not already returned back into stock, and a cancelled
+// order cannot be moved on again. The order is only moved from the status it was read in, so of two
+// requests racing to change it one fails with a 409, and a cancellation restocks once
+func UpdateOrderStatus(c *fiber.Ctx) error {
+	var body struct {
+		Status string `json:"status"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	valid := false
+	for _, status := range orderStatuses {
+		if body.Status == status {
+			valid = true
+		}
+	}
+	if !valid {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid status"})
+	}
+
+	var order models.Order
+	if err := database.DB.Db.First(&order, c.Params("id")).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(404).JSON(fiber.Map{"error": "Order not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	previousStatus := order.Status
+	if previousStatus == body.Status {
+		return c.JSON(order)
+	}
+	if previousStatus == "cancelled" {
+		return c.Status(400).JSON(fiber.Map{"error": "Order is cancelled"})
+	}
+
+	err := database.DB.Db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&order).Where("status = ?", previousStatus).Update("status", body.Status)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errOrderStatusChanged
+		}
+		if body.Status == "cancelled" && (previousStatus == "ordered" || previousStatus == "paid") {
+			if err := restockCancelled(tx, &order, stockActor(c)); err != nil {
+				return err
+			}
+		}
+		return outbox.Write(tx, webhooks.EventOrderStatusChanged, "order", order.ID, fiber.Map{"order": order, "previous_status": previousStatus})
+	})
+	if err != nil {
+		if errors.Is(err, errOrderStatusChanged) {
+			return c.Status(409).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	return c.JSON(order)
+}
+
+// restockCancelled puts the items of a cancelled order back into stock, less those already
+// restocked by refunds
+func restockCancelled(tx *gorm.DB, order *models.Order, actor string) error {
+	var returned int
+	err := tx.Model(&models.Refund{}).Where("order_id = ? AND restocked", order.ID).Select("COALESCE(SUM(quantity), 0)").Scan(&returned).Error
+	if err != nil {
+		return err
+	}
+	if order.Quantity <= returned {
+		return nil
+	}
+	return inventory.Restock(tx, order, order.Quantity-returned, models.StockMovement{Reason: models.StockCancellation, Actor: actor})
+}
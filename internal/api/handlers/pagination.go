@@ -0,0 +1,252 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// Page is the envelope returned by every list endpoint
+type Page struct {
+	Data       any     `json:"data"`
+	NextCursor *string `json:"next_cursor"`
+	PrevCursor *string `json:"prev_cursor"`
+	Total      int64   `json:"total"`
+}
+
+// cursor marks the row a page starts after, or ends before when Before is set. It holds the
+// row's sort key, of which only one of S, N and T is set, and its id as a tie-breaker
+type cursor struct {
+	S      *string    `json:"s,omitempty"`
+	N      *int64     `json:"n,omitempty"`
+	T      *time.Time `json:"t,omitempty"`
+	ID     uint       `json:"id"`
+	Before bool       `json:"b,omitempty"`
+}
+
+func newCursor(key any, id uint, before bool) (*cursor, error) {
+	cur := &cursor{ID: id, Before: before}
+	switch v := key.(type) {
+	case nil:
+	case string:
+		cur.S = &v
+	case int:
+		n := int64(v)
+		cur.N = &n
+	case int64:
+		cur.N = &v
+	case uint:
+		n := int64(v)
+		cur.N = &n
+	case time.Time:
+		cur.T = &v
+	default:
+		return nil, errors.New("unsupported cursor key type")
+	}
+	return cur, nil
+}
+
+func (cur *cursor) key() any {
+	switch {
+	case cur.S != nil:
+		return *cur.S
+	case cur.N != nil:
+		return *cur.N
+	case cur.T != nil:
+		return *cur.T
+	}
+	return nil
+}
+
+func (cur *cursor) encode() string {
+	b, _ := json.Marshal(cur)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(value string) (*cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	var cur cursor
+	if err := json.Unmarshal(b, &cur); err != nil {
+		return nil, err
+	}
+	return &cur, nil
+}
+
+// paginator pages through a query by keyset on Column and id. Pages can also be addressed by
+// the legacy ?page number, which falls back to an offset for the first request
+type paginator struct {
+	Column string
+	Desc   bool
+	Limit  int
+	Cursor *cursor
+	Offset int
+}
+
+// parsePaginator reads the cursor, page and page_size query parameters
+func parsePaginator(c *fiber.Ctx, column string, desc bool) (*paginator, error) {
+	p := &paginator{Column: column, Desc: desc, Limit: defaultPageSize}
+
+	if pageSize := c.Query("page_size"); pageSize != "" {
+		limit, err := strconv.Atoi(pageSize)
+		if err != nil || limit < 1 {
+			return nil, errors.New("Invalid page_size")
+		}
+		p.Limit = min(limit, maxPageSize)
+	}
+
+	if value := c.Query("cursor"); value != "" {
+		cur, err := decodeCursor(value)
+		if err != nil {
+			return nil, errors.New("Invalid cursor")
+		}
+		p.Cursor = cur
+	} else if page := c.Query("page"); page != "" {
+		pageNum, err := strconv.Atoi(page)
+		if err != nil || pageNum < 1 {
+			return nil, errors.New("Invalid page number")
+		}
+		p.Offset = (pageNum - 1) * p.Limit
+	}
+
+	return p, nil
+}
+
+// backward reports whether the page is read towards the start of the list
+func (p *paginator) backward() bool {
+	return p.Cursor != nil && p.Cursor.Before
+}
+
+// apply adds the keyset condition, order and limit to a query. One extra row is fetched to tell
+// whether another page follows
+func (p *paginator) apply(db *gorm.DB) *gorm.DB {
+	// Reading backward walks the list in reverse and the rows are flipped afterwards
+	desc := p.Desc != p.backward()
+	op, direction := " > ", " ASC"
+	if desc {
+		op, direction = " < ", " DESC"
+	}
+
+	if p.Cursor != nil {
+		if p.Column == "id" {
+			db = db.Where("id"+op+"?", p.Cursor.ID)
+		} else {
+			key := p.Cursor.key()
+			db = db.Where("("+p.Column+op+"?) OR ("+p.Column+" = ? AND id"+op+"?)", key, key, p.Cursor.ID)
+		}
+	}
+
+	if p.Column != "id" {
+		db = db.Order(p.Column + direction)
+	}
+	return db.Order("id" + direction).Offset(p.Offset).Limit(p.Limit + 1)
+}
+
+// paginate counts and fetches a page of T. filtered must return a fresh query with the list's
+// filters applied, and key must return a row's sort key and id
+func paginate[T any](p *paginator, filtered func() *gorm.DB, key func(T) (any, uint)) (Page, error) {
+	var total int64
+	if err := filtered().Count(&total).Error; err != nil {
+		return Page{}, err
+	}
+
+	var rows []T
+	if err := p.apply(filtered()).Find(&rows).Error; err != nil {
+		return Page{}, err
+	}
+
+	more := len(rows) > p.Limit
+	if more {
+		rows = rows[:p.Limit]
+	}
+	if p.backward() {
+		for i, j := 0, len(rows)-1; i < j; i, j = i+1, j-1 {
+			rows[i], rows[j] = rows[j], rows[i]
+		}
+	}
+
+	page := Page{Data: rows, Total: total}
+	if rows == nil {
+		page.Data = []T{}
+	}
+
+	if len(rows) > 0 {
+		// Reading forward, there is a next page when the extra row was found and a previous one
+		// whenever we started from a cursor or offset. Reading backward it is the other way round
+		hasNext, hasPrev := more, p.Cursor != nil || p.Offset > 0
+		if p.backward() {
+			hasNext, hasPrev = true, more
+		}
+
+		if hasNext {
+			next, err := cursorFor(rows[len(rows)-1], key, false)
+			if err != nil {
+				return Page{}, err
+			}
+			page.NextCursor = &next
+		}
+		if hasPrev {
+			prev, err := cursorFor(rows[0], key, true)
+			if err != nil {
+				return Page{}, err
+			}
+			page.PrevCursor = &prev
+		}
+	}
+
+	return page, nil
+}
+
+// sendPage writes the page as JSON with Link headers for the neighbouring pages
+func sendPage(c *fiber.Ctx, page Page) error {
+	setLinkHeader(c, page)
+	return c.Status(200).JSON(page)
+}
+
+func cursorFor[T any](row T, key func(T) (any, uint), before bool) (string, error) {
+	value, id := key(row)
+	cur, err := newCursor(value, id, before)
+	if err != nil {
+		return "", err
+	}
+	return cur.encode(), nil
+}
+
+// setLinkHeader advertises the next and previous pages as RFC 8288 links
+func setLinkHeader(c *fiber.Ctx, page Page) {
+	var links []string
+	if page.NextCursor != nil {
+		links = append(links, "<"+pageURL(c, *page.NextCursor)+`>; rel="next"`)
+	}
+	if page.PrevCursor != nil {
+		links = append(links, "<"+pageURL(c, *page.PrevCursor)+`>; rel="prev"`)
+	}
+	if len(links) > 0 {
+		c.Set(fiber.HeaderLink, strings.Join(links, ", "))
+	}
+}
+
+// pageURL returns the request URL with its cursor replaced and any page number dropped
+func pageURL(c *fiber.Ctx, cursor string) string {
+	args := fiber.AcquireArgs()
+	defer fiber.ReleaseArgs(args)
+
+	c.Request().URI().QueryArgs().CopyTo(args)
+	args.Del("page")
+	args.Set("cursor", cursor)
+
+	return c.BaseURL() + c.Path() + "?" + args.String()
+}
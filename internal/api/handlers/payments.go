@@ -0,0 +1,200 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/leroysb/go_kubernetes/internal/database"
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"github.com/leroysb/go_kubernetes/internal/payments"
+	"gorm.io/gorm"
+)
+
+// findCustomerOrder loads an order of the customer by the id in the path
+func findCustomerOrder(c *fiber.Ctx, customerID uint) (*models.Order, error) {
+	var order models.Order
+	if err := database.DB.Db.Where("customer_id = ?", customerID).First(&order, c.Params("id")).Error; err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// StartPayment starts paying for the order with a provider, M-Pesa unless another is named. An M-Pesa
+// payment prompts the customer's phone, or the phone in the body, and the order is marked paid when
+// Daraja calls back
+func StartPayment(c *fiber.Ctx) error {
+	user := c.Locals("user").(*models.Customer)
+
+	var body struct {
+		Provider string `json:"provider"`
+		Phone    string `json:"phone"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&body); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+		}
+	}
+	if body.Provider == "" {
+		body.Provider = payments.Mpesa{}.Name()
+	}
+	if body.Phone == "" {
+		body.Phone = user.Phone
+	}
+
+	order, err := findCustomerOrder(c, user.ID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(404).JSON(fiber.Map{"error": "Order not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	payment, err := payments.Start(order, body.Provider, body.Phone)
+	if err != nil {
+		var apiErr *payments.APIError
+		switch {
+		case errors.Is(err, payments.ErrUnknownProvider), errors.Is(err, payments.ErrNotPayable), errors.Is(err, payments.ErrInvalidPhone), errors.Is(err, payments.ErrCurrency):
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		case errors.Is(err, payments.ErrInProgress):
+			return c.Status(409).JSON(fiber.Map{"error": err.Error()})
+		case errors.As(err, &apiErr):
+			log.Printf("Error starting M-Pesa payment for order %d: %v", order.ID, err)
+			return c.Status(502).JSON(fiber.Map{"error": "M-Pesa could not start the payment"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	return c.Status(202).JSON(payment)
+}
+
+// GetPayment returns a payment of the customer, checking with the provider first if it is overdue
+func GetPayment(c *fiber.Ctx) error {
+	user := c.Locals("user").(*models.Customer)
+
+	var payment models.Payment
+	err := database.DB.Db.Where("order_id IN (?)", database.DB.Db.Model(&models.Order{}).Select("id").Where("customer_id = ?", user.ID)).
+		First(&payment, c.Params("id")).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(404).JSON(fiber.Map{"error": "Payment not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	if err := payments.Check(&payment); err != nil {
+		log.Printf("Error checking payment %d: %v", payment.ID, err)
+	}
+
+	var latest models.Payment
+	if err := database.DB.Db.First(&latest, payment.ID).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+	return c.JSON(latest)
+}
+
+// ConfirmPayment records that a manual payment, such as cash on delivery, was received
+func ConfirmPayment(c *fiber.Ctx) error {
+	var body struct {
+		Receipt string `json:"receipt"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&body); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+		}
+	}
+
+	var payment models.Payment
+	if err := database.DB.Db.First(&payment, c.Params("id")).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(404).JSON(fiber.Map{"error": "Payment not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+	if payment.Status != payments.StatusPending {
+		return c.Status(409).JSON(fiber.Map{"error": "Payment is already " + payment.Status})
+	}
+
+	if err := payments.Confirm(&payment, body.Receipt); err != nil {
+		if errors.Is(err, payments.ErrNotManual) {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	var latest models.Payment
+	if err := database.DB.Db.First(&latest, payment.ID).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+	return c.JSON(latest)
+}
+
+// mpesaCallbackAllowed checks the token of a Daraja callback. Daraja does not sign its callbacks, so
+// the callback URLs given to it must carry MPESA_CALLBACK_TOKEN as ?token=. Without a token set every
+// callback is refused, as anyone could otherwise report a payment made
+func mpesaCallbackAllowed(c *fiber.Ctx) bool {
+	token := os.Getenv("MPESA_CALLBACK_TOKEN")
+	if token == "" {
+		log.Println("MPESA_CALLBACK_TOKEN is not set, refusing M-Pesa callback")
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(c.Query("token")), []byte(token)) == 1
+}
+
+// MpesaCallback receives the result of an STK Push from Daraja
+func MpesaCallback(c *fiber.Ctx) error {
+	if !mpesaCallbackAllowed(c) {
+		return c.Status(401).JSON(fiber.Map{"ResultCode": 1, "ResultDesc": "Unauthorized"})
+	}
+
+	var callback payments.Callback
+	if err := json.Unmarshal(c.Body(), &callback); err != nil || callback.Body.STKCallback.CheckoutRequestID == "" {
+		return c.Status(400).JSON(fiber.Map{"ResultCode": 1, "ResultDesc": "Invalid callback"})
+	}
+
+	if err := payments.HandleMpesaCallback(c.Body()); err != nil {
+		if errors.Is(err, payments.ErrUnknownPayment) {
+			log.Printf("M-Pesa callback for unknown checkout request %s", callback.Body.STKCallback.CheckoutRequestID)
+			return c.Status(404).JSON(fiber.Map{"ResultCode": 1, "ResultDesc": err.Error()})
+		}
+		log.Printf("Error handling M-Pesa callback: %v", err)
+		return c.Status(500).JSON(fiber.Map{"ResultCode": 1, "ResultDesc": "Internal server error"})
+	}
+
+	return c.JSON(fiber.Map{"ResultCode": 0, "ResultDesc": "Accepted"})
+}
+
+// MpesaB2CResult receives the result of a refund paid out by M-Pesa B2C
+func MpesaB2CResult(c *fiber.Ctx) error {
+	return mpesaB2C(c, false)
+}
+
+// MpesaB2CTimeout is told by Daraja that a refund could not be paid out in time
+func MpesaB2CTimeout(c *fiber.Ctx) error {
+	return mpesaB2C(c, true)
+}
+
+func mpesaB2C(c *fiber.Ctx, timedOut bool) error {
+	if !mpesaCallbackAllowed(c) {
+		return c.Status(401).JSON(fiber.Map{"ResultCode": 1, "ResultDesc": "Unauthorized"})
+	}
+
+	var result payments.B2CResult
+	if err := json.Unmarshal(c.Body(), &result); err != nil || result.Result.ConversationID == "" {
+		return c.Status(400).JSON(fiber.Map{"ResultCode": 1, "ResultDesc": "Invalid result"})
+	}
+
+	if err := payments.HandleB2CResult(c.Body(), timedOut); err != nil {
+		if errors.Is(err, payments.ErrUnknownRefund) {
+			log.Printf("M-Pesa B2C result for unknown conversation %s", result.Result.ConversationID)
+			return c.Status(404).JSON(fiber.Map{"ResultCode": 1, "ResultDesc": err.Error()})
+		}
+		log.Printf("Error handling M-Pesa B2C result: %v", err)
+		return c.Status(500).JSON(fiber.Map{"ResultCode": 1, "ResultDesc": "Internal server error"})
+	}
+
+	return c.JSON(fiber.Map{"ResultCode": 0, "ResultDesc": "Accepted"})
+}
@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/leroysb/go_kubernetes/internal/database"
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"github.com/leroysb/go_kubernetes/internal/outbox"
+	"github.com/leroysb/go_kubernetes/internal/storage"
+	"github.com/leroysb/go_kubernetes/internal/webhooks"
+	"gorm.io/gorm"
+)
+
+// Deleted products stay in the database so that the orders placed for them keep pointing at a
+// product. They drop out of listings, cannot be added to carts or ordered, and cart lines already
+// holding them are refused at checkout. Their name stays reserved: creating a product with the
+// name of a deleted one is refused with a 409 pointing at the deleted product, which can be
+// restored, or purged if no order refers to it
+
+// deletedProduct returns the product with the name among the deleted ones, if there is one
+func deletedProduct(db *gorm.DB, name string) (*models.Product, error) {
+	var product models.Product
+	err := db.Unscoped().Where("name = ? AND deleted_at IS NOT NULL", name).First(&product).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &product, nil
+}
+
+// findDeletedProduct loads a deleted product by the id in the path
+func findDeletedProduct(c *fiber.Ctx) (*models.Product, error) {
+	var product models.Product
+	if err := database.DB.Db.Unscoped().Where("deleted_at IS NOT NULL").First(&product, c.Params("id")).Error; err != nil {
+		return nil, err
+	}
+	return &product, nil
+}
+
+// GetDeletedProducts returns a page of deleted products, most recently deleted first
+func GetDeletedProducts(c *fiber.Ctx) error {
+	pager, err := parsePaginator(c, "deleted_at", true)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	page, err := paginate(pager, func() *gorm.DB {
+		return database.DB.Db.Unscoped().Model(&models.Product{}).Where("deleted_at IS NOT NULL")
+	}, func(product models.Product) (any, uint) {
+		return product.DeletedAt.Time, product.ID
+	})
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+	return sendPage(c, page)
+}
+
+// RestoreProduct brings a deleted product back, unless another product has taken its name since
+func RestoreProduct(c *fiber.Ctx) error {
+	product, err := findDeletedProduct(c)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(404).JSON(fiber.Map{"error": "Deleted product not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	var taken int64
+	if err := database.DB.Db.Model(&models.Product{}).Where("name = ?", product.Name).Count(&taken).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+	if taken > 0 {
+		return c.Status(409).JSON(fiber.Map{"error": "Another product now has this name"})
+	}
+
+	err = database.DB.Db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Model(&models.Product{}).Where("id = ?", product.ID).Updates(map[string]any{"deleted_at": nil, "version": gorm.Expr("version + 1")}).Error; err != nil {
+			return err
+		}
+		product.DeletedAt = gorm.DeletedAt{}
+		if err := tx.First(product, product.ID).Error; err != nil {
+			return err
+		}
+		return outbox.Write(tx, webhooks.EventProductUpdated, "product", product.ID, product)
+	})
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	c.Set(fiber.HeaderETag, productETag(product))
+	return c.JSON(product)
+}
+
+// PurgeProduct permanently removes a deleted product with its variants, images and category links.
+// Products that any order refers to are kept, since the orders would lose their product
+func PurgeProduct(c *fiber.Ctx) error {
+	product, err := findDeletedProduct(c)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(404).JSON(fiber.Map{"error": "Deleted product not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	var orders int64
+	if err := database.DB.Db.Unscoped().Model(&models.Order{}).Where("product_id = ?", product.ID).Count(&orders).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+	if orders > 0 {
+		return c.Status(409).JSON(fiber.Map{"error": "Product is referred to by orders and cannot be purged"})
+	}
+
+	var images []models.ProductImage
+	err = database.DB.Db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("product_id = ?", product.ID).Find(&images).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("product_id = ?", product.ID).Delete(&models.ProductImage{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("product_id = ?", product.ID).Delete(&models.ProductVariant{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(product).Association("Categories").Clear(); err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(product).Error
+	})
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	// The files go once the rows are gone
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for _, image := range images {
+		deleteObjects(ctx, storage.Default(), image.Key, image.ThumbnailKey)
+	}
+
+	return c.SendStatus(204)
+}
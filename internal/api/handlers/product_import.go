@@ -0,0 +1,529 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/leroysb/go_kubernetes/internal/currency"
+	"github.com/leroysb/go_kubernetes/internal/database"
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"github.com/leroysb/go_kubernetes/internal/inventory"
+	"github.com/leroysb/go_kubernetes/internal/outbox"
+	"github.com/leroysb/go_kubernetes/internal/webhooks"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	formatCSV   = "csv"
+	formatJSONL = "jsonl"
+
+	// importBatchSize is the number of rows committed in each transaction of an import
+	importBatchSize = 500
+)
+
+// productColumns are the CSV columns of an export, and the ones read on import
+var productColumns = []string{"name", "sku", "price", "stock", "options"}
+
+var (
+	errDryRun    = errors.New("dry run")
+	errRowFailed = errors.New("row failed")
+)
+
+// productRow is one line of an import or export. Rows with a SKU are product variants and rows
+// without one are products sold on their own
+type productRow struct {
+	Line    int               `json:"-"`
+	Name    string            `json:"name"`
+	SKU     string            `json:"sku,omitempty"`
+	Price   models.Money      `json:"price"`
+	Stock   int               `json:"stock"`
+	Options map[string]string `json:"options,omitempty"`
+}
+
+func (r *productRow) validate() error {
+	r.Name = strings.TrimSpace(r.Name)
+	r.SKU = strings.TrimSpace(r.SKU)
+	if r.Name == "" {
+		return errors.New("Missing name")
+	}
+	if err := checkPrice(r.Price); err != nil {
+		return err
+	}
+	if r.Stock < 0 {
+		return errors.New("Stock must not be negative")
+	}
+	return nil
+}
+
+// rowError reports a row that could not be imported. Row is the line number in the file
+type rowError struct {
+	Row   int    `json:"row"`
+	Error string `json:"error"`
+}
+
+type importReport struct {
+	DryRun  bool       `json:"dry_run"`
+	Rows    int        `json:"rows"`
+	Created int        `json:"created"`
+	Updated int        `json:"updated"`
+	Errors  []rowError `json:"errors"`
+}
+
+// importFormat picks the format from the format parameter, then the file extension or content type
+func importFormat(c *fiber.Ctx, filename string) (string, error) {
+	format := strings.ToLower(c.Query("format"))
+	if format == "" {
+		switch strings.ToLower(filepath.Ext(filename)) {
+		case ".csv":
+			format = formatCSV
+		case ".jsonl", ".ndjson":
+			format = formatJSONL
+		}
+	}
+	if format == "" && filename == "" {
+		mediaType, _, _ := mime.ParseMediaType(c.Get(fiber.HeaderContentType))
+		switch mediaType {
+		case "text/csv":
+			format = formatCSV
+		case "application/jsonl", "application/x-ndjson", "application/x-jsonlines", "application/json":
+			format = formatJSONL
+		}
+	}
+
+	switch format {
+	case formatCSV, formatJSONL:
+		return format, nil
+	case "json", "ndjson":
+		return formatJSONL, nil
+	}
+	return "", errors.New("Unknown format, expected csv or jsonl")
+}
+
+// parseCSV reads rows by the names in the header line. Columns other than productColumns are ignored
+func parseCSV(r io.Reader) ([]productRow, []rowError, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, nil, errors.New("Missing CSV header")
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := columns["name"]; !ok {
+		return nil, nil, errors.New("CSV header must include name")
+	}
+
+	var rows []productRow
+	var rowErrors []rowError
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				rowErrors = append(rowErrors, rowError{Row: parseErr.Line, Error: parseErr.Err.Error()})
+				continue
+			}
+			return nil, nil, err
+		}
+		line, _ := reader.FieldPos(0)
+
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+
+		row := productRow{Line: line, Name: field("name"), SKU: field("sku")}
+		if field("price") == "" {
+			rowErrors = append(rowErrors, rowError{Row: line, Error: "Missing price"})
+			continue
+		}
+		if row.Price, err = models.ParseMoney(field("price"), currency.Base()); err != nil {
+			rowErrors = append(rowErrors, rowError{Row: line, Error: "Invalid price number format"})
+			continue
+		}
+		if stock := field("stock"); stock != "" {
+			if row.Stock, err = strconv.Atoi(stock); err != nil {
+				rowErrors = append(rowErrors, rowError{Row: line, Error: "Invalid stock number format"})
+				continue
+			}
+		}
+		if options := field("options"); options != "" {
+			if err := json.Unmarshal([]byte(options), &row.Options); err != nil {
+				rowErrors = append(rowErrors, rowError{Row: line, Error: "Options must be a JSON object of strings"})
+				continue
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, rowErrors, nil
+}
+
+// parseJSONL reads one JSON object per line, skipping blank lines
+func parseJSONL(r io.Reader) ([]productRow, []rowError, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var rows []productRow
+	var rowErrors []rowError
+	for line := 1; scanner.Scan(); line++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+
+		row := productRow{Line: line}
+		if err := json.Unmarshal(text, &row); err != nil {
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &typeErr) {
+				rowErrors = append(rowErrors, rowError{Row: line, Error: fmt.Sprintf("Invalid %s", typeErr.Field)})
+			} else if errors.Is(err, models.ErrInvalidMoney) {
+				rowErrors = append(rowErrors, rowError{Row: line, Error: "Invalid price"})
+			} else {
+				rowErrors = append(rowErrors, rowError{Row: line, Error: "Invalid JSON"})
+			}
+			continue
+		}
+		rows = append(rows, row)
+	}
+	return rows, rowErrors, scanner.Err()
+}
+
+// createProduct inserts a product that may start out of stock, recording its stock as received by
+// actor. A zero stock would be replaced by the column's null default on insert, so it is written by
+// a follow-up update instead
+func createProduct(tx *gorm.DB, product *models.Product, actor string) error {
+	stock := product.Stock
+	if stock == 0 {
+		product.Stock = 1
+	}
+	if err := tx.Omit(clause.Associations).Create(product).Error; err != nil {
+		return err
+	}
+	if stock == 0 {
+		product.Stock = 0
+		return tx.Model(product).Update("stock", 0).Error
+	}
+	return inventory.Record(tx, &models.StockMovement{ProductID: product.ID, Delta: stock, Reason: models.StockRestock, Reference: fmt.Sprintf("product:%d", product.ID), Actor: actor})
+}
+
+// importMovement is the ledger entry for stock set by an import
+var importMovement = models.StockMovement{Reference: "import", Actor: "import"}
+
+// importRow upserts a row: by SKU when it has one, otherwise by product name. It returns whether a
+// product or variant was created. A returned rowError leaves the database untouched
+func importRow(tx *gorm.DB, row productRow) (bool, *rowError, error) {
+	fail := func(message string) (bool, *rowError, error) {
+		return false, &rowError{Row: row.Line, Error: message}, nil
+	}
+
+	var product models.Product
+	err := tx.Preload("Variants").Where("name = ?", row.Name).First(&product).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil, err
+	}
+	exists := err == nil
+	previousStock := product.Stock
+
+	if !exists {
+		deleted, err := deletedProduct(tx, row.Name)
+		if err != nil {
+			return false, nil, err
+		}
+		if deleted != nil {
+			return fail("A deleted product has this name, restore it first")
+		}
+	}
+
+	created := false
+	if row.SKU == "" {
+		if exists && len(product.Variants) > 0 {
+			return fail("Product has variants, so the row needs a sku")
+		}
+		if exists {
+			err = tx.Model(&product).Updates(map[string]any{"price_minor": row.Price.Amount, "price_currency": row.Price.Currency, "version": gorm.Expr("version + 1")}).Error
+			if err == nil {
+				err = setProductStock(tx, product.ID, row.Stock, importMovement)
+			}
+		} else {
+			product = models.Product{Name: row.Name, Price: row.Price, Stock: row.Stock}
+			err = createProduct(tx, &product, importMovement.Actor)
+			created = true
+		}
+		if err != nil {
+			return false, nil, err
+		}
+	} else {
+		var variant models.ProductVariant
+		err := tx.Unscoped().Where("sku = ?", row.SKU).First(&variant).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return false, nil, err
+		}
+		variantExists := err == nil
+		if variantExists && variant.DeletedAt.Valid {
+			return fail("SKU belongs to a deleted variant")
+		}
+		if variantExists && (!exists || variant.ProductID != product.ID) {
+			return fail("SKU belongs to another product")
+		}
+
+		if !exists {
+			product = models.Product{Name: row.Name, Price: row.Price, Stock: row.Stock}
+			if err := createProduct(tx, &product, importMovement.Actor); err != nil {
+				return false, nil, err
+			}
+		}
+
+		// The row's price becomes an override when it differs from the product price
+		var price *models.Money
+		if row.Price != product.Price {
+			price = &row.Price
+		}
+
+		if variantExists {
+			variant.Price, variant.Stock = price, row.Stock
+			if row.Options != nil {
+				variant.Options = row.Options
+			}
+			err = tx.Select("options", "stock").Updates(&variant).Error
+			if err == nil {
+				err = updateVariantPrice(tx, &variant)
+			}
+		} else {
+			variant = models.ProductVariant{ProductID: product.ID, SKU: row.SKU, Options: row.Options, Price: price, Stock: row.Stock}
+			err = tx.Create(&variant).Error
+			created = true
+		}
+		if err != nil {
+			return false, nil, err
+		}
+		if err := syncProductStock(tx, product.ID, importMovement); err != nil {
+			return false, nil, err
+		}
+	}
+
+	if created && !exists {
+		return true, nil, nil
+	}
+
+	// Changes to existing products are announced the same way as updates through the API
+	product.Variants = nil
+	if err := tx.First(&product).Error; err != nil {
+		return false, nil, err
+	}
+	if err := outbox.Write(tx, webhooks.EventProductUpdated, "product", product.ID, product); err != nil {
+		return false, nil, err
+	}
+	if webhooks.LowStockCrossed(previousStock, product.Stock) {
+		if err := outbox.Write(tx, webhooks.EventProductStockLow, "product", product.ID, fiber.Map{"product": product, "threshold": webhooks.LowStockThreshold()}); err != nil {
+			return false, nil, err
+		}
+	}
+	return created, nil, nil
+}
+
+// importRows applies rows in transactions of importBatchSize rows and stops at the first row that
+// fails, leaving earlier batches committed. A dry run applies every row in one transaction that is
+// rolled back, reporting all failing rows
+func importRows(rows []productRow, report *importReport) error {
+	batchSize := importBatchSize
+	if report.DryRun {
+		batchSize = max(len(rows), 1)
+	}
+
+	for start := 0; start < len(rows); start += batchSize {
+		batch := rows[start:min(start+batchSize, len(rows))]
+		created, updated := 0, 0
+
+		err := database.DB.Db.Transaction(func(tx *gorm.DB) error {
+			for _, row := range batch {
+				isNew, rowErr, err := importRow(tx, row)
+				if err != nil {
+					return err
+				}
+				if rowErr != nil {
+					report.Errors = append(report.Errors, *rowErr)
+					if !report.DryRun {
+						return errRowFailed
+					}
+					continue
+				}
+				if isNew {
+					created++
+				} else {
+					updated++
+				}
+			}
+			if report.DryRun {
+				return errDryRun
+			}
+			return nil
+		})
+
+		switch {
+		case err == nil || errors.Is(err, errDryRun):
+			report.Created += created
+			report.Updated += updated
+		case errors.Is(err, errRowFailed):
+			return nil
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportProducts creates or updates products from a CSV or JSON Lines file, sent as the request
+// body or as the file form field. Rows are validated before anything is written, and with
+// dry_run=true nothing is written at all
+func ImportProducts(c *fiber.Ctx) error {
+	dryRun := c.QueryBool("dry_run")
+
+	var body io.Reader = bytes.NewReader(c.Body())
+	filename := ""
+	if header, err := c.FormFile("file"); err == nil {
+		file, err := header.Open()
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid file"})
+		}
+		defer file.Close()
+		body, filename = file, header.Filename
+	}
+
+	format, err := importFormat(c, filename)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	var rows []productRow
+	var rowErrors []rowError
+	if format == formatCSV {
+		rows, rowErrors, err = parseCSV(body)
+	} else {
+		rows, rowErrors, err = parseJSONL(body)
+	}
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	report := &importReport{DryRun: dryRun, Rows: len(rows) + len(rowErrors), Errors: rowErrors}
+	valid := rows[:0]
+	for _, row := range rows {
+		if err := row.validate(); err != nil {
+			report.Errors = append(report.Errors, rowError{Row: row.Line, Error: err.Error()})
+			continue
+		}
+		valid = append(valid, row)
+	}
+
+	if report.Errors == nil {
+		report.Errors = []rowError{}
+	}
+	if !dryRun && len(report.Errors) > 0 {
+		return c.Status(422).JSON(report)
+	}
+
+	if err := importRows(valid, report); err != nil {
+		log.Println("Error importing products:", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+	if !dryRun && len(report.Errors) > 0 {
+		return c.Status(422).JSON(report)
+	}
+
+	return c.JSON(report)
+}
+
+// ExportProducts streams the catalogue as CSV or, with format=jsonl, JSON Lines. Products with
+// variants are written as one row per variant so the file can be imported again
+func ExportProducts(c *fiber.Ctx) error {
+	format := strings.ToLower(c.Query("format", formatCSV))
+	if format != formatCSV && format != formatJSONL {
+		return c.Status(400).JSON(fiber.Map{"error": "Unknown format, expected csv or jsonl"})
+	}
+
+	if format == formatCSV {
+		c.Set(fiber.HeaderContentType, "text/csv; charset=utf-8")
+	} else {
+		c.Set(fiber.HeaderContentType, "application/jsonl; charset=utf-8")
+	}
+	c.Set(fiber.HeaderContentDisposition, `attachment; filename="products.`+format+`"`)
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		var write func(row productRow) error
+		if format == formatCSV {
+			writer := csv.NewWriter(w)
+			writer.Write(productColumns)
+			write = func(row productRow) error {
+				options := ""
+				if len(row.Options) > 0 {
+					b, _ := json.Marshal(row.Options)
+					options = string(b)
+				}
+				writer.Write([]string{row.Name, row.SKU, row.Price.Decimal(), strconv.Itoa(row.Stock), options})
+				writer.Flush()
+				return writer.Error()
+			}
+		} else {
+			encoder := json.NewEncoder(w)
+			write = func(row productRow) error {
+				return encoder.Encode(row)
+			}
+		}
+
+		var lastID uint
+		for {
+			var products []models.Product
+			if err := database.DB.Db.Preload("Variants", func(db *gorm.DB) *gorm.DB { return db.Order("id") }).
+				Where("id > ?", lastID).Order("id").Limit(importBatchSize).Find(&products).Error; err != nil {
+				log.Println("Error exporting products:", err)
+				return
+			}
+			if len(products) == 0 {
+				return
+			}
+
+			for _, product := range products {
+				rows := []productRow{{Name: product.Name, Price: product.Price, Stock: product.Stock}}
+				if len(product.Variants) > 0 {
+					rows = rows[:0]
+					for _, variant := range product.Variants {
+						rows = append(rows, productRow{Name: product.Name, SKU: variant.SKU, Price: variant.UnitPrice(&product), Stock: variant.Stock, Options: variant.Options})
+					}
+				}
+				for _, row := range rows {
+					if err := write(row); err != nil {
+						log.Println("Error exporting products:", err)
+						return
+					}
+				}
+			}
+			if err := w.Flush(); err != nil {
+				return
+			}
+			lastID = products[len(products)-1].ID
+		}
+	})
+
+	return nil
+}
@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/leroysb/go_kubernetes/internal/currency"
+	"github.com/leroysb/go_kubernetes/internal/database"
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"gorm.io/gorm"
+)
+
+// productSortColumns maps the accepted sort keys to their columns
+var productSortColumns = map[string]string{
+	"name":       "name",
+	"price":      "price_minor",
+	"created_at": "created_at",
+}
+
+// productSearch holds the search, filter and sort parameters accepted by GetProducts
+type productSearch struct {
+	Query    string
+	MinPrice *models.Money
+	MaxPrice *models.Money
+	InStock  bool
+	Sort     string
+	Desc     bool
+	// CategoryIDs limits the results to products in any of these categories
+	CategoryIDs []uint
+}
+
+// errSearchLookup marks a failure reading what the search parameters refer to, as opposed to a
+// parameter being invalid
+var errSearchLookup = errors.New("search lookup failed")
+
+// parseProductSearch reads and validates the search, filter and sort parameters
+func parseProductSearch(c *fiber.Ctx) (*productSearch, error) {
+	search := &productSearch{
+		Query: strings.TrimSpace(c.Query("q")),
+		Sort:  c.Query("sort", "created_at"),
+	}
+
+	var err error
+	if search.MinPrice, err = optionalPrice(c.Query("min_price")); err != nil {
+		return nil, errors.New("Invalid min_price")
+	}
+	if search.MaxPrice, err = optionalPrice(c.Query("max_price")); err != nil {
+		return nil, errors.New("Invalid max_price")
+	}
+	if search.MinPrice != nil && search.MaxPrice != nil && search.MinPrice.Amount > search.MaxPrice.Amount {
+		return nil, errors.New("min_price must not exceed max_price")
+	}
+
+	if inStock := c.Query("in_stock"); inStock != "" {
+		if search.InStock, err = strconv.ParseBool(inStock); err != nil {
+			return nil, errors.New("Invalid in_stock")
+		}
+	}
+
+	if category := c.Query("category"); category != "" {
+		id, err := strconv.ParseUint(category, 10, 0)
+		if err != nil {
+			return nil, errors.New("Invalid category")
+		}
+		if err := database.DB.Db.First(&models.Category{}, id).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, errors.New("Category not found")
+			}
+			return nil, fmt.Errorf("%w: %v", errSearchLookup, err)
+		}
+		// Products in subcategories belong to the category as well
+		if search.CategoryIDs, err = categoryWithDescendants(database.DB.Db, uint(id)); err != nil {
+			return nil, fmt.Errorf("%w: %v", errSearchLookup, err)
+		}
+	}
+
+	// A leading "-" sorts descending, e.g. sort=-price
+	if strings.HasPrefix(search.Sort, "-") {
+		search.Sort = strings.TrimPrefix(search.Sort, "-")
+		search.Desc = true
+	}
+	if _, ok := productSortColumns[search.Sort]; !ok {
+		return nil, errors.New("Invalid sort, expected name, price or created_at")
+	}
+	switch strings.ToLower(c.Query("order")) {
+	case "":
+	case "asc":
+		search.Desc = false
+	case "desc":
+		search.Desc = true
+	default:
+		return nil, errors.New("Invalid order, expected asc or desc")
+	}
+
+	return search, nil
+}
+
+// filter applies the search and filters to a products query
+func (s *productSearch) filter(db *gorm.DB) *gorm.DB {
+	if s.Query != "" {
+		pattern := "%" + escapeLike(s.Query) + "%"
+		if db.Dialector.Name() == "postgres" {
+			db = db.Where("to_tsvector('simple', name) @@ plainto_tsquery('simple', ?) OR name ILIKE ? ESCAPE '\\'", s.Query, pattern)
+		} else {
+			// SQLite's LIKE is already case-insensitive for ASCII
+			db = db.Where("name LIKE ? ESCAPE '\\'", pattern)
+		}
+	}
+
+	if s.MinPrice != nil {
+		db = db.Where("price_minor >= ?", s.MinPrice.Amount)
+	}
+	if s.MaxPrice != nil {
+		db = db.Where("price_minor <= ?", s.MaxPrice.Amount)
+	}
+	if s.InStock {
+		db = db.Where("stock > 0")
+	}
+	if s.CategoryIDs != nil {
+		db = db.Where("id IN (?)", database.DB.Db.Table("product_categories").Select("product_id").Where("category_id IN ?", s.CategoryIDs))
+	}
+
+	return db
+}
+
+// key returns the product's value for the sort column and its id, as used in cursors
+func (s *productSearch) key(product models.Product) (any, uint) {
+	switch s.Sort {
+	case "name":
+		return product.Name, product.ID
+	case "price":
+		return product.Price.Amount, product.ID
+	default:
+		return product.CreatedAt, product.ID
+	}
+}
+
+// optionalPrice reads a price filter given in major units of the store currency, e.g. 19.99
+func optionalPrice(value string) (*models.Money, error) {
+	if value == "" {
+		return nil, nil
+	}
+	price, err := models.ParseMoney(value, currency.Base())
+	if err != nil {
+		return nil, err
+	}
+	return &price, nil
+}
+
+// escapeLike escapes the LIKE wildcards in a user supplied substring
+func escapeLike(value string) string {
+	return strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(value)
+}
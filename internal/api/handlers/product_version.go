@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/leroysb/go_kubernetes/internal/database"
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"github.com/leroysb/go_kubernetes/internal/inventory"
+	"github.com/leroysb/go_kubernetes/internal/outbox"
+	"github.com/leroysb/go_kubernetes/internal/webhooks"
+	"gorm.io/gorm"
+)
+
+var errVersionConflict = errors.New("Product was changed by another request")
+
+// productETag is the entity tag of the product's current version
+func productETag(product *models.Product) string {
+	return `"` + strconv.Itoa(product.Version) + `"`
+}
+
+// ifMatch reports whether the If-Match header, when there is one, names the product's current version
+func ifMatch(c *fiber.Ctx, product *models.Product) bool {
+	header := c.Get(fiber.HeaderIfMatch)
+	if header == "" {
+		return true
+	}
+
+	etag := productETag(product)
+	for _, tag := range strings.Split(header, ",") {
+		if tag = strings.TrimSpace(tag); tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// saveProduct writes the name, price, stock and tax class of a product, provided it is still at
+// the version it was loaded at, and reloads it. errVersionConflict is returned when another request
+// changed the product in the meantime. The resulting events and the stock change, made by actor, are
+// recorded in the same transaction
+func saveProduct(product *models.Product, previousStock int, actor string) error {
+	return database.DB.Db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.Product{}).Where("id = ? AND version = ?", product.ID, product.Version).Updates(map[string]any{
+			"name":           product.Name,
+			"price_minor":    product.Price.Amount,
+			"price_currency": product.Price.Currency,
+			"stock":          product.Stock,
+			"tax_class":      product.TaxClass,
+			"version":        gorm.Expr("version + 1"),
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errVersionConflict
+		}
+
+		// The version check guarantees the stock was still previousStock
+		reference := fmt.Sprintf("product:%d", product.ID)
+		delta := product.Stock - previousStock
+		edit := models.StockMovement{ProductID: product.ID, Delta: delta, Reason: editReason(delta), Reference: reference, Actor: actor}
+		if err := inventory.Adjust(tx, product.Stock, edit); err != nil {
+			return err
+		}
+
+		// Products with variants keep the total of their variants' stock
+		if err := syncProductStock(tx, product.ID, models.StockMovement{Reason: models.StockAdjustment, Reference: reference, Actor: actor}); err != nil {
+			return err
+		}
+		if err := tx.First(product, product.ID).Error; err != nil {
+			return err
+		}
+
+		if err := outbox.Write(tx, webhooks.EventProductUpdated, "product", product.ID, product); err != nil {
+			return err
+		}
+		if webhooks.Restocked(previousStock, product.Stock) {
+			if err := outbox.Write(tx, webhooks.EventProductRestocked, "product", product.ID, product); err != nil {
+				return err
+			}
+		}
+		if webhooks.LowStockCrossed(previousStock, product.Stock) {
+			return outbox.Write(tx, webhooks.EventProductStockLow, "product", product.ID, fiber.Map{"product": product, "threshold": webhooks.LowStockThreshold()})
+		}
+		return nil
+	})
+}
@@ -2,13 +2,15 @@ package handlers
 
 import (
 	"encoding/json"
-	"strconv"
+	"errors"
 	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/leroysb/go_kubernetes/internal/database"
 	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"github.com/leroysb/go_kubernetes/internal/inventory"
+	"gorm.io/gorm"
 )
 
 // CreateProduct creates a new product
@@ -17,6 +19,9 @@ func CreateProduct(c *fiber.Ctx) error {
 
 	// Error check fields
 	if err := c.BodyParser(product); err != nil {
+		if errors.Is(err, models.ErrInvalidMoney) {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid price, expected a number or an amount and currency"})
+		}
 		if _, ok := err.(*json.UnmarshalTypeError); ok {
 			// Check if the error is related to the "stock" field
 			if strings.Contains(err.Error(), "stock") {
@@ -24,7 +29,7 @@ func CreateProduct(c *fiber.Ctx) error {
 			}
 			// Check if the error is related to the "price" field
 			if strings.Contains(err.Error(), "price") {
-				return c.Status(400).JSON(fiber.Map{"error": "Missing price of type integer"})
+				return c.Status(400).JSON(fiber.Map{"error": "Missing price of type number"})
 			}
 			if strings.Contains(err.Error(), "name") {
 				return c.Status(400).JSON(fiber.Map{"error": "Missing name of type string"})
@@ -45,8 +50,11 @@ func CreateProduct(c *fiber.Ctx) error {
 		return c.Status(400).JSON(fiber.Map{"error": "Missing name"})
 	}
 
-	if product.Price <= 0 {
-		return c.Status(400).JSON(fiber.Map{"error": "Price must be a positive integer"})
+	if err := checkPrice(product.Price); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := checkTaxClass(product); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
 	}
 
 	if product.Stock <= 0 {
@@ -59,9 +67,22 @@ func CreateProduct(c *fiber.Ctx) error {
 		return c.Status(400).JSON(fiber.Map{"error": "Product already exists"})
 	}
 
-	// Create the product in a goroutine
+	// The name of a deleted product stays reserved until it is restored or purged
+	if deleted, err := deletedProduct(database.DB.Db, product.Name); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	} else if deleted != nil {
+		return c.Status(409).JSON(fiber.Map{"error": "A deleted product has this name, restore it instead", "deleted_product_id": deleted.ID})
+	}
+
+	product.Version = 1
+
+	// Create the product and record its stock in a goroutine
+	actor := stockActor(c)
 	go func() {
-		if err := database.DB.Db.Create(&product).Error; err != nil {
+		err := database.DB.Db.Transaction(func(tx *gorm.DB) error {
+			return createProduct(tx, product, actor)
+		})
+		if err != nil {
 			// Handle error in goroutine
 			// fmt.Println("Error creating product:", err)
 			c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
@@ -72,38 +93,51 @@ func CreateProduct(c *fiber.Ctx) error {
 	return c.Status(200).JSON(product)
 }
 
-// GetProducts returns all products with pagination
+// GetProducts returns a page of products matching the search and filter parameters
 func GetProducts(c *fiber.Ctx) error {
-	page := c.Query("page")
-	if page == "" {
-		page = "1"
+	search, err := parseProductSearch(c)
+	if errors.Is(err, errSearchLookup) {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
 	}
-
-	// Convert page to integer
-	pageNum, err := strconv.Atoi(page)
 	if err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid page number"})
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
 	}
 
-	// Calculate offset and limit for pagination
-	offset := (pageNum - 1) * 20
-	limit := 20
+	return listProducts(c, search)
+}
+
+// listProducts writes a page of the products matching search
+func listProducts(c *fiber.Ctx, search *productSearch) error {
+	pager, err := parsePaginator(c, productSortColumns[search.Sort], search.Desc)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	display, err := displayCurrency(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
 
 	// Fetch products from database in a goroutine
-	var products []models.Product
+	var page Page
 	done := make(chan bool)
 	go func() {
-		if err := database.DB.Db.Offset(offset).Limit(limit).Find(&products).Error; err != nil {
-			done <- false
-		} else {
-			done <- true
+		var err error
+		page, err = paginate(pager, func() *gorm.DB {
+			return search.filter(database.DB.Db.Model(&models.Product{}))
+		}, search.key)
+		if err == nil {
+			err = attachImages(page.Data.([]models.Product))
 		}
+		if err == nil {
+			err = setDisplayPrices(page.Data.([]models.Product), display)
+		}
+		done <- err == nil
 	}()
 
 	select {
 	case success := <-done:
 		if success {
-			return c.Status(200).JSON(products)
+			return sendPage(c, page)
 		} else {
 			return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
 		}
@@ -117,9 +151,14 @@ func GetProduct(c *fiber.Ctx) error {
 	id := c.Params("id")
 	product := new(models.Product)
 
+	display, err := displayCurrency(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
 	done := make(chan bool)
 	go func() {
-		if err := database.DB.Db.First(&product, id).Error; err != nil {
+		if err := database.DB.Db.Preload("Categories").Preload("Variants").Preload("Images", orderImages).First(&product, id).Error; err != nil {
 			done <- false
 		} else {
 			done <- true
@@ -129,6 +168,19 @@ func GetProduct(c *fiber.Ctx) error {
 	select {
 	case success := <-done:
 		if success {
+			if display != "" {
+				price, err := product.Price.Convert(display)
+				if err != nil {
+					return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+				}
+				product.DisplayPrice = &price
+			}
+			availability, err := inventory.Availability(database.DB.Db, product)
+			if err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+			}
+			product.Availability = availability
+			c.Set(fiber.HeaderETag, productETag(product))
 			return c.Status(200).JSON(product)
 		} else {
 			return c.Status(404).JSON(fiber.Map{"error": "Product not found"})
@@ -138,20 +190,37 @@ func GetProduct(c *fiber.Ctx) error {
 	}
 }
 
-// UpdateProduct updates a product
+// UpdateProduct replaces the name, price, stock and tax class of a product. The stock of a product
+// with variants is the total of theirs and cannot be changed here
 func UpdateProduct(c *fiber.Ctx) error {
 	id := c.Params("id")
 	product := new(models.Product)
-	done := make(chan bool)
+	done := make(chan error)
 
 	go func() {
-		database.DB.Db.First(&product, id)
-		done <- true
+		done <- database.DB.Db.First(&product, id).Error
 	}()
 
 	select {
-	case <-done:
+	case err := <-done:
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return c.Status(404).JSON(fiber.Map{"error": "Product not found"})
+			}
+			return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+		}
+
+		if !ifMatch(c, product) {
+			return c.Status(412).JSON(fiber.Map{"error": errVersionConflict.Error()})
+		}
+
+		previousStock := product.Stock
+		productID, version := product.ID, product.Version
+
 		if err := c.BodyParser(product); err != nil {
+			if errors.Is(err, models.ErrInvalidMoney) {
+				return c.Status(400).JSON(fiber.Map{"error": "Invalid price, expected a number or an amount and currency"})
+			}
 			if _, ok := err.(*json.UnmarshalTypeError); ok {
 				// Check if the error is related to the "stock" field
 				if strings.Contains(err.Error(), "stock") {
@@ -159,7 +228,7 @@ func UpdateProduct(c *fiber.Ctx) error {
 				}
 				// Check if the error is related to the "price" field
 				if strings.Contains(err.Error(), "price") {
-					return c.Status(400).JSON(fiber.Map{"error": "Missing price of type integer"})
+					return c.Status(400).JSON(fiber.Map{"error": "Missing price of type number"})
 				}
 				if strings.Contains(err.Error(), "name") {
 					return c.Status(400).JSON(fiber.Map{"error": "Missing name of type string"})
@@ -176,6 +245,9 @@ func UpdateProduct(c *fiber.Ctx) error {
 			return c.Status(400).SendString(err.Error())
 		}
 
+		// The body cannot move the product or its version
+		product.ID, product.Version = productID, version
+
 		if product.Name == "" {
 			return c.Status(400).JSON(fiber.Map{"error": "Missing name"})
 		}
@@ -184,17 +256,134 @@ func UpdateProduct(c *fiber.Ctx) error {
 			return c.Status(400).JSON(fiber.Map{"error": "Stock must be a positive integer"})
 		}
 
-		if product.Price <= 0 {
-			return c.Status(400).JSON(fiber.Map{"error": "Price must be a positive integer"})
+		if err := checkPrice(product.Price); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		if err := checkTaxClass(product); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		// The stock of a product with variants can only be given as it is
+		if product.Stock != previousStock {
+			if variants, err := hasVariants(database.DB.Db, product.ID); err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+			} else if variants {
+				return c.Status(400).JSON(fiber.Map{"error": "Stock of a product with variants is the total of its variants"})
+			}
 		}
 
-		database.DB.Db.Save(&product)
-		return c.JSON(product)
+		return sendSavedProduct(c, product, previousStock)
 	case <-time.After(5 * time.Second):
 		return c.Status(500).JSON(fiber.Map{"error": "Timeout"})
 	}
 }
 
+// PatchProduct applies a JSON Merge Patch (RFC 7396) to a product, changing only the fields in
+// the body. name, price, stock and tax_class can be patched and none of them can be removed
+func PatchProduct(c *fiber.Ctx) error {
+	var patch map[string]json.RawMessage
+	if err := json.Unmarshal(c.Body(), &patch); err != nil || patch == nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Body must be a JSON object"})
+	}
+
+	product := new(models.Product)
+	if err := database.DB.Db.First(product, c.Params("id")).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(404).JSON(fiber.Map{"error": "Product not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	if !ifMatch(c, product) {
+		return c.Status(412).JSON(fiber.Map{"error": errVersionConflict.Error()})
+	}
+
+	previousStock := product.Stock
+	for field, value := range patch {
+		var target any
+		switch field {
+		case "name":
+			target = &product.Name
+		case "price":
+			target = &product.Price
+		case "stock":
+			target = &product.Stock
+		case "tax_class":
+			target = &product.TaxClass
+		default:
+			return c.Status(400).JSON(fiber.Map{"error": "Field " + field + " cannot be patched"})
+		}
+
+		if string(value) == "null" {
+			return c.Status(400).JSON(fiber.Map{"error": "Field " + field + " cannot be removed"})
+		}
+		if err := json.Unmarshal(value, target); err != nil {
+			kind := "integer"
+			switch field {
+			case "name", "tax_class":
+				kind = "string"
+			case "price":
+				kind = "number"
+			}
+			return c.Status(400).JSON(fiber.Map{"error": "Missing " + field + " of type " + kind})
+		}
+	}
+
+	if strings.TrimSpace(product.Name) == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "Missing name"})
+	}
+	if err := checkPrice(product.Price); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := checkTaxClass(product); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	if product.Stock < 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "Stock must not be negative"})
+	}
+
+	// A new name must not be taken by another product, deleted or not, as when creating one
+	if _, ok := patch["name"]; ok {
+		var existingProduct models.Product
+		if err := database.DB.Db.Where("name = ? AND id <> ?", product.Name, product.ID).First(&existingProduct).Error; err == nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Product already exists"})
+		}
+		if deleted, err := deletedProduct(database.DB.Db, product.Name); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+		} else if deleted != nil {
+			return c.Status(409).JSON(fiber.Map{"error": "A deleted product has this name, restore it instead", "deleted_product_id": deleted.ID})
+		}
+	}
+
+	if _, ok := patch["stock"]; ok {
+		if variants, err := hasVariants(database.DB.Db, product.ID); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+		} else if variants {
+			return c.Status(400).JSON(fiber.Map{"error": "Stock of a product with variants is the total of its variants"})
+		}
+	}
+
+	if len(patch) == 0 {
+		c.Set(fiber.HeaderETag, productETag(product))
+		return c.JSON(product)
+	}
+
+	return sendSavedProduct(c, product, previousStock)
+}
+
+// sendSavedProduct saves the product and writes it with its new ETag, or a 412 when it changed
+// since it was loaded
+func sendSavedProduct(c *fiber.Ctx, product *models.Product, previousStock int) error {
+	if err := saveProduct(product, previousStock, stockActor(c)); err != nil {
+		if errors.Is(err, errVersionConflict) {
+			return c.Status(412).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	c.Set(fiber.HeaderETag, productETag(product))
+	return c.JSON(product)
+}
+
 // DeleteProduct deletes a product
 func DeleteProduct(c *fiber.Ctx) error {
 	id := c.Params("id")
@@ -0,0 +1,572 @@
+package handlers
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/leroysb/go_kubernetes/internal/currency"
+	"github.com/leroysb/go_kubernetes/internal/database"
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"gorm.io/gorm"
+)
+
+var (
+	errCouponInactive      = errors.New("Coupon is not active")
+	errCouponNotStarted    = errors.New("Coupon is not valid yet")
+	errCouponExpired       = errors.New("Coupon has expired")
+	errCouponUsedUp        = errors.New("Coupon has been used up")
+	errCouponCustomerLimit = errors.New("Coupon has already been used the maximum number of times")
+	errCouponNotApplicable = errors.New("Coupon does not apply to the products in the cart")
+	errCouponTaken         = errors.New("Coupon was used by another order in the meantime")
+)
+
+// isCouponError reports whether err is one of the reasons a coupon cannot be used
+func isCouponError(err error) bool {
+	for _, target := range []error{errCouponInactive, errCouponNotStarted, errCouponExpired, errCouponUsedUp, errCouponCustomerLimit, errCouponNotApplicable, errCouponTaken} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+type promotionRequest struct {
+	Code             *string       `json:"code"`
+	Description      *string       `json:"description"`
+	Kind             *string       `json:"kind"`
+	Percent          *int          `json:"percent"`
+	Amount           *models.Money `json:"amount"`
+	MinOrder         *models.Money `json:"min_order"`
+	ProductIDs       *[]uint       `json:"product_ids"`
+	CategoryIDs      *[]uint       `json:"category_ids"`
+	StartsAt         *time.Time    `json:"starts_at"`
+	EndsAt           *time.Time    `json:"ends_at"`
+	UsageLimit       *int          `json:"usage_limit"`
+	PerCustomerLimit *int          `json:"per_customer_limit"`
+	Active           *bool         `json:"active"`
+}
+
+// apply copies the fields that were set onto the promotion and validates the result
+func (r promotionRequest) apply(promotion *models.Promotion) error {
+	if r.Code != nil {
+		promotion.Code = strings.ToUpper(strings.TrimSpace(*r.Code))
+	}
+	if r.Description != nil {
+		promotion.Description = *r.Description
+	}
+	if r.Kind != nil {
+		promotion.Kind = *r.Kind
+	}
+	if r.Percent != nil {
+		promotion.Percent = *r.Percent
+	}
+	if r.Amount != nil {
+		promotion.Amount = r.Amount
+	}
+	if r.MinOrder != nil {
+		promotion.MinOrder = r.MinOrder
+	}
+	if r.ProductIDs != nil {
+		promotion.ProductIDs = *r.ProductIDs
+	}
+	if r.CategoryIDs != nil {
+		promotion.CategoryIDs = *r.CategoryIDs
+	}
+	if r.StartsAt != nil {
+		promotion.StartsAt = r.StartsAt
+	}
+	if r.EndsAt != nil {
+		promotion.EndsAt = r.EndsAt
+	}
+	if r.UsageLimit != nil {
+		promotion.UsageLimit = r.UsageLimit
+	}
+	if r.PerCustomerLimit != nil {
+		promotion.PerCustomerLimit = r.PerCustomerLimit
+	}
+	if r.Active != nil {
+		promotion.Active = *r.Active
+	}
+
+	if promotion.Code == "" {
+		return errors.New("Missing code")
+	}
+	switch promotion.Kind {
+	case models.PromotionPercentage:
+		if promotion.Percent < 1 || promotion.Percent > 100 {
+			return errors.New("Percent must be between 1 and 100")
+		}
+		promotion.Amount = nil
+	case models.PromotionFixed:
+		if promotion.Amount == nil {
+			return errors.New("Missing amount")
+		}
+		if err := checkPrice(*promotion.Amount); err != nil {
+			return errors.New("Amount must be positive and in the store currency " + currency.Base())
+		}
+		promotion.Percent = 0
+	default:
+		return errors.New("Invalid kind, expected percentage or fixed")
+	}
+	if promotion.MinOrder != nil && (promotion.MinOrder.Amount < 0 || promotion.MinOrder.Currency != currency.Base()) {
+		return errors.New("min_order must not be negative and in the store currency " + currency.Base())
+	}
+	if promotion.StartsAt != nil && promotion.EndsAt != nil && !promotion.EndsAt.After(*promotion.StartsAt) {
+		return errors.New("ends_at must be after starts_at")
+	}
+	if (promotion.UsageLimit != nil && *promotion.UsageLimit < 1) || (promotion.PerCustomerLimit != nil && *promotion.PerCustomerLimit < 1) {
+		return errors.New("Usage limits must be positive")
+	}
+	return nil
+}
+
+// savePromotion writes a promotion, storing the amounts it does not have as NULL rather than zero.
+// Save fills in nil embedded amounts, so which ones to clear is decided before
+func savePromotion(db *gorm.DB, promotion *models.Promotion) error {
+	unset := map[string]any{}
+	if promotion.Amount == nil {
+		unset["amount_minor"], unset["amount_currency"] = nil, nil
+	}
+	if promotion.MinOrder == nil {
+		unset["min_order_minor"], unset["min_order_currency"] = nil, nil
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		// uses is only ever counted up by redeemPromotion
+		if err := tx.Omit("uses").Save(promotion).Error; err != nil {
+			return err
+		}
+		if len(unset) == 0 {
+			return nil
+		}
+		if err := tx.Model(promotion).Updates(unset).Error; err != nil {
+			return err
+		}
+		if _, ok := unset["amount_minor"]; ok {
+			promotion.Amount = nil
+		}
+		if _, ok := unset["min_order_minor"]; ok {
+			promotion.MinOrder = nil
+		}
+		return nil
+	})
+}
+
+// codeTaken reports whether another promotion, deleted or not, has the code
+func codeTaken(code string, exceptID uint) (bool, error) {
+	var count int64
+	err := database.DB.Db.Unscoped().Model(&models.Promotion{}).Where("code = ? AND id <> ?", code, exceptID).Count(&count).Error
+	return count > 0, err
+}
+
+// GetPromotions returns a page of promotions
+func GetPromotions(c *fiber.Ctx) error {
+	pager, err := parsePaginator(c, "id", true)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	page, err := paginate(pager, func() *gorm.DB {
+		return database.DB.Db.Model(&models.Promotion{})
+	}, func(promotion models.Promotion) (any, uint) {
+		return nil, promotion.ID
+	})
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+	return sendPage(c, page)
+}
+
+// CreatePromotion creates a promotion, active unless the body says otherwise
+func CreatePromotion(c *fiber.Ctx) error {
+	var req promotionRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	promotion := models.Promotion{Active: true}
+	if err := req.apply(&promotion); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	if taken, err := codeTaken(promotion.Code, 0); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	} else if taken {
+		return c.Status(409).JSON(fiber.Map{"error": "Coupon code already exists"})
+	}
+
+	if err := savePromotion(database.DB.Db, &promotion); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	return c.Status(201).JSON(promotion)
+}
+
+// UpdatePromotion updates the fields given in the body of a promotion
+func UpdatePromotion(c *fiber.Ctx) error {
+	var promotion models.Promotion
+	if err := database.DB.Db.First(&promotion, c.Params("id")).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(404).JSON(fiber.Map{"error": "Promotion not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	var req promotionRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	if err := req.apply(&promotion); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	if taken, err := codeTaken(promotion.Code, promotion.ID); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	} else if taken {
+		return c.Status(409).JSON(fiber.Map{"error": "Coupon code already exists"})
+	}
+
+	if err := savePromotion(database.DB.Db, &promotion); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	return c.JSON(promotion)
+}
+
+// DeletePromotion deletes a promotion. Orders that redeemed it keep their discount
+func DeletePromotion(c *fiber.Ctx) error {
+	result := database.DB.Db.Delete(&models.Promotion{}, c.Params("id"))
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+	if result.RowsAffected == 0 {
+		return c.Status(404).JSON(fiber.Map{"error": "Promotion not found"})
+	}
+
+	return c.SendStatus(204)
+}
+
+// checkPromotion refuses a promotion that is switched off, outside its validity window, or that
+// the customer or everyone together has used up
+func checkPromotion(db *gorm.DB, promotion *models.Promotion, customerID uint, now time.Time) error {
+	if !promotion.Active {
+		return errCouponInactive
+	}
+	if promotion.StartsAt != nil && now.Before(*promotion.StartsAt) {
+		return errCouponNotStarted
+	}
+	if promotion.EndsAt != nil && !now.Before(*promotion.EndsAt) {
+		return errCouponExpired
+	}
+	if promotion.UsageLimit != nil && promotion.Uses >= *promotion.UsageLimit {
+		return errCouponUsedUp
+	}
+
+	if promotion.PerCustomerLimit != nil {
+		var uses int64
+		if err := db.Model(&models.Order{}).Where("promotion_id = ? AND customer_id = ?", promotion.ID, customerID).Count(&uses).Error; err != nil {
+			return err
+		}
+		if uses >= int64(*promotion.PerCustomerLimit) {
+			return errCouponCustomerLimit
+		}
+	}
+	return nil
+}
+
+// promotionCovers reports whether the promotion applies to the product, directly or through one of
+// its categories or their subcategories
+func promotionCovers(db *gorm.DB, promotion *models.Promotion, product *models.Product) (bool, error) {
+	if len(promotion.ProductIDs) == 0 && len(promotion.CategoryIDs) == 0 {
+		return true, nil
+	}
+	if slices.Contains(promotion.ProductIDs, product.ID) {
+		return true, nil
+	}
+	if len(promotion.CategoryIDs) == 0 {
+		return false, nil
+	}
+
+	var categories []uint
+	for _, id := range promotion.CategoryIDs {
+		ids, err := categoryWithDescendants(db, id)
+		if err != nil {
+			return false, err
+		}
+		categories = append(categories, ids...)
+	}
+	var count int64
+	err := db.Table("product_categories").Where("product_id = ? AND category_id IN ?", product.ID, categories).Count(&count).Error
+	return count > 0, err
+}
+
+// couponDiscounts is the discount the promotion gives on each line, bought in the quantity at the
+// same index. The minimum order is checked against all the lines together, and a fixed amount is
+// shared out between the covered lines by what they cost, the last taking what rounding leaves.
+// covered tells whether any line is in the promotion's scope, whether or not the minimum was met
+func couponDiscounts(db *gorm.DB, promotion *models.Promotion, lines []*orderLine, quantities []int) (discounts []models.Money, covered bool, err error) {
+	amounts := make([]models.Money, len(lines))
+	discounts = make([]models.Money, len(lines))
+	var subtotal models.Money
+	var coveredTotal models.Money
+	var coveredLines []int
+	for i, line := range lines {
+		amounts[i] = line.UnitPrice.Mul(quantities[i])
+		discounts[i] = models.Money{Currency: amounts[i].Currency}
+		subtotal.Amount += amounts[i].Amount
+
+		ok, err := promotionCovers(db, promotion, &line.Product)
+		if err != nil {
+			return nil, false, err
+		}
+		if ok {
+			coveredLines = append(coveredLines, i)
+			coveredTotal.Amount += amounts[i].Amount
+			coveredTotal.Currency = amounts[i].Currency
+		}
+	}
+
+	if len(coveredLines) == 0 {
+		return discounts, false, nil
+	}
+	if promotion.MinOrder != nil && subtotal.Amount < promotion.MinOrder.Amount {
+		return discounts, true, nil
+	}
+
+	if promotion.Kind != models.PromotionFixed {
+		for _, i := range coveredLines {
+			discounts[i] = promotion.Discount(amounts[i])
+		}
+		return discounts, true, nil
+	}
+	if coveredTotal.Amount == 0 {
+		return discounts, true, nil
+	}
+	total := promotion.Discount(coveredTotal).Amount
+	left := total
+	for n, i := range coveredLines {
+		share := total * amounts[i].Amount / coveredTotal.Amount
+		if n == len(coveredLines)-1 {
+			share = left
+		}
+		discounts[i].Amount = share
+		left -= share
+	}
+	return discounts, true, nil
+}
+
+// cartPromotion returns the promotion applied to the cart, if any
+func cartPromotion(db *gorm.DB, cart *models.Cart) (*models.Promotion, error) {
+	if cart == nil || cart.PromotionID == nil {
+		return nil, nil
+	}
+	var promotion models.Promotion
+	err := db.First(&promotion, *cart.PromotionID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &promotion, nil
+}
+
+// checkoutDiscount works out the discount of the coupon applied to the customer's cart on an order
+// of quantity items of the line. The order takes the line's share of the discount on the cart, with
+// the ordered quantity in place of what the cart holds of it. Orders the coupon does not cover are
+// placed at full price
+func checkoutDiscount(customerID uint, line *orderLine, quantity int) (models.Money, *models.Promotion, error) {
+	cart, err := activeCart(database.DB.Db, customerID, false)
+	if err != nil {
+		return models.Money{}, nil, err
+	}
+	promotion, err := cartPromotion(database.DB.Db, cart)
+	if err != nil || promotion == nil {
+		return models.Money{}, nil, err
+	}
+	if err := checkPromotion(database.DB.Db, promotion, customerID, time.Now()); err != nil {
+		return models.Money{}, nil, err
+	}
+
+	items, err := cartItems(database.DB.Db, cart)
+	if err != nil {
+		return models.Money{}, nil, err
+	}
+	lines := []*orderLine{}
+	quantities := []int{}
+	ordered := -1
+	for _, item := range items {
+		if item.ProductID == line.Product.ID && sameVariant(item.VariantID, line.Variant) {
+			ordered = len(lines)
+			lines, quantities = append(lines, line), append(quantities, quantity)
+			continue
+		}
+		itemLine, err := resolveLine(database.DB.Db, item.ProductID, item.VariantID)
+		if err != nil {
+			continue
+		}
+		lines, quantities = append(lines, itemLine), append(quantities, item.Quantity)
+	}
+	if ordered < 0 {
+		ordered = len(lines)
+		lines, quantities = append(lines, line), append(quantities, quantity)
+	}
+
+	discounts, _, err := couponDiscounts(database.DB.Db, promotion, lines, quantities)
+	if err != nil || discounts[ordered].Amount == 0 {
+		return models.Money{}, nil, err
+	}
+	return discounts[ordered], promotion, nil
+}
+
+// sameVariant reports whether a cart item's variant is the variant of a line
+func sameVariant(variantID *uint, variant *models.ProductVariant) bool {
+	if variantID == nil || variant == nil {
+		return variantID == nil && variant == nil
+	}
+	return *variantID == variant.ID
+}
+
+// redeemPromotion counts a use of the promotion, failing with errCouponUsedUp when another order
+// took its last use in the meantime. The coupon is taken off the customer's cart, as each time it
+// is applied it is good for one order, so of two checkouts at once only the one that takes it gets
+// the discount. The customer's uses, this order's among them, are counted again once the update
+// has locked the promotion
+func redeemPromotion(tx *gorm.DB, promotionID, customerID uint) error {
+	result := tx.Model(&models.Promotion{}).
+		Where("id = ? AND (usage_limit IS NULL OR uses < usage_limit)", promotionID).
+		Update("uses", gorm.Expr("uses + 1"))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errCouponUsedUp
+	}
+
+	var promotion models.Promotion
+	if err := tx.First(&promotion, promotionID).Error; err != nil {
+		return err
+	}
+	if promotion.PerCustomerLimit != nil {
+		var uses int64
+		if err := tx.Model(&models.Order{}).Where("promotion_id = ? AND customer_id = ?", promotionID, customerID).Count(&uses).Error; err != nil {
+			return err
+		}
+		if uses > int64(*promotion.PerCustomerLimit) {
+			return errCouponCustomerLimit
+		}
+	}
+
+	result = tx.Model(&models.Cart{}).Where("customer_id = ? AND status = ? AND promotion_id = ?", customerID, models.CartActive, promotionID).
+		Update("promotion_id", nil)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected != 1 {
+		return errCouponTaken
+	}
+	return nil
+}
+
+// couponLine is the discount a coupon gives on one item of the cart
+type couponLine struct {
+	ItemID    uint         `json:"item_id"`
+	ProductID uint         `json:"product_id"`
+	VariantID *uint        `json:"variant_id"`
+	Quantity  int          `json:"quantity"`
+	Discount  models.Money `json:"discount"`
+}
+
+// ApplyCoupon applies a coupon code to the customer's cart, replacing any applied before, and
+// returns the discount it gives on each line. The discount is taken again at checkout
+func ApplyCoupon(c *fiber.Ctx) error {
+	user := c.Locals("user").(*models.Customer)
+
+	var body struct {
+		Code string `json:"code"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	if strings.TrimSpace(body.Code) == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "Missing code"})
+	}
+
+	var promotion models.Promotion
+	if err := database.DB.Db.Where("code = ?", strings.ToUpper(strings.TrimSpace(body.Code))).First(&promotion).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(404).JSON(fiber.Map{"error": "Coupon not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+	if err := checkPromotion(database.DB.Db, &promotion, user.ID, time.Now()); err != nil {
+		if isCouponError(err) {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	cart, err := activeCart(database.DB.Db, user.ID, false)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+	items := []models.CartItem{}
+	if cart != nil {
+		if items, err = cartItems(database.DB.Db, cart); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+		}
+	}
+	if len(items) == 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "Cart is empty"})
+	}
+
+	var resolved []*orderLine
+	var quantities []int
+	var bought []models.CartItem
+	for _, item := range items {
+		line, err := resolveLine(database.DB.Db, item.ProductID, item.VariantID)
+		if err != nil {
+			// Items that can no longer be bought are refused at checkout, and get no discount
+			continue
+		}
+		resolved, quantities, bought = append(resolved, line), append(quantities, item.Quantity), append(bought, item)
+	}
+	discounts, covered, err := couponDiscounts(database.DB.Db, &promotion, resolved, quantities)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	total := models.NewMoney(0)
+	lines := []couponLine{}
+	for i, item := range bought {
+		total.Amount += discounts[i].Amount
+		lines = append(lines, couponLine{ItemID: item.ID, ProductID: item.ProductID, VariantID: item.VariantID, Quantity: item.Quantity, Discount: discounts[i]})
+	}
+
+	if total.Amount == 0 {
+		if covered && promotion.MinOrder != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Coupon needs an order of at least " + promotion.MinOrder.String()})
+		}
+		return c.Status(400).JSON(fiber.Map{"error": errCouponNotApplicable.Error()})
+	}
+
+	if err := database.DB.Db.Model(cart).Update("promotion_id", promotion.ID).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	return c.JSON(fiber.Map{"code": promotion.Code, "description": promotion.Description, "discount": total, "lines": lines})
+}
+
+// RemoveCoupon takes the coupon off the customer's cart
+func RemoveCoupon(c *fiber.Ctx) error {
+	user := c.Locals("user").(*models.Customer)
+
+	err := database.DB.Db.Model(&models.Cart{}).Where("customer_id = ? AND status = ?", user.ID, models.CartActive).Update("promotion_id", nil).Error
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+	return c.SendStatus(204)
+}
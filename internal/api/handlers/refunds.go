@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/leroysb/go_kubernetes/internal/database"
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"github.com/leroysb/go_kubernetes/internal/payments"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	errRefundQuantity = errors.New("Refund quantity is more than the items not yet returned")
+	errRefundCurrency = errors.New("Refund must be in the currency of the payment")
+	errFullyRefunded  = errors.New("Order has been fully refunded")
+	errLateQuantity   = errors.New("A late payment is refunded without returning items")
+)
+
+// refundTooLargeError is returned for a refund of more than is left, and says how much is left to refund
+type refundTooLargeError struct {
+	remaining models.Money
+}
+
+func (e refundTooLargeError) Error() string {
+	return fmt.Sprintf("Refund is more than the %s left to refund", e.remaining)
+}
+
+type refundRequest struct {
+	PaymentID *uint         `json:"payment_id"`
+	Quantity  int           `json:"quantity"`
+	Amount    *models.Money `json:"amount"`
+	Restock   bool          `json:"restock"`
+	Reason    string        `json:"reason"`
+}
+
+// CreateRefund refunds some of the items of a paid order, an amount of it, or both, through the
+// provider that took the payment. Without an amount, returned items are refunded at their share of
+// the payment, and returning the last of them refunds whatever is left. Naming a late payment of the
+// order refunds it instead, in full unless an amount is given
+func CreateRefund(c *fiber.Ctx) error {
+	var body refundRequest
+	if err := c.BodyParser(&body); err != nil {
+		if errors.Is(err, models.ErrInvalidMoney) {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid amount, expected a number or an amount and currency"})
+		}
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	if body.Quantity < 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid quantity"})
+	}
+	if body.Quantity == 0 && body.Amount == nil && body.PaymentID == nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Missing quantity or amount"})
+	}
+	if body.Amount != nil && body.Amount.Amount <= 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "Refund amount must be positive"})
+	}
+	if body.Restock && body.Quantity == 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "Restocking needs the quantity returned"})
+	}
+
+	refund := &models.Refund{Quantity: body.Quantity, Restock: body.Restock, Reason: body.Reason}
+	err := database.DB.Db.Transaction(func(tx *gorm.DB) error {
+		// Lock the order so two refunds at once cannot both take what is left
+		query := tx
+		if tx.Dialector.Name() == "postgres" {
+			query = query.Clauses(clause.Locking{Strength: "UPDATE"})
+		}
+		var order models.Order
+		if err := query.First(&order, c.Params("id")).Error; err != nil {
+			return err
+		}
+
+		var payment *models.Payment
+		var err error
+		if body.PaymentID != nil {
+			if body.Quantity > 0 {
+				return errLateQuantity
+			}
+			payment, err = payments.LatePayment(tx, order.ID, *body.PaymentID)
+		} else {
+			payment, err = payments.PaidPayment(tx, order.ID)
+		}
+		if err != nil {
+			return err
+		}
+		refunded, returned, err := payments.Refunded(tx, payment.ID)
+		if err != nil {
+			return err
+		}
+
+		remaining := payment.Amount.Amount - refunded
+		if remaining <= 0 {
+			return errFullyRefunded
+		}
+		left := order.Quantity - returned
+		if body.Quantity > left {
+			return errRefundQuantity
+		}
+
+		if body.Amount != nil {
+			refund.Amount = *body.Amount
+		} else if body.PaymentID != nil {
+			refund.Amount = models.Money{Amount: remaining, Currency: payment.Amount.Currency}
+		} else {
+			share := (payment.Amount.Amount*int64(body.Quantity) + int64(order.Quantity)/2) / int64(order.Quantity)
+			if body.Quantity == left {
+				share = remaining
+			}
+			refund.Amount = models.Money{Amount: min(share, remaining), Currency: payment.Amount.Currency}
+		}
+		if refund.Amount.Currency != payment.Amount.Currency {
+			return errRefundCurrency
+		}
+		if refund.Amount.Amount > remaining {
+			return refundTooLargeError{remaining: models.Money{Amount: remaining, Currency: payment.Amount.Currency}}
+		}
+
+		return payments.CreateRefund(tx, payment, refund)
+	})
+	if err == nil {
+		// The refund is recorded before it is paid out, and the items are restocked once it has been
+		err = payments.SendRefund(refund)
+	}
+	if err != nil {
+		var tooLarge refundTooLargeError
+		var apiErr *payments.APIError
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			return c.Status(404).JSON(fiber.Map{"error": "Order not found"})
+		case errors.Is(err, payments.ErrNotPaid), errors.Is(err, payments.ErrNotLate), errors.Is(err, errLateQuantity), errors.Is(err, errFullyRefunded),
+			errors.Is(err, errRefundQuantity), errors.Is(err, errRefundCurrency), errors.As(err, &tooLarge), errors.Is(err, payments.ErrCurrency), errors.Is(err, payments.ErrRefundTooSmall):
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		case errors.As(err, &apiErr):
+			log.Printf("Error refunding order %s: %v", c.Params("id"), err)
+			return c.Status(502).JSON(fiber.Map{"error": "The payment provider could not make the refund"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	return c.Status(201).JSON(refund)
+}
+
+// GetRefunds returns the refunds of an order, oldest first
+func GetRefunds(c *fiber.Ctx) error {
+	var order models.Order
+	if err := database.DB.Db.First(&order, c.Params("id")).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(404).JSON(fiber.Map{"error": "Order not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	refunds := []models.Refund{}
+	if err := database.DB.Db.Where("order_id = ?", order.ID).Order("id").Find(&refunds).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+	return c.JSON(refunds)
+}
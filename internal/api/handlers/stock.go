@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/leroysb/go_kubernetes/internal/database"
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"github.com/leroysb/go_kubernetes/internal/inventory"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// stockActor names who a request changes stock on behalf of for the ledger
+func stockActor(c *fiber.Ctx) string {
+	if user, ok := c.Locals("user").(*models.Customer); ok && user != nil {
+		return fmt.Sprintf("customer:%d", user.ID)
+	}
+	return "api"
+}
+
+// editReason is the ledger reason of a stock level set by hand: a restock when it went up and an
+// adjustment otherwise
+func editReason(delta int) string {
+	if delta > 0 {
+		return models.StockRestock
+	}
+	return models.StockAdjustment
+}
+
+// setProductStock sets the stock of a product, deleted or not, and records the change in the ledger
+// with the reference and actor of movement. Without a reason, it is taken to be set by hand
+func setProductStock(tx *gorm.DB, productID uint, stock int, movement models.StockMovement) error {
+	query := tx.Unscoped().Model(&models.Product{}).Select("stock")
+	if tx.Dialector.Name() == "postgres" {
+		query = query.Clauses(clause.Locking{Strength: "UPDATE"})
+	}
+	var current int
+	if err := query.Where("id = ?", productID).Scan(&current).Error; err != nil {
+		return err
+	}
+	if current == stock {
+		return nil
+	}
+
+	err := tx.Unscoped().Model(&models.Product{}).Where("id = ?", productID).Updates(map[string]any{"stock": stock, "version": gorm.Expr("version + 1")}).Error
+	if err != nil {
+		return err
+	}
+	movement.ProductID, movement.Delta = productID, stock-current
+	if movement.Reason == "" {
+		movement.Reason = editReason(movement.Delta)
+	}
+	return inventory.Adjust(tx, stock, movement)
+}
+
+// GetStockMovements returns a page of the stock ledger of a product, newest first
+func GetStockMovements(c *fiber.Ctx) error {
+	var product models.Product
+	if err := database.DB.Db.Unscoped().First(&product, c.Params("id")).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(404).JSON(fiber.Map{"error": "Product not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	pager, err := parsePaginator(c, "id", true)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	page, err := paginate(pager, func() *gorm.DB {
+		return database.DB.Db.Model(&models.StockMovement{}).Where("product_id = ?", product.ID)
+	}, func(movement models.StockMovement) (any, uint) {
+		return nil, movement.ID
+	})
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+	return sendPage(c, page)
+}
@@ -0,0 +1,306 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/leroysb/go_kubernetes/internal/database"
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"github.com/leroysb/go_kubernetes/internal/inventory"
+	"github.com/leroysb/go_kubernetes/internal/tax"
+	"gorm.io/gorm"
+)
+
+var errVariantRequired = errors.New("Missing variant_id")
+var errVariantNotFound = errors.New("Variant not found")
+var errProductDeleted = errors.New("Product is no longer available")
+
+type variantRequest struct {
+	SKU     string            `json:"sku"`
+	Options map[string]string `json:"options"`
+	Price   *models.Money     `json:"price"`
+	Stock   int               `json:"stock"`
+}
+
+func (r *variantRequest) validate() error {
+	r.SKU = strings.TrimSpace(r.SKU)
+	if r.SKU == "" {
+		return errors.New("Missing sku")
+	}
+	if r.Price != nil {
+		if err := checkPrice(*r.Price); err != nil {
+			return err
+		}
+	}
+	if r.Stock < 0 {
+		return errors.New("Stock must not be negative")
+	}
+	return nil
+}
+
+// updateVariantPrice writes the variant's price override. Updating through the struct would store
+// a removed override as zero rather than NULL
+func updateVariantPrice(tx *gorm.DB, variant *models.ProductVariant) error {
+	price := map[string]any{"price_minor": nil, "price_currency": nil}
+	if variant.Price != nil {
+		price = map[string]any{"price_minor": variant.Price.Amount, "price_currency": variant.Price.Currency}
+	}
+	return tx.Model(variant).Updates(price).Error
+}
+
+// orderLine is a product, and the variant when it has variants, resolved for a cart or order line
+type orderLine struct {
+	Product   models.Product
+	Variant   *models.ProductVariant
+	UnitPrice models.Money
+	Available int
+}
+
+// charge sets the amounts of an order of quantity items of the line, less the discount, with the
+// tax of the product's class
+func (l *orderLine) charge(order *models.Order, quantity int, discount models.Money) {
+	amount := l.UnitPrice.Mul(quantity)
+	discount.Currency = amount.Currency
+	amount.Amount -= discount.Amount
+
+	line := tax.Apply(amount, l.Product.TaxClass)
+	order.Discount, order.Subtotal, order.Tax, order.Amount = discount, line.Subtotal, line.Tax, line.Total
+	order.TaxClass, order.TaxRate, order.TaxInclusive = line.Class, line.Percent(), line.Inclusive
+}
+
+// resolveLine loads the product and variant for a line. Products with variants can only be
+// bought as one of their variants, and deleted products and variants cannot be bought at all
+func resolveLine(db *gorm.DB, productID uint, variantID *uint) (*orderLine, error) {
+	line := &orderLine{}
+	if err := db.Unscoped().First(&line.Product, productID).Error; err != nil {
+		return nil, err
+	}
+	if line.Product.DeletedAt.Valid {
+		return nil, errProductDeleted
+	}
+	// The product is looked up unscoped to tell deleted from missing, but its deleted variants are left out
+	if err := db.Where("product_id = ?", productID).Order("id").Find(&line.Product.Variants).Error; err != nil {
+		return nil, err
+	}
+
+	if variantID == nil {
+		if len(line.Product.Variants) > 0 {
+			return nil, errVariantRequired
+		}
+		line.UnitPrice = line.Product.Price
+		line.Available = line.Product.Stock
+		return line, nil
+	}
+
+	for i := range line.Product.Variants {
+		if line.Product.Variants[i].ID == *variantID {
+			line.Variant = &line.Product.Variants[i]
+			line.UnitPrice = line.Variant.UnitPrice(&line.Product)
+			line.Available = line.Variant.Stock
+			return line, nil
+		}
+	}
+	return nil, errVariantNotFound
+}
+
+// reserveStock takes quantity from the line's variant, if any, and from the product, failing with
+// errOutOfStock when either would go negative. The sale is allocated to warehouses for the order,
+// shipping to the location if known, and recorded in the ledger with the reference and actor of
+// movement
+func reserveStock(tx *gorm.DB, line *orderLine, order *models.Order, to *inventory.Location, movement models.StockMovement) error {
+	quantity := order.Quantity
+	if line.Variant != nil {
+		result := tx.Model(&models.ProductVariant{}).Where("id = ? AND stock >= ?", line.Variant.ID, quantity).Update("stock", gorm.Expr("stock - ?", quantity))
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errOutOfStock
+		}
+		line.Variant.Stock -= quantity
+	}
+
+	result := tx.Model(&models.Product{}).Where("id = ? AND stock >= ?", line.Product.ID, quantity).Updates(map[string]any{"stock": gorm.Expr("stock - ?", quantity), "version": gorm.Expr("version + 1")})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errOutOfStock
+	}
+	line.Product.Stock -= quantity
+	line.Product.Version++
+
+	movement.ProductID, movement.Delta, movement.Reason = line.Product.ID, -quantity, models.StockSale
+	if line.Variant != nil {
+		movement.VariantID = &line.Variant.ID
+	}
+	allocations, err := inventory.Allocate(tx, order.ID, to, movement)
+	order.Allocations = allocations
+	return err
+}
+
+// hasVariants reports whether a product has variants, in which case its stock is the total of theirs
+// and cannot be set on the product
+func hasVariants(tx *gorm.DB, productID uint) (bool, error) {
+	var count int64
+	err := tx.Model(&models.ProductVariant{}).Where("product_id = ?", productID).Count(&count).Error
+	return count > 0, err
+}
+
+// syncProductStock sets a product's stock to the total of its variants, if it has any, recording
+// the change as setProductStock does
+func syncProductStock(tx *gorm.DB, productID uint, movement models.StockMovement) error {
+	if variants, err := hasVariants(tx, productID); err != nil || !variants {
+		return err
+	}
+
+	var total int
+	if err := tx.Model(&models.ProductVariant{}).Where("product_id = ?", productID).Select("COALESCE(SUM(stock), 0)").Scan(&total).Error; err != nil {
+		return err
+	}
+	return setProductStock(tx, productID, total, movement)
+}
+
+// variantMovement is the ledger entry for a change to the stock of a variant
+func variantMovement(c *fiber.Ctx, variant *models.ProductVariant) models.StockMovement {
+	return models.StockMovement{VariantID: &variant.ID, Reference: fmt.Sprintf("variant:%d", variant.ID), Actor: stockActor(c)}
+}
+
+// skuTaken reports whether another variant, including deleted ones, already uses the SKU
+func skuTaken(sku string, exceptID uint) (bool, error) {
+	var count int64
+	err := database.DB.Db.Unscoped().Model(&models.ProductVariant{}).Where("sku = ? AND id <> ?", sku, exceptID).Count(&count).Error
+	return count > 0, err
+}
+
+// GetProductVariants returns the variants of a product
+func GetProductVariants(c *fiber.Ctx) error {
+	var product models.Product
+	if err := database.DB.Db.Preload("Variants").First(&product, c.Params("id")).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(404).JSON(fiber.Map{"error": "Product not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	if product.Variants == nil {
+		product.Variants = []models.ProductVariant{}
+	}
+	return c.JSON(product.Variants)
+}
+
+// CreateProductVariant adds a variant to a product. The product's stock becomes the total of its variants
+func CreateProductVariant(c *fiber.Ctx) error {
+	var product models.Product
+	if err := database.DB.Db.First(&product, c.Params("id")).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(404).JSON(fiber.Map{"error": "Product not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	var req variantRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	if err := req.validate(); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	if taken, err := skuTaken(req.SKU, 0); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	} else if taken {
+		return c.Status(409).JSON(fiber.Map{"error": "SKU already exists"})
+	}
+
+	variant := models.ProductVariant{ProductID: product.ID, SKU: req.SKU, Options: req.Options, Price: req.Price, Stock: req.Stock}
+	err := database.DB.Db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&variant).Error; err != nil {
+			return err
+		}
+		return syncProductStock(tx, product.ID, variantMovement(c, &variant))
+	})
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	return c.Status(201).JSON(variant)
+}
+
+// UpdateProductVariant replaces the SKU, options, price override and stock of a variant
+func UpdateProductVariant(c *fiber.Ctx) error {
+	var variant models.ProductVariant
+	if err := database.DB.Db.Where("product_id = ?", c.Params("id")).First(&variant, c.Params("variant_id")).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(404).JSON(fiber.Map{"error": "Variant not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	var req variantRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	if err := req.validate(); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	if taken, err := skuTaken(req.SKU, variant.ID); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	} else if taken {
+		return c.Status(409).JSON(fiber.Map{"error": "SKU already exists"})
+	}
+
+	variant.SKU, variant.Options, variant.Price, variant.Stock = req.SKU, req.Options, req.Price, req.Stock
+	err := database.DB.Db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Select("sku", "options", "stock").Updates(&variant).Error; err != nil {
+			return err
+		}
+		if err := updateVariantPrice(tx, &variant); err != nil {
+			return err
+		}
+		return syncProductStock(tx, variant.ProductID, variantMovement(c, &variant))
+	})
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	return c.JSON(variant)
+}
+
+// DeleteProductVariant deletes a variant and removes its stock from the product
+func DeleteProductVariant(c *fiber.Ctx) error {
+	var variant models.ProductVariant
+	if err := database.DB.Db.Where("product_id = ?", c.Params("id")).First(&variant, c.Params("variant_id")).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(404).JSON(fiber.Map{"error": "Variant not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	err := database.DB.Db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&variant).Error; err != nil {
+			return err
+		}
+		movement := variantMovement(c, &variant)
+		if err := syncProductStock(tx, variant.ProductID, movement); err != nil {
+			return err
+		}
+		// The last variant is gone, so the product is sold on its own again with no stock
+		var remaining int64
+		if err := tx.Model(&models.ProductVariant{}).Where("product_id = ?", variant.ProductID).Count(&remaining).Error; err != nil {
+			return err
+		}
+		if remaining == 0 {
+			return setProductStock(tx, variant.ProductID, 0, movement)
+		}
+		return nil
+	})
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	return c.SendStatus(204)
+}
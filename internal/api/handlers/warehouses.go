@@ -0,0 +1,198 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/leroysb/go_kubernetes/internal/database"
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"github.com/leroysb/go_kubernetes/internal/inventory"
+	"github.com/leroysb/go_kubernetes/internal/outbox"
+	"github.com/leroysb/go_kubernetes/internal/webhooks"
+	"gorm.io/gorm"
+)
+
+var errHasVariants = errors.New("Stock of a product with variants is set on its variants, use a transfer to place it in a warehouse")
+
+// GetWarehouses lists the warehouses stock is shipped from
+func GetWarehouses(c *fiber.Ctx) error {
+	warehouses := []models.Warehouse{}
+	if err := database.DB.Db.Order("id").Find(&warehouses).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+	return c.JSON(warehouses)
+}
+
+// CreateWarehouse adds a warehouse. Its latitude and longitude are needed for orders to be sent
+// from the nearest warehouse
+func CreateWarehouse(c *fiber.Ctx) error {
+	var warehouse models.Warehouse
+	if err := c.BodyParser(&warehouse); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	warehouse.Name = strings.TrimSpace(warehouse.Name)
+	if warehouse.Name == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "Missing name"})
+	}
+	if (warehouse.Latitude == nil) != (warehouse.Longitude == nil) {
+		return c.Status(400).JSON(fiber.Map{"error": "Latitude and longitude go together"})
+	}
+
+	var count int64
+	if err := database.DB.Db.Unscoped().Model(&models.Warehouse{}).Where("name = ?", warehouse.Name).Count(&count).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+	if count > 0 {
+		return c.Status(409).JSON(fiber.Map{"error": "Warehouse already exists"})
+	}
+
+	if err := database.DB.Db.Create(&warehouse).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+	return c.Status(201).JSON(warehouse)
+}
+
+// SetWarehouseStock sets how much of a product a warehouse holds, as counted or received there.
+// The product's stock goes up or down by the difference. Products with variants keep the total of
+// their variants' stock, so theirs is placed in warehouses by transfers instead
+func SetWarehouseStock(c *fiber.Ctx) error {
+	var warehouse models.Warehouse
+	if err := database.DB.Db.First(&warehouse, c.Params("id")).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(404).JSON(fiber.Map{"error": "Warehouse not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+	var product models.Product
+	if err := database.DB.Db.Preload("Variants").First(&product, c.Params("product_id")).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(404).JSON(fiber.Map{"error": "Product not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	var body struct {
+		Quantity *int `json:"quantity"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	if body.Quantity == nil || *body.Quantity < 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "Missing quantity"})
+	}
+
+	if len(product.Variants) > 0 {
+		return c.Status(400).JSON(fiber.Map{"error": errHasVariants.Error()})
+	}
+
+	previousStock := product.Stock
+	err := database.DB.Db.Transaction(func(tx *gorm.DB) error {
+		movement := models.StockMovement{Reference: fmt.Sprintf("warehouse:%d", warehouse.ID), Actor: stockActor(c)}
+		delta, err := inventory.SetLevel(tx, warehouse.ID, product.ID, *body.Quantity, movement)
+		if err != nil || delta == 0 {
+			return err
+		}
+
+		if err := tx.First(&product, product.ID).Error; err != nil {
+			return err
+		}
+		if err := outbox.Write(tx, webhooks.EventProductUpdated, "product", product.ID, product); err != nil {
+			return err
+		}
+		if webhooks.Restocked(previousStock, product.Stock) {
+			if err := outbox.Write(tx, webhooks.EventProductRestocked, "product", product.ID, product); err != nil {
+				return err
+			}
+		}
+		if webhooks.LowStockCrossed(previousStock, product.Stock) {
+			return outbox.Write(tx, webhooks.EventProductStockLow, "product", product.ID, fiber.Map{"product": product, "threshold": webhooks.LowStockThreshold()})
+		}
+		return nil
+	})
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	availability, err := inventory.Availability(database.DB.Db, &product)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+	return c.JSON(availability)
+}
+
+// CreateStockTransfer moves stock of a product between warehouses. Leaving out from_warehouse_id
+// or to_warehouse_id moves it from or to the product's unassigned stock
+func CreateStockTransfer(c *fiber.Ctx) error {
+	var body struct {
+		ProductID       uint  `json:"product_id"`
+		FromWarehouseID *uint `json:"from_warehouse_id"`
+		ToWarehouseID   *uint `json:"to_warehouse_id"`
+		Quantity        int   `json:"quantity"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	if body.ProductID == 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "Missing product_id"})
+	}
+	if body.Quantity <= 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "Missing quantity"})
+	}
+
+	if err := database.DB.Db.First(&models.Product{}, body.ProductID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(400).JSON(fiber.Map{"error": "Product not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+	for _, warehouseID := range []*uint{body.FromWarehouseID, body.ToWarehouseID} {
+		if warehouseID == nil {
+			continue
+		}
+		if err := database.DB.Db.First(&models.Warehouse{}, *warehouseID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return c.Status(400).JSON(fiber.Map{"error": "Warehouse not found"})
+			}
+			return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+		}
+	}
+
+	var transfer *models.StockTransfer
+	err := database.DB.Db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		transfer, err = inventory.Transfer(tx, body.ProductID, body.FromWarehouseID, body.ToWarehouseID, body.Quantity, stockActor(c))
+		return err
+	})
+	if err != nil {
+		if errors.Is(err, inventory.ErrNotEnoughStock) || errors.Is(err, inventory.ErrSameLocation) {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+	return c.Status(201).JSON(transfer)
+}
+
+// GetStockTransfers returns a page of stock transfers, newest first, of one product when product_id
+// is given
+func GetStockTransfers(c *fiber.Ctx) error {
+	pager, err := parsePaginator(c, "id", true)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	productID := c.QueryInt("product_id")
+	page, err := paginate(pager, func() *gorm.DB {
+		query := database.DB.Db.Model(&models.StockTransfer{})
+		if productID > 0 {
+			query = query.Where("product_id = ?", productID)
+		}
+		return query
+	}, func(transfer models.StockTransfer) (any, uint) {
+		return nil, transfer.ID
+	})
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+	return sendPage(c, page)
+}
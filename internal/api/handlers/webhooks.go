@@ -0,0 +1,215 @@
+package handlers
+
+import (
+	"errors"
+	"net/url"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/leroysb/go_kubernetes/internal/database"
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"github.com/leroysb/go_kubernetes/internal/webhooks"
+	"gorm.io/gorm"
+)
+
+type webhookRequest struct {
+	URL    *string   `json:"url"`
+	Events *[]string `json:"events"`
+	Secret *string   `json:"secret"`
+	Active *bool     `json:"active"`
+}
+
+// webhookWithSecret is a subscription along with its signing secret, which is only shown when the
+// subscription is created and when the secret is rotated
+type webhookWithSecret struct {
+	models.WebhookSubscription
+	Secret string `json:"secret"`
+}
+
+// apply validates the request and copies the fields that were set onto the subscription
+func (r webhookRequest) apply(subscription *models.WebhookSubscription) error {
+	if r.URL != nil {
+		u, err := url.Parse(*r.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("Invalid url")
+		}
+		subscription.URL = *r.URL
+	}
+
+	if r.Events != nil {
+		if len(*r.Events) == 0 {
+			return errors.New("Missing events")
+		}
+		for _, event := range *r.Events {
+			if event != "*" && !webhooks.IsEvent(event) {
+				return errors.New("Unknown event " + event)
+			}
+		}
+		subscription.Events = *r.Events
+	}
+
+	if r.Secret != nil {
+		subscription.Secret = *r.Secret
+	}
+
+	if r.Active != nil {
+		subscription.Active = *r.Active
+	}
+
+	return nil
+}
+
+// GetWebhooks returns a page of webhook subscriptions
+func GetWebhooks(c *fiber.Ctx) error {
+	pager, err := parsePaginator(c, "id", false)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	page, err := paginate(pager, func() *gorm.DB {
+		return database.DB.Db.Model(&models.WebhookSubscription{})
+	}, func(subscription models.WebhookSubscription) (any, uint) {
+		return nil, subscription.ID
+	})
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+	return sendPage(c, page)
+}
+
+// CreateWebhook creates a webhook subscription, generating a signing secret when none is given
+func CreateWebhook(c *fiber.Ctx) error {
+	var req webhookRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	if req.URL == nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Missing url"})
+	}
+	if req.Events == nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Missing events"})
+	}
+
+	subscription := models.WebhookSubscription{Active: true}
+	if err := req.apply(&subscription); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	if subscription.Secret == "" {
+		secret, err := webhooks.NewSecret()
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+		}
+		subscription.Secret = secret
+	}
+
+	if err := database.DB.Db.Create(&subscription).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	return c.Status(201).JSON(webhookWithSecret{WebhookSubscription: subscription, Secret: subscription.Secret})
+}
+
+// UpdateWebhook updates the fields given in the body of a webhook subscription
+func UpdateWebhook(c *fiber.Ctx) error {
+	var subscription models.WebhookSubscription
+	if err := database.DB.Db.First(&subscription, c.Params("id")).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(404).JSON(fiber.Map{"error": "Webhook not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	var req webhookRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	if err := req.apply(&subscription); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	if err := database.DB.Db.Save(&subscription).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	return c.JSON(subscription)
+}
+
+// RotateWebhookSecret replaces the signing secret of a webhook subscription with a new one, returned
+// with the subscription
+func RotateWebhookSecret(c *fiber.Ctx) error {
+	var subscription models.WebhookSubscription
+	if err := database.DB.Db.First(&subscription, c.Params("id")).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(404).JSON(fiber.Map{"error": "Webhook not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	secret, err := webhooks.NewSecret()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+	if err := database.DB.Db.Model(&subscription).Update("secret", secret).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	return c.JSON(webhookWithSecret{WebhookSubscription: subscription, Secret: secret})
+}
+
+// DeleteWebhook deletes a webhook subscription
+func DeleteWebhook(c *fiber.Ctx) error {
+	result := database.DB.Db.Delete(&models.WebhookSubscription{}, c.Params("id"))
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+	if result.RowsAffected == 0 {
+		return c.Status(404).JSON(fiber.Map{"error": "Webhook not found"})
+	}
+
+	return c.SendStatus(204)
+}
+
+// GetWebhookDeliveries returns a page of the delivery log of a webhook subscription, newest first
+func GetWebhookDeliveries(c *fiber.Ctx) error {
+	pager, err := parsePaginator(c, "id", true)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	page, err := paginate(pager, func() *gorm.DB {
+		return database.DB.Db.Model(&models.WebhookDelivery{}).Where("subscription_id = ?", c.Params("id"))
+	}, func(delivery models.WebhookDelivery) (any, uint) {
+		return nil, delivery.ID
+	})
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+	return sendPage(c, page)
+}
+
+// ReplayWebhookDelivery sends the payload of a logged delivery again, unless its subscription was
+// deleted or is not active
+func ReplayWebhookDelivery(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid delivery id"})
+	}
+
+	delivery, err := webhooks.Replay(uint(id))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(404).JSON(fiber.Map{"error": "Delivery not found"})
+		}
+		if errors.Is(err, webhooks.ErrSubscriptionDeleted) {
+			return c.Status(404).JSON(fiber.Map{"error": err.Error()})
+		}
+		if errors.Is(err, webhooks.ErrSubscriptionInactive) {
+			return c.Status(409).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	return c.Status(202).JSON(delivery)
+}
@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/leroysb/go_kubernetes/internal/database"
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// sendWishlist responds with the customer's wishlist, most recently saved first. Products deleted
+// since they were saved are left out
+func sendWishlist(c *fiber.Ctx, customerID uint) error {
+	items := []models.WishlistItem{}
+	err := database.DB.Db.InnerJoins("Product").Where("wishlist_items.customer_id = ?", customerID).Order("wishlist_items.id DESC").Find(&items).Error
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+	return c.JSON(items)
+}
+
+// GetWishlist returns the products the customer saved for later
+func GetWishlist(c *fiber.Ctx) error {
+	user := c.Locals("user").(*models.Customer)
+	return sendWishlist(c, user.ID)
+}
+
+// AddWishlistItem saves a product to the customer's wishlist. Saving one that is already there
+// changes nothing
+func AddWishlistItem(c *fiber.Ctx) error {
+	user := c.Locals("user").(*models.Customer)
+
+	var body struct {
+		ProductID uint `json:"product_id"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	if body.ProductID == 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "Missing product_id"})
+	}
+
+	var product models.Product
+	if err := database.DB.Db.First(&product, body.ProductID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(400).JSON(fiber.Map{"error": "Product not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	item := models.WishlistItem{CustomerID: user.ID, ProductID: product.ID}
+	if err := database.DB.Db.Clauses(clause.OnConflict{DoNothing: true}).Omit(clause.Associations).Create(&item).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+	return sendWishlist(c, user.ID)
+}
+
+// findWishlistItem loads the item of the customer's wishlist for the product in the path
+func findWishlistItem(c *fiber.Ctx, customerID uint) (*models.WishlistItem, error) {
+	var item models.WishlistItem
+	if err := database.DB.Db.Where("customer_id = ? AND product_id = ?", customerID, c.Params("product_id")).First(&item).Error; err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// DeleteWishlistItem takes a product off the customer's wishlist
+func DeleteWishlistItem(c *fiber.Ctx) error {
+	user := c.Locals("user").(*models.Customer)
+
+	item, err := findWishlistItem(c, user.ID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(404).JSON(fiber.Map{"error": "Wishlist item not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	if err := database.DB.Db.Unscoped().Delete(item).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+	return sendWishlist(c, user.ID)
+}
+
+// MoveWishlistItem puts a product from the customer's wishlist in their cart, one of it unless a
+// quantity is given, and takes it off the wishlist. Products with variants need a variant_id
+func MoveWishlistItem(c *fiber.Ctx) error {
+	user := c.Locals("user").(*models.Customer)
+
+	body := struct {
+		VariantID *uint `json:"variant_id"`
+		Quantity  int   `json:"quantity"`
+	}{Quantity: 1}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&body); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+		}
+	}
+	if body.Quantity <= 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "Missing quantity"})
+	}
+
+	item, err := findWishlistItem(c, user.ID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(404).JSON(fiber.Map{"error": "Wishlist item not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	line, err := resolveLine(database.DB.Db, item.ProductID, body.VariantID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(400).JSON(fiber.Map{"error": "Product not found"})
+		}
+		if errors.Is(err, errVariantRequired) || errors.Is(err, errVariantNotFound) || errors.Is(err, errProductDeleted) {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	err = database.DB.Db.Transaction(func(tx *gorm.DB) error {
+		if err := putInCart(c, tx, customerCart, line, body.Quantity); err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(item).Error
+	})
+	if err != nil {
+		if errors.Is(err, errOutOfStock) {
+			return c.Status(400).JSON(fiber.Map{"error": "Product not available"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+	}
+
+	return sendCart(c, customerCart)
+}
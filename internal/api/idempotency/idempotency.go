@@ -0,0 +1,214 @@
+package idempotency
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"os"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/leroysb/go_kubernetes/internal/api/handlers"
+	"github.com/leroysb/go_kubernetes/internal/database"
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"gorm.io/gorm/clause"
+)
+
+// Header is the request header carrying the client's key for a request
+const Header = "Idempotency-Key"
+
+// A request still in progress after staleAfter is taken to have died with the server, so a retry may run it again
+const staleAfter = time.Minute
+
+var (
+	errMismatch   = errors.New("Idempotency-Key was already used for a different request")
+	errInProgress = errors.New("A request with this Idempotency-Key is still in progress")
+)
+
+// TTL is how long a key is remembered, from IDEMPOTENCY_KEY_TTL. It is a day by default
+func TTL() time.Duration {
+	ttl, err := time.ParseDuration(os.Getenv("IDEMPOTENCY_KEY_TTL"))
+	if err != nil || ttl <= 0 {
+		return 24 * time.Hour
+	}
+	return ttl
+}
+
+// New returns a middleware that makes POST, PUT, PATCH and DELETE requests carrying an Idempotency-Key
+// header safe to retry. The first request with a key is handled and its response stored, and a retry
+// with the same key and body gets that response back instead of being handled again. Server errors
+// are not stored, so they can be retried. Requests with neither credentials nor a guest cart token
+// have nothing to keep their keys apart from anyone else's, and are handled as if they had no key
+func New() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		key := c.Get(Header)
+		if key == "" || !mutating(c.Method()) {
+			return c.Next()
+		}
+		if len(key) > 255 {
+			return c.Status(400).JSON(fiber.Map{"error": "Idempotency-Key must be at most 255 characters"})
+		}
+		owner := scope(c)
+		if owner == "" {
+			return c.Next()
+		}
+
+		record, err := claim(key, owner, fingerprint(c))
+		if err != nil {
+			switch {
+			case errors.Is(err, errMismatch):
+				return c.Status(422).JSON(fiber.Map{"error": err.Error()})
+			case errors.Is(err, errInProgress):
+				return c.Status(409).JSON(fiber.Map{"error": err.Error()})
+			}
+			log.Printf("Error claiming idempotency key: %v", err)
+			return c.Status(500).JSON(fiber.Map{"error": "Internal server error"})
+		}
+
+		if record.ResponseStatus != 0 {
+			c.Set("Idempotent-Replayed", "true")
+			if record.ContentType != "" {
+				c.Set(fiber.HeaderContentType, record.ContentType)
+			}
+			for name, values := range record.ResponseHeaders {
+				for _, value := range values {
+					c.Response().Header.Add(name, value)
+				}
+			}
+			return c.Status(record.ResponseStatus).Send(record.ResponseBody)
+		}
+
+		if err := c.Next(); err != nil {
+			release(record)
+			return err
+		}
+
+		status := c.Response().StatusCode()
+		if status >= 500 {
+			release(record)
+			return nil
+		}
+		record.ResponseStatus = status
+		record.ResponseBody = append([]byte(nil), c.Response().Body()...)
+		record.ContentType = string(c.Response().Header.ContentType())
+		record.ResponseHeaders = responseHeaders(c)
+		err = database.DB.Db.Model(record).Select("response_status", "response_body", "content_type", "response_headers").Updates(record).Error
+		if err != nil {
+			log.Printf("Error storing response for idempotency key %s: %v", key, err)
+		}
+		return nil
+	}
+}
+
+func mutating(method string) bool {
+	switch method {
+	case fiber.MethodPost, fiber.MethodPut, fiber.MethodPatch, fiber.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// scope keeps the keys of different callers apart by the credentials they sent, or by the token of
+// a guest's cart. It is empty when the request carries neither
+func scope(c *fiber.Ctx) string {
+	owner := c.Get(fiber.HeaderAuthorization)
+	if owner == "" {
+		token := c.Get(handlers.CartTokenHeader)
+		if token == "" {
+			token = c.Cookies(handlers.CartTokenCookie)
+		}
+		if token == "" {
+			return ""
+		}
+		owner = "cart " + token
+	}
+	sum := sha256.Sum256([]byte(owner))
+	return hex.EncodeToString(sum[:])
+}
+
+// responseHeaders returns the headers of the response worth giving a retry, leaving out those the
+// server sets on every response and the content type, which is stored on its own
+func responseHeaders(c *fiber.Ctx) map[string][]string {
+	headers := map[string][]string{}
+	c.Response().Header.VisitAll(func(key, value []byte) {
+		name := string(key)
+		switch name {
+		case fiber.HeaderContentType, fiber.HeaderContentLength, fiber.HeaderDate, fiber.HeaderServer, fiber.HeaderConnection:
+			return
+		}
+		headers[name] = append(headers[name], string(value))
+	})
+	return headers
+}
+
+// fingerprint identifies a request by its method, URL and body
+func fingerprint(c *fiber.Ctx) string {
+	hash := sha256.New()
+	hash.Write([]byte(c.Method() + " " + c.OriginalURL() + "\n"))
+	hash.Write(c.Body())
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// claim records the key for a new request, or returns the record of the request that used it before.
+// An expired or abandoned record is replaced
+func claim(key, scope, fingerprint string) (*models.IdempotencyKey, error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		record := models.IdempotencyKey{Key: key, Scope: scope, Fingerprint: fingerprint, ExpiresAt: time.Now().Add(TTL())}
+		created := database.DB.Db.Clauses(clause.OnConflict{DoNothing: true}).Create(&record)
+		if created.Error != nil {
+			return nil, created.Error
+		}
+		if created.RowsAffected == 1 {
+			return &record, nil
+		}
+
+		var existing models.IdempotencyKey
+		if err := database.DB.Db.Unscoped().Where("key = ? AND scope = ?", key, scope).First(&existing).Error; err != nil {
+			return nil, err
+		}
+		abandoned := existing.ResponseStatus == 0 && time.Since(existing.UpdatedAt) > staleAfter
+		if existing.DeletedAt.Valid || existing.ExpiresAt.Before(time.Now()) || abandoned {
+			release(&existing)
+			continue
+		}
+		if existing.Fingerprint != fingerprint {
+			return nil, errMismatch
+		}
+		if existing.ResponseStatus == 0 {
+			return nil, errInProgress
+		}
+		return &existing, nil
+	}
+	return nil, errInProgress
+}
+
+// release forgets a key so the request can be made again
+func release(record *models.IdempotencyKey) {
+	if err := database.DB.Db.Unscoped().Delete(record).Error; err != nil {
+		log.Printf("Error releasing idempotency key %s: %v", record.Key, err)
+	}
+}
+
+// Purge deletes the keys that have expired
+func Purge() {
+	if err := database.DB.Db.Unscoped().Where("expires_at < ?", time.Now()).Delete(&models.IdempotencyKey{}).Error; err != nil {
+		log.Printf("Error purging idempotency keys: %v", err)
+	}
+}
+
+// Run purges expired keys every interval until the context is cancelled
+func Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			Purge()
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package routes
 
 import (
+	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
@@ -9,7 +10,9 @@ import (
 	"github.com/gofiber/fiber/v2/middleware/logger"
 	"github.com/leroysb/go_kubernetes/internal/api/auth"
 	"github.com/leroysb/go_kubernetes/internal/api/handlers"
+	"github.com/leroysb/go_kubernetes/internal/api/idempotency"
 	"github.com/leroysb/go_kubernetes/internal/database"
+	"github.com/leroysb/go_kubernetes/internal/storage"
 )
 
 func SetupRoutes(app *fiber.App) {
@@ -26,6 +29,12 @@ func SetupRoutes(app *fiber.App) {
 	}))
 	app.Use(cors.New())
 	app.Use(logger.New())
+	app.Use(idempotency.New())
+
+	// Uploaded files, when they are kept on local disk
+	if local, ok := storage.Default().(*storage.Local); ok && strings.HasPrefix(local.BaseURL, "/") {
+		app.Static(local.BaseURL, local.Dir)
+	}
 
 	// API group
 	api := app.Group("/api/v1")
@@ -34,22 +43,85 @@ func SetupRoutes(app *fiber.App) {
 	api.Get("/status", StatusHandler)
 	api.Get("/products", handlers.GetProducts)
 	api.Post("/products", handlers.CreateProduct)
+	api.Get("/products/export", handlers.ExportProducts)
 	api.Get("/products/:id", handlers.GetProduct)
 	api.Put("/products/:id", handlers.UpdateProduct)
+	api.Patch("/products/:id", handlers.PatchProduct)
 	api.Delete("/products/:id", handlers.DeleteProduct)
+	api.Put("/products/:id/categories", handlers.SetProductCategories)
+	api.Get("/products/:id/variants", handlers.GetProductVariants)
+	api.Post("/products/:id/variants", handlers.CreateProductVariant)
+	api.Put("/products/:id/variants/:variant_id", handlers.UpdateProductVariant)
+	api.Delete("/products/:id/variants/:variant_id", handlers.DeleteProductVariant)
+	api.Get("/products/:id/images", handlers.GetProductImages)
+	api.Post("/products/:id/images", handlers.UploadProductImage)
+	api.Put("/products/:id/images/order", handlers.ReorderProductImages)
+	api.Delete("/products/:id/images/:image_id", handlers.DeleteProductImage)
+	api.Get("/categories", handlers.GetCategories)
+	api.Post("/categories", handlers.CreateCategory)
+	api.Get("/categories/:id", handlers.GetCategory)
+	api.Put("/categories/:id", handlers.UpdateCategory)
+	api.Delete("/categories/:id", handlers.DeleteCategory)
+	api.Get("/categories/:id/products", handlers.GetCategoryProducts)
 	api.Post("/customers", handlers.CreateCustomer) // user registration
 	api.Post("/customers/login", handlers.Login)    // user authentication
+	api.Get("/cart", handlers.GetGuestCart)         // guest carts, named by their cart token
+	api.Post("/cart", handlers.AddGuestCartItem)
+	api.Put("/cart/:id", handlers.UpdateGuestCartItem)
+	api.Delete("/cart/:id", handlers.DeleteGuestCartItem)
 	api.Get("/orders", handlers.GetOrders)
+	api.Post("/sms/inbound", handlers.InboundSMS) // SMS gateway callback
 	api.Post("/orders", handlers.CreateOrder)
+	api.Post("/payments/mpesa/callback", handlers.MpesaCallback) // Daraja STK Push callback
+	api.Post("/payments/mpesa/b2c/result", handlers.MpesaB2CResult)
+	api.Post("/payments/mpesa/b2c/timeout", handlers.MpesaB2CTimeout)
 
 	// Private API endpoints
 	api.Get("/customers/me", auth.AuthMiddleware(handlers.GetCustomer))
+	api.Get("/customers/me/notifications", auth.AuthMiddleware(handlers.GetNotificationPreferences))
+	api.Put("/customers/me/notifications", auth.AuthMiddleware(handlers.UpdateNotificationPreferences))
 	api.Post("/customers/logout", auth.AuthMiddleware(handlers.Logout))
-	api.Post("/customers/cart", auth.AuthMiddleware(handlers.CreateCart))
+	api.Post("/customers/cart", auth.AuthMiddleware(handlers.AddCartItem))
 	api.Get("/customers/cart", auth.AuthMiddleware(handlers.GetCart))
-	api.Put("/customers/cart/:id", auth.AuthMiddleware(handlers.UpdateCart))
-	api.Delete("/customers/cart/:id", auth.AuthMiddleware(handlers.DeleteCart))
+	api.Post("/customers/cart/coupon", auth.AuthMiddleware(handlers.ApplyCoupon))
+	api.Delete("/customers/cart/coupon", auth.AuthMiddleware(handlers.RemoveCoupon))
+	api.Put("/customers/cart/:id", auth.AuthMiddleware(handlers.UpdateCartItem))
+	api.Delete("/customers/cart/:id", auth.AuthMiddleware(handlers.DeleteCartItem))
+	api.Get("/customers/wishlist", auth.AuthMiddleware(handlers.GetWishlist))
+	api.Post("/customers/wishlist", auth.AuthMiddleware(handlers.AddWishlistItem))
+	api.Delete("/customers/wishlist/:product_id", auth.AuthMiddleware(handlers.DeleteWishlistItem))
+	api.Post("/customers/wishlist/:product_id/cart", auth.AuthMiddleware(handlers.MoveWishlistItem))
 	api.Post("/customers/orders/:id", auth.AuthMiddleware(handlers.CreateOrder))
+	api.Post("/customers/orders/:id/payments", auth.AuthMiddleware(handlers.StartPayment))
+	api.Get("/customers/payments/:id", auth.AuthMiddleware(handlers.GetPayment))
+
+	// Admin API endpoints
+	admin := api.Group("/admin", auth.AdminOnly)
+	admin.Put("/orders/:id/status", auth.AuthMiddleware(handlers.UpdateOrderStatus))
+	admin.Post("/orders/:id/refunds", auth.AuthMiddleware(handlers.CreateRefund))
+	admin.Get("/orders/:id/refunds", auth.AuthMiddleware(handlers.GetRefunds))
+	admin.Get("/products/deleted", auth.AuthMiddleware(handlers.GetDeletedProducts))
+	admin.Post("/products/:id/restore", auth.AuthMiddleware(handlers.RestoreProduct))
+	admin.Post("/products/import", auth.AuthMiddleware(handlers.ImportProducts))
+	admin.Get("/products/:id/stock-movements", auth.AuthMiddleware(handlers.GetStockMovements))
+	admin.Get("/warehouses", auth.AuthMiddleware(handlers.GetWarehouses))
+	admin.Post("/warehouses", auth.AuthMiddleware(handlers.CreateWarehouse))
+	admin.Put("/warehouses/:id/stock/:product_id", auth.AuthMiddleware(handlers.SetWarehouseStock))
+	admin.Get("/stock-transfers", auth.AuthMiddleware(handlers.GetStockTransfers))
+	admin.Post("/stock-transfers", auth.AuthMiddleware(handlers.CreateStockTransfer))
+	admin.Delete("/products/:id", auth.AuthMiddleware(handlers.PurgeProduct))
+	admin.Post("/payments/:id/confirm", auth.AuthMiddleware(handlers.ConfirmPayment))
+	admin.Get("/promotions", auth.AuthMiddleware(handlers.GetPromotions))
+	admin.Post("/promotions", auth.AuthMiddleware(handlers.CreatePromotion))
+	admin.Put("/promotions/:id", auth.AuthMiddleware(handlers.UpdatePromotion))
+	admin.Delete("/promotions/:id", auth.AuthMiddleware(handlers.DeletePromotion))
+	admin.Get("/webhooks", auth.AuthMiddleware(handlers.GetWebhooks))
+	admin.Post("/webhooks", auth.AuthMiddleware(handlers.CreateWebhook))
+	admin.Put("/webhooks/:id", auth.AuthMiddleware(handlers.UpdateWebhook))
+	admin.Delete("/webhooks/:id", auth.AuthMiddleware(handlers.DeleteWebhook))
+	admin.Post("/webhooks/:id/secret", auth.AuthMiddleware(handlers.RotateWebhookSecret))
+	admin.Get("/webhooks/:id/deliveries", auth.AuthMiddleware(handlers.GetWebhookDeliveries))
+	admin.Post("/webhooks/deliveries/:id/replay", auth.AuthMiddleware(handlers.ReplayWebhookDelivery))
 
 	// 404 Handler
 	app.Use(notFoundHandler)
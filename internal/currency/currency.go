@@ -0,0 +1,64 @@
+package currency
+
+import (
+	"math/big"
+	"os"
+	"strings"
+)
+
+// exponents lists the ISO 4217 currencies whose minor unit is not a hundredth
+var exponents = map[string]int{
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0, "KRW": 0,
+	"PYG": 0, "RWF": 0, "UGX": 0, "VND": 0, "VUV": 0, "XAF": 0, "XOF": 0, "XPF": 0,
+}
+
+// Base is the store currency from STORE_CURRENCY, in which all prices are kept. It defaults to KES
+func Base() string {
+	if code := strings.ToUpper(strings.TrimSpace(os.Getenv("STORE_CURRENCY"))); Valid(code) {
+		return code
+	}
+	return "KES"
+}
+
+// Valid reports whether code looks like an ISO 4217 code
+func Valid(code string) bool {
+	if len(code) != 3 {
+		return false
+	}
+	for _, c := range code {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// Exponent is the number of decimal digits of the currency's minor unit
+func Exponent(code string) int {
+	if exponent, ok := exponents[code]; ok {
+		return exponent
+	}
+	return 2
+}
+
+// Rate returns how much of the currency one unit of the store currency buys, from the
+// CURRENCY_RATES table, e.g. "USD=0.0077,EUR=0.0071". The store currency always has a rate of 1
+func Rate(code string) (*big.Rat, bool) {
+	if code == Base() {
+		return big.NewRat(1, 1), true
+	}
+
+	for _, entry := range strings.Split(os.Getenv("CURRENCY_RATES"), ",") {
+		name, value, ok := strings.Cut(entry, "=")
+		if !ok || strings.ToUpper(strings.TrimSpace(name)) != code {
+			continue
+		}
+		rate, ok := new(big.Rat).SetString(strings.TrimSpace(value))
+		if !ok || rate.Sign() <= 0 {
+			return nil, false
+		}
+		return rate, true
+	}
+	return nil, false
+}
@@ -0,0 +1,86 @@
+package database
+
+import (
+	"log"
+	"time"
+
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"gorm.io/gorm"
+)
+
+// migrateCartOrders moves the cart lines kept as orders with status "cart" into carts, together with
+// the coupon that was applied on the customer, then deletes those orders and the coupon column
+func migrateCartOrders(db *gorm.DB) error {
+	hasCoupons := db.Migrator().HasColumn("customers", "cart_promotion_id")
+
+	var lines []models.Order
+	if err := db.Where("status = ?", "cart").Order("id").Find(&lines).Error; err != nil {
+		return err
+	}
+	if len(lines) == 0 && !hasCoupons {
+		return nil
+	}
+
+	coupons := map[uint]*uint{}
+	if hasCoupons {
+		var customers []struct {
+			ID              uint
+			CartPromotionID *uint
+		}
+		if err := db.Table("customers").Select("id, cart_promotion_id").Where("cart_promotion_id IS NOT NULL").Scan(&customers).Error; err != nil {
+			return err
+		}
+		for _, customer := range customers {
+			coupons[customer.ID] = customer.CartPromotionID
+		}
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		carts := map[uint]*models.Cart{}
+		for _, line := range lines {
+			cart, ok := carts[line.CustomerID]
+			if !ok {
+				cart = &models.Cart{CustomerID: &line.CustomerID, Status: models.CartActive, PromotionID: coupons[line.CustomerID]}
+				carts[line.CustomerID] = cart
+			}
+			if expires := line.UpdatedAt.Add(models.CartTTL()); expires.After(cart.ExpiresAt) {
+				cart.ExpiresAt = expires
+			}
+			cart.Items = mergeCartItem(cart.Items, models.CartItem{ProductID: line.ProductID, VariantID: line.VariantID, Quantity: line.Quantity})
+		}
+
+		now := time.Now()
+		for _, cart := range carts {
+			if cart.ExpiresAt.Before(now) {
+				cart.Status = models.CartExpired
+			}
+			if err := tx.Omit("Customer").Create(cart).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Unscoped().Where("status = ?", "cart").Delete(&models.Order{}).Error; err != nil {
+			return err
+		}
+
+		log.Printf("Migrated %d cart lines to %d carts", len(lines), len(carts))
+		if hasCoupons {
+			return tx.Migrator().DropColumn("customers", "cart_promotion_id")
+		}
+		return nil
+	})
+}
+
+// mergeCartItem adds the item to items, adding to the quantity of an item of the same product and variant
+func mergeCartItem(items []models.CartItem, item models.CartItem) []models.CartItem {
+	for i := range items {
+		if items[i].ProductID == item.ProductID && sameVariant(items[i].VariantID, item.VariantID) {
+			items[i].Quantity += item.Quantity
+			return items
+		}
+	}
+	return append(items, item)
+}
+
+func sameVariant(a, b *uint) bool {
+	return (a == nil && b == nil) || (a != nil && b != nil && *a == *b)
+}
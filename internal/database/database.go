@@ -52,7 +52,37 @@ func ConnectDB() {
 
 	// Perform auto-migration
 	log.Println("Performing auto-migration")
-	db.AutoMigrate(&models.Product{}, &models.Customer{}, &models.Order{})
+	db.AutoMigrate(&models.Product{}, &models.Customer{}, &models.Order{}, &models.NotificationPreference{}, &models.WebhookSubscription{}, &models.WebhookDelivery{}, &models.OutboxEvent{}, &models.Category{}, &models.ProductVariant{}, &models.ProductImage{}, &models.Promotion{}, &models.Payment{}, &models.Refund{}, &models.IdempotencyKey{}, &models.Cart{}, &models.CartItem{}, &models.WishlistItem{}, &models.StockMovement{}, &models.Warehouse{}, &models.StockLevel{}, &models.OrderAllocation{}, &models.StockTransfer{})
+
+	// Prices used to be whole units in a single column
+	if err := migrateMoney(db); err != nil {
+		log.Printf("Failed to migrate prices: %v", err)
+	}
+	if err := backfillOrders(db); err != nil {
+		log.Printf("Failed to backfill order amounts: %v", err)
+	}
+
+	// M-Pesa payments used to have a table of their own
+	if err := migrateMpesaRequests(db); err != nil {
+		log.Printf("Failed to migrate M-Pesa requests: %v", err)
+	}
+
+	// Carts used to be orders with status "cart"
+	if err := migrateCartOrders(db); err != nil {
+		log.Printf("Failed to migrate cart orders: %v", err)
+	}
+	// A customer has a single active cart
+	db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_carts_active_customer ON carts (customer_id) WHERE status = 'active' AND deleted_at IS NULL")
+
+	// Stock from before the inventory ledger opens it
+	if err := openStockLedger(db); err != nil {
+		log.Printf("Failed to open stock ledger: %v", err)
+	}
+
+	// Full-text index for product search
+	if db.Dialector.Name() == "postgres" {
+		db.Exec("CREATE INDEX IF NOT EXISTS idx_products_name_fts ON products USING GIN (to_tsvector('simple', name))")
+	}
 
 	log.Println("Database migration successful")
 
@@ -1,6 +1,51 @@
 package models
 
+import (
+	"os"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Cart statuses. A customer has at most one active cart, which expires once it has been left
+// alone past its ExpiresAt. A guest's cart is merged into the customer's when they log in
+const (
+	CartActive  = "active"
+	CartExpired = "expired"
+	CartMerged  = "merged"
+)
+
+// CartTTL is how long a cart is kept without being changed, from CART_TTL. It is thirty days by default
+func CartTTL() time.Duration {
+	ttl, err := time.ParseDuration(os.Getenv("CART_TTL"))
+	if err != nil || ttl <= 0 {
+		return 30 * 24 * time.Hour
+	}
+	return ttl
+}
+
+// Cart holds what a customer means to buy. A guest's cart has no CustomerID and is found by a signed
+// token instead. PromotionID is the coupon applied to it, taken off again at checkout. The cart is
+// always priced as the catalogue is now
 type Cart struct {
-	ProductID uint `json:"product_id"`
-	Quantity  int  `json:"quantity"`
+	gorm.Model
+	CustomerID  *uint      `json:"customer_id" gorm:"integer;index"`
+	Customer    Customer   `json:"-" gorm:"foreignKey:CustomerID"`
+	Status      string     `json:"status" gorm:"text;not null;default:null"`
+	PromotionID *uint      `json:"promotion_id,omitempty"`
+	Items       []CartItem `json:"items" gorm:"foreignKey:CartID"`
+	ExpiresAt   time.Time  `json:"expires_at" gorm:"not null;index"`
+}
+
+// CartItem is a quantity of a product, or of one of its variants, in a cart. Adding the same
+// product and variant again adds to the quantity of the item already there. AddedPrice is the unit
+// price when the item was last added, so the customer can be told it has changed since. It is zero
+// for items added before it was recorded
+type CartItem struct {
+	gorm.Model
+	CartID     uint  `json:"cart_id" gorm:"integer;not null;default:null;index"`
+	ProductID  uint  `json:"product_id" gorm:"integer;not null;default:null"`
+	VariantID  *uint `json:"variant_id" gorm:"integer"`
+	Quantity   int   `json:"quantity" gorm:"integer;not null;default:null"`
+	AddedPrice Money `json:"added_price" gorm:"embedded;embeddedPrefix:added_price_"`
 }
@@ -0,0 +1,12 @@
+package models
+
+import "gorm.io/gorm"
+
+type Category struct {
+	gorm.Model
+	Name     string     `json:"name" gorm:"text;not null;default:null"`
+	ParentID *uint      `json:"parent_id" gorm:"index"`
+	Parent   *Category  `json:"-" gorm:"foreignKey:ParentID"`
+	Children []Category `json:"children,omitempty" gorm:"foreignKey:ParentID"`
+	Products []Product  `json:"-" gorm:"many2many:product_categories"`
+}
@@ -4,7 +4,10 @@ import "gorm.io/gorm"
 
 type Customer struct {
 	gorm.Model
-	Name     string `json:"name" gorm:"text;not null;default:null"`
-	Phone    string `json:"phone" gorm:"text;not null;unique"`
-	Password string `json:"password" gorm:"text;not null;default:null"`
+	Name                    string                   `json:"name" gorm:"text;not null;default:null"`
+	Phone                   string                   `json:"phone" gorm:"text;not null;unique"`
+	Password                string                   `json:"password" gorm:"text;not null;default:null"`
+	Email                   string                   `json:"email,omitempty" gorm:"text"`
+	SMSOptOut               bool                     `json:"sms_opt_out" gorm:"not null;default:false"`
+	NotificationPreferences []NotificationPreference `json:"-" gorm:"foreignKey:CustomerID"`
 }
@@ -0,0 +1,23 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// IdempotencyKey remembers a mutating request made with an Idempotency-Key header and the response
+// it got, so a retry is answered with the same response. ResponseStatus is zero while the first
+// request is still being handled. ResponseHeaders keep what the response handed out, such as a token
+// or cookie, for the retry. Keys are scoped to the credentials or guest cart that sent them
+type IdempotencyKey struct {
+	gorm.Model
+	Key             string              `json:"key" gorm:"text;not null;default:null;uniqueIndex:idx_idempotency_keys_scope_key"`
+	Scope           string              `json:"-" gorm:"text;not null;default:'';uniqueIndex:idx_idempotency_keys_scope_key"`
+	Fingerprint     string              `json:"-" gorm:"text;not null;default:null"`
+	ResponseStatus  int                 `json:"response_status" gorm:"integer;not null;default:0"`
+	ResponseBody    []byte              `json:"-"`
+	ContentType     string              `json:"-" gorm:"text"`
+	ResponseHeaders map[string][]string `json:"-" gorm:"serializer:json"`
+	ExpiresAt       time.Time           `json:"expires_at" gorm:"not null;index"`
+}
@@ -0,0 +1,32 @@
+package models
+
+import (
+	"github.com/leroysb/go_kubernetes/internal/storage"
+	"gorm.io/gorm"
+)
+
+type ProductImage struct {
+	gorm.Model
+	ProductID    uint   `json:"product_id" gorm:"integer;not null;default:null;index"`
+	Key          string `json:"-" gorm:"text;not null;default:null"`
+	ThumbnailKey string `json:"-" gorm:"text;not null;default:null"`
+	ContentType  string `json:"content_type" gorm:"text;not null;default:null"`
+	Size         int    `json:"size" gorm:"integer;not null;default:null"`
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+	Position     int    `json:"position" gorm:"integer;not null;default:0"`
+	URL          string `json:"url" gorm:"-"`
+	ThumbnailURL string `json:"thumbnail_url" gorm:"-"`
+}
+
+// AfterFind fills in the public URLs of the image and its thumbnail from the configured storage
+func (i *ProductImage) AfterFind(tx *gorm.DB) error {
+	i.SetURLs(storage.Default())
+	return nil
+}
+
+// SetURLs fills in the public URLs of the image and its thumbnail
+func (i *ProductImage) SetURLs(s storage.Storage) {
+	i.URL = s.URL(i.Key)
+	i.ThumbnailURL = s.URL(i.ThumbnailKey)
+}
@@ -0,0 +1,172 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/leroysb/go_kubernetes/internal/currency"
+)
+
+var ErrInvalidMoney = errors.New("invalid amount of money")
+
+// Money is an amount in the minor unit of its ISO 4217 currency, e.g. 1999 KES is KES 19.99.
+// Models embed it with a column prefix, so a Price is stored as price_minor and price_currency
+type Money struct {
+	Amount   int64  `json:"amount" gorm:"column:minor"`
+	Currency string `json:"currency" gorm:"column:currency;size:3"`
+}
+
+// NewMoney returns an amount in minor units of the store currency
+func NewMoney(amount int64) Money {
+	return Money{Amount: amount, Currency: currency.Base()}
+}
+
+// ParseMoney reads a decimal amount in major units, such as "19.99", in the given currency
+func ParseMoney(value, code string) (Money, error) {
+	exponent := currency.Exponent(code)
+
+	value = strings.TrimSpace(value)
+	negative := strings.HasPrefix(value, "-")
+	value = strings.TrimPrefix(value, "-")
+
+	whole, fraction, _ := strings.Cut(value, ".")
+	if whole == "" || len(fraction) > exponent || !digits(whole) || !digits(fraction) {
+		return Money{}, ErrInvalidMoney
+	}
+	fraction += strings.Repeat("0", exponent-len(fraction))
+
+	amount, ok := new(big.Int).SetString(whole+fraction, 10)
+	if !ok || !amount.IsInt64() {
+		return Money{}, ErrInvalidMoney
+	}
+
+	m := Money{Amount: amount.Int64(), Currency: code}
+	if negative {
+		m.Amount = -m.Amount
+	}
+	return m, nil
+}
+
+func digits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Decimal formats the amount in major units, e.g. "19.99"
+func (m Money) Decimal() string {
+	exponent := currency.Exponent(m.Currency)
+	amount := m.Amount
+	sign := ""
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+	if exponent == 0 {
+		return fmt.Sprintf("%s%d", sign, amount)
+	}
+
+	unit := int64(1)
+	for i := 0; i < exponent; i++ {
+		unit *= 10
+	}
+	return fmt.Sprintf("%s%d.%0*d", sign, amount/unit, exponent, amount%unit)
+}
+
+// String formats the amount with its currency, e.g. "KES 19.99"
+func (m Money) String() string {
+	return m.Currency + " " + m.Decimal()
+}
+
+// Mul returns the amount multiplied by a quantity
+func (m Money) Mul(quantity int) Money {
+	return Money{Amount: m.Amount * int64(quantity), Currency: m.Currency}
+}
+
+// Convert returns the amount in another currency using the configured rate table, rounded to the
+// nearest minor unit. It is meant for display; prices are always charged in the store currency
+func (m Money) Convert(code string) (Money, error) {
+	if code == m.Currency {
+		return m, nil
+	}
+	from, ok := currency.Rate(m.Currency)
+	if !ok {
+		return Money{}, fmt.Errorf("no exchange rate for %s", m.Currency)
+	}
+	to, ok := currency.Rate(code)
+	if !ok {
+		return Money{}, fmt.Errorf("no exchange rate for %s", code)
+	}
+
+	// minor units in the store currency, then in the target currency
+	amount := new(big.Rat).SetInt64(m.Amount)
+	amount.Quo(amount, from)
+	amount.Mul(amount, to)
+	amount.Mul(amount, new(big.Rat).SetFrac(pow10(currency.Exponent(code)), pow10(currency.Exponent(m.Currency))))
+
+	// Round half away from zero
+	num, den := amount.Num(), amount.Denom()
+	quo, rem := new(big.Int).QuoRem(num, den, new(big.Int))
+	if rem.Mul(rem.Abs(rem), big.NewInt(2)).Cmp(den) >= 0 {
+		quo.Add(quo, big.NewInt(int64(num.Sign())))
+	}
+	return Money{Amount: quo.Int64(), Currency: code}, nil
+}
+
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
+
+// MarshalJSON writes the amount in minor units with its currency, and a formatted copy for display
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Amount    int64  `json:"amount"`
+		Currency  string `json:"currency"`
+		Formatted string `json:"formatted"`
+	}{m.Amount, m.Currency, m.String()})
+}
+
+// UnmarshalJSON reads either {"amount": 1999, "currency": "KES"} in minor units, or a plain decimal
+// number such as 19.99 in major units of the store currency. A missing currency is the store currency
+func (m *Money) UnmarshalJSON(b []byte) error {
+	b = bytes.TrimSpace(b)
+	if bytes.Equal(b, []byte("null")) {
+		return nil
+	}
+
+	if len(b) > 0 && b[0] != '{' {
+		var number json.Number
+		if err := json.Unmarshal(b, &number); err != nil {
+			return ErrInvalidMoney
+		}
+		parsed, err := ParseMoney(number.String(), currency.Base())
+		if err != nil {
+			return err
+		}
+		*m = parsed
+		return nil
+	}
+
+	var value struct {
+		Amount   *int64 `json:"amount"`
+		Currency string `json:"currency"`
+	}
+	if err := json.Unmarshal(b, &value); err != nil || value.Amount == nil {
+		return ErrInvalidMoney
+	}
+	code := strings.ToUpper(value.Currency)
+	if code == "" {
+		code = currency.Base()
+	}
+	if !currency.Valid(code) {
+		return ErrInvalidMoney
+	}
+	*m = Money{Amount: *value.Amount, Currency: code}
+	return nil
+}
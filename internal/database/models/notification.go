@@ -0,0 +1,11 @@
+package models
+
+import "gorm.io/gorm"
+
+type NotificationPreference struct {
+	gorm.Model
+	CustomerID uint   `json:"-" gorm:"integer;not null;uniqueIndex:idx_notification_preference"`
+	Event      string `json:"event" gorm:"text;not null;uniqueIndex:idx_notification_preference"`
+	Channel    string `json:"channel" gorm:"text;not null;uniqueIndex:idx_notification_preference"`
+	Enabled    bool   `json:"enabled" gorm:"not null"`
+}
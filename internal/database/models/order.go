@@ -2,14 +2,26 @@ package models
 
 import "gorm.io/gorm"
 
+// Order is a line bought by a customer. Discount is taken off the price before tax is worked out,
+// Subtotal is the amount before tax and Amount the total charged, tax included
 type Order struct {
 	gorm.Model
-	Customer   Customer `gorm:"foreignKey:CustomerID"`
-	CustomerID uint     `json:"customer_id" gorm:"integer;not null;default:null"`
-	Product    Product  `gorm:"foreignKey:ProductID"`
-	ProductID  uint     `json:"product_id" gorm:"integer;not null;default:null"`
-	Quantity   int      `json:"quantity" gorm:"integer;not null;default:null"`
-	Amount     int      `json:"amount" gorm:"float;not null;default:null"`
-	Time       string   `json:"time" gorm:"text;not null;default:null"`
-	Status     string   `json:"status" gorm:"text;not null;default:null"`
+	Customer     Customer          `gorm:"foreignKey:CustomerID"`
+	CustomerID   uint              `json:"customer_id" gorm:"integer;not null;default:null"`
+	Product      Product           `gorm:"foreignKey:ProductID"`
+	ProductID    uint              `json:"product_id" gorm:"integer;not null;default:null"`
+	Variant      *ProductVariant   `json:"variant,omitempty" gorm:"foreignKey:VariantID"`
+	VariantID    *uint             `json:"variant_id" gorm:"integer"`
+	Quantity     int               `json:"quantity" gorm:"integer;not null;default:null"`
+	PromotionID  *uint             `json:"promotion_id,omitempty" gorm:"index"`
+	Discount     Money             `json:"discount" gorm:"embedded;embeddedPrefix:discount_"`
+	Subtotal     Money             `json:"subtotal" gorm:"embedded;embeddedPrefix:subtotal_"`
+	Tax          Money             `json:"tax" gorm:"embedded;embeddedPrefix:tax_"`
+	Amount       Money             `json:"amount" gorm:"embedded;embeddedPrefix:amount_"`
+	TaxClass     string            `json:"tax_class" gorm:"text"`
+	TaxRate      string            `json:"tax_rate" gorm:"text"`
+	TaxInclusive bool              `json:"tax_inclusive"`
+	Time         string            `json:"time" gorm:"text;not null;default:null"`
+	Status       string            `json:"status" gorm:"text;not null;default:null"`
+	Allocations  []OrderAllocation `json:"allocations,omitempty" gorm:"foreignKey:OrderID"`
 }
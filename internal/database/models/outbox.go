@@ -0,0 +1,21 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type OutboxEvent struct {
+	gorm.Model
+	IdempotencyKey string     `json:"idempotency_key" gorm:"text;not null;default:null;uniqueIndex"`
+	EventType      string     `json:"event_type" gorm:"text;not null;default:null"`
+	AggregateType  string     `json:"aggregate_type" gorm:"text;not null;default:null"`
+	AggregateID    uint       `json:"aggregate_id" gorm:"integer;not null;default:null"`
+	Payload        string     `json:"payload" gorm:"text;not null;default:null"`
+	Attempts       int        `json:"attempts" gorm:"integer;not null;default:0"`
+	LastError      string     `json:"last_error" gorm:"text"`
+	DeliveredTo    []string   `json:"delivered_to" gorm:"serializer:json"`
+	AvailableAt    time.Time  `json:"available_at" gorm:"not null;index"`
+	PublishedAt    *time.Time `json:"published_at" gorm:"index"`
+}
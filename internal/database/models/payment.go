@@ -0,0 +1,31 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Payment is an attempt to collect the amount of an order through a payment provider. It stays
+// pending until the provider reports the outcome. ProviderReference identifies the attempt at the
+// provider and Receipt the transaction that settled it, such as an M-Pesa code. Details holds
+// provider-specific values and Payload the last raw callback, kept for disputes. The provider's
+// references are kept from customers, as they are what the provider's callbacks are matched on
+type Payment struct {
+	gorm.Model
+	OrderID           uint              `json:"order_id" gorm:"integer;not null;default:null;index"`
+	Order             Order             `json:"-" gorm:"foreignKey:OrderID"`
+	Provider          string            `json:"provider" gorm:"text;not null;default:null;uniqueIndex:idx_payments_provider_reference;uniqueIndex:idx_payments_provider_receipt"`
+	Amount            Money             `json:"amount" gorm:"embedded;embeddedPrefix:amount_"`
+	Status            string            `json:"status" gorm:"text;not null;default:null;index"`
+	StatusReason      string            `json:"status_reason,omitempty" gorm:"text"`
+	Reference         string            `json:"reference" gorm:"text;not null;default:null"`
+	ProviderReference string            `json:"-" gorm:"text;not null;default:null;uniqueIndex:idx_payments_provider_reference"`
+	Receipt           *string           `json:"receipt" gorm:"text;uniqueIndex:idx_payments_provider_receipt"`
+	Phone             string            `json:"phone,omitempty" gorm:"text"`
+	Details           map[string]string `json:"-" gorm:"serializer:json"`
+	PaidAmount        *Money            `json:"paid_amount,omitempty" gorm:"embedded;embeddedPrefix:paid_amount_"`
+	Payload           string            `json:"-" gorm:"text"`
+	ExpiresAt         *time.Time        `json:"expires_at"`
+	CompletedAt       *time.Time        `json:"completed_at"`
+}
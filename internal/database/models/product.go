@@ -4,7 +4,17 @@ import "gorm.io/gorm"
 
 type Product struct {
 	gorm.Model
-	Name  string `json:"name" gorm:"text;not null;default:null"`
-	Price int    `json:"price" gorm:"float;not null;default:null"`
-	Stock int    `json:"stock" gorm:"integer;not null;default:null"`
+	Name       string           `json:"name" gorm:"text;not null;default:null"`
+	Price      Money            `json:"price" gorm:"embedded;embeddedPrefix:price_"`
+	Stock      int              `json:"stock" gorm:"integer;not null;default:null"`
+	TaxClass   string           `json:"tax_class" gorm:"text;not null;default:standard"`
+	Version    int              `json:"version" gorm:"integer;not null;default:1"`
+	Categories []Category       `json:"categories,omitempty" gorm:"many2many:product_categories"`
+	Variants   []ProductVariant `json:"variants,omitempty" gorm:"foreignKey:ProductID"`
+	Images     []ProductImage   `json:"images,omitempty" gorm:"foreignKey:ProductID"`
+
+	// DisplayPrice is the price converted to the currency the client asked for, for display only
+	DisplayPrice *Money `json:"display_price,omitempty" gorm:"-"`
+	// Availability is the stock by location, reported for a single product
+	Availability *Availability `json:"availability,omitempty" gorm:"-"`
 }
@@ -0,0 +1,50 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Kinds of discount a promotion gives
+const (
+	PromotionPercentage = "percentage"
+	PromotionFixed      = "fixed"
+)
+
+// Promotion is a discount redeemed with a coupon code. It applies to the products listed, or in
+// the categories listed, or to every product when neither is set. Uses counts the orders that
+// redeemed it
+type Promotion struct {
+	gorm.Model
+	Code             string     `json:"code" gorm:"text;not null;default:null;uniqueIndex"`
+	Description      string     `json:"description" gorm:"text"`
+	Kind             string     `json:"kind" gorm:"text;not null;default:null"`
+	Percent          int        `json:"percent,omitempty" gorm:"integer"`
+	Amount           *Money     `json:"amount,omitempty" gorm:"embedded;embeddedPrefix:amount_"`
+	MinOrder         *Money     `json:"min_order,omitempty" gorm:"embedded;embeddedPrefix:min_order_"`
+	ProductIDs       []uint     `json:"product_ids" gorm:"serializer:json"`
+	CategoryIDs      []uint     `json:"category_ids" gorm:"serializer:json"`
+	StartsAt         *time.Time `json:"starts_at"`
+	EndsAt           *time.Time `json:"ends_at"`
+	UsageLimit       *int       `json:"usage_limit"`
+	PerCustomerLimit *int       `json:"per_customer_limit"`
+	Uses             int        `json:"uses" gorm:"integer;not null;default:0"`
+	Active           bool       `json:"active" gorm:"not null"`
+}
+
+// Discount is the amount taken off an order of the given amount, never more than the amount itself.
+// Percentages are rounded half up to the minor unit
+func (p *Promotion) Discount(amount Money) Money {
+	discount := Money{Currency: amount.Currency}
+	switch p.Kind {
+	case PromotionPercentage:
+		discount.Amount = (amount.Amount*int64(p.Percent) + 50) / 100
+	case PromotionFixed:
+		if p.Amount != nil {
+			discount.Amount = p.Amount.Amount
+		}
+	}
+	discount.Amount = min(discount.Amount, amount.Amount)
+	return discount
+}
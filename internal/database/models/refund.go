@@ -0,0 +1,29 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Refund returns money taken by a payment. Quantity is the number of items returned, zero for a
+// refund of an amount alone. Restock is whether they go back into stock once the refund has been
+// paid out, and Restocked whether they have. A refund is pending until the provider has paid it out
+type Refund struct {
+	gorm.Model
+	OrderID           uint       `json:"order_id" gorm:"integer;not null;default:null;index"`
+	Order             Order      `json:"-" gorm:"foreignKey:OrderID"`
+	PaymentID         uint       `json:"payment_id" gorm:"integer;not null;default:null;index"`
+	Payment           Payment    `json:"-" gorm:"foreignKey:PaymentID"`
+	Amount            Money      `json:"amount" gorm:"embedded;embeddedPrefix:amount_"`
+	Quantity          int        `json:"quantity" gorm:"integer;not null;default:0"`
+	Restock           bool       `json:"restock" gorm:"not null;default:false"`
+	Restocked         bool       `json:"restocked" gorm:"not null;default:false"`
+	Reason            string     `json:"reason" gorm:"text"`
+	Status            string     `json:"status" gorm:"text;not null;default:null;index"`
+	StatusReason      string     `json:"status_reason,omitempty" gorm:"text"`
+	ProviderReference string     `json:"provider_reference" gorm:"text;index"`
+	Receipt           *string    `json:"receipt" gorm:"text"`
+	Payload           string     `json:"-" gorm:"text"`
+	CompletedAt       *time.Time `json:"completed_at"`
+}
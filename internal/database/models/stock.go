@@ -0,0 +1,28 @@
+package models
+
+import "gorm.io/gorm"
+
+// Reasons the stock of a product changes
+const (
+	StockSale         = "sale"
+	StockRestock      = "restock"
+	StockAdjustment   = "adjustment"
+	StockReturn       = "return"
+	StockCancellation = "cancellation"
+	StockTransferred  = "transfer"
+)
+
+// StockMovement is an entry of the inventory ledger: a change of Delta to the stock of a product,
+// and of its variant when VariantID is set, held by a warehouse or unassigned when WarehouseID is
+// nil. The movements of a product add up to its stock. Reference names what caused the change,
+// such as "order:12", and Actor who made it
+type StockMovement struct {
+	gorm.Model
+	ProductID   uint   `json:"product_id" gorm:"integer;not null;default:null;index"`
+	VariantID   *uint  `json:"variant_id" gorm:"integer"`
+	WarehouseID *uint  `json:"warehouse_id" gorm:"integer"`
+	Delta       int    `json:"delta" gorm:"integer;not null;default:null"`
+	Reason      string `json:"reason" gorm:"text;not null;default:null"`
+	Reference   string `json:"reference" gorm:"text"`
+	Actor       string `json:"actor" gorm:"text"`
+}
@@ -0,0 +1,20 @@
+package models
+
+import "gorm.io/gorm"
+
+type ProductVariant struct {
+	gorm.Model
+	ProductID uint              `json:"product_id" gorm:"integer;not null;default:null;index"`
+	SKU       string            `json:"sku" gorm:"text;not null;default:null;uniqueIndex"`
+	Options   map[string]string `json:"options" gorm:"serializer:json"`
+	Price     *Money            `json:"price" gorm:"embedded;embeddedPrefix:price_"`
+	Stock     int               `json:"stock" gorm:"integer;not null;default:0"`
+}
+
+// UnitPrice is the variant's price override, or the product price when it has none
+func (v *ProductVariant) UnitPrice(product *Product) Money {
+	if v.Price != nil {
+		return *v.Price
+	}
+	return product.Price
+}
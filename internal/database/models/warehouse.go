@@ -0,0 +1,58 @@
+package models
+
+import "gorm.io/gorm"
+
+// Warehouse is a location stock is shipped from. Its coordinates, when known, let orders be sent
+// from the warehouse nearest the customer
+type Warehouse struct {
+	gorm.Model
+	Name      string   `json:"name" gorm:"text;not null;default:null;uniqueIndex"`
+	Latitude  *float64 `json:"latitude"`
+	Longitude *float64 `json:"longitude"`
+}
+
+// StockLevel is how much of a product a warehouse holds. A product's Stock is the total of what it
+// has everywhere, so stock not held by any warehouse is unassigned. Variants are not split by warehouse
+type StockLevel struct {
+	gorm.Model
+	WarehouseID uint      `json:"warehouse_id" gorm:"integer;not null;default:null;uniqueIndex:idx_stock_levels_warehouse_product"`
+	Warehouse   Warehouse `json:"-" gorm:"foreignKey:WarehouseID"`
+	ProductID   uint      `json:"product_id" gorm:"integer;not null;default:null;uniqueIndex:idx_stock_levels_warehouse_product;index"`
+	Quantity    int       `json:"quantity" gorm:"integer;not null;default:0"`
+}
+
+// OrderAllocation is the part of an order shipped from a warehouse. Returned counts the items put
+// back into that warehouse by refunds or cancellation. What no warehouse was allocated came from
+// unassigned stock
+type OrderAllocation struct {
+	gorm.Model
+	OrderID     uint `json:"order_id" gorm:"integer;not null;default:null;index"`
+	WarehouseID uint `json:"warehouse_id" gorm:"integer;not null;default:null"`
+	Quantity    int  `json:"quantity" gorm:"integer;not null;default:null"`
+	Returned    int  `json:"returned" gorm:"integer;not null;default:0"`
+}
+
+// StockTransfer moves stock of a product between warehouses. A missing warehouse stands for the
+// product's unassigned stock, so stock can be put into a warehouse or taken out of all of them
+type StockTransfer struct {
+	gorm.Model
+	ProductID       uint   `json:"product_id" gorm:"integer;not null;default:null;index"`
+	FromWarehouseID *uint  `json:"from_warehouse_id"`
+	ToWarehouseID   *uint  `json:"to_warehouse_id"`
+	Quantity        int    `json:"quantity" gorm:"integer;not null;default:null"`
+	Actor           string `json:"actor" gorm:"text"`
+}
+
+// WarehouseStock is what one warehouse holds of a product
+type WarehouseStock struct {
+	WarehouseID uint   `json:"warehouse_id"`
+	Name        string `json:"name"`
+	Quantity    int    `json:"quantity"`
+}
+
+// Availability is a product's stock in total and by location
+type Availability struct {
+	Total      int              `json:"total"`
+	Unassigned int              `json:"unassigned"`
+	Warehouses []WarehouseStock `json:"warehouses"`
+}
@@ -0,0 +1,31 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type WebhookSubscription struct {
+	gorm.Model
+	URL    string   `json:"url" gorm:"text;not null;default:null"`
+	Events []string `json:"events" gorm:"serializer:json;not null;default:null"`
+	Secret string   `json:"-" gorm:"text;not null;default:null"`
+	Active bool     `json:"active" gorm:"not null"`
+}
+
+type WebhookDelivery struct {
+	gorm.Model
+	SubscriptionID uint                `json:"subscription_id" gorm:"integer;not null;default:null;index;uniqueIndex:idx_webhook_deliveries_key,where:replay_of IS NULL"`
+	Subscription   WebhookSubscription `json:"-" gorm:"foreignKey:SubscriptionID"`
+	Event          string              `json:"event" gorm:"text;not null;default:null"`
+	Payload        string              `json:"payload" gorm:"text;not null;default:null"`
+	Status         string              `json:"status" gorm:"text;not null;default:null;index"`
+	Attempts       int                 `json:"attempts" gorm:"integer;not null;default:0"`
+	ResponseStatus int                 `json:"response_status" gorm:"integer"`
+	LastError      string              `json:"last_error" gorm:"text"`
+	NextAttemptAt  *time.Time          `json:"next_attempt_at"`
+	DeliveredAt    *time.Time          `json:"delivered_at"`
+	ReplayOf       *uint               `json:"replay_of,omitempty"`
+	IdempotencyKey *string             `json:"idempotency_key,omitempty" gorm:"text;uniqueIndex:idx_webhook_deliveries_key"`
+}
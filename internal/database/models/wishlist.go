@@ -0,0 +1,12 @@
+package models
+
+import "gorm.io/gorm"
+
+// WishlistItem is a product a customer saved for later. A product is on a customer's wishlist at most once
+type WishlistItem struct {
+	gorm.Model
+	CustomerID uint     `json:"customer_id" gorm:"integer;not null;default:null;uniqueIndex:idx_wishlist_items_customer_product"`
+	Customer   Customer `json:"-" gorm:"foreignKey:CustomerID"`
+	ProductID  uint     `json:"product_id" gorm:"integer;not null;default:null;uniqueIndex:idx_wishlist_items_customer_product"`
+	Product    Product  `json:"product" gorm:"foreignKey:ProductID"`
+}
@@ -0,0 +1,68 @@
+package database
+
+import (
+	"log"
+	"math"
+
+	"github.com/leroysb/go_kubernetes/internal/currency"
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// moneyColumns are the columns that held whole amounts before prices became Money, by table,
+// and the prefix of the columns that replace them
+var moneyColumns = []struct {
+	Table, Column, Prefix string
+}{
+	{"products", "price", "price_"},
+	{"orders", "amount", "amount_"},
+	{"product_variants", "price", "price_"},
+}
+
+// migrateMoney moves amounts from the old whole-unit columns to minor units in the store currency,
+// then drops the old columns. Tables that were already migrated are left alone
+func migrateMoney(db *gorm.DB) error {
+	base := currency.Base()
+	factor := int64(math.Pow10(currency.Exponent(base)))
+
+	for _, money := range moneyColumns {
+		if !db.Migrator().HasColumn(money.Table, money.Column) {
+			continue
+		}
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			err := tx.Table(money.Table).Where(money.Column + " IS NOT NULL").Updates(map[string]any{
+				money.Prefix + "minor":    gorm.Expr("CAST(ROUND("+money.Column+" * ?) AS BIGINT)", factor),
+				money.Prefix + "currency": base,
+			}).Error
+			if err != nil {
+				return err
+			}
+			return tx.Exec("ALTER TABLE ? DROP COLUMN ?", clause.Table{Name: money.Table}, clause.Column{Name: money.Column}).Error
+		})
+		if err != nil {
+			return err
+		}
+		log.Printf("Migrated %s.%s to %sminor in %s", money.Table, money.Column, money.Prefix, base)
+	}
+	return nil
+}
+
+// backfillOrders gives orders placed before tax and discounts were worked out a subtotal equal to
+// their amount, no tax and no discount, since what they were charged cannot be split after the fact
+func backfillOrders(db *gorm.DB) error {
+	err := db.Unscoped().Model(&models.Order{}).Where("subtotal_minor IS NULL AND amount_minor IS NOT NULL").Updates(map[string]any{
+		"subtotal_minor":    gorm.Expr("amount_minor"),
+		"subtotal_currency": gorm.Expr("amount_currency"),
+		"tax_minor":         0,
+		"tax_currency":      gorm.Expr("amount_currency"),
+	}).Error
+	if err != nil {
+		return err
+	}
+	return db.Unscoped().Model(&models.Order{}).Where("discount_minor IS NULL AND amount_minor IS NOT NULL").Updates(map[string]any{
+		"discount_minor":    0,
+		"discount_currency": gorm.Expr("amount_currency"),
+	}).Error
+}
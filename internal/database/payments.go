@@ -0,0 +1,82 @@
+package database
+
+import (
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"gorm.io/gorm"
+)
+
+// mpesaRequest is a row of the table M-Pesa payments were kept in before payments had providers
+type mpesaRequest struct {
+	ID                 uint
+	CreatedAt          time.Time
+	UpdatedAt          time.Time
+	DeletedAt          gorm.DeletedAt
+	OrderID            uint
+	Phone              string
+	AmountMinor        int64
+	AmountCurrency     string
+	Reference          string
+	MerchantRequestID  string
+	CheckoutRequestID  string
+	Status             string
+	ResultCode         *int
+	ResultDesc         string
+	ReceiptNumber      *string
+	PaidAmountMinor    *int64
+	PaidAmountCurrency *string
+	ExpiresAt          time.Time
+	CompletedAt        *time.Time
+}
+
+// migrateMpesaRequests copies M-Pesa requests into payments and drops their table
+func migrateMpesaRequests(db *gorm.DB) error {
+	if !db.Migrator().HasTable("mpesa_requests") {
+		return nil
+	}
+
+	var requests []mpesaRequest
+	if err := db.Unscoped().Table("mpesa_requests").Find(&requests).Error; err != nil {
+		return err
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, request := range requests {
+			details := map[string]string{"merchant_request_id": request.MerchantRequestID}
+			if request.ResultCode != nil {
+				details["result_code"] = strconv.Itoa(*request.ResultCode)
+			}
+
+			payment := models.Payment{
+				Model:             gorm.Model{CreatedAt: request.CreatedAt, UpdatedAt: request.UpdatedAt, DeletedAt: request.DeletedAt},
+				OrderID:           request.OrderID,
+				Provider:          "mpesa",
+				Amount:            models.Money{Amount: request.AmountMinor, Currency: request.AmountCurrency},
+				Status:            request.Status,
+				StatusReason:      request.ResultDesc,
+				Reference:         request.Reference,
+				ProviderReference: request.CheckoutRequestID,
+				Receipt:           request.ReceiptNumber,
+				Phone:             request.Phone,
+				Details:           details,
+				ExpiresAt:         &request.ExpiresAt,
+				CompletedAt:       request.CompletedAt,
+			}
+			// A nil embedded amount would be written as zero, so its columns are left out instead
+			omit := []string{"Order", "paid_amount_minor", "paid_amount_currency"}
+			if request.PaidAmountMinor != nil && request.PaidAmountCurrency != nil {
+				payment.PaidAmount = &models.Money{Amount: *request.PaidAmountMinor, Currency: *request.PaidAmountCurrency}
+				omit = omit[:1]
+			}
+			if err := tx.Omit(omit...).Create(&payment).Error; err != nil {
+				return err
+			}
+		}
+
+		log.Printf("Migrated %d M-Pesa requests to payments", len(requests))
+		return tx.Migrator().DropTable("mpesa_requests")
+	})
+}
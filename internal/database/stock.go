@@ -0,0 +1,30 @@
+package database
+
+import (
+	"log"
+
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"gorm.io/gorm"
+)
+
+// openStockLedger records the stock of products without any movements as their opening balance, so
+// the ledger of every product adds up to its stock
+func openStockLedger(db *gorm.DB) error {
+	var products []models.Product
+	err := db.Unscoped().Select("id", "stock").
+		Where("stock <> 0 AND NOT EXISTS (SELECT 1 FROM stock_movements WHERE stock_movements.product_id = products.id)").
+		Find(&products).Error
+	if err != nil || len(products) == 0 {
+		return err
+	}
+
+	movements := make([]models.StockMovement, len(products))
+	for i, product := range products {
+		movements[i] = models.StockMovement{ProductID: product.ID, Delta: product.Stock, Reason: models.StockAdjustment, Reference: "opening balance", Actor: "system"}
+	}
+	if err := db.Create(&movements).Error; err != nil {
+		return err
+	}
+	log.Printf("Opened the stock ledger of %d products", len(products))
+	return nil
+}
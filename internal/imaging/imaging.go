@@ -0,0 +1,116 @@
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+)
+
+var (
+	ErrUnsupportedType = errors.New("unsupported image type")
+	ErrTooManyPixels   = errors.New("image has too many pixels")
+)
+
+// ContentTypes are the image formats that can be uploaded, mapped to their file extension
+var ContentTypes = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+}
+
+// Image is a decoded upload along with its sniffed content type
+type Image struct {
+	ContentType string
+	Width       int
+	Height      int
+	img         image.Image
+}
+
+// Decode sniffs the content type of data, rejecting anything but JPEG, PNG and GIF, and decodes it.
+// The dimensions are read from the header first, and images of more than maxPixels are refused before
+// anything is allocated for them, as a small file can claim to be enormous
+func Decode(data []byte, maxPixels int) (*Image, error) {
+	contentType := http.DetectContentType(data)
+	if _, ok := ContentTypes[contentType]; !ok {
+		return nil, ErrUnsupportedType
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if config.Width <= 0 || config.Height <= 0 || int64(config.Width)*int64(config.Height) > int64(maxPixels) {
+		return nil, ErrTooManyPixels
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := img.Bounds()
+	return &Image{ContentType: contentType, Width: bounds.Dx(), Height: bounds.Dy(), img: img}, nil
+}
+
+// Thumbnail scales the image down to fit within size x size, keeping its aspect ratio, and encodes it.
+// JPEGs stay JPEG and everything else becomes PNG so transparency is kept. The content type is returned
+// with the encoded bytes
+func (im *Image) Thumbnail(size int) ([]byte, string, error) {
+	width, height := im.Width, im.Height
+	if width > size || height > size {
+		if width >= height {
+			width, height = size, max(1, height*size/width)
+		} else {
+			width, height = max(1, width*size/height), size
+		}
+	}
+
+	thumb := resize(im.img, width, height)
+
+	var buf bytes.Buffer
+	if im.ContentType == "image/jpeg" {
+		if err := jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 85}); err != nil {
+			return nil, "", err
+		}
+		return buf.Bytes(), "image/jpeg", nil
+	}
+	if err := png.Encode(&buf, thumb); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), "image/png", nil
+}
+
+// resize scales src to width x height by averaging the source pixels that fall in each target pixel
+func resize(src image.Image, width, height int) *image.NRGBA {
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	bounds := src.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+
+	for y := 0; y < height; y++ {
+		y0 := bounds.Min.Y + y*srcH/height
+		y1 := max(y0+1, bounds.Min.Y+(y+1)*srcH/height)
+		for x := 0; x < width; x++ {
+			x0 := bounds.Min.X + x*srcW/width
+			x1 := max(x0+1, bounds.Min.X+(x+1)*srcW/width)
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					c := color.NRGBA64Model.Convert(src.At(sx, sy)).(color.NRGBA64)
+					r += uint64(c.R)
+					g += uint64(c.G)
+					b += uint64(c.B)
+					a += uint64(c.A)
+					n++
+				}
+			}
+			dst.SetNRGBA(x, y, color.NRGBA{R: uint8(r / n >> 8), G: uint8(g / n >> 8), B: uint8(b / n >> 8), A: uint8(a / n >> 8)})
+		}
+	}
+	return dst
+}
@@ -0,0 +1,68 @@
+package inventory
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/leroysb/go_kubernetes/internal/database"
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"gorm.io/gorm"
+)
+
+// Record adds a movement to the ledger. It must be called in the transaction that changes the stock,
+// so the ledger and the stock cannot disagree. A movement of nothing is not recorded
+func Record(tx *gorm.DB, movement *models.StockMovement) error {
+	if movement.Delta == 0 {
+		return nil
+	}
+	return tx.Create(movement).Error
+}
+
+// Mismatch is a product whose stock is not what its ledger adds up to
+type Mismatch struct {
+	ProductID uint `json:"product_id"`
+	Stock     int  `json:"stock"`
+	Ledger    int  `json:"ledger"`
+}
+
+// Reconcile returns the products, deleted ones included, whose stock differs from the sum of their
+// movements, meaning the stock was changed without going through the ledger
+func Reconcile() ([]Mismatch, error) {
+	var mismatches []Mismatch
+	err := database.DB.Db.Table("products").
+		Select("products.id AS product_id, products.stock AS stock, COALESCE(SUM(stock_movements.delta), 0) AS ledger").
+		Joins("LEFT JOIN stock_movements ON stock_movements.product_id = products.id AND stock_movements.deleted_at IS NULL").
+		Group("products.id, products.stock").
+		Having("products.stock <> COALESCE(SUM(stock_movements.delta), 0)").
+		Order("products.id").
+		Scan(&mismatches).Error
+	return mismatches, err
+}
+
+// Check logs every product whose stock does not match its ledger
+func Check() {
+	mismatches, err := Reconcile()
+	if err != nil {
+		log.Printf("Error reconciling stock: %v", err)
+		return
+	}
+	for _, m := range mismatches {
+		log.Printf("Stock of product %d is %d but its ledger adds up to %d", m.ProductID, m.Stock, m.Ledger)
+	}
+}
+
+// Run reconciles the stock every interval until the context is cancelled
+func Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			Check()
+		}
+	}
+}
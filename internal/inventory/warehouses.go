@@ -0,0 +1,323 @@
+package inventory
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Allocation strategies, chosen with WAREHOUSE_ALLOCATION
+const (
+	StrategyNearest   = "nearest"
+	StrategyMostStock = "most_stock"
+)
+
+var (
+	ErrNotEnoughStock = errors.New("Not enough stock to transfer")
+	ErrSameLocation   = errors.New("Cannot transfer to the same location")
+)
+
+// Location is where an order is shipped to
+type Location struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// Strategy returns how orders are allocated to warehouses: from the nearest first, or from the
+// one with the most stock first, which is the default
+func Strategy() string {
+	if os.Getenv("WAREHOUSE_ALLOCATION") == StrategyNearest {
+		return StrategyNearest
+	}
+	return StrategyMostStock
+}
+
+// distance is the great-circle distance in kilometres from a warehouse to a location, or infinity
+// for a warehouse without coordinates
+func distance(warehouse *models.Warehouse, to *Location) float64 {
+	if warehouse.Latitude == nil || warehouse.Longitude == nil {
+		return math.Inf(1)
+	}
+	const radius = 6371.0
+	lat1, lat2 := *warehouse.Latitude*math.Pi/180, to.Latitude*math.Pi/180
+	dLat := lat2 - lat1
+	dLng := (to.Longitude - *warehouse.Longitude) * math.Pi / 180
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * radius * math.Asin(math.Sqrt(a))
+}
+
+// stockLevels loads the levels of a product that hold any stock, with their warehouses, most stock
+// first. They are locked for the transaction on postgres
+func stockLevels(tx *gorm.DB, productID uint) ([]models.StockLevel, error) {
+	query := tx.Joins("Warehouse")
+	if tx.Dialector.Name() == "postgres" {
+		query = query.Clauses(clause.Locking{Strength: "UPDATE", Table: clause.Table{Name: "stock_levels"}})
+	}
+	var levels []models.StockLevel
+	err := query.Where("stock_levels.product_id = ? AND stock_levels.quantity > 0", productID).
+		Order("stock_levels.quantity DESC, stock_levels.warehouse_id").Find(&levels).Error
+	return levels, err
+}
+
+// held is the stock of a product held by its warehouses
+func held(levels []models.StockLevel) int {
+	total := 0
+	for _, level := range levels {
+		total += level.Quantity
+	}
+	return total
+}
+
+// moveLevel changes what a warehouse holds of a product by delta and records it with the reason,
+// reference and actor of movement
+func moveLevel(tx *gorm.DB, warehouseID, productID uint, delta int, movement models.StockMovement) error {
+	level := models.StockLevel{WarehouseID: warehouseID, ProductID: productID}
+	if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Omit(clause.Associations).Create(&level).Error; err != nil {
+		return err
+	}
+	err := tx.Model(&models.StockLevel{}).Where("warehouse_id = ? AND product_id = ?", warehouseID, productID).
+		Update("quantity", gorm.Expr("quantity + ?", delta)).Error
+	if err != nil {
+		return err
+	}
+	movement.ProductID, movement.WarehouseID, movement.Delta = productID, &warehouseID, delta
+	return Record(tx, &movement)
+}
+
+// withdraw takes up to quantity out of the warehouses in the order given, recording a movement for
+// each, and returns what each gave
+func withdraw(tx *gorm.DB, levels []models.StockLevel, quantity int, movement models.StockMovement) ([]models.OrderAllocation, error) {
+	var taken []models.OrderAllocation
+	for _, level := range levels {
+		if quantity == 0 {
+			break
+		}
+		n := min(quantity, level.Quantity)
+		if err := moveLevel(tx, level.WarehouseID, level.ProductID, -n, movement); err != nil {
+			return nil, err
+		}
+		taken = append(taken, models.OrderAllocation{WarehouseID: level.WarehouseID, Quantity: n})
+		quantity -= n
+	}
+	return taken, nil
+}
+
+// Adjust records a change of movement.Delta to the stock of a product, which is now stock, made
+// by hand or by an import. Stock added is unassigned. Stock taken comes out of unassigned stock
+// first, then out of the warehouses holding the most, each recorded as a movement of its own
+func Adjust(tx *gorm.DB, stock int, movement models.StockMovement) error {
+	if movement.Delta >= 0 {
+		return Record(tx, &movement)
+	}
+	levels, err := stockLevels(tx, movement.ProductID)
+	if err != nil {
+		return err
+	}
+
+	taken := -movement.Delta
+	unassigned := max(stock+taken-held(levels), 0)
+	fromUnassigned := movement
+	fromUnassigned.Delta = -min(taken, unassigned)
+	if err := Record(tx, &fromUnassigned); err != nil {
+		return err
+	}
+	_, err = withdraw(tx, levels, taken-min(taken, unassigned), movement)
+	return err
+}
+
+// Allocate records the sale of a product, already taken off its stock, and decides where it ships
+// from. Warehouses are drawn on by the configured strategy, nearest to the order's location or
+// most stock first, and unassigned stock makes up the rest. Nearest falls back to most stock for
+// orders without a location. The warehouses' shares are saved as the order's allocations
+func Allocate(tx *gorm.DB, orderID uint, to *Location, movement models.StockMovement) ([]models.OrderAllocation, error) {
+	levels, err := stockLevels(tx, movement.ProductID)
+	if err != nil {
+		return nil, err
+	}
+	if Strategy() == StrategyNearest && to != nil {
+		sort.SliceStable(levels, func(i, j int) bool {
+			return distance(&levels[i].Warehouse, to) < distance(&levels[j].Warehouse, to)
+		})
+	}
+
+	quantity := -movement.Delta
+	allocations, err := withdraw(tx, levels, quantity, movement)
+	if err != nil {
+		return nil, err
+	}
+	for i := range allocations {
+		allocations[i].OrderID = orderID
+		quantity -= allocations[i].Quantity
+		if err := tx.Create(&allocations[i]).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	unassigned := movement
+	unassigned.Delta = -quantity
+	return allocations, Record(tx, &unassigned)
+}
+
+// Return records movement.Delta items of an order, already put back into the product's stock,
+// as returned to the warehouses they were allocated from, latest first. Items beyond what the
+// warehouses gave came from unassigned stock and go back there
+func Return(tx *gorm.DB, orderID uint, movement models.StockMovement) error {
+	var allocations []models.OrderAllocation
+	if err := tx.Where("order_id = ? AND quantity > returned", orderID).Order("id DESC").Find(&allocations).Error; err != nil {
+		return err
+	}
+
+	quantity := movement.Delta
+	for _, allocation := range allocations {
+		if quantity == 0 {
+			break
+		}
+		n := min(quantity, allocation.Quantity-allocation.Returned)
+		if err := tx.Model(&allocation).Update("returned", gorm.Expr("returned + ?", n)).Error; err != nil {
+			return err
+		}
+		if err := moveLevel(tx, allocation.WarehouseID, movement.ProductID, n, movement); err != nil {
+			return err
+		}
+		quantity -= n
+	}
+
+	unassigned := movement
+	unassigned.Delta = quantity
+	return Record(tx, &unassigned)
+}
+
+// Restock puts quantity items of an order back into stock, on its variant as well if it has one,
+// and into the warehouses it shipped from, recording them in the ledger with the reason and actor
+// of movement
+func Restock(tx *gorm.DB, order *models.Order, quantity int, movement models.StockMovement) error {
+	if order.VariantID != nil {
+		err := tx.Unscoped().Model(&models.ProductVariant{}).Where("id = ?", *order.VariantID).Update("stock", gorm.Expr("stock + ?", quantity)).Error
+		if err != nil {
+			return err
+		}
+	}
+	err := tx.Unscoped().Model(&models.Product{}).Where("id = ?", order.ProductID).
+		Updates(map[string]any{"stock": gorm.Expr("stock + ?", quantity), "version": gorm.Expr("version + 1")}).Error
+	if err != nil {
+		return err
+	}
+
+	movement.ProductID, movement.VariantID, movement.Delta = order.ProductID, order.VariantID, quantity
+	movement.Reference = fmt.Sprintf("order:%d", order.ID)
+	return Return(tx, order.ID, movement)
+}
+
+// SetLevel sets what a warehouse holds of a product to quantity, counted or received there, and
+// returns the change. The product's stock changes by as much, recorded as a restock when it went
+// up and an adjustment otherwise
+func SetLevel(tx *gorm.DB, warehouseID, productID uint, quantity int, movement models.StockMovement) (int, error) {
+	level := models.StockLevel{WarehouseID: warehouseID, ProductID: productID}
+	if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Omit(clause.Associations).Create(&level).Error; err != nil {
+		return 0, err
+	}
+	query := tx.Where("warehouse_id = ? AND product_id = ?", warehouseID, productID)
+	if tx.Dialector.Name() == "postgres" {
+		query = query.Clauses(clause.Locking{Strength: "UPDATE"})
+	}
+	if err := query.First(&level).Error; err != nil {
+		return 0, err
+	}
+
+	delta := quantity - level.Quantity
+	if delta == 0 {
+		return 0, nil
+	}
+	err := tx.Unscoped().Model(&models.Product{}).Where("id = ?", productID).
+		Updates(map[string]any{"stock": gorm.Expr("stock + ?", delta), "version": gorm.Expr("version + 1")}).Error
+	if err != nil {
+		return 0, err
+	}
+	movement.Reason = models.StockRestock
+	if delta < 0 {
+		movement.Reason = models.StockAdjustment
+	}
+	return delta, moveLevel(tx, warehouseID, productID, delta, movement)
+}
+
+// Transfer moves quantity of a product from one warehouse to another. A nil warehouse is the
+// product's unassigned stock. The product's stock is unchanged, and the ledger records the move
+// out of one location and into the other. ErrNotEnoughStock is returned when the source holds
+// less than quantity
+func Transfer(tx *gorm.DB, productID uint, from, to *uint, quantity int, actor string) (*models.StockTransfer, error) {
+	if (from == nil && to == nil) || (from != nil && to != nil && *from == *to) {
+		return nil, ErrSameLocation
+	}
+
+	query := tx.Model(&models.Product{}).Select("stock")
+	if tx.Dialector.Name() == "postgres" {
+		query = query.Clauses(clause.Locking{Strength: "UPDATE"})
+	}
+	var stock int
+	if err := query.Where("id = ?", productID).Scan(&stock).Error; err != nil {
+		return nil, err
+	}
+	levels, err := stockLevels(tx, productID)
+	if err != nil {
+		return nil, err
+	}
+
+	available := stock - held(levels)
+	if from != nil {
+		available = 0
+		for _, level := range levels {
+			if level.WarehouseID == *from {
+				available = level.Quantity
+			}
+		}
+	}
+	if available < quantity {
+		return nil, ErrNotEnoughStock
+	}
+
+	transfer := &models.StockTransfer{ProductID: productID, FromWarehouseID: from, ToWarehouseID: to, Quantity: quantity, Actor: actor}
+	if err := tx.Create(transfer).Error; err != nil {
+		return nil, err
+	}
+
+	movement := models.StockMovement{ProductID: productID, Reason: models.StockTransferred, Reference: fmt.Sprintf("transfer:%d", transfer.ID), Actor: actor}
+	for _, side := range []struct {
+		warehouseID *uint
+		delta       int
+	}{{from, -quantity}, {to, quantity}} {
+		if side.warehouseID != nil {
+			err = moveLevel(tx, *side.warehouseID, productID, side.delta, movement)
+		} else {
+			unassigned := movement
+			unassigned.Delta = side.delta
+			err = Record(tx, &unassigned)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return transfer, nil
+}
+
+// Availability reports the stock of a product in total, unassigned and held by each warehouse
+func Availability(db *gorm.DB, product *models.Product) (*models.Availability, error) {
+	var levels []models.StockLevel
+	err := db.Joins("Warehouse").Where("stock_levels.product_id = ? AND stock_levels.quantity > 0", product.ID).
+		Order("stock_levels.quantity DESC, stock_levels.warehouse_id").Find(&levels).Error
+	if err != nil {
+		return nil, err
+	}
+
+	availability := &models.Availability{Total: product.Stock, Warehouses: []models.WarehouseStock{}}
+	for _, level := range levels {
+		availability.Warehouses = append(availability.Warehouses, models.WarehouseStock{WarehouseID: level.WarehouseID, Name: level.Warehouse.Name, Quantity: level.Quantity})
+	}
+	availability.Unassigned = max(product.Stock-held(levels), 0)
+	return availability, nil
+}
@@ -0,0 +1,77 @@
+package notifications
+
+import (
+	"errors"
+
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"github.com/leroysb/go_kubernetes/internal/email"
+	"github.com/leroysb/go_kubernetes/internal/sms"
+)
+
+// Message is a notification rendered for every channel
+type Message struct {
+	Subject string
+	Text    string
+	HTML    string
+	// Short replaces Text on channels with tight length limits such as SMS
+	Short string
+}
+
+// Channel delivers a message to a customer over one medium
+type Channel interface {
+	Name() string
+	Send(customer *models.Customer, msg Message) error
+}
+
+var ErrNoAddress = errors.New("customer has no address for this channel")
+
+// SMSChannel sends notifications through the SMS gateway
+type SMSChannel struct{}
+
+func (SMSChannel) Name() string {
+	return ChannelSMS
+}
+
+func (SMSChannel) Send(customer *models.Customer, msg Message) error {
+	if customer.Phone == "" {
+		return ErrNoAddress
+	}
+
+	text := msg.Short
+	if text == "" {
+		text = msg.Text
+	}
+	return sms.SendSMS(customer.Phone, text)
+}
+
+// EmailChannel sends notifications through an SMTP server. A nil Sender is read from the environment on each send
+type EmailChannel struct {
+	Sender *email.Sender
+}
+
+func (EmailChannel) Name() string {
+	return ChannelEmail
+}
+
+func (ch EmailChannel) Send(customer *models.Customer, msg Message) error {
+	if customer.Email == "" {
+		return ErrNoAddress
+	}
+
+	sender := ch.Sender
+	if sender == nil {
+		sender = email.NewSenderFromEnv()
+	}
+	return sender.Send(customer.Email, msg.Subject, msg.Text, msg.HTML)
+}
+
+// channels are the senders Notify dispatches to, in order
+var channels = []Channel{
+	SMSChannel{},
+	EmailChannel{},
+}
+
+// SetChannels replaces the senders Notify dispatches to
+func SetChannels(c ...Channel) {
+	channels = c
+}
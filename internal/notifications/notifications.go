@@ -0,0 +1,130 @@
+package notifications
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/leroysb/go_kubernetes/internal/database"
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"github.com/leroysb/go_kubernetes/internal/email"
+)
+
+// Events a customer can be notified about
+const (
+	EventSignup      = "signup"
+	EventOrder       = "order"
+	EventBackInStock = "back_in_stock"
+)
+
+// Channels a notification can be delivered over
+const (
+	ChannelSMS   = "sms"
+	ChannelEmail = "email"
+)
+
+var Events = []string{EventSignup, EventOrder, EventBackInStock}
+var Channels = []string{ChannelSMS, ChannelEmail}
+
+var ErrUnknownEvent = errors.New("unknown notification event")
+var ErrUnknownChannel = errors.New("unknown notification channel")
+
+// Preferences returns the event/channel matrix for a customer. Pairs without a stored preference default to enabled
+func Preferences(customerID uint) (map[string]map[string]bool, error) {
+	var stored []models.NotificationPreference
+	if err := database.DB.Db.Where("customer_id = ?", customerID).Find(&stored).Error; err != nil {
+		return nil, err
+	}
+
+	prefs := make(map[string]map[string]bool, len(Events))
+	for _, event := range Events {
+		prefs[event] = make(map[string]bool, len(Channels))
+		for _, channel := range Channels {
+			prefs[event][channel] = true
+		}
+	}
+
+	for _, pref := range stored {
+		if _, ok := prefs[pref.Event]; ok {
+			prefs[pref.Event][pref.Channel] = pref.Enabled
+		}
+	}
+
+	return prefs, nil
+}
+
+// SetPreferences stores the given event/channel preferences for a customer, leaving unlisted pairs untouched
+func SetPreferences(customerID uint, prefs map[string]map[string]bool) error {
+	for event, channels := range prefs {
+		if !contains(Events, event) {
+			return fmt.Errorf("%w: %s", ErrUnknownEvent, event)
+		}
+		for channel := range channels {
+			if !contains(Channels, channel) {
+				return fmt.Errorf("%w: %s", ErrUnknownChannel, channel)
+			}
+		}
+	}
+
+	for event, channels := range prefs {
+		for channel, enabled := range channels {
+			pref := models.NotificationPreference{CustomerID: customerID, Event: event, Channel: channel}
+			if err := database.DB.Db.Where(pref).FirstOrCreate(&pref).Error; err != nil {
+				return err
+			}
+			if err := database.DB.Db.Model(&pref).Update("enabled", enabled).Error; err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Allowed reports whether the customer wants to receive the event over the channel
+func Allowed(customer *models.Customer, event, channel string) bool {
+	if channel == ChannelSMS && customer.SMSOptOut {
+		return false
+	}
+
+	var pref models.NotificationPreference
+	err := database.DB.Db.Where("customer_id = ? AND event = ? AND channel = ?", customer.ID, event, channel).Limit(1).Find(&pref).Error
+	if err != nil {
+		log.Printf("Error loading notification preference: %v", err)
+		return false
+	}
+
+	// No stored preference means the customer has not opted out
+	if pref.ID == 0 {
+		return true
+	}
+	return pref.Enabled
+}
+
+// Notify sends the message over every channel the customer allows for the event
+func Notify(customer *models.Customer, event string, msg Message) {
+	for _, channel := range channels {
+		if !Allowed(customer, event, channel.Name()) {
+			continue
+		}
+
+		err := channel.Send(customer, msg)
+		if err != nil && !errors.Is(err, ErrNoAddress) && !errors.Is(err, email.ErrNotConfigured) {
+			log.Printf("Error sending %s notification over %s: %v", event, channel.Name(), err)
+		}
+	}
+}
+
+// SetSMSOptOut opts the customer with the given phone number out of, or back into, all SMS
+func SetSMSOptOut(phone string, optOut bool) error {
+	return database.DB.Db.Model(&models.Customer{}).Where("phone = ?", phone).Update("sms_opt_out", optOut).Error
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
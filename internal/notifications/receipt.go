@@ -0,0 +1,93 @@
+package notifications
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	texttemplate "text/template"
+
+	"github.com/leroysb/go_kubernetes/internal/database"
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"gorm.io/gorm"
+)
+
+const receiptText = `Hi {{.Customer.Name}},
+
+Thank you for your order.
+
+Order #{{.Order.ID}}
+Placed: {{.Order.Time}}
+
+{{.Product.Name}} x {{.Order.Quantity}} @ {{.Product.Price}}
+Subtotal: {{.Order.Subtotal}}
+{{template "tax" .Order}}: {{.Order.Tax}}
+Total: {{.Order.Amount}}
+`
+
+const receiptHTML = `<!DOCTYPE html>
+<html>
+<body style="font-family: sans-serif;">
+<p>Hi {{.Customer.Name}},</p>
+<p>Thank you for your order.</p>
+<h2>Order #{{.Order.ID}}</h2>
+<p>Placed: {{.Order.Time}}</p>
+<table cellpadding="6" style="border-collapse: collapse;">
+<tr><th align="left">Product</th><th align="right">Quantity</th><th align="right">Price</th></tr>
+<tr><td>{{.Product.Name}}</td><td align="right">{{.Order.Quantity}}</td><td align="right">{{.Product.Price}}</td></tr>
+<tr><td colspan="2">Subtotal</td><td align="right">{{.Order.Subtotal}}</td></tr>
+<tr><td colspan="2">{{template "tax" .Order}}</td><td align="right">{{.Order.Tax}}</td></tr>
+<tr><td colspan="2"><strong>Total</strong></td><td align="right"><strong>{{.Order.Amount}}</strong></td></tr>
+</table>
+</body>
+</html>
+`
+
+// receiptTax names the tax line, e.g. "VAT 16% (included)". Orders from before tax was worked
+// out have no rate
+const receiptTax = `{{define "tax"}}{{if eq .TaxClass "exempt"}}VAT exempt{{else if .TaxRate}}VAT {{.TaxRate}}%{{if .TaxInclusive}} (included){{end}}{{else}}VAT{{end}}{{end}}`
+
+var receiptTextTemplate = texttemplate.Must(texttemplate.Must(texttemplate.New("receipt").Parse(receiptText)).Parse(receiptTax))
+var receiptHTMLTemplate = htmltemplate.Must(htmltemplate.Must(htmltemplate.New("receipt").Parse(receiptHTML)).Parse(receiptTax))
+
+type receiptData struct {
+	Customer *models.Customer
+	Order    *models.Order
+	Product  *models.Product
+}
+
+// OrderReceipt renders the order receipt as plain text and HTML
+func OrderReceipt(customer *models.Customer, order *models.Order, product *models.Product) (Message, error) {
+	data := receiptData{Customer: customer, Order: order, Product: product}
+
+	var text, html bytes.Buffer
+	if err := receiptTextTemplate.Execute(&text, data); err != nil {
+		return Message{}, err
+	}
+	if err := receiptHTMLTemplate.Execute(&html, data); err != nil {
+		return Message{}, err
+	}
+
+	return Message{
+		Subject: fmt.Sprintf("Your order #%d", order.ID),
+		Text:    text.String(),
+		HTML:    html.String(),
+		Short:   "Order successful",
+	}, nil
+}
+
+// SendOrderReceipt loads an order with its customer and product, even if the product has since
+// been deleted, and notifies the customer
+func SendOrderReceipt(orderID uint) error {
+	var order models.Order
+	if err := database.DB.Db.Preload("Customer").Preload("Product", func(db *gorm.DB) *gorm.DB { return db.Unscoped() }).First(&order, orderID).Error; err != nil {
+		return err
+	}
+
+	receipt, err := OrderReceipt(&order.Customer, &order, &order.Product)
+	if err != nil {
+		return err
+	}
+
+	Notify(&order.Customer, EventOrder, receipt)
+	return nil
+}
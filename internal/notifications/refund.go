@@ -0,0 +1,33 @@
+package notifications
+
+import (
+	"fmt"
+
+	"github.com/leroysb/go_kubernetes/internal/database"
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+)
+
+// RefundNotice tells the customer a refund of the order was paid out
+func RefundNotice(customer *models.Customer, refund *models.Refund) Message {
+	text := fmt.Sprintf("Hi %s, a refund of %s for order #%d has been sent to you.", customer.Name, refund.Amount, refund.OrderID)
+	if refund.Receipt != nil {
+		text += fmt.Sprintf(" Reference: %s.", *refund.Receipt)
+	}
+
+	return Message{
+		Subject: fmt.Sprintf("Refund for order #%d", refund.OrderID),
+		Text:    text,
+		Short:   text,
+	}
+}
+
+// SendRefundNotice loads a refund with the customer of its order and notifies them
+func SendRefundNotice(refundID uint) error {
+	var refund models.Refund
+	if err := database.DB.Db.Preload("Order.Customer").First(&refund, refundID).Error; err != nil {
+		return err
+	}
+
+	Notify(&refund.Order.Customer, EventOrder, RefundNotice(&refund.Order.Customer, &refund))
+	return nil
+}
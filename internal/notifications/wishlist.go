@@ -0,0 +1,45 @@
+package notifications
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/leroysb/go_kubernetes/internal/database"
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"gorm.io/gorm"
+)
+
+// BackInStockNotice tells the customer a product on their wishlist can be bought again
+func BackInStockNotice(customer *models.Customer, product *models.Product) Message {
+	text := fmt.Sprintf("Hi %s, %s from your wishlist is back in stock at %s.", customer.Name, product.Name, product.Price)
+
+	return Message{
+		Subject: fmt.Sprintf("%s is back in stock", product.Name),
+		Text:    text,
+		Short:   text,
+	}
+}
+
+// SendBackInStock notifies every customer with the product on their wishlist that it is back in
+// stock. Nothing is sent for a product deleted or sold out again since
+func SendBackInStock(productID uint) error {
+	var product models.Product
+	if err := database.DB.Db.First(&product, productID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+	if product.Stock <= 0 {
+		return nil
+	}
+
+	var items []models.WishlistItem
+	if err := database.DB.Db.Preload("Customer").Where("product_id = ?", productID).Find(&items).Error; err != nil {
+		return err
+	}
+	for _, item := range items {
+		Notify(&item.Customer, EventBackInStock, BackInStockNotice(&item.Customer, &product))
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package outbox
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/leroysb/go_kubernetes/internal/database"
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Event is an outbox row as handed to sinks. Sinks may see the same event more than once and should
+// use IdempotencyKey to discard duplicates
+type Event struct {
+	IdempotencyKey string          `json:"idempotency_key"`
+	Type           string          `json:"type"`
+	AggregateType  string          `json:"aggregate_type"`
+	AggregateID    uint            `json:"aggregate_id"`
+	Payload        json.RawMessage `json:"payload"`
+	CreatedAt      time.Time       `json:"created_at"`
+}
+
+// Sink publishes outbox events to a destination
+type Sink interface {
+	Name() string
+	Publish(ctx context.Context, event Event) error
+}
+
+// Write records an event in the outbox using tx, so it is committed or rolled back with the change it describes
+func Write(tx *gorm.DB, eventType, aggregateType string, aggregateID uint, data any) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+
+	return tx.Create(&models.OutboxEvent{
+		IdempotencyKey: hex.EncodeToString(key),
+		EventType:      eventType,
+		AggregateType:  aggregateType,
+		AggregateID:    aggregateID,
+		Payload:        string(payload),
+		AvailableAt:    time.Now(),
+	}).Error
+}
+
+// Relay moves outbox rows to its sinks. A row is marked published once every sink has accepted it;
+// sinks that failed are retried with backoff while sinks that succeeded are not called again
+type Relay struct {
+	Sinks     []Sink
+	Interval  time.Duration
+	BatchSize int
+	Backoff   time.Duration
+}
+
+// NewRelay creates a relay polling every OUTBOX_POLL_INTERVAL, one second by default
+func NewRelay(sinks ...Sink) *Relay {
+	interval, err := time.ParseDuration(os.Getenv("OUTBOX_POLL_INTERVAL"))
+	if err != nil || interval <= 0 {
+		interval = time.Second
+	}
+
+	return &Relay{Sinks: sinks, Interval: interval, BatchSize: 100, Backoff: 5 * time.Second}
+}
+
+// Run publishes pending events until the context is cancelled
+func (r *Relay) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := r.RunOnce(ctx); err != nil {
+			log.Printf("Error relaying outbox events: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOnce publishes one batch of due events and returns how many were fully published
+func (r *Relay) RunOnce(ctx context.Context) (int, error) {
+	// SQLite allows a single writer, so sinks writing through their own connection would block on a
+	// relay transaction. Only Postgres claims the batch with row locks inside a transaction
+	if database.DB.Db.Dialector.Name() != "postgres" {
+		return r.relay(ctx, database.DB.Db, false)
+	}
+
+	var published int
+	err := database.DB.Db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		published, err = r.relay(ctx, tx, true)
+		return err
+	})
+	return published, err
+}
+
+func (r *Relay) relay(ctx context.Context, db *gorm.DB, lock bool) (int, error) {
+	query := db.Where("published_at IS NULL AND available_at <= ?", time.Now()).Order("id").Limit(r.BatchSize)
+	if lock {
+		// Let several relays share the table without handing out the same rows
+		query = query.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"})
+	}
+
+	var rows []models.OutboxEvent
+	if err := query.Find(&rows).Error; err != nil {
+		return 0, err
+	}
+
+	published := 0
+	for i := range rows {
+		if r.publish(ctx, &rows[i]) {
+			published++
+		}
+		if err := db.Save(&rows[i]).Error; err != nil {
+			return published, err
+		}
+	}
+	return published, nil
+}
+
+// publish hands the row to every sink that has not yet accepted it and records the outcome on the row
+func (r *Relay) publish(ctx context.Context, row *models.OutboxEvent) bool {
+	event := Event{
+		IdempotencyKey: row.IdempotencyKey,
+		Type:           row.EventType,
+		AggregateType:  row.AggregateType,
+		AggregateID:    row.AggregateID,
+		Payload:        json.RawMessage(row.Payload),
+		CreatedAt:      row.CreatedAt,
+	}
+
+	var failed error
+	for _, sink := range r.Sinks {
+		if delivered(row, sink.Name()) {
+			continue
+		}
+		if err := sink.Publish(ctx, event); err != nil {
+			failed = fmt.Errorf("%s: %w", sink.Name(), err)
+			continue
+		}
+		row.DeliveredTo = append(row.DeliveredTo, sink.Name())
+	}
+
+	row.Attempts++
+	if failed != nil {
+		row.LastError = failed.Error()
+		row.AvailableAt = time.Now().Add(r.Backoff * time.Duration(min(row.Attempts, 12)))
+		return false
+	}
+
+	now := time.Now()
+	row.LastError = ""
+	row.PublishedAt = &now
+	return true
+}
+
+func delivered(row *models.OutboxEvent, sink string) bool {
+	for _, name := range row.DeliveredTo {
+		if name == sink {
+			return true
+		}
+	}
+	return false
+}
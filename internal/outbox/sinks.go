@@ -0,0 +1,85 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/leroysb/go_kubernetes/internal/webhooks"
+)
+
+// Handler reacts to an event published on a Bus
+type Handler func(ctx context.Context, event Event) error
+
+// Bus is an in-process sink that calls the handlers subscribed to each event type
+type Bus struct {
+	mu       sync.RWMutex
+	handlers map[string][]Handler
+}
+
+func NewBus() *Bus {
+	return &Bus{handlers: make(map[string][]Handler)}
+}
+
+// Subscribe registers a handler for an event type, or for every event when eventType is "*"
+func (b *Bus) Subscribe(eventType string, handler Handler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers[eventType] = append(b.handlers[eventType], handler)
+}
+
+func (b *Bus) Name() string {
+	return "bus"
+}
+
+// Publish calls every matching handler and fails if any of them fails
+func (b *Bus) Publish(ctx context.Context, event Event) error {
+	b.mu.RLock()
+	handlers := append(append([]Handler{}, b.handlers[event.Type]...), b.handlers["*"]...)
+	b.mu.RUnlock()
+
+	for _, handler := range handlers {
+		if err := handler(ctx, event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WebhookSink hands events to the webhook subscriptions, which keep their own delivery log and retries
+type WebhookSink struct{}
+
+func (WebhookSink) Name() string {
+	return "webhooks"
+}
+
+func (WebhookSink) Publish(ctx context.Context, event Event) error {
+	if !webhooks.IsEvent(event.Type) {
+		return nil
+	}
+	return webhooks.Publish(event.Type, event.Payload, event.IdempotencyKey)
+}
+
+// Publisher is the subset of a message broker client BrokerSink needs. A *nats.Conn satisfies it
+// directly and Kafka producers need only a small wrapper that writes to the topic named by subject
+type Publisher interface {
+	Publish(subject string, data []byte) error
+}
+
+// BrokerSink publishes each event as JSON on the subject Prefix + event type, e.g. "store.order.created"
+type BrokerSink struct {
+	Publisher Publisher
+	Prefix    string
+}
+
+func (s BrokerSink) Name() string {
+	return "broker"
+}
+
+func (s BrokerSink) Publish(ctx context.Context, event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return s.Publisher.Publish(s.Prefix+event.Type, data)
+}
@@ -0,0 +1,324 @@
+package payments
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Daraja result codes of an STK Push that need handling of their own. Any other non-zero code is a failure
+const (
+	ResultSuccess   = 0
+	ResultCancelled = 1032 // the customer dismissed the prompt
+	ResultTimeout   = 1037 // the phone could not be reached or the customer did not answer
+)
+
+// errorProcessing is the Daraja error code a query returns while the customer has not answered yet
+const errorProcessing = "500.001.1001"
+
+var client = &http.Client{Timeout: 30 * time.Second}
+
+// Daraja is a client for the M-Pesa API of a paybill or till
+type Daraja struct {
+	BaseURL        string
+	ConsumerKey    string
+	ConsumerSecret string
+	Shortcode      string
+	Passkey        string
+	CallbackURL    string
+
+	// B2C payments, used for refunds, are made by an initiator on a shortcode of their own
+	B2CShortcode       string
+	InitiatorName      string
+	SecurityCredential string
+	B2CResultURL       string
+	B2CTimeoutURL      string
+}
+
+// NewDaraja reads the Daraja credentials from MPESA_* variables. MPESA_BASE_URL is the sandbox by
+// default and B2C payments are made from MPESA_SHORTCODE unless MPESA_B2C_SHORTCODE is set
+func NewDaraja() *Daraja {
+	baseURL := os.Getenv("MPESA_BASE_URL")
+	if baseURL == "" {
+		baseURL = "https://sandbox.safaricom.co.ke"
+	}
+	b2cShortcode := os.Getenv("MPESA_B2C_SHORTCODE")
+	if b2cShortcode == "" {
+		b2cShortcode = os.Getenv("MPESA_SHORTCODE")
+	}
+
+	return &Daraja{
+		BaseURL:            baseURL,
+		ConsumerKey:        os.Getenv("MPESA_CONSUMER_KEY"),
+		ConsumerSecret:     os.Getenv("MPESA_CONSUMER_SECRET"),
+		Shortcode:          os.Getenv("MPESA_SHORTCODE"),
+		Passkey:            os.Getenv("MPESA_PASSKEY"),
+		CallbackURL:        os.Getenv("MPESA_CALLBACK_URL"),
+		B2CShortcode:       b2cShortcode,
+		InitiatorName:      os.Getenv("MPESA_INITIATOR_NAME"),
+		SecurityCredential: os.Getenv("MPESA_SECURITY_CREDENTIAL"),
+		B2CResultURL:       os.Getenv("MPESA_B2C_RESULT_URL"),
+		B2CTimeoutURL:      os.Getenv("MPESA_B2C_TIMEOUT_URL"),
+	}
+}
+
+// APIError is an error response from Daraja
+type APIError struct {
+	Status  int
+	Code    string `json:"errorCode"`
+	Message string `json:"errorMessage"`
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("daraja: %s %s (status %d)", e.Code, e.Message, e.Status)
+}
+
+// STKPushResponse is Daraja's answer to an STK Push. The result itself arrives later on the callback
+type STKPushResponse struct {
+	MerchantRequestID   string `json:"MerchantRequestID"`
+	CheckoutRequestID   string `json:"CheckoutRequestID"`
+	ResponseCode        string `json:"ResponseCode"`
+	ResponseDescription string `json:"ResponseDescription"`
+	CustomerMessage     string `json:"CustomerMessage"`
+}
+
+// QueryResponse is the state of an STK Push that has been answered
+type QueryResponse struct {
+	MerchantRequestID string `json:"MerchantRequestID"`
+	CheckoutRequestID string `json:"CheckoutRequestID"`
+	ResultCode        string `json:"ResultCode"`
+	ResultDesc        string `json:"ResultDesc"`
+}
+
+// Callback is the body Daraja posts to the callback URL with the result of an STK Push
+type Callback struct {
+	Body struct {
+		STKCallback struct {
+			MerchantRequestID string `json:"MerchantRequestID"`
+			CheckoutRequestID string `json:"CheckoutRequestID"`
+			ResultCode        int    `json:"ResultCode"`
+			ResultDesc        string `json:"ResultDesc"`
+			CallbackMetadata  struct {
+				Item []struct {
+					Name  string `json:"Name"`
+					Value any    `json:"Value"`
+				} `json:"Item"`
+			} `json:"CallbackMetadata"`
+		} `json:"stkCallback"`
+	} `json:"Body"`
+}
+
+// B2CResponse is Daraja's answer to a B2C payment. The result arrives later on the result URL
+type B2CResponse struct {
+	ConversationID           string `json:"ConversationID"`
+	OriginatorConversationID string `json:"OriginatorConversationID"`
+	ResponseCode             string `json:"ResponseCode"`
+	ResponseDescription      string `json:"ResponseDescription"`
+}
+
+// B2CResult is the body Daraja posts to the result URL of a B2C payment, and to its timeout URL
+// when the payment could not be processed in time
+type B2CResult struct {
+	Result struct {
+		ResultType               int    `json:"ResultType"`
+		ResultCode               int    `json:"ResultCode"`
+		ResultDesc               string `json:"ResultDesc"`
+		OriginatorConversationID string `json:"OriginatorConversationID"`
+		ConversationID           string `json:"ConversationID"`
+		TransactionID            string `json:"TransactionID"`
+	} `json:"Result"`
+}
+
+// Item returns a value of the callback metadata as a string, as Daraja sends numbers for some of them
+func (cb *Callback) Item(name string) string {
+	for _, item := range cb.Body.STKCallback.CallbackMetadata.Item {
+		if item.Name != name || item.Value == nil {
+			continue
+		}
+		if number, ok := item.Value.(float64); ok {
+			return strconv.FormatFloat(number, 'f', -1, 64)
+		}
+		return fmt.Sprint(item.Value)
+	}
+	return ""
+}
+
+// STKPush prompts the phone to pay amount whole shillings to the shortcode. reference is shown to the
+// customer and on the statement, description is a short note for the transaction
+func (d *Daraja) STKPush(phone string, amount int64, reference, description string) (*STKPushResponse, error) {
+	timestamp := time.Now().Format("20060102150405")
+	body := map[string]any{
+		"BusinessShortCode": d.Shortcode,
+		"Password":          d.password(timestamp),
+		"Timestamp":         timestamp,
+		"TransactionType":   "CustomerPayBillOnline",
+		"Amount":            amount,
+		"PartyA":            phone,
+		"PartyB":            d.Shortcode,
+		"PhoneNumber":       phone,
+		"CallBackURL":       d.CallbackURL,
+		"AccountReference":  reference,
+		"TransactionDesc":   description,
+	}
+
+	var resp STKPushResponse
+	if err := d.post("/mpesa/stkpush/v1/processrequest", body, &resp); err != nil {
+		return nil, err
+	}
+	if resp.ResponseCode != "0" {
+		return nil, &APIError{Status: http.StatusOK, Code: resp.ResponseCode, Message: resp.ResponseDescription}
+	}
+	return &resp, nil
+}
+
+// Query asks for the result of an STK Push. It returns pending while the customer has not answered
+func (d *Daraja) Query(checkoutRequestID string) (resp *QueryResponse, pending bool, err error) {
+	timestamp := time.Now().Format("20060102150405")
+	body := map[string]any{
+		"BusinessShortCode": d.Shortcode,
+		"Password":          d.password(timestamp),
+		"Timestamp":         timestamp,
+		"CheckoutRequestID": checkoutRequestID,
+	}
+
+	resp = new(QueryResponse)
+	if err := d.post("/mpesa/stkpushquery/v1/query", body, resp); err != nil {
+		if apiErr, ok := err.(*APIError); ok && apiErr.Code == errorProcessing {
+			return nil, true, nil
+		}
+		return nil, false, err
+	}
+	return resp, false, nil
+}
+
+// B2C sends amount whole shillings from the B2C shortcode to the phone
+func (d *Daraja) B2C(phone string, amount int64, remarks, occasion string) (*B2CResponse, error) {
+	body := map[string]any{
+		"InitiatorName":      d.InitiatorName,
+		"SecurityCredential": d.SecurityCredential,
+		"CommandID":          "BusinessPayment",
+		"Amount":             amount,
+		"PartyA":             d.B2CShortcode,
+		"PartyB":             phone,
+		"Remarks":            remarks,
+		"QueueTimeOutURL":    d.B2CTimeoutURL,
+		"ResultURL":          d.B2CResultURL,
+		"Occasion":           occasion,
+	}
+
+	var resp B2CResponse
+	if err := d.post("/mpesa/b2c/v1/paymentrequest", body, &resp); err != nil {
+		return nil, err
+	}
+	if resp.ResponseCode != "0" {
+		return nil, &APIError{Status: http.StatusOK, Code: resp.ResponseCode, Message: resp.ResponseDescription}
+	}
+	return &resp, nil
+}
+
+// password is the base64 of the shortcode, passkey and timestamp that signs each request
+func (d *Daraja) password(timestamp string) string {
+	return base64.StdEncoding.EncodeToString([]byte(d.Shortcode + d.Passkey + timestamp))
+}
+
+func (d *Daraja) post(path string, body, out any) error {
+	token, err := d.token()
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", d.BaseURL+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	return do(req, out)
+}
+
+// tokens caches access tokens by consumer key until shortly before they expire
+var tokens = struct {
+	sync.Mutex
+	byKey map[string]cachedToken
+}{byKey: make(map[string]cachedToken)}
+
+type cachedToken struct {
+	value   string
+	expires time.Time
+}
+
+// token returns an OAuth access token for the consumer key and secret
+func (d *Daraja) token() (string, error) {
+	key := d.BaseURL + "|" + d.ConsumerKey
+	tokens.Lock()
+	defer tokens.Unlock()
+	if cached, ok := tokens.byKey[key]; ok && time.Now().Before(cached.expires) {
+		return cached.value, nil
+	}
+
+	req, err := http.NewRequest("GET", d.BaseURL+"/oauth/v1/generate?grant_type=client_credentials", nil)
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth(d.ConsumerKey, d.ConsumerSecret)
+
+	var resp struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   string `json:"expires_in"`
+	}
+	if err := do(req, &resp); err != nil {
+		return "", err
+	}
+	if resp.AccessToken == "" {
+		return "", fmt.Errorf("daraja: no access token in response")
+	}
+
+	// Tokens last an hour. Refresh a minute early so one does not expire in flight
+	seconds, err := strconv.Atoi(resp.ExpiresIn)
+	if err != nil || seconds <= 0 {
+		seconds = 3600
+	}
+	expires := time.Now().Add(time.Duration(seconds)*time.Second - time.Minute)
+	tokens.byKey[key] = cachedToken{value: resp.AccessToken, expires: expires}
+
+	return resp.AccessToken, nil
+}
+
+// do sends a request and decodes the JSON response into out, or the Daraja error for a non-2xx status
+func do(req *http.Request, out any) error {
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		apiErr := &APIError{Status: resp.StatusCode}
+		if json.Unmarshal(body, apiErr) != nil || apiErr.Code == "" {
+			apiErr.Message = http.StatusText(resp.StatusCode)
+		}
+		return apiErr
+	}
+
+	return json.Unmarshal(body, out)
+}
@@ -0,0 +1,61 @@
+package payments
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+)
+
+var ErrNotManual = errors.New("Only manual payments can be confirmed by hand")
+
+// Manual collects cash on delivery or any other payment taken outside the shop. It stays pending
+// until staff confirm the money was received
+type Manual struct{}
+
+func (Manual) Name() string {
+	return "manual"
+}
+
+func (Manual) Initiate(payment *models.Payment) error {
+	reference, err := randomReference("COD-")
+	if err != nil {
+		return err
+	}
+	payment.ProviderReference = reference
+	return nil
+}
+
+// Verify has no one to ask, so a manual payment is pending until it is confirmed
+func (Manual) Verify(payment *models.Payment) (Result, bool, error) {
+	return Result{}, true, nil
+}
+
+// Refund is handed over by hand, so it succeeds at once and only needs a reference to record
+func (Manual) Refund(payment *models.Payment, refund *models.Refund) error {
+	reference, err := randomReference("COD-REFUND-")
+	if err != nil {
+		return err
+	}
+	refund.ProviderReference = reference
+	refund.Status = RefundSucceeded
+	return nil
+}
+
+// Confirm settles a pending manual payment as paid in full. receipt is the number of the cash receipt,
+// if one was written
+func Confirm(payment *models.Payment, receipt string) error {
+	if payment.Provider != (Manual{}).Name() {
+		return ErrNotManual
+	}
+	return Settle(payment, Result{Status: StatusPaid, Receipt: receipt, Amount: &payment.Amount})
+}
+
+func randomReference(prefix string) (string, error) {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return prefix + hex.EncodeToString(b), nil
+}
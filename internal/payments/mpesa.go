@@ -0,0 +1,176 @@
+package payments
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/leroysb/go_kubernetes/internal/database"
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrInvalidPhone = errors.New("Invalid phone number, expected a Safaricom number such as 0712345678")
+	ErrCurrency     = errors.New("M-Pesa only accepts payments in KES")
+)
+
+var phonePattern = regexp.MustCompile(`^254[17]\d{8}$`)
+
+// NormalizePhone turns 07XXXXXXXX, +2547XXXXXXXX and 2547XXXXXXXX into the 2547XXXXXXXX form Daraja expects
+func NormalizePhone(phone string) (string, error) {
+	phone = strings.NewReplacer(" ", "", "-", "").Replace(phone)
+	phone = strings.TrimPrefix(phone, "+")
+	if strings.HasPrefix(phone, "0") {
+		phone = "254" + phone[1:]
+	}
+	if !phonePattern.MatchString(phone) {
+		return "", ErrInvalidPhone
+	}
+	return phone, nil
+}
+
+// Timeout is how long to wait for the callback of an STK Push before asking Daraja for its result,
+// from MPESA_TIMEOUT. It is two minutes by default, as the prompt on the phone lapses after about one
+func Timeout() time.Duration {
+	timeout, err := time.ParseDuration(os.Getenv("MPESA_TIMEOUT"))
+	if err != nil || timeout <= 0 {
+		return 2 * time.Minute
+	}
+	return timeout
+}
+
+// Mpesa collects payments with an STK Push prompt on the payer's phone. Daraja posts the result to
+// MPESA_CALLBACK_URL, which is handed to HandleMpesaCallback
+type Mpesa struct{}
+
+func (Mpesa) Name() string {
+	return "mpesa"
+}
+
+// Initiate sends the STK Push. Daraja only takes whole shillings, so an amount with cents is rounded up
+func (Mpesa) Initiate(payment *models.Payment) error {
+	phone, err := NormalizePhone(payment.Phone)
+	if err != nil {
+		return err
+	}
+	if payment.Amount.Currency != "KES" {
+		return ErrCurrency
+	}
+
+	shillings := (payment.Amount.Amount + 99) / 100
+	resp, err := NewDaraja().STKPush(phone, shillings, payment.Reference, "Payment for order "+strconv.FormatUint(uint64(payment.OrderID), 10))
+	if err != nil {
+		return err
+	}
+
+	expires := time.Now().Add(Timeout())
+	payment.Phone = phone
+	payment.Amount = models.Money{Amount: shillings * 100, Currency: "KES"}
+	payment.ProviderReference = resp.CheckoutRequestID
+	payment.Details = map[string]string{"merchant_request_id": resp.MerchantRequestID}
+	payment.ExpiresAt = &expires
+	return nil
+}
+
+// Verify queries the STK Push. One Daraja cannot find any more is taken to have timed out
+func (Mpesa) Verify(payment *models.Payment) (Result, bool, error) {
+	resp, pending, err := NewDaraja().Query(payment.ProviderReference)
+	if err != nil {
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && apiErr.Status >= 400 && apiErr.Status < 500 {
+			return Result{Status: StatusTimeout, Reason: apiErr.Message}, false, nil
+		}
+		return Result{}, false, err
+	}
+	if pending {
+		return Result{}, true, nil
+	}
+
+	code, err := strconv.Atoi(resp.ResultCode)
+	if err != nil {
+		return Result{}, false, fmt.Errorf("daraja: unexpected result code %q", resp.ResultCode)
+	}
+	return Result{Status: mpesaStatus(code), Reason: resp.ResultDesc, Details: map[string]string{"result_code": resp.ResultCode}}, false, nil
+}
+
+// CheckRefund rounds the amount to whole shillings, as B2C pays out no cents
+func (Mpesa) CheckRefund(payment *models.Payment, refund *models.Refund) error {
+	if refund.Amount.Currency != "KES" {
+		return ErrCurrency
+	}
+	shillings := (refund.Amount.Amount + 50) / 100
+	if shillings < 1 {
+		return ErrRefundTooSmall
+	}
+	refund.Amount = models.Money{Amount: shillings * 100, Currency: "KES"}
+	return nil
+}
+
+// Refund sends the amount, checked by CheckRefund, back to the phone that paid with a B2C payment.
+// Daraja posts the result to MPESA_B2C_RESULT_URL, which is handed to HandleB2CResult
+func (Mpesa) Refund(payment *models.Payment, refund *models.Refund) error {
+	resp, err := NewDaraja().B2C(payment.Phone, refund.Amount.Amount/100, "Refund for order "+strconv.FormatUint(uint64(payment.OrderID), 10), payment.Reference)
+	if err != nil {
+		return err
+	}
+
+	refund.ProviderReference = resp.ConversationID
+	refund.Status = RefundPending
+	return nil
+}
+
+// mpesaStatus maps a Daraja result code to a payment status
+func mpesaStatus(code int) string {
+	switch code {
+	case ResultSuccess:
+		return StatusPaid
+	case ResultCancelled:
+		return StatusCancelled
+	case ResultTimeout:
+		return StatusTimeout
+	}
+	return StatusFailed
+}
+
+// HandleMpesaCallback records the result Daraja posted for an STK Push, given the raw body
+func HandleMpesaCallback(payload []byte) error {
+	var cb Callback
+	if err := json.Unmarshal(payload, &cb); err != nil {
+		return err
+	}
+	stk := cb.Body.STKCallback
+
+	var payment models.Payment
+	err := database.DB.Db.Where("provider = ? AND provider_reference = ?", Mpesa{}.Name(), stk.CheckoutRequestID).First(&payment).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrUnknownPayment
+		}
+		return err
+	}
+	if payment.Details["merchant_request_id"] != stk.MerchantRequestID {
+		return ErrUnknownPayment
+	}
+
+	result := Result{
+		Status:  mpesaStatus(stk.ResultCode),
+		Reason:  stk.ResultDesc,
+		Receipt: cb.Item("MpesaReceiptNumber"),
+		Details: map[string]string{"result_code": strconv.Itoa(stk.ResultCode)},
+		Payload: string(payload),
+	}
+	if stk.ResultCode == ResultSuccess {
+		paid, err := models.ParseMoney(cb.Item("Amount"), "KES")
+		if err != nil {
+			paid = models.Money{Currency: "KES"}
+		}
+		result.Amount = &paid
+	}
+	return Settle(&payment, result)
+}
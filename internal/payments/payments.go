@@ -0,0 +1,345 @@
+package payments
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/leroysb/go_kubernetes/internal/database"
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"github.com/leroysb/go_kubernetes/internal/outbox"
+	"github.com/leroysb/go_kubernetes/internal/webhooks"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Payment statuses. A payment is mismatched when the provider reports a payment that does not
+// reconcile with what was asked for, which leaves the order unpaid for someone to look at. A payment
+// is late when it was paid after its order stopped awaiting payment, such as a second payment for
+// it, and is kept to be refunded
+const (
+	StatusPending   = "pending"
+	StatusPaid      = "paid"
+	StatusCancelled = "cancelled"
+	StatusTimeout   = "timeout"
+	StatusFailed    = "failed"
+	StatusMismatch  = "mismatch"
+	StatusLate      = "late"
+)
+
+var (
+	ErrUnknownProvider = errors.New("Unknown payment provider")
+	ErrNotPayable      = errors.New("Order is not awaiting payment")
+	ErrInProgress      = errors.New("A payment for this order is already in progress")
+	ErrUnknownPayment  = errors.New("Unknown payment")
+)
+
+// Provider collects payments through an outside service
+type Provider interface {
+	Name() string
+
+	// Initiate asks the provider to collect a new payment, setting its ProviderReference and anything
+	// else the provider needs to recognise it later
+	Initiate(payment *models.Payment) error
+
+	// Verify asks the provider for the outcome of a pending payment. pending is true while it is not known yet
+	Verify(payment *models.Payment) (result Result, pending bool, err error)
+
+	// Refund pays the refund's amount of a paid payment back to the payer. It sets the refund's
+	// ProviderReference and Status, and may round its Amount to what the provider can pay out
+	Refund(payment *models.Payment, refund *models.Refund) error
+}
+
+// Result is the outcome of a payment reported by its provider. Amount is what the provider says was
+// paid, nil when it did not say
+type Result struct {
+	Status  string
+	Reason  string
+	Receipt string
+	Amount  *models.Money
+	Details map[string]string
+	Payload string
+}
+
+var (
+	mu        sync.RWMutex
+	providers = make(map[string]Provider)
+)
+
+func init() {
+	Register(Mpesa{})
+	Register(Manual{})
+}
+
+// Register makes a provider available by its name, replacing any provider of the same name
+func Register(provider Provider) {
+	mu.Lock()
+	defer mu.Unlock()
+	providers[provider.Name()] = provider
+}
+
+// Get returns the provider registered under name
+func Get(name string) (Provider, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	provider, ok := providers[name]
+	return provider, ok
+}
+
+// Start records a pending payment for the order, then initiates it with the provider. phone is the
+// payer's number, for providers that need one. The payment is recorded first so a provider's
+// callback always finds it, and the provider is called outside the transaction so the order is not
+// locked while it answers. A payment the provider does not take is failed
+func Start(order *models.Order, providerName, phone string) (*models.Payment, error) {
+	provider, ok := Get(providerName)
+	if !ok {
+		return nil, ErrUnknownProvider
+	}
+	if order.Status != "ordered" {
+		return nil, ErrNotPayable
+	}
+	if err := checkOverdue(order.ID); err != nil {
+		return nil, err
+	}
+
+	// Until the provider gives its own, the payment needs a reference of its own to be recorded
+	placeholder, err := randomReference("STARTING-")
+	if err != nil {
+		return nil, err
+	}
+	payment := &models.Payment{
+		OrderID:           order.ID,
+		Provider:          provider.Name(),
+		Amount:            order.Amount,
+		Status:            StatusPending,
+		Reference:         fmt.Sprintf("ORDER%d", order.ID),
+		ProviderReference: placeholder,
+		Phone:             phone,
+	}
+	err = database.DB.Db.Transaction(func(tx *gorm.DB) error {
+		// Lock the order until the payment is recorded, so two requests at once cannot both start
+		// one. The order may have been paid or cancelled since it was read
+		query := tx
+		if tx.Dialector.Name() == "postgres" {
+			query = query.Clauses(clause.Locking{Strength: "UPDATE"})
+		}
+		var locked models.Order
+		if err := query.First(&locked, order.ID).Error; err != nil {
+			return err
+		}
+		if locked.Status != "ordered" {
+			return ErrNotPayable
+		}
+
+		var pending int64
+		err := tx.Model(&models.Payment{}).
+			Where("order_id = ? AND status = ? AND (expires_at IS NULL OR expires_at > ?)", order.ID, StatusPending, time.Now()).
+			Count(&pending).Error
+		if err != nil {
+			return err
+		}
+		if pending > 0 {
+			return ErrInProgress
+		}
+
+		// Nothing is paid yet, and a nil embedded amount would be written as zero
+		return tx.Omit("Order", "paid_amount_minor", "paid_amount_currency").Create(payment).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := provider.Initiate(payment); err != nil {
+		now := time.Now()
+		payment.Status, payment.StatusReason, payment.CompletedAt = StatusFailed, err.Error(), &now
+		if dbErr := database.DB.Db.Model(payment).Updates(map[string]any{"status": payment.Status, "status_reason": payment.StatusReason, "completed_at": now}).Error; dbErr != nil {
+			log.Printf("Error failing payment %d: %v", payment.ID, dbErr)
+		}
+		return nil, err
+	}
+	err = database.DB.Db.Model(payment).
+		Select("provider_reference", "phone", "amount_minor", "amount_currency", "details", "expires_at").
+		Updates(payment).Error
+	if err != nil {
+		log.Printf("Payment %d for order %d was started with %s as %q but could not be recorded: %v", payment.ID, order.ID, payment.Provider, payment.ProviderReference, err)
+		return nil, err
+	}
+	return payment, nil
+}
+
+// checkOverdue asks the providers for the outcome of the order's payments that are overdue or timed
+// out, as they can still be paid, so a new payment is not started while one of them may go through.
+// It returns ErrInProgress while the outcome of one is not known yet
+func checkOverdue(orderID uint) error {
+	var overdue []models.Payment
+	err := database.DB.Db.Where("order_id = ? AND (status = ? OR (status = ? AND expires_at <= ?))", orderID, StatusTimeout, StatusPending, time.Now()).
+		Find(&overdue).Error
+	if err != nil {
+		return err
+	}
+
+	for i := range overdue {
+		provider, ok := Get(overdue[i].Provider)
+		if !ok {
+			return ErrUnknownProvider
+		}
+		result, pending, err := provider.Verify(&overdue[i])
+		if err != nil {
+			return err
+		}
+		if pending {
+			return ErrInProgress
+		}
+		if result.Status == overdue[i].Status {
+			continue
+		}
+		if err := Settle(&overdue[i], result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check asks the provider for the outcome of a pending payment that is overdue
+func Check(payment *models.Payment) error {
+	if payment.Status != StatusPending || payment.ExpiresAt == nil || time.Now().Before(*payment.ExpiresAt) {
+		return nil
+	}
+
+	provider, ok := Get(payment.Provider)
+	if !ok {
+		return ErrUnknownProvider
+	}
+	result, pending, err := provider.Verify(payment)
+	if err != nil || pending {
+		return err
+	}
+	return Settle(payment, result)
+}
+
+// CheckExpired checks every pending payment that is overdue
+func CheckExpired() {
+	var payments []models.Payment
+	if err := database.DB.Db.Where("status = ? AND expires_at <= ?", StatusPending, time.Now()).Find(&payments).Error; err != nil {
+		log.Printf("Error loading expired payments: %v", err)
+		return
+	}
+
+	for i := range payments {
+		if err := Check(&payments[i]); err != nil {
+			log.Printf("Error checking payment %d: %v", payments[i].ID, err)
+		}
+	}
+}
+
+// Run checks overdue payments every interval until the context is cancelled, so orders are settled
+// even when a callback never arrives
+func Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			CheckExpired()
+		}
+	}
+}
+
+// Settle moves a payment out of pending and, for a payment that reconciles, marks the order paid.
+// A timed out payment can still be settled, since a provider may report after we gave up on it. One
+// paid after the order stopped awaiting payment is late. A payment that is already settled is left
+// alone, so repeated callbacks are harmless
+func Settle(payment *models.Payment, result Result) error {
+	status := result.Status
+	updates := map[string]any{"status": status, "status_reason": result.Reason, "completed_at": time.Now()}
+	if result.Payload != "" {
+		updates["payload"] = result.Payload
+	}
+	if len(result.Details) > 0 {
+		details := make(map[string]string, len(payment.Details)+len(result.Details))
+		for key, value := range payment.Details {
+			details[key] = value
+		}
+		for key, value := range result.Details {
+			details[key] = value
+		}
+		encoded, err := json.Marshal(details)
+		if err != nil {
+			return err
+		}
+		updates["details"] = string(encoded)
+	}
+	if status == StatusPaid {
+		if result.Receipt != "" {
+			updates["receipt"] = result.Receipt
+		}
+		if result.Amount != nil {
+			updates["paid_amount_minor"] = result.Amount.Amount
+			updates["paid_amount_currency"] = result.Amount.Currency
+		}
+		if reason := reconcile(payment, result); reason != "" {
+			log.Printf("Payment %d for order %d does not reconcile: %s", payment.ID, payment.OrderID, reason)
+			status = StatusMismatch
+			updates["status"] = status
+			updates["status_reason"] = reason
+			delete(updates, "receipt")
+		}
+	}
+
+	return database.DB.Db.Transaction(func(tx *gorm.DB) error {
+		// Only one of the callback and a check may settle the payment
+		settled := tx.Model(&models.Payment{}).
+			Where("id = ? AND status IN ?", payment.ID, []string{StatusPending, StatusTimeout}).
+			Updates(updates)
+		if settled.Error != nil {
+			return settled.Error
+		}
+		if settled.RowsAffected == 0 {
+			return nil
+		}
+		payment.Status = status
+		if status != StatusPaid {
+			return nil
+		}
+
+		var order models.Order
+		if err := tx.First(&order, payment.OrderID).Error; err != nil {
+			return err
+		}
+		previousStatus := order.Status
+		paid := tx.Model(&order).Where("status = ?", "ordered").Update("status", StatusPaid)
+		if paid.Error != nil {
+			return paid.Error
+		}
+		// The order was cancelled or paid for, now or while it was being read
+		if paid.RowsAffected == 0 {
+			log.Printf("Payment %d arrived for order %d no longer awaiting payment, it is to be refunded", payment.ID, order.ID)
+			payment.Status = StatusLate
+			return tx.Model(payment).Updates(map[string]any{"status": StatusLate, "status_reason": "order was no longer awaiting payment"}).Error
+		}
+		return outbox.Write(tx, webhooks.EventOrderStatusChanged, "order", order.ID, map[string]any{"order": order, "previous_status": previousStatus})
+	})
+}
+
+// reconcile returns why a successful payment does not match what was asked for, or "" when it does
+func reconcile(payment *models.Payment, result Result) string {
+	if result.Amount != nil && *result.Amount != payment.Amount {
+		return fmt.Sprintf("paid %s instead of %s", result.Amount, payment.Amount)
+	}
+
+	if result.Receipt != "" {
+		var used int64
+		database.DB.Db.Model(&models.Payment{}).Where("provider = ? AND receipt = ? AND id <> ?", payment.Provider, result.Receipt, payment.ID).Count(&used)
+		if used > 0 {
+			return "receipt " + result.Receipt + " was already used for another payment"
+		}
+	}
+	return ""
+}
@@ -0,0 +1,252 @@
+package payments
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/leroysb/go_kubernetes/internal/database"
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"github.com/leroysb/go_kubernetes/internal/inventory"
+	"github.com/leroysb/go_kubernetes/internal/outbox"
+	"github.com/leroysb/go_kubernetes/internal/webhooks"
+	"gorm.io/gorm"
+)
+
+// Refund statuses
+const (
+	RefundPending   = "pending"
+	RefundSucceeded = "succeeded"
+	RefundFailed    = "failed"
+)
+
+// Order statuses set once refunds have succeeded
+const (
+	OrderRefunded          = "refunded"
+	OrderPartiallyRefunded = "partially_refunded"
+)
+
+var (
+	ErrNotPaid        = errors.New("Order has not been paid")
+	ErrNotLate        = errors.New("Payment is not a late payment of this order")
+	ErrUnknownRefund  = errors.New("Unknown refund")
+	ErrRefundTooSmall = errors.New("Refund is too small for the payment provider")
+)
+
+// PaidPayment returns the payment that paid for the order
+func PaidPayment(tx *gorm.DB, orderID uint) (*models.Payment, error) {
+	var payment models.Payment
+	if err := tx.Where("order_id = ? AND status = ?", orderID, StatusPaid).Order("id DESC").First(&payment).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotPaid
+		}
+		return nil, err
+	}
+	return &payment, nil
+}
+
+// LatePayment returns a payment of the order that was paid after the order stopped awaiting payment
+func LatePayment(tx *gorm.DB, orderID, paymentID uint) (*models.Payment, error) {
+	var payment models.Payment
+	if err := tx.Where("order_id = ? AND status = ?", orderID, StatusLate).First(&payment, paymentID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotLate
+		}
+		return nil, err
+	}
+	return &payment, nil
+}
+
+// Refunded returns the amount and quantity of the payment's refunds that are pending or have
+// succeeded. Failed refunds do not count, so they can be tried again
+func Refunded(tx *gorm.DB, paymentID uint) (amount int64, quantity int, err error) {
+	var total struct {
+		Amount   int64
+		Quantity int
+	}
+	err = tx.Model(&models.Refund{}).
+		Select("COALESCE(SUM(amount_minor), 0) AS amount, COALESCE(SUM(quantity), 0) AS quantity").
+		Where("payment_id = ? AND status IN ?", paymentID, []string{RefundPending, RefundSucceeded}).
+		Scan(&total).Error
+	return total.Amount, total.Quantity, err
+}
+
+// refundChecker is implemented by providers with limits on what they can refund. CheckRefund may
+// round the amount to what the provider can pay out
+type refundChecker interface {
+	CheckRefund(payment *models.Payment, refund *models.Refund) error
+}
+
+// CreateRefund records a refund of the payment as pending using tx. Nothing is paid out until
+// SendRefund is called once tx has committed, so no money leaves without a record of it
+func CreateRefund(tx *gorm.DB, payment *models.Payment, refund *models.Refund) error {
+	provider, ok := Get(payment.Provider)
+	if !ok {
+		return ErrUnknownProvider
+	}
+	if checker, ok := provider.(refundChecker); ok {
+		if err := checker.CheckRefund(payment, refund); err != nil {
+			return err
+		}
+	}
+
+	refund.PaymentID = payment.ID
+	refund.OrderID = payment.OrderID
+	refund.Status = RefundPending
+	return tx.Omit("Order", "Payment").Create(refund).Error
+}
+
+// SendRefund asks the provider to pay out a recorded refund, then records its reference and, for
+// providers that pay out at once, its outcome. A refund the provider turned down is failed so it
+// can be tried again. One whose outcome is unknown, because the provider could not be reached or the outcome
+// could not be recorded, stays pending to be reconciled with the provider
+func SendRefund(refund *models.Refund) error {
+	var payment models.Payment
+	if err := database.DB.Db.First(&payment, refund.PaymentID).Error; err != nil {
+		return err
+	}
+	provider, ok := Get(payment.Provider)
+	if !ok {
+		return ErrUnknownProvider
+	}
+
+	if err := provider.Refund(&payment, refund); err != nil {
+		var apiErr *APIError
+		if !errors.As(err, &apiErr) || apiErr.Status >= 500 {
+			log.Printf("Refund %d for order %d is left pending, %s did not answer: %v", refund.ID, refund.OrderID, payment.Provider, err)
+			return err
+		}
+		now := time.Now()
+		refund.Status, refund.StatusReason, refund.CompletedAt = RefundFailed, err.Error(), &now
+		if dbErr := database.DB.Db.Model(refund).Updates(map[string]any{"status": refund.Status, "status_reason": refund.StatusReason, "completed_at": now}).Error; dbErr != nil {
+			log.Printf("Error failing refund %d: %v", refund.ID, dbErr)
+		}
+		return err
+	}
+
+	err := database.DB.Db.Transaction(func(tx *gorm.DB) error {
+		updates := map[string]any{"provider_reference": refund.ProviderReference, "status": refund.Status}
+		if refund.Status != RefundPending {
+			now := time.Now()
+			refund.CompletedAt = &now
+			updates["completed_at"] = now
+		}
+		if err := tx.Model(refund).Updates(updates).Error; err != nil {
+			return err
+		}
+		if refund.Status == RefundSucceeded {
+			return finishRefund(tx, refund)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Refund %d for order %d was taken by %s as %q but could not be recorded: %v", refund.ID, refund.OrderID, payment.Provider, refund.ProviderReference, err)
+	}
+	return err
+}
+
+// SettleRefund records the outcome of a pending refund. A refund that is already settled is left alone
+func SettleRefund(refund *models.Refund, status, reason, receipt, payload string) error {
+	updates := map[string]any{"status": status, "status_reason": reason, "completed_at": time.Now()}
+	if receipt != "" {
+		updates["receipt"] = receipt
+	}
+	if payload != "" {
+		updates["payload"] = payload
+	}
+
+	return database.DB.Db.Transaction(func(tx *gorm.DB) error {
+		settled := tx.Model(&models.Refund{}).Where("id = ? AND status = ?", refund.ID, RefundPending).Updates(updates)
+		if settled.Error != nil {
+			return settled.Error
+		}
+		if settled.RowsAffected == 0 {
+			return nil
+		}
+		refund.Status = status
+		if status != RefundSucceeded {
+			return nil
+		}
+		return finishRefund(tx, refund)
+	})
+}
+
+// finishRefund restocks the items of a succeeded refund if asked, moves the order to refunded, or
+// partially refunded while some of the payment is left, and emits order.refunded so the customer is
+// told. Items are only restocked here, so a refund that fails and is made again restocks them once.
+// Refunding a late payment leaves the order as it is, as it did not pay for it
+func finishRefund(tx *gorm.DB, refund *models.Refund) error {
+	var payment models.Payment
+	if err := tx.First(&payment, refund.PaymentID).Error; err != nil {
+		return err
+	}
+	var refunded int64
+	err := tx.Model(&models.Refund{}).Select("COALESCE(SUM(amount_minor), 0)").
+		Where("payment_id = ? AND status = ?", payment.ID, RefundSucceeded).Scan(&refunded).Error
+	if err != nil {
+		return err
+	}
+
+	var order models.Order
+	if err := tx.First(&order, refund.OrderID).Error; err != nil {
+		return err
+	}
+
+	// A cancelled order already had all of its items not yet returned put back
+	if refund.Restock && !refund.Restocked && order.Status != "cancelled" {
+		if err := inventory.Restock(tx, &order, refund.Quantity, models.StockMovement{Reason: models.StockReturn, Actor: "system"}); err != nil {
+			return err
+		}
+		refund.Restocked = true
+		if err := tx.Model(refund).Update("restocked", true).Error; err != nil {
+			return err
+		}
+	}
+
+	status := OrderPartiallyRefunded
+	if refunded >= payment.Amount.Amount {
+		status = OrderRefunded
+	}
+	if payment.Status != StatusLate && order.Status != status {
+		previousStatus := order.Status
+		if err := tx.Model(&order).Update("status", status).Error; err != nil {
+			return err
+		}
+		if err := outbox.Write(tx, webhooks.EventOrderStatusChanged, "order", order.ID, map[string]any{"order": order, "previous_status": previousStatus}); err != nil {
+			return err
+		}
+	}
+
+	return outbox.Write(tx, webhooks.EventOrderRefunded, "refund", refund.ID, map[string]any{"refund": refund, "order": order})
+}
+
+// HandleB2CResult records the outcome Daraja posted for a refund paid out by B2C, given the raw body.
+// A post to the timeout URL fails the refund, so it can be tried again
+func HandleB2CResult(payload []byte, timedOut bool) error {
+	var result B2CResult
+	if err := json.Unmarshal(payload, &result); err != nil {
+		return err
+	}
+
+	var refund models.Refund
+	err := database.DB.Db.Where("provider_reference = ?", result.Result.ConversationID).First(&refund).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrUnknownRefund
+		}
+		return err
+	}
+
+	status := RefundFailed
+	reason := result.Result.ResultDesc
+	if timedOut {
+		reason = "M-Pesa did not process the refund in time"
+	} else if result.Result.ResultCode == ResultSuccess {
+		status = RefundSucceeded
+	}
+	if status == RefundFailed {
+		log.Printf("M-Pesa refund %d for order %d failed: %s", refund.ID, refund.OrderID, reason)
+	}
+	return SettleRefund(&refund, status, reason, result.Result.TransactionID, string(payload))
+}
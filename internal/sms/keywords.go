@@ -0,0 +1,29 @@
+package sms
+
+import "strings"
+
+// optOutKeywords are the inbound message bodies that unsubscribe a number
+var optOutKeywords = []string{"STOP", "STOPALL", "UNSUBSCRIBE", "CANCEL", "END", "QUIT"}
+
+// optInKeywords are the inbound message bodies that resubscribe a number
+var optInKeywords = []string{"START", "UNSTOP", "SUBSCRIBE", "YES"}
+
+// IsOptOut reports whether an inbound message is an opt-out request
+func IsOptOut(text string) bool {
+	return matchKeyword(text, optOutKeywords)
+}
+
+// IsOptIn reports whether an inbound message is an opt-in request
+func IsOptIn(text string) bool {
+	return matchKeyword(text, optInKeywords)
+}
+
+func matchKeyword(text string, keywords []string) bool {
+	word := strings.ToUpper(strings.TrimSpace(text))
+	for _, keyword := range keywords {
+		if word == keyword {
+			return true
+		}
+	}
+	return false
+}
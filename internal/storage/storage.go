@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+)
+
+var ErrNotFound = errors.New("object not found")
+
+// Storage keeps uploaded files under slash-separated keys and knows the public URL of each
+type Storage interface {
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	Delete(ctx context.Context, key string) error
+	URL(key string) string
+}
+
+var (
+	mu      sync.Mutex
+	current Storage
+)
+
+// Default returns the storage configured by the environment, or the one set with SetDefault
+func Default() Storage {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if current == nil {
+		current = NewFromEnv()
+	}
+	return current
+}
+
+// SetDefault replaces the storage returned by Default
+func SetDefault(s Storage) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	current = s
+}
+
+// NewFromEnv builds an S3 storage when STORAGE_DRIVER is s3, and a local one otherwise
+func NewFromEnv() Storage {
+	if strings.EqualFold(os.Getenv("STORAGE_DRIVER"), "s3") {
+		return NewS3FromEnv()
+	}
+	return NewLocalFromEnv()
+}
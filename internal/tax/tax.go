@@ -0,0 +1,130 @@
+package tax
+
+import (
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+)
+
+// Tax classes a product can be in. Zero-rated and exempt supplies are both charged no tax, but
+// are reported apart since only zero-rated ones count as taxable supplies
+const (
+	Standard  = "standard"
+	ZeroRated = "zero_rated"
+	Exempt    = "exempt"
+)
+
+// Rounding modes for the tax of a line, from TAX_ROUNDING
+const (
+	HalfUp   = "half_up"
+	HalfEven = "half_even"
+	Down     = "down"
+	Up       = "up"
+)
+
+// Valid reports whether class is a known tax class
+func Valid(class string) bool {
+	return class == Standard || class == ZeroRated || class == Exempt
+}
+
+// Rate returns the rate of a tax class as a fraction. The standard rate is TAX_STANDARD_RATE in
+// percent, 16 by default for Kenyan VAT
+func Rate(class string) *big.Rat {
+	if class != Standard {
+		return new(big.Rat)
+	}
+	if rate, ok := new(big.Rat).SetString(strings.TrimSpace(os.Getenv("TAX_STANDARD_RATE"))); ok && rate.Sign() >= 0 {
+		return rate.Quo(rate, big.NewRat(100, 1))
+	}
+	return big.NewRat(16, 100)
+}
+
+// PricesIncludeTax reports whether product prices already include tax, from PRICES_INCLUDE_TAX.
+// They do by default, as shelf prices in Kenya are quoted with VAT
+func PricesIncludeTax() bool {
+	include, err := strconv.ParseBool(os.Getenv("PRICES_INCLUDE_TAX"))
+	return err != nil || include
+}
+
+// Rounding returns the rounding mode from TAX_ROUNDING, half_up by default
+func Rounding() string {
+	switch mode := os.Getenv("TAX_ROUNDING"); mode {
+	case HalfEven, Down, Up:
+		return mode
+	}
+	return HalfUp
+}
+
+// Line is the tax worked out for one order line. Subtotal is the amount before tax and Total the
+// amount charged
+type Line struct {
+	Class     string
+	Rate      *big.Rat
+	Inclusive bool
+	Subtotal  models.Money
+	Tax       models.Money
+	Total     models.Money
+}
+
+// Percent formats the rate in percent, e.g. "16" or "12.5"
+func (l Line) Percent() string {
+	percent := new(big.Rat).Mul(l.Rate, big.NewRat(100, 1)).FloatString(4)
+	return strings.TrimSuffix(strings.TrimRight(percent, "0"), ".")
+}
+
+// Calculate works out the tax of quantity items at the unit price. Tax is rounded once per line,
+// so a line of many items is not off by the rounding of each item
+func Calculate(unit models.Money, quantity int, class string) Line {
+	return Apply(unit.Mul(quantity), class)
+}
+
+// Apply works out the tax of a line of the given amount, which is taken to include tax or not
+// depending on PRICES_INCLUDE_TAX
+func Apply(amount models.Money, class string) Line {
+	if class == "" {
+		class = Standard
+	}
+	line := Line{Class: class, Rate: Rate(class), Inclusive: PricesIncludeTax()}
+
+	if line.Inclusive {
+		// The tax part of a gross amount is amount × rate / (1 + rate)
+		share := new(big.Rat).Quo(line.Rate, new(big.Rat).Add(big.NewRat(1, 1), line.Rate))
+		line.Tax = models.Money{Amount: round(share.Mul(share, new(big.Rat).SetInt64(amount.Amount))), Currency: amount.Currency}
+		line.Total = amount
+		line.Subtotal = models.Money{Amount: amount.Amount - line.Tax.Amount, Currency: amount.Currency}
+	} else {
+		tax := new(big.Rat).Mul(line.Rate, new(big.Rat).SetInt64(amount.Amount))
+		line.Tax = models.Money{Amount: round(tax), Currency: amount.Currency}
+		line.Subtotal = amount
+		line.Total = models.Money{Amount: amount.Amount + line.Tax.Amount, Currency: amount.Currency}
+	}
+	return line
+}
+
+// round rounds a non-negative amount of minor units to a whole one by the configured mode
+func round(amount *big.Rat) int64 {
+	quo, rem := new(big.Int).QuoRem(amount.Num(), amount.Denom(), new(big.Int))
+	if rem.Sign() == 0 {
+		return quo.Int64()
+	}
+
+	// Compare twice the remainder with the denominator to tell below, at and above half
+	half := new(big.Int).Mul(rem, big.NewInt(2)).Cmp(amount.Denom())
+	switch Rounding() {
+	case Down:
+	case Up:
+		quo.Add(quo, big.NewInt(1))
+	case HalfEven:
+		if half > 0 || (half == 0 && quo.Bit(0) == 1) {
+			quo.Add(quo, big.NewInt(1))
+		}
+	default:
+		if half >= 0 {
+			quo.Add(quo, big.NewInt(1))
+		}
+	}
+	return quo.Int64()
+}
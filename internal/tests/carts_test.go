@@ -0,0 +1,195 @@
+package tests
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/leroysb/go_kubernetes/internal/api/handlers"
+	"github.com/leroysb/go_kubernetes/internal/database"
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"github.com/stretchr/testify/suite"
+)
+
+// cartView is the cart as GET /customers/cart returns it
+type cartView struct {
+	ID    uint `json:"id"`
+	Items []struct {
+		ID           uint          `json:"id"`
+		ProductID    uint          `json:"product_id"`
+		Quantity     int           `json:"quantity"`
+		UnitPrice    models.Money  `json:"unit_price"`
+		AddedPrice   *models.Money `json:"added_price"`
+		PriceChanged bool          `json:"price_changed"`
+		Available    int           `json:"available"`
+		Removed      bool          `json:"removed"`
+		Amount       models.Money  `json:"amount"`
+		Error        string        `json:"error"`
+	} `json:"items"`
+	Valid    bool         `json:"valid"`
+	Subtotal models.Money `json:"subtotal"`
+	Tax      models.Money `json:"tax"`
+	Total    models.Money `json:"total"`
+}
+
+type CartTestSuite struct {
+	apiSuite
+	customer *models.Customer
+	lamp     *models.Product
+	rug      *models.Product
+}
+
+func (suite *CartTestSuite) SetupTest() {
+	database.ConnectDB()
+
+	suite.customer = createCustomer(suite.T(), "Shopper", "+254700000045")
+
+	suite.lamp = &models.Product{Name: "Cart Lamp", Price: kes(1160), Stock: 5}
+	suite.rug = &models.Product{Name: "Cart Rug", Price: kes(2320), Stock: 1}
+	createProducts(suite.T(), suite.lamp, suite.rug)
+
+	suite.app = fiber.New()
+	suite.app.Get("/customers/cart", asCustomer(suite.customer, handlers.GetCart))
+	suite.app.Post("/customers/cart", asCustomer(suite.customer, handlers.AddCartItem))
+	suite.app.Put("/customers/cart/:id", asCustomer(suite.customer, handlers.UpdateCartItem))
+	suite.app.Delete("/customers/cart/:id", asCustomer(suite.customer, handlers.DeleteCartItem))
+	suite.app.Post("/customers/orders", asCustomer(suite.customer, handlers.CreateOrder))
+}
+
+func (suite *CartTestSuite) TearDownTest() {
+	deleteCustomer(suite.customer)
+	deleteProducts(suite.lamp, suite.rug)
+}
+
+func (suite *CartTestSuite) add(product *models.Product, quantity int) int {
+	return suite.request("POST", "/customers/cart", fmt.Sprintf(`{"product_id": %d, "quantity": %d}`, product.ID, quantity), nil)
+}
+
+// TestCart checks items are merged, priced as the catalogue is now and kept within stock
+func (suite *CartTestSuite) TestCart() {
+	var cart cartView
+	suite.Equal(200, suite.request("GET", "/customers/cart", "", &cart))
+	suite.Empty(cart.Items)
+
+	suite.Equal(200, suite.add(suite.lamp, 1))
+	suite.Equal(200, suite.add(suite.lamp, 2))
+	suite.Equal(400, suite.add(suite.lamp, 3))
+	suite.Equal(200, suite.add(suite.rug, 1))
+
+	suite.Equal(200, suite.request("GET", "/customers/cart", "", &cart))
+	suite.Require().Len(cart.Items, 2)
+	suite.Equal(3, cart.Items[0].Quantity)
+	suite.Equal(kes(3480), cart.Items[0].Amount)
+	suite.Equal(kes(5800), cart.Total)
+	suite.Equal(kes(5000), cart.Subtotal)
+
+	var carts int64
+	database.DB.Db.Model(&models.Cart{}).Where("customer_id = ?", suite.customer.ID).Count(&carts)
+	suite.Equal(int64(1), carts)
+
+	// A price change shows at once, and an item out of stock is left out of the total
+	database.DB.Db.Model(suite.lamp).Updates(map[string]any{"price_minor": 100000})
+	database.DB.Db.Model(suite.rug).Update("stock", 0)
+	suite.Equal(200, suite.request("GET", "/customers/cart", "", &cart))
+	suite.Equal(kes(1000), cart.Items[0].UnitPrice)
+	suite.Equal("Product not available", cart.Items[1].Error)
+	suite.Equal(kes(3000), cart.Total)
+
+	lamp := fmt.Sprintf("/customers/cart/%d", cart.Items[0].ID)
+	suite.Equal(400, suite.request("PUT", lamp, `{"quantity": 0}`, nil))
+	suite.Equal(400, suite.request("PUT", lamp, `{"quantity": 6}`, nil))
+	suite.Equal(200, suite.request("PUT", lamp, `{"quantity": 1}`, &cart))
+	suite.Equal(kes(1000), cart.Total)
+
+	suite.Equal(200, suite.request("DELETE", fmt.Sprintf("/customers/cart/%d", cart.Items[1].ID), "", &cart))
+	suite.Len(cart.Items, 1)
+	suite.Equal(404, suite.request("DELETE", "/customers/cart/999999", "", nil))
+}
+
+// TestValidation checks the cart reports price changes and removed products, and that a removed
+// product does not stop the rest of the cart being ordered
+func (suite *CartTestSuite) TestValidation() {
+	suite.Equal(200, suite.add(suite.lamp, 2))
+	suite.Equal(200, suite.add(suite.rug, 1))
+
+	var cart cartView
+	suite.Equal(200, suite.request("GET", "/customers/cart", "", &cart))
+	suite.True(cart.Valid)
+	suite.Require().Len(cart.Items, 2)
+	suite.Equal(kes(1160), *cart.Items[0].AddedPrice)
+	suite.False(cart.Items[0].PriceChanged)
+	suite.Equal(5, cart.Items[0].Available)
+
+	// Items added before prices were recorded are not reported as changed
+	database.DB.Db.Exec("UPDATE cart_items SET added_price_minor = NULL, added_price_currency = NULL WHERE product_id = ?", suite.rug.ID)
+	database.DB.Db.Model(suite.lamp).Update("price_minor", 150000)
+	database.DB.Db.Delete(suite.rug)
+	cart = cartView{}
+	suite.Equal(200, suite.request("GET", "/customers/cart", "", &cart))
+	suite.False(cart.Valid)
+	suite.True(cart.Items[0].PriceChanged)
+	suite.Equal(kes(1500), cart.Items[0].UnitPrice)
+	suite.True(cart.Items[1].Removed)
+	suite.Nil(cart.Items[1].AddedPrice)
+	suite.NotEmpty(cart.Items[1].Error)
+
+	// Adding the item again takes the new price
+	suite.Equal(200, suite.add(suite.lamp, 1))
+	suite.Equal(200, suite.request("GET", "/customers/cart", "", &cart))
+	suite.False(cart.Items[0].PriceChanged)
+	suite.Equal(3, cart.Items[0].Quantity)
+
+	// Ordering takes what was ordered out of the cart, whatever else is in it
+	suite.Equal(400, suite.request("POST", "/customers/orders", fmt.Sprintf(`{"product_id": %d, "quantity": 1}`, suite.rug.ID), nil))
+	suite.Equal(200, suite.request("POST", "/customers/orders", fmt.Sprintf(`{"product_id": %d, "quantity": 1}`, suite.lamp.ID), nil))
+	suite.Equal(200, suite.request("GET", "/customers/cart", "", &cart))
+	suite.Require().Len(cart.Items, 2)
+	suite.Equal(2, cart.Items[0].Quantity)
+	suite.Equal(200, suite.request("POST", "/customers/orders", fmt.Sprintf(`{"product_id": %d, "quantity": 2}`, suite.lamp.ID), nil))
+	suite.Equal(200, suite.request("GET", "/customers/cart", "", &cart))
+	suite.Require().Len(cart.Items, 1)
+	suite.True(cart.Items[0].Removed)
+}
+
+// TestExpiry checks a cart left alone too long is replaced by a new one
+func (suite *CartTestSuite) TestExpiry() {
+	suite.Equal(200, suite.add(suite.lamp, 1))
+	var cart models.Cart
+	database.DB.Db.Where("customer_id = ?", suite.customer.ID).First(&cart)
+	database.DB.Db.Model(&cart).Update("expires_at", time.Now().Add(-time.Minute))
+
+	var view cartView
+	suite.Equal(200, suite.request("GET", "/customers/cart", "", &view))
+	suite.Empty(view.Items)
+	suite.Equal(200, suite.add(suite.rug, 1))
+	suite.Equal(200, suite.request("GET", "/customers/cart", "", &view))
+	suite.NotEqual(cart.ID, view.ID)
+	suite.Len(view.Items, 1)
+
+	var expired models.Cart
+	database.DB.Db.First(&expired, cart.ID)
+	suite.Equal(models.CartExpired, expired.Status)
+}
+
+// TestMigrateCartOrders checks cart lines kept as orders are moved into a cart on startup
+func (suite *CartTestSuite) TestMigrateCartOrders() {
+	for _, quantity := range []int{1, 2} {
+		line := &models.Order{CustomerID: suite.customer.ID, ProductID: suite.lamp.ID, Quantity: quantity, Amount: suite.lamp.Price.Mul(quantity), Time: "-", Status: "cart"}
+		suite.Require().NoError(database.DB.Db.Create(line).Error)
+	}
+
+	database.ConnectDB()
+	var orders int64
+	database.DB.Db.Unscoped().Model(&models.Order{}).Where("customer_id = ?", suite.customer.ID).Count(&orders)
+	suite.Zero(orders)
+
+	var cart cartView
+	suite.Equal(200, suite.request("GET", "/customers/cart", "", &cart))
+	suite.Require().Len(cart.Items, 1)
+	suite.Equal(3, cart.Items[0].Quantity)
+}
+
+func TestCartTestSuite(t *testing.T) {
+	suite.Run(t, new(CartTestSuite))
+}
@@ -0,0 +1,84 @@
+package tests
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/leroysb/go_kubernetes/internal/api/handlers"
+	"github.com/leroysb/go_kubernetes/internal/database"
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"github.com/stretchr/testify/suite"
+)
+
+type CategoryTestSuite struct {
+	apiSuite
+	clothing   models.Category
+	shirts     models.Category
+	kitchen    models.Category
+	shirt, mug models.Product
+}
+
+func (suite *CategoryTestSuite) SetupTest() {
+	database.ConnectDB()
+
+	suite.clothing = models.Category{Name: "Category Clothing"}
+	suite.Require().NoError(database.DB.Db.Create(&suite.clothing).Error)
+	suite.shirts = models.Category{Name: "Category Shirts", ParentID: &suite.clothing.ID}
+	suite.Require().NoError(database.DB.Db.Create(&suite.shirts).Error)
+	suite.kitchen = models.Category{Name: "Category Kitchen"}
+	suite.Require().NoError(database.DB.Db.Create(&suite.kitchen).Error)
+
+	suite.shirt = models.Product{Name: "Category Shirt", Price: kes(1000), Stock: 3}
+	suite.mug = models.Product{Name: "Category Mug", Price: kes(300), Stock: 3}
+	createProducts(suite.T(), &suite.shirt, &suite.mug)
+
+	suite.app = fiber.New()
+	suite.app.Get("/products", handlers.GetProducts)
+	suite.app.Put("/products/:id/categories", handlers.SetProductCategories)
+	suite.app.Put("/categories/:id", handlers.UpdateCategory)
+	suite.app.Get("/categories/:id/products", handlers.GetCategoryProducts)
+
+	suite.Equal(200, suite.request("PUT", fmt.Sprintf("/products/%d/categories", suite.shirt.ID), fmt.Sprintf(`{"category_ids": [%d]}`, suite.shirts.ID), nil))
+	suite.Equal(200, suite.request("PUT", fmt.Sprintf("/products/%d/categories", suite.mug.ID), fmt.Sprintf(`{"category_ids": [%d]}`, suite.kitchen.ID), nil))
+}
+
+func (suite *CategoryTestSuite) TearDownTest() {
+	for _, product := range []*models.Product{&suite.shirt, &suite.mug} {
+		database.DB.Db.Model(product).Association("Categories").Clear()
+	}
+	deleteProducts(&suite.shirt, &suite.mug)
+	for _, category := range []*models.Category{&suite.shirts, &suite.clothing, &suite.kitchen} {
+		database.DB.Db.Unscoped().Delete(category)
+	}
+}
+
+// TestListingIncludesSubcategories checks that a parent category lists products filed under its children
+func (suite *CategoryTestSuite) TestListingIncludesSubcategories() {
+	var page productPage
+	suite.Equal(200, suite.request("GET", fmt.Sprintf("/categories/%d/products", suite.clothing.ID), "", &page))
+	suite.Equal([]string{"Category Shirt"}, names(page.Data))
+
+	suite.Equal(200, suite.request("GET", fmt.Sprintf("/products?category=%d", suite.kitchen.ID), "", &page))
+	suite.Equal([]string{"Category Mug"}, names(page.Data))
+
+	suite.Equal(404, suite.request("GET", "/categories/999999/products", "", nil))
+	suite.Equal(400, suite.request("GET", "/products?category=999999", "", nil))
+}
+
+// TestMoveCategory checks that categories can be re-parented but not under their own subtree
+func (suite *CategoryTestSuite) TestMoveCategory() {
+	body := fmt.Sprintf(`{"name": "Category Clothing", "parent_id": %d}`, suite.shirts.ID)
+	suite.Equal(400, suite.request("PUT", fmt.Sprintf("/categories/%d", suite.clothing.ID), body, nil))
+
+	body = fmt.Sprintf(`{"name": "Category Shirts", "parent_id": %d}`, suite.kitchen.ID)
+	suite.Equal(200, suite.request("PUT", fmt.Sprintf("/categories/%d", suite.shirts.ID), body, nil))
+
+	var page productPage
+	suite.request("GET", fmt.Sprintf("/categories/%d/products?sort=name", suite.kitchen.ID), "", &page)
+	suite.Equal([]string{"Category Mug", "Category Shirt"}, names(page.Data))
+}
+
+func TestCategoryTestSuite(t *testing.T) {
+	suite.Run(t, new(CategoryTestSuite))
+}
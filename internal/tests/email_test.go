@@ -0,0 +1,172 @@
+package tests
+
+import (
+	"bufio"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"github.com/leroysb/go_kubernetes/internal/email"
+	"github.com/leroysb/go_kubernetes/internal/notifications"
+	"github.com/stretchr/testify/suite"
+)
+
+// smtpStandIn is a minimal in-process SMTP server that records every message it accepts
+type smtpStandIn struct {
+	listener net.Listener
+	mu       sync.Mutex
+	messages []string
+	rcpts    []string
+}
+
+func newSMTPStandIn() (*smtpStandIn, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &smtpStandIn{listener: listener}
+	go s.serve()
+	return s, nil
+}
+
+func (s *smtpStandIn) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *smtpStandIn) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { io.WriteString(conn, line+"\r\n") }
+
+	reply("220 localhost ESMTP stand-in")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(cmd, "MAIL FROM"):
+			reply("250 OK")
+		case strings.HasPrefix(cmd, "RCPT TO"):
+			s.mu.Lock()
+			s.rcpts = append(s.rcpts, strings.Trim(strings.TrimSpace(line)[len("RCPT TO:"):], "<>"))
+			s.mu.Unlock()
+			reply("250 OK")
+		case cmd == "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var data strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(l, "."))
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, data.String())
+			s.mu.Unlock()
+			reply("250 OK")
+		case cmd == "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+func (s *smtpStandIn) sender() *email.Sender {
+	host, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	return &email.Sender{Host: host, Port: port, From: "shop@example.com"}
+}
+
+type EmailTestSuite struct {
+	suite.Suite
+	smtp *smtpStandIn
+}
+
+func (suite *EmailTestSuite) SetupTest() {
+	var err error
+	suite.smtp, err = newSMTPStandIn()
+	suite.Require().NoError(err)
+}
+
+func (suite *EmailTestSuite) TearDownTest() {
+	suite.smtp.listener.Close()
+}
+
+// TestOrderReceipt checks that a receipt is delivered as multipart plain text and HTML
+func (suite *EmailTestSuite) TestOrderReceipt() {
+	customer := &models.Customer{Name: "Jane", Email: "jane@example.com"}
+	order := &models.Order{Quantity: 2, Time: "2024-03-01 10:00:00"}
+	order.Subtotal, order.Tax, order.Amount = models.NewMoney(34483), models.NewMoney(5517), kes(400)
+	order.TaxClass, order.TaxRate, order.TaxInclusive = "standard", "16", true
+	order.ID = 42
+	product := &models.Product{Name: "Mug", Price: kes(200)}
+
+	receipt, err := notifications.OrderReceipt(customer, order, product)
+	suite.Require().NoError(err)
+
+	channel := notifications.EmailChannel{Sender: suite.smtp.sender()}
+	suite.Require().NoError(channel.Send(customer, receipt))
+
+	suite.Require().Len(suite.smtp.messages, 1)
+	suite.Equal([]string{"jane@example.com"}, suite.smtp.rcpts)
+
+	msg, err := mail.ReadMessage(strings.NewReader(suite.smtp.messages[0]))
+	suite.Require().NoError(err)
+	suite.Equal("Your order #42", msg.Header.Get("Subject"))
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	suite.Require().NoError(err)
+	suite.Equal("multipart/alternative", mediaType)
+
+	parts := map[string]string{}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		suite.Require().NoError(err)
+		body, _ := io.ReadAll(quotedprintable.NewReader(part))
+		contentType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		parts[contentType] = string(body)
+	}
+
+	suite.Contains(parts["text/plain"], "Mug x 2 @ KES 200.00")
+	suite.Contains(parts["text/plain"], "VAT 16% (included): KES 55.17")
+	suite.Contains(parts["text/plain"], "Total: KES 400.00")
+	suite.Contains(parts["text/html"], "<h2>Order #42</h2>")
+}
+
+// TestCustomerWithoutEmail checks that customers without an address are skipped
+func (suite *EmailTestSuite) TestCustomerWithoutEmail() {
+	channel := notifications.EmailChannel{Sender: suite.smtp.sender()}
+	err := channel.Send(&models.Customer{Name: "NoMail"}, notifications.Message{Subject: "Hi", Text: "Hi"})
+	suite.ErrorIs(err, notifications.ErrNoAddress)
+	suite.Empty(suite.smtp.messages)
+}
+
+func TestEmailTestSuite(t *testing.T) {
+	suite.Run(t, new(EmailTestSuite))
+}
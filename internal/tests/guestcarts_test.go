@@ -0,0 +1,114 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/leroysb/go_kubernetes/internal/api/handlers"
+	"github.com/leroysb/go_kubernetes/internal/database"
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"github.com/leroysb/go_kubernetes/internal/utils"
+)
+
+// guestRequest makes a request as a guest holding the cart token, returning the token handed back
+func (suite *CartTestSuite) guestRequest(method, url, token, body string, out any) (int, string) {
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set(handlers.CartTokenHeader, token)
+	}
+	resp, err := suite.app.Test(req)
+	suite.Require().NoError(err)
+	if out != nil {
+		json.NewDecoder(resp.Body).Decode(out)
+	}
+	return resp.StatusCode, resp.Header.Get(handlers.CartTokenHeader)
+}
+
+// guestCart fills a guest cart with the quantities of the products, returning its token
+func (suite *CartTestSuite) guestCart(quantities map[*models.Product]int) string {
+	token := ""
+	for product, quantity := range quantities {
+		status, returned := suite.guestRequest("POST", "/cart", token, fmt.Sprintf(`{"product_id": %d, "quantity": %d}`, product.ID, quantity), nil)
+		suite.Require().Equal(200, status)
+		token = returned
+	}
+	return token
+}
+
+func (suite *CartTestSuite) deleteGuestCarts() {
+	carts := database.DB.Db.Unscoped().Model(&models.Cart{}).Select("id").Where("customer_id IS NULL")
+	database.DB.Db.Unscoped().Where("cart_id IN (?)", carts).Delete(&models.CartItem{})
+	database.DB.Db.Unscoped().Where("customer_id IS NULL").Delete(&models.Cart{})
+}
+
+// TestGuestCart checks a guest cart is found again only by the token it was handed
+func (suite *CartTestSuite) TestGuestCart() {
+	defer suite.deleteGuestCarts()
+	suite.app.Get("/cart", handlers.GetGuestCart)
+	suite.app.Post("/cart", handlers.AddGuestCartItem)
+
+	token := suite.guestCart(map[*models.Product]int{suite.lamp: 2})
+	suite.Require().NotEmpty(token)
+
+	var cart cartView
+	status, again := suite.guestRequest("POST", "/cart", token, fmt.Sprintf(`{"product_id": %d, "quantity": 1}`, suite.lamp.ID), &cart)
+	suite.Equal(200, status)
+	suite.Equal(token, again)
+	suite.Require().Len(cart.Items, 1)
+	suite.Equal(3, cart.Items[0].Quantity)
+
+	var other cartView
+	suite.guestRequest("GET", "/cart", "", "", &other)
+	suite.Empty(other.Items)
+	id, _, _ := strings.Cut(token, ".")
+	suite.guestRequest("GET", "/cart", id+".forged", "", &other)
+	suite.Empty(other.Items)
+	suite.guestRequest("GET", "/cart", token, "", &other)
+	suite.Equal(cart.ID, other.ID)
+}
+
+// TestMergeOnLogin checks logging in brings the guest cart into the customer's, within stock
+func (suite *CartTestSuite) TestMergeOnLogin() {
+	defer suite.deleteGuestCarts()
+	hydra := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"client_id": "shop", "access_token": "token"}`))
+	}))
+	defer hydra.Close()
+	suite.T().Setenv("HYDRA_CLIENT_URL", hydra.URL)
+	suite.T().Setenv("HYDRA_TOKEN_URL", hydra.URL)
+
+	database.DB.Db.Model(suite.customer).Update("password", utils.HashPassword("secret"))
+
+	suite.app.Post("/cart", handlers.AddGuestCartItem)
+	suite.app.Post("/customers/login", handlers.Login)
+	login := func(token string) {
+		status, _ := suite.guestRequest("POST", "/customers/login", token, `{"phone": "+254700000045", "password": "secret"}`, nil)
+		suite.Require().Equal(200, status)
+	}
+
+	// Without a cart of their own the customer takes the guest cart over
+	guest := suite.guestCart(map[*models.Product]int{suite.rug: 1})
+	login(guest)
+	var cart cartView
+	suite.Equal(200, suite.request("GET", "/customers/cart", "", &cart))
+	suite.Require().Len(cart.Items, 1)
+	suite.Equal(suite.rug.ID, cart.Items[0].ProductID)
+
+	// Otherwise quantities are added up to what is in stock, and what is out of stock is skipped
+	guest = suite.guestCart(map[*models.Product]int{suite.lamp: 4, suite.rug: 1})
+	suite.Equal(200, suite.add(suite.lamp, 3))
+	login(guest)
+	suite.Equal(200, suite.request("GET", "/customers/cart", "", &cart))
+	suite.Require().Len(cart.Items, 2)
+	suite.Equal(suite.rug.ID, cart.Items[0].ProductID)
+	suite.Equal(1, cart.Items[0].Quantity)
+	suite.Equal(5, cart.Items[1].Quantity)
+
+	var merged int64
+	database.DB.Db.Model(&models.Cart{}).Where("customer_id IS NULL AND status = ?", models.CartMerged).Count(&merged)
+	suite.Equal(int64(1), merged)
+}
@@ -0,0 +1,84 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/leroysb/go_kubernetes/internal/database"
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+// apiSuite is a suite that makes requests against its own app, set up by the suite with the
+// routes it tests
+type apiSuite struct {
+	suite.Suite
+	app *fiber.App
+}
+
+// request makes a JSON request against the app, decoding the response into out if given, and
+// returns the status code
+func (s *apiSuite) request(method, url, body string, out any) int {
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.app.Test(req)
+	s.Require().NoError(err)
+	if out != nil {
+		json.NewDecoder(resp.Body).Decode(out)
+	}
+	return resp.StatusCode
+}
+
+// kes returns a price of whole shillings in the default store currency
+func kes(shillings int64) models.Money {
+	return models.Money{Amount: shillings * 100, Currency: "KES"}
+}
+
+// asCustomer runs handler with customer stored as the authorized user
+func asCustomer(customer *models.Customer, handler fiber.Handler) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		c.Locals("user", customer)
+		return handler(c)
+	}
+}
+
+// createCustomer creates a customer, first removing one left behind with the same phone
+func createCustomer(t *testing.T, name, phone string) *models.Customer {
+	customer := &models.Customer{Name: name, Phone: phone, Password: "secret"}
+	database.DB.Db.Unscoped().Where("phone = ?", phone).Delete(&models.Customer{})
+	require.NoError(t, database.DB.Db.Create(customer).Error)
+	return customer
+}
+
+// deleteCarts removes the carts of the customer with their items
+func deleteCarts(customer *models.Customer) {
+	carts := database.DB.Db.Unscoped().Model(&models.Cart{}).Select("id").Where("customer_id = ?", customer.ID)
+	database.DB.Db.Unscoped().Where("cart_id IN (?)", carts).Delete(&models.CartItem{})
+	database.DB.Db.Unscoped().Where("customer_id = ?", customer.ID).Delete(&models.Cart{})
+}
+
+// deleteCustomer removes the customer along with their carts and orders
+func deleteCustomer(customer *models.Customer) {
+	deleteCarts(customer)
+	database.DB.Db.Unscoped().Where("customer_id = ?", customer.ID).Delete(&models.Order{})
+	database.DB.Db.Unscoped().Delete(customer)
+}
+
+// createProducts creates the products, first removing any left behind with the same names
+func createProducts(t *testing.T, products ...*models.Product) {
+	for _, product := range products {
+		database.DB.Db.Unscoped().Where("name = ?", product.Name).Delete(&models.Product{})
+		require.NoError(t, database.DB.Db.Create(product).Error)
+	}
+}
+
+// deleteProducts removes the products for good
+func deleteProducts(products ...*models.Product) {
+	for _, product := range products {
+		database.DB.Db.Unscoped().Delete(product)
+	}
+}
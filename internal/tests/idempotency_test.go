@@ -0,0 +1,153 @@
+package tests
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/leroysb/go_kubernetes/internal/api/handlers"
+	"github.com/leroysb/go_kubernetes/internal/api/idempotency"
+	"github.com/leroysb/go_kubernetes/internal/database"
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"github.com/stretchr/testify/suite"
+)
+
+type IdempotencyTestSuite struct {
+	suite.Suite
+	app      *fiber.App
+	calls    int
+	failures int
+}
+
+func (suite *IdempotencyTestSuite) SetupTest() {
+	database.ConnectDB()
+	database.DB.Db.Exec("DELETE FROM idempotency_keys")
+
+	// orders counts the requests it handles and fails while failures is positive
+	suite.calls, suite.failures = 0, 0
+	suite.app = fiber.New()
+	suite.app.Use(idempotency.New())
+	suite.app.Post("/orders", func(c *fiber.Ctx) error {
+		if suite.failures > 0 {
+			suite.failures--
+			return c.Status(503).JSON(fiber.Map{"error": "Unavailable"})
+		}
+		suite.calls++
+		return c.Status(201).JSON(fiber.Map{"id": suite.calls, "body": string(c.Body())})
+	})
+	// login hands out a new token and cart cookie on each call
+	suite.app.Post("/login", func(c *fiber.Ctx) error {
+		suite.calls++
+		c.Set(fiber.HeaderAuthorization, fmt.Sprintf("Bearer token-%d", suite.calls))
+		c.Set(fiber.HeaderETag, fmt.Sprintf(`"%d"`, suite.calls))
+		c.Cookie(&fiber.Cookie{Name: handlers.CartTokenCookie, Value: fmt.Sprintf("cart-%d", suite.calls)})
+		return c.JSON(fiber.Map{"message": "Login successful"})
+	})
+}
+
+func (suite *IdempotencyTestSuite) TearDownTest() {
+	database.DB.Db.Exec("DELETE FROM idempotency_keys")
+}
+
+// post makes a request as a logged in customer
+func (suite *IdempotencyTestSuite) post(url, key, body string) (*http.Response, string) {
+	return suite.postAs(url, key, body, map[string]string{fiber.HeaderAuthorization: "Bearer customer"})
+}
+
+func (suite *IdempotencyTestSuite) postAs(url, key, body string, headers map[string]string) (*http.Response, string) {
+	req, _ := http.NewRequest("POST", url, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	if key != "" {
+		req.Header.Set(idempotency.Header, key)
+	}
+	resp, err := suite.app.Test(req)
+	suite.Require().NoError(err)
+	b, _ := io.ReadAll(resp.Body)
+	return resp, string(b)
+}
+
+// TestReplay checks a retried request is answered from the first response without being handled again
+func (suite *IdempotencyTestSuite) TestReplay() {
+	body := `{"product_id": 1, "quantity": 2}`
+	first, created := suite.post("/orders", "order-1", body)
+	suite.Equal(201, first.StatusCode)
+	suite.Empty(first.Header.Get("Idempotent-Replayed"))
+
+	retry, replayed := suite.post("/orders", "order-1", body)
+	suite.Equal(201, retry.StatusCode)
+	suite.Equal("true", retry.Header.Get("Idempotent-Replayed"))
+	suite.Equal(created, replayed)
+	suite.Equal(first.Header.Get("Content-Type"), retry.Header.Get("Content-Type"))
+	suite.Equal(1, suite.calls)
+
+	mismatch, _ := suite.post("/orders", "order-1", `{"product_id": 1, "quantity": 3}`)
+	suite.Equal(422, mismatch.StatusCode)
+
+	// Without a key, or with another one, the request is made again
+	suite.post("/orders", "order-2", body)
+	suite.post("/orders", "", body)
+	suite.Equal(3, suite.calls)
+}
+
+// TestExpiry checks a key is forgotten once it expires, and that server errors are not stored
+func (suite *IdempotencyTestSuite) TestExpiry() {
+	suite.T().Setenv("IDEMPOTENCY_KEY_TTL", "1ns")
+	suite.post("/orders", "order-1", "{}")
+	retry, _ := suite.post("/orders", "order-1", "{}")
+	suite.Empty(retry.Header.Get("Idempotent-Replayed"))
+	suite.Equal(2, suite.calls)
+
+	idempotency.Purge()
+	var keys int64
+	database.DB.Db.Model(&models.IdempotencyKey{}).Count(&keys)
+	suite.Zero(keys)
+
+	suite.T().Setenv("IDEMPOTENCY_KEY_TTL", "1h")
+	suite.failures = 1
+	failed, _ := suite.post("/orders", "order-2", "{}")
+	suite.Equal(503, failed.StatusCode)
+	ok, _ := suite.post("/orders", "order-2", "{}")
+	suite.Equal(201, ok.StatusCode)
+	suite.Empty(ok.Header.Get("Idempotent-Replayed"))
+}
+
+// TestReplayHeaders checks a retry gets the headers and cookies the first response handed out
+func (suite *IdempotencyTestSuite) TestReplayHeaders() {
+	first, _ := suite.post("/login", "login-1", "{}")
+	retry, _ := suite.post("/login", "login-1", "{}")
+	suite.Equal("true", retry.Header.Get("Idempotent-Replayed"))
+	suite.Equal("Bearer token-1", retry.Header.Get(fiber.HeaderAuthorization))
+	suite.Equal(first.Header.Get(fiber.HeaderETag), retry.Header.Get(fiber.HeaderETag))
+	suite.NotEmpty(first.Header.Values("Set-Cookie"))
+	suite.Equal(first.Header.Values("Set-Cookie"), retry.Header.Values("Set-Cookie"))
+	suite.Equal(1, suite.calls)
+}
+
+// TestAnonymousKeys checks guests' keys are kept apart by their cart token, and that requests with
+// nothing to tell their sender by are not remembered
+func (suite *IdempotencyTestSuite) TestAnonymousKeys() {
+	guest := map[string]string{handlers.CartTokenHeader: "guest-1"}
+	other := map[string]string{handlers.CartTokenHeader: "guest-2"}
+	suite.postAs("/orders", "order-1", "{}", guest)
+	retry, _ := suite.postAs("/orders", "order-1", "{}", guest)
+	suite.Equal("true", retry.Header.Get("Idempotent-Replayed"))
+	elsewhere, _ := suite.postAs("/orders", "order-1", "{}", other)
+	suite.Empty(elsewhere.Header.Get("Idempotent-Replayed"))
+	suite.Equal(2, suite.calls)
+
+	for i := 0; i < 2; i++ {
+		anonymous, _ := suite.postAs("/orders", "order-2", "{}", nil)
+		suite.Empty(anonymous.Header.Get("Idempotent-Replayed"))
+	}
+	suite.Equal(4, suite.calls)
+}
+
+func TestIdempotencyTestSuite(t *testing.T) {
+	suite.Run(t, new(IdempotencyTestSuite))
+}
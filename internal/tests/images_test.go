@@ -0,0 +1,184 @@
+package tests
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/leroysb/go_kubernetes/internal/api/handlers"
+	"github.com/leroysb/go_kubernetes/internal/database"
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"github.com/leroysb/go_kubernetes/internal/storage"
+	"github.com/stretchr/testify/suite"
+)
+
+// objectStore is a stand-in for an S3-compatible service such as MinIO. It keeps objects in memory
+// and rejects requests that are unsigned or whose payload hash does not match the body
+type objectStore struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (s *objectStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	sum := sha256.Sum256(body)
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=minio/") || r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sum[:]) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		s.objects[r.URL.Path] = body
+	case http.MethodDelete:
+		delete(s.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *objectStore) keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for key := range s.objects {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+type ImageTestSuite struct {
+	suite.Suite
+	app     *fiber.App
+	server  *httptest.Server
+	store   *objectStore
+	product *models.Product
+}
+
+func (suite *ImageTestSuite) SetupTest() {
+	database.ConnectDB()
+
+	suite.store = &objectStore{objects: make(map[string][]byte)}
+	suite.server = httptest.NewServer(suite.store)
+	storage.SetDefault(&storage.S3{Endpoint: suite.server.URL, Region: "us-east-1", Bucket: "products", AccessKey: "minio", SecretKey: "minio123"})
+
+	suite.product = &models.Product{Name: "Image Lamp", Price: kes(2500), Stock: 4}
+	createProducts(suite.T(), suite.product)
+
+	suite.app = fiber.New()
+	suite.app.Get("/products/:id", handlers.GetProduct)
+	suite.app.Post("/products/:id/images", handlers.UploadProductImage)
+	suite.app.Put("/products/:id/images/order", handlers.ReorderProductImages)
+	suite.app.Delete("/products/:id/images/:image_id", handlers.DeleteProductImage)
+}
+
+func (suite *ImageTestSuite) TearDownTest() {
+	database.DB.Db.Unscoped().Where("product_id = ?", suite.product.ID).Delete(&models.ProductImage{})
+	deleteProducts(suite.product)
+	storage.SetDefault(nil)
+	suite.server.Close()
+}
+
+func (suite *ImageTestSuite) upload(filename string, data []byte, out any) int {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("image", filename)
+	part.Write(data)
+	form.Close()
+
+	req, _ := http.NewRequest("POST", fmt.Sprintf("/products/%d/images", suite.product.ID), &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	resp, err := suite.app.Test(req)
+	suite.Require().NoError(err)
+	if out != nil {
+		json.NewDecoder(resp.Body).Decode(out)
+	}
+	return resp.StatusCode
+}
+
+func pngImage(width, height int) []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: uint8(x), G: uint8(y), B: 200, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	return buf.Bytes()
+}
+
+// pngClaiming returns a small PNG whose header claims it is width x height
+func pngClaiming(width, height int) []byte {
+	data := pngImage(1, 1)
+	// The IHDR chunk follows the 8 byte signature, its length and type, and ends with a CRC of its type and data
+	binary.BigEndian.PutUint32(data[16:], uint32(width))
+	binary.BigEndian.PutUint32(data[20:], uint32(height))
+	binary.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(data[12:29]))
+	return data
+}
+
+// TestUploadImages checks that uploads are validated, stored with a thumbnail and returned on the product in order
+func (suite *ImageTestSuite) TestUploadImages() {
+	suite.Equal(415, suite.upload("notes.png", []byte("not an image at all"), nil))
+
+	suite.T().Setenv("IMAGE_MAX_BYTES", "64")
+	suite.Equal(413, suite.upload("big.png", pngImage(100, 100), nil))
+	suite.T().Setenv("IMAGE_MAX_BYTES", "")
+	suite.Equal(413, suite.upload("bomb.png", pngClaiming(50000, 50000), nil))
+	suite.T().Setenv("IMAGE_MAX_PIXELS", "5000")
+	suite.Equal(413, suite.upload("big.png", pngImage(100, 100), nil))
+	suite.T().Setenv("IMAGE_MAX_PIXELS", "")
+
+	var first, second models.ProductImage
+	suite.Equal(201, suite.upload("wide.png", pngImage(800, 400), &first))
+	suite.Equal(201, suite.upload("square.png", pngImage(50, 50), &second))
+	suite.Equal("image/png", first.ContentType)
+	suite.Equal(0, first.Position)
+	suite.Equal(1, second.Position)
+	suite.Len(suite.store.keys(), 4)
+
+	// The thumbnail fits in the thumbnail box and keeps the aspect ratio
+	thumbPath := strings.TrimPrefix(first.ThumbnailURL, suite.server.URL)
+	thumb, err := png.DecodeConfig(bytes.NewReader(suite.store.objects[thumbPath]))
+	suite.Require().NoError(err)
+	suite.Equal(320, thumb.Width)
+	suite.Equal(160, thumb.Height)
+
+	req, _ := http.NewRequest("PUT", fmt.Sprintf("/products/%d/images/order", suite.product.ID), strings.NewReader(fmt.Sprintf(`{"image_ids": [%d, %d]}`, second.ID, first.ID)))
+	req.Header.Set("Content-Type", "application/json")
+	resp, _ := suite.app.Test(req)
+	suite.Equal(200, resp.StatusCode)
+
+	var product models.Product
+	resp, _ = suite.app.Test(httptest.NewRequest("GET", fmt.Sprintf("/products/%d", suite.product.ID), nil))
+	json.NewDecoder(resp.Body).Decode(&product)
+	suite.Require().Len(product.Images, 2)
+	suite.Equal(second.ID, product.Images[0].ID)
+	suite.Equal(first.URL, product.Images[1].URL)
+	suite.True(strings.HasPrefix(first.URL, suite.server.URL+"/products/products/"))
+
+	resp, _ = suite.app.Test(httptest.NewRequest("DELETE", fmt.Sprintf("/products/%d/images/%d", suite.product.ID, first.ID), nil))
+	suite.Equal(204, resp.StatusCode)
+	suite.Len(suite.store.keys(), 2)
+}
+
+func TestImageTestSuite(t *testing.T) {
+	suite.Run(t, new(ImageTestSuite))
+}
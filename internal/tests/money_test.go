@@ -0,0 +1,90 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/leroysb/go_kubernetes/internal/api/handlers"
+	"github.com/leroysb/go_kubernetes/internal/database"
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"github.com/stretchr/testify/suite"
+)
+
+type MoneyTestSuite struct {
+	suite.Suite
+}
+
+// TestParseAndFormat checks that decimal amounts convert exactly to and from minor units
+func (suite *MoneyTestSuite) TestParseAndFormat() {
+	price, err := models.ParseMoney("19.9", "KES")
+	suite.Require().NoError(err)
+	suite.Equal(models.Money{Amount: 1990, Currency: "KES"}, price)
+	suite.Equal("KES 19.90", price.String())
+	suite.Equal("KES 59.70", price.Mul(3).String())
+
+	yen, err := models.ParseMoney("1500", "JPY")
+	suite.Require().NoError(err)
+	suite.Equal(int64(1500), yen.Amount)
+	suite.Equal("JPY 1500", yen.String())
+
+	for _, invalid := range []string{"", "1.999", "1e3", "abc", ".5"} {
+		_, err := models.ParseMoney(invalid, "KES")
+		suite.ErrorIs(err, models.ErrInvalidMoney, invalid)
+	}
+}
+
+// TestJSON checks both accepted input forms and the output form
+func (suite *MoneyTestSuite) TestJSON() {
+	var price models.Money
+	suite.Require().NoError(json.Unmarshal([]byte(`12.5`), &price))
+	suite.Equal(models.Money{Amount: 1250, Currency: "KES"}, price)
+
+	suite.Require().NoError(json.Unmarshal([]byte(`{"amount": 999, "currency": "usd"}`), &price))
+	suite.Equal(models.Money{Amount: 999, Currency: "USD"}, price)
+
+	suite.ErrorIs(json.Unmarshal([]byte(`{"currency": "KES"}`), &price), models.ErrInvalidMoney)
+
+	out, err := json.Marshal(kes(20))
+	suite.Require().NoError(err)
+	suite.JSONEq(`{"amount": 2000, "currency": "KES", "formatted": "KES 20.00"}`, string(out))
+}
+
+// TestDisplayPrice checks that a product price is shown converted when a currency is asked for
+func (suite *MoneyTestSuite) TestDisplayPrice() {
+	suite.T().Setenv("CURRENCY_RATES", "USD=0.0077,JPY=1.15")
+
+	database.ConnectDB()
+	product := &models.Product{Name: "Money Basket", Price: kes(1299), Stock: 2}
+	createProducts(suite.T(), product)
+	defer deleteProducts(product)
+
+	app := fiber.New()
+	app.Get("/products/:id", handlers.GetProduct)
+	get := func(currency string) (int, models.Product) {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("/products/%d?currency=%s", product.ID, currency), nil)
+		resp, err := app.Test(req)
+		suite.Require().NoError(err)
+		var out models.Product
+		json.NewDecoder(resp.Body).Decode(&out)
+		return resp.StatusCode, out
+	}
+
+	status, out := get("usd")
+	suite.Equal(200, status)
+	suite.Equal(kes(1299), out.Price)
+	suite.Require().NotNil(out.DisplayPrice)
+	suite.Equal(models.Money{Amount: 1000, Currency: "USD"}, *out.DisplayPrice)
+
+	_, out = get("JPY")
+	suite.Equal(models.Money{Amount: 1494, Currency: "JPY"}, *out.DisplayPrice)
+
+	status, _ = get("XYZ")
+	suite.Equal(400, status)
+}
+
+func TestMoneyTestSuite(t *testing.T) {
+	suite.Run(t, new(MoneyTestSuite))
+}
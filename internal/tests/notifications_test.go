@@ -0,0 +1,91 @@
+package tests
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/leroysb/go_kubernetes/internal/api/handlers"
+	"github.com/leroysb/go_kubernetes/internal/database"
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"github.com/leroysb/go_kubernetes/internal/notifications"
+	"github.com/stretchr/testify/suite"
+)
+
+type NotificationTestSuite struct {
+	suite.Suite
+	app      *fiber.App
+	customer *models.Customer
+}
+
+func (suite *NotificationTestSuite) SetupTest() {
+	database.ConnectDB()
+	suite.T().Setenv("SMS_CALLBACK_TOKEN", "t0ken")
+
+	suite.customer = createCustomer(suite.T(), "Notify", "+254700000026")
+
+	suite.app = fiber.New()
+	suite.app.Post("/sms/inbound", handlers.InboundSMS)
+}
+
+func (suite *NotificationTestSuite) TearDownTest() {
+	database.DB.Db.Unscoped().Where("customer_id = ?", suite.customer.ID).Delete(&models.NotificationPreference{})
+	deleteCustomer(suite.customer)
+}
+
+// inbound forwards a message from the customer with the gateway's token, returning the status code
+func (suite *NotificationTestSuite) inbound(text, token string) int {
+	form := url.Values{"from": {suite.customer.Phone}, "text": {text}}
+	req, _ := http.NewRequest("POST", "/sms/inbound?token="+token, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := suite.app.Test(req)
+	suite.Require().NoError(err)
+	database.DB.Db.First(suite.customer, suite.customer.ID)
+	return resp.StatusCode
+}
+
+// TestPreferencesDefaultToEnabled checks that a customer without stored preferences receives everything
+func (suite *NotificationTestSuite) TestPreferencesDefaultToEnabled() {
+	prefs, err := notifications.Preferences(suite.customer.ID)
+	suite.Require().NoError(err)
+	suite.True(prefs[notifications.EventOrder][notifications.ChannelSMS])
+	suite.True(notifications.Allowed(suite.customer, notifications.EventOrder, notifications.ChannelSMS))
+}
+
+// TestSetPreferences checks that a disabled event/channel pair is honored
+func (suite *NotificationTestSuite) TestSetPreferences() {
+	err := notifications.SetPreferences(suite.customer.ID, map[string]map[string]bool{
+		notifications.EventOrder: {notifications.ChannelSMS: false},
+	})
+	suite.Require().NoError(err)
+
+	suite.False(notifications.Allowed(suite.customer, notifications.EventOrder, notifications.ChannelSMS))
+	suite.True(notifications.Allowed(suite.customer, notifications.EventSignup, notifications.ChannelSMS))
+
+	err = notifications.SetPreferences(suite.customer.ID, map[string]map[string]bool{"birthday": {notifications.ChannelSMS: true}})
+	suite.ErrorIs(err, notifications.ErrUnknownEvent)
+}
+
+// TestInboundStopAndStart checks that STOP and START keywords toggle the SMS opt-out, and that only
+// messages carrying the gateway's token are acted on
+func (suite *NotificationTestSuite) TestInboundStopAndStart() {
+	suite.Equal(401, suite.inbound("STOP", "guess"))
+	suite.T().Setenv("SMS_CALLBACK_TOKEN", "")
+	suite.Equal(401, suite.inbound("STOP", ""))
+	suite.False(suite.customer.SMSOptOut)
+	suite.T().Setenv("SMS_CALLBACK_TOKEN", "t0ken")
+
+	suite.Equal(200, suite.inbound(" stop ", "t0ken"))
+	suite.True(suite.customer.SMSOptOut)
+	suite.False(notifications.Allowed(suite.customer, notifications.EventOrder, notifications.ChannelSMS))
+
+	suite.Equal(200, suite.inbound("START", "t0ken"))
+	suite.False(suite.customer.SMSOptOut)
+	suite.True(notifications.Allowed(suite.customer, notifications.EventOrder, notifications.ChannelSMS))
+}
+
+func TestNotificationTestSuite(t *testing.T) {
+	suite.Run(t, new(NotificationTestSuite))
+}
@@ -0,0 +1,129 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/leroysb/go_kubernetes/internal/api/handlers"
+	"github.com/leroysb/go_kubernetes/internal/database"
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"github.com/leroysb/go_kubernetes/internal/outbox"
+	"github.com/leroysb/go_kubernetes/internal/webhooks"
+	"github.com/stretchr/testify/suite"
+)
+
+// recordingSink remembers the idempotency keys it accepted and fails while failures is positive
+type recordingSink struct {
+	name     string
+	keys     []string
+	failures int
+}
+
+func (s *recordingSink) Name() string {
+	return s.name
+}
+
+func (s *recordingSink) Publish(ctx context.Context, event outbox.Event) error {
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("sink unavailable")
+	}
+	s.keys = append(s.keys, event.IdempotencyKey)
+	return nil
+}
+
+type OutboxTestSuite struct {
+	suite.Suite
+	app      *fiber.App
+	customer *models.Customer
+	product  *models.Product
+}
+
+func (suite *OutboxTestSuite) SetupTest() {
+	database.ConnectDB()
+	database.DB.Db.Exec("DELETE FROM outbox_events")
+
+	suite.customer = createCustomer(suite.T(), "Outbox", "+254700000029")
+
+	suite.product = &models.Product{Name: "Outbox Mug", Price: kes(300), Stock: 8}
+	createProducts(suite.T(), suite.product)
+
+	suite.app = fiber.New()
+	suite.app.Post("/customers/orders", asCustomer(suite.customer, handlers.CreateOrder))
+}
+
+func (suite *OutboxTestSuite) TearDownTest() {
+	deleteCustomer(suite.customer)
+	deleteProducts(suite.product)
+	database.DB.Db.Exec("DELETE FROM outbox_events")
+}
+
+func (suite *OutboxTestSuite) order(quantity string) int {
+	body := `{"product_id": ` + strconv.FormatUint(uint64(suite.product.ID), 10) + `, "quantity": ` + quantity + `}`
+	req, _ := http.NewRequest("POST", "/customers/orders", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := suite.app.Test(req)
+	suite.Require().NoError(err)
+	return resp.StatusCode
+}
+
+func (suite *OutboxTestSuite) events() []models.OutboxEvent {
+	var events []models.OutboxEvent
+	database.DB.Db.Order("id").Find(&events)
+	return events
+}
+
+// TestOrderWritesOutbox checks that the order, the stock change and the events are committed together
+func (suite *OutboxTestSuite) TestOrderWritesOutbox() {
+	suite.Equal(200, suite.order("8"))
+
+	var product models.Product
+	database.DB.Db.First(&product, suite.product.ID)
+	suite.Equal(0, product.Stock)
+
+	events := suite.events()
+	suite.Require().Len(events, 2)
+	suite.Equal(webhooks.EventOrderCreated, events[0].EventType)
+	suite.Equal(webhooks.EventProductStockLow, events[1].EventType)
+	suite.Nil(events[0].PublishedAt)
+
+	// Nothing is written when the stock check inside the transaction fails
+	suite.Equal(400, suite.order("1"))
+	suite.Len(suite.events(), 2)
+}
+
+// TestRelayRetriesOnlyFailedSinks checks at-least-once delivery without re-sending to sinks that succeeded
+func (suite *OutboxTestSuite) TestRelayRetriesOnlyFailedSinks() {
+	suite.Equal(200, suite.order("1"))
+
+	healthy := &recordingSink{name: "healthy"}
+	flaky := &recordingSink{name: "flaky", failures: 1}
+	relay := outbox.NewRelay(healthy, flaky)
+	relay.Backoff = 0
+
+	published, err := relay.RunOnce(context.Background())
+	suite.Require().NoError(err)
+	suite.Equal(0, published)
+	suite.Len(healthy.keys, 1)
+	suite.Empty(flaky.keys)
+
+	published, err = relay.RunOnce(context.Background())
+	suite.Require().NoError(err)
+	suite.Equal(1, published)
+	suite.Len(healthy.keys, 1)
+	suite.Equal(healthy.keys, flaky.keys)
+
+	events := suite.events()
+	suite.Require().Len(events, 1)
+	suite.NotNil(events[0].PublishedAt)
+	suite.Equal(2, events[0].Attempts)
+}
+
+func TestOutboxTestSuite(t *testing.T) {
+	suite.Run(t, new(OutboxTestSuite))
+}
@@ -0,0 +1,379 @@
+package tests
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/leroysb/go_kubernetes/internal/api/handlers"
+	"github.com/leroysb/go_kubernetes/internal/database"
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"github.com/leroysb/go_kubernetes/internal/payments"
+	"github.com/leroysb/go_kubernetes/internal/webhooks"
+	"github.com/stretchr/testify/suite"
+)
+
+// daraja stands in for the Daraja API. It records the STK Pushes and B2C payments it was sent and
+// answers queries with queryResult, or as still processing while that is empty. STK Pushes are
+// turned down while rejectPushes is set, and B2C payments while rejectPayouts is
+type daraja struct {
+	mu            sync.Mutex
+	pushes        []map[string]any
+	payouts       []map[string]any
+	queryResult   string
+	rejectPushes  bool
+	rejectPayouts bool
+}
+
+func (d *daraja) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if r.URL.Path == "/oauth/v1/generate" {
+		if key, secret, ok := r.BasicAuth(); !ok || key != "key" || secret != "secret" {
+			w.WriteHeader(400)
+			return
+		}
+		fmt.Fprint(w, `{"access_token": "token", "expires_in": "3599"}`)
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(401)
+		fmt.Fprint(w, `{"errorCode": "404.001.03", "errorMessage": "Invalid Access Token"}`)
+		return
+	}
+
+	var body map[string]any
+	json.NewDecoder(r.Body).Decode(&body)
+	if r.URL.Path == "/mpesa/b2c/v1/paymentrequest" && d.rejectPayouts {
+		w.WriteHeader(400)
+		fmt.Fprint(w, `{"errorCode": "400.002.02", "errorMessage": "Bad Request - Invalid Initiator"}`)
+		return
+	}
+	if r.URL.Path == "/mpesa/b2c/v1/paymentrequest" {
+		d.payouts = append(d.payouts, body)
+		n := len(d.payouts)
+		fmt.Fprintf(w, `{"ConversationID": "AG_%d", "OriginatorConversationID": "origin-%d", "ResponseCode": "0", "ResponseDescription": "Accept the service request successfully."}`, n, n)
+		return
+	}
+	password, _ := base64.StdEncoding.DecodeString(body["Password"].(string))
+	if string(password) != "174379passkey"+body["Timestamp"].(string) {
+		w.WriteHeader(400)
+		fmt.Fprint(w, `{"errorCode": "400.002.02", "errorMessage": "Bad Request - Invalid Password"}`)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/mpesa/stkpush/v1/processrequest":
+		if d.rejectPushes {
+			w.WriteHeader(400)
+			fmt.Fprint(w, `{"errorCode": "400.002.02", "errorMessage": "Bad Request - Invalid PhoneNumber"}`)
+			return
+		}
+		d.pushes = append(d.pushes, body)
+		n := len(d.pushes)
+		fmt.Fprintf(w, `{"MerchantRequestID": "merchant-%d", "CheckoutRequestID": "ws_CO_%d", "ResponseCode": "0", "ResponseDescription": "Success. Request accepted for processing", "CustomerMessage": "Success. Request accepted for processing"}`, n, n)
+	case "/mpesa/stkpushquery/v1/query":
+		if d.queryResult == "" {
+			w.WriteHeader(500)
+			fmt.Fprint(w, `{"errorCode": "500.001.1001", "errorMessage": "The transaction is being processed"}`)
+			return
+		}
+		fmt.Fprintf(w, `{"CheckoutRequestID": %q, "ResultCode": %q, "ResultDesc": "Result"}`, body["CheckoutRequestID"], d.queryResult)
+	default:
+		w.WriteHeader(404)
+	}
+}
+
+type PaymentTestSuite struct {
+	apiSuite
+	daraja   *daraja
+	server   *httptest.Server
+	customer *models.Customer
+	product  *models.Product
+}
+
+func (suite *PaymentTestSuite) SetupTest() {
+	database.ConnectDB()
+
+	suite.daraja = &daraja{}
+	suite.server = httptest.NewServer(suite.daraja)
+	suite.T().Setenv("MPESA_BASE_URL", suite.server.URL)
+	suite.T().Setenv("MPESA_CONSUMER_KEY", "key")
+	suite.T().Setenv("MPESA_CONSUMER_SECRET", "secret")
+	suite.T().Setenv("MPESA_SHORTCODE", "174379")
+	suite.T().Setenv("MPESA_PASSKEY", "passkey")
+	suite.T().Setenv("MPESA_CALLBACK_URL", "https://shop.example/api/v1/payments/mpesa/callback?token=t0ken")
+	suite.T().Setenv("MPESA_CALLBACK_TOKEN", "t0ken")
+
+	suite.customer = createCustomer(suite.T(), "Payer", "+254700000041")
+
+	suite.product = &models.Product{Name: "Mpesa Kettle", Price: models.NewMoney(1999), Stock: 10}
+	createProducts(suite.T(), suite.product)
+
+	suite.app = fiber.New()
+	suite.app.Post("/customers/orders/:id/payments", asCustomer(suite.customer, handlers.StartPayment))
+	suite.app.Get("/customers/payments/:id", asCustomer(suite.customer, handlers.GetPayment))
+	suite.app.Post("/admin/payments/:id/confirm", handlers.ConfirmPayment)
+	suite.app.Post("/payments/mpesa/callback", handlers.MpesaCallback)
+	suite.app.Post("/admin/orders/:id/refunds", handlers.CreateRefund)
+	suite.app.Get("/admin/orders/:id/refunds", handlers.GetRefunds)
+	suite.app.Post("/payments/mpesa/b2c/result", handlers.MpesaB2CResult)
+	suite.app.Post("/payments/mpesa/b2c/timeout", handlers.MpesaB2CTimeout)
+}
+
+func (suite *PaymentTestSuite) TearDownTest() {
+	suite.server.Close()
+	database.DB.Db.Unscoped().Where("order_id IN (?)", database.DB.Db.Unscoped().Model(&models.Order{}).Select("id").Where("customer_id = ?", suite.customer.ID)).Delete(&models.Refund{})
+	database.DB.Db.Unscoped().Where("order_id IN (?)", database.DB.Db.Unscoped().Model(&models.Order{}).Select("id").Where("customer_id = ?", suite.customer.ID)).Delete(&models.Payment{})
+	deleteCustomer(suite.customer)
+	deleteProducts(suite.product)
+	database.DB.Db.Exec("DELETE FROM outbox_events")
+}
+
+// placeOrder creates an order of one item awaiting payment directly, as checkout is covered elsewhere
+func (suite *PaymentTestSuite) placeOrder() *models.Order {
+	return suite.placeOrderOf(1)
+}
+
+func (suite *PaymentTestSuite) placeOrderOf(quantity int) *models.Order {
+	amount := models.Money{Amount: suite.product.Price.Amount * int64(quantity), Currency: suite.product.Price.Currency}
+	order := &models.Order{CustomerID: suite.customer.ID, ProductID: suite.product.ID, Quantity: quantity, Amount: amount, Time: "-", Status: "ordered"}
+	suite.Require().NoError(database.DB.Db.Create(order).Error)
+	return order
+}
+
+// pay starts paying for the order, by M-Pesa unless body names another provider
+func (suite *PaymentTestSuite) pay(order *models.Order, body string) models.Payment {
+	var payment models.Payment
+	suite.Require().Equal(202, suite.request("POST", fmt.Sprintf("/customers/orders/%d/payments", order.ID), body, &payment))
+	return payment
+}
+
+// check fetches a payment the way a customer would
+func (suite *PaymentTestSuite) check(payment models.Payment) models.Payment {
+	var checked models.Payment
+	suite.Require().Equal(200, suite.request("GET", fmt.Sprintf("/customers/payments/%d", payment.ID), "", &checked))
+	return checked
+}
+
+// callback posts a Daraja callback for the payment, with metadata when it went through. The references
+// Daraja calls back with are read from the database, as customers are not shown them
+func (suite *PaymentTestSuite) callback(payment models.Payment, code int, amount int, receipt string) int {
+	if payment.ID != 0 {
+		suite.Require().NoError(database.DB.Db.First(&payment, payment.ID).Error)
+	}
+	metadata := ""
+	if code == payments.ResultSuccess {
+		metadata = fmt.Sprintf(`, "CallbackMetadata": {"Item": [{"Name": "Amount", "Value": %d}, {"Name": "MpesaReceiptNumber", "Value": %q}, {"Name": "Balance"}, {"Name": "TransactionDate", "Value": 20261019101500}, {"Name": "PhoneNumber", "Value": 254700000041}]}`, amount, receipt)
+	}
+	body := fmt.Sprintf(`{"Body": {"stkCallback": {"MerchantRequestID": %q, "CheckoutRequestID": %q, "ResultCode": %d, "ResultDesc": "Result"%s}}}`, payment.Details["merchant_request_id"], payment.ProviderReference, code, metadata)
+	return suite.request("POST", "/payments/mpesa/callback?token=t0ken", body, nil)
+}
+
+func (suite *PaymentTestSuite) status(order *models.Order) string {
+	var stored models.Order
+	database.DB.Db.First(&stored, order.ID)
+	return stored.Status
+}
+
+// TestPaidCallback checks that a successful M-Pesa callback marks the order paid once
+func (suite *PaymentTestSuite) TestPaidCallback() {
+	order := suite.placeOrder()
+	url := fmt.Sprintf("/customers/orders/%d/payments", order.ID)
+	suite.Equal(400, suite.request("POST", url, `{"phone": "12345"}`, nil))
+	suite.Equal(400, suite.request("POST", url, `{"provider": "bitcoin"}`, nil))
+
+	var started map[string]any
+	suite.Require().Equal(202, suite.request("POST", url, "", &started))
+	suite.NotContains(started, "provider_reference")
+	suite.NotContains(started, "details")
+	var payment models.Payment
+	suite.Require().NoError(database.DB.Db.First(&payment, uint(started["ID"].(float64))).Error)
+	suite.Equal("mpesa", payment.Provider)
+	suite.Equal(payments.StatusPending, payment.Status)
+	suite.Equal(kes(20), payment.Amount)
+	suite.Nil(payment.PaidAmount)
+
+	// Daraja takes whole shillings, so KES 19.99 is asked for as 20
+	suite.Require().Len(suite.daraja.pushes, 1)
+	push := suite.daraja.pushes[0]
+	suite.Equal(float64(20), push["Amount"])
+	suite.Equal("254700000041", push["PhoneNumber"])
+	suite.Equal(fmt.Sprintf("ORDER%d", order.ID), push["AccountReference"])
+
+	suite.Equal(409, suite.request("POST", url, "", nil))
+
+	unknown := models.Payment{ProviderReference: "ws_CO_unknown", Details: map[string]string{"merchant_request_id": "merchant-1"}}
+	suite.Equal(404, suite.callback(unknown, 0, 20, "TJK0000000"))
+	suite.Equal(200, suite.callback(payment, payments.ResultSuccess, 20, "TJK1A2B3C4"))
+	suite.Equal("paid", suite.status(order))
+
+	paid := suite.check(payment)
+	suite.Equal(payments.StatusPaid, paid.Status)
+	suite.Equal("TJK1A2B3C4", *paid.Receipt)
+
+	var events int64
+	database.DB.Db.Model(&models.OutboxEvent{}).Where("event_type = ? AND aggregate_id = ?", webhooks.EventOrderStatusChanged, order.ID).Count(&events)
+	suite.Equal(int64(1), events)
+
+	// Daraja may send the same callback again
+	suite.Equal(200, suite.callback(payment, payments.ResultSuccess, 20, "TJK1A2B3C4"))
+	database.DB.Db.Model(&models.OutboxEvent{}).Where("event_type = ? AND aggregate_id = ?", webhooks.EventOrderStatusChanged, order.ID).Count(&events)
+	suite.Equal(int64(1), events)
+	suite.Equal(400, suite.request("POST", url, "", nil))
+}
+
+// TestUnpaidCallbacks checks cancelled and mismatched payments leave the order awaiting payment
+func (suite *PaymentTestSuite) TestUnpaidCallbacks() {
+	order := suite.placeOrder()
+	payment := suite.pay(order, "")
+	suite.Equal(200, suite.callback(payment, payments.ResultCancelled, 0, ""))
+	suite.Equal("ordered", suite.status(order))
+	suite.Equal(payments.StatusCancelled, suite.check(payment).Status)
+
+	// The customer can try again after cancelling, and paying too little does not settle the order
+	payment = suite.pay(order, "")
+	suite.Equal(200, suite.callback(payment, payments.ResultSuccess, 10, "TJK5D6E7F8"))
+	suite.Equal("ordered", suite.status(order))
+	mismatched := suite.check(payment)
+	suite.Equal(payments.StatusMismatch, mismatched.Status)
+	suite.Equal("paid KES 10.00 instead of KES 20.00", mismatched.StatusReason)
+
+	// Callbacks must carry the token, and are refused while none is set
+	suite.T().Setenv("MPESA_CALLBACK_TOKEN", "s3cret")
+	suite.Equal(401, suite.callback(payment, payments.ResultSuccess, 20, "TJK5D6E7F8"))
+	suite.T().Setenv("MPESA_CALLBACK_TOKEN", "")
+	suite.Equal(401, suite.request("POST", "/payments/mpesa/callback", "{}", nil))
+}
+
+// TestTimeout checks that an overdue M-Pesa payment is queried, and that a late callback still pays the order
+func (suite *PaymentTestSuite) TestTimeout() {
+	suite.T().Setenv("MPESA_TIMEOUT", "1ns")
+	order := suite.placeOrder()
+	payment := suite.pay(order, "")
+	suite.Equal(payments.StatusPending, suite.check(payment).Status)
+
+	suite.daraja.queryResult = "1037"
+	payments.CheckExpired()
+	suite.Equal(payments.StatusTimeout, suite.check(payment).Status)
+	suite.Equal("ordered", suite.status(order))
+
+	suite.Equal(200, suite.callback(payment, payments.ResultSuccess, 20, "TJK9G8H7I6"))
+	suite.Equal("paid", suite.status(order))
+}
+
+// TestManualPayment checks that cash on delivery stays pending until it is confirmed
+func (suite *PaymentTestSuite) TestManualPayment() {
+	order := suite.placeOrder()
+	payment := suite.pay(order, `{"provider": "manual"}`)
+	suite.Equal("manual", payment.Provider)
+	suite.Equal(suite.product.Price, payment.Amount)
+	var stored models.Payment
+	database.DB.Db.First(&stored, payment.ID)
+	suite.True(strings.HasPrefix(stored.ProviderReference, "COD-"))
+	suite.Empty(suite.daraja.pushes)
+	suite.Equal(409, suite.request("POST", fmt.Sprintf("/customers/orders/%d/payments", order.ID), "", nil))
+
+	suite.Equal(payments.StatusPending, suite.check(payment).Status)
+	suite.Equal("ordered", suite.status(order))
+
+	var confirmed models.Payment
+	url := fmt.Sprintf("/admin/payments/%d/confirm", payment.ID)
+	suite.Equal(200, suite.request("POST", url, `{"receipt": "R-0042"}`, &confirmed))
+	suite.Equal(payments.StatusPaid, confirmed.Status)
+	suite.Equal("R-0042", *confirmed.Receipt)
+	suite.Equal("paid", suite.status(order))
+	suite.Equal(409, suite.request("POST", url, "", nil))
+}
+
+// TestConcurrentStart checks an order paid for by several requests at once gets one pending payment
+func (suite *PaymentTestSuite) TestConcurrentStart() {
+	order := suite.placeOrder()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest("POST", fmt.Sprintf("/customers/orders/%d/payments", order.ID), strings.NewReader(`{"provider": "manual"}`))
+			req.Header.Set("Content-Type", "application/json")
+			suite.app.Test(req, -1)
+		}()
+	}
+	wg.Wait()
+
+	var pending int64
+	database.DB.Db.Model(&models.Payment{}).Where("order_id = ? AND status = ?", order.ID, payments.StatusPending).Count(&pending)
+	suite.Equal(int64(1), pending)
+}
+
+// TestRejectedStart checks a payment is recorded before M-Pesa is asked for it, and that one M-Pesa
+// turns down is failed and does not stop the customer trying again
+func (suite *PaymentTestSuite) TestRejectedStart() {
+	order := suite.placeOrder()
+	suite.daraja.rejectPushes = true
+	suite.Equal(502, suite.request("POST", fmt.Sprintf("/customers/orders/%d/payments", order.ID), "", nil))
+	var failed []models.Payment
+	database.DB.Db.Where("order_id = ?", order.ID).Find(&failed)
+	suite.Require().Len(failed, 1)
+	suite.Equal(payments.StatusFailed, failed[0].Status)
+	suite.NotEmpty(failed[0].StatusReason)
+
+	suite.daraja.rejectPushes = false
+	payment := suite.pay(order, "")
+	suite.Equal(200, suite.callback(payment, payments.ResultSuccess, 20, "TJK1A2B3C4"))
+	suite.Equal("paid", suite.status(order))
+}
+
+// TestRetryAfterTimeout checks a payment is only started again once M-Pesa says the overdue one
+// did not go through, and that one paid after the order was paid for is late and can be refunded
+func (suite *PaymentTestSuite) TestRetryAfterTimeout() {
+	suite.T().Setenv("MPESA_TIMEOUT", "1ns")
+	order := suite.placeOrder()
+	first := suite.pay(order, "")
+	url := fmt.Sprintf("/customers/orders/%d/payments", order.ID)
+
+	// M-Pesa is still processing the first payment
+	suite.Equal(409, suite.request("POST", url, "", nil))
+	suite.Len(suite.daraja.pushes, 1)
+
+	suite.daraja.queryResult = "1037"
+	second := suite.pay(order, "")
+	suite.Len(suite.daraja.pushes, 2)
+	suite.Equal(payments.StatusTimeout, suite.check(first).Status)
+
+	// A timed out payment is asked about again before another is started
+	suite.daraja.queryResult = ""
+	suite.Equal(409, suite.request("POST", url, "", nil))
+	suite.Len(suite.daraja.pushes, 2)
+
+	suite.Equal(200, suite.callback(second, payments.ResultSuccess, 20, "TJK1A2B3C4"))
+	suite.Equal(200, suite.callback(first, payments.ResultSuccess, 20, "TJK5D6E7F8"))
+	suite.Equal("paid", suite.status(order))
+	late := suite.check(first)
+	suite.Equal(payments.StatusLate, late.Status)
+	suite.Equal("TJK5D6E7F8", *late.Receipt)
+
+	code, _ := suite.refund(order, fmt.Sprintf(`{"payment_id": %d, "quantity": 1}`, first.ID))
+	suite.Equal(400, code)
+	code, _ = suite.refund(order, fmt.Sprintf(`{"payment_id": %d}`, second.ID))
+	suite.Equal(400, code)
+	code, refund := suite.refund(order, fmt.Sprintf(`{"payment_id": %d}`, first.ID))
+	suite.Require().Equal(201, code)
+	suite.Equal(first.ID, refund.PaymentID)
+	suite.Equal(kes(20), refund.Amount)
+	suite.Equal(200, suite.b2cResult(refund, payments.ResultSuccess, "UJK1A2B3C4", false))
+	suite.Equal("paid", suite.status(order))
+	suite.Equal(int64(1), suite.refundEvents(order))
+}
+
+func TestPaymentTestSuite(t *testing.T) {
+	suite.Run(t, new(PaymentTestSuite))
+}
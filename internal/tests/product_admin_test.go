@@ -0,0 +1,80 @@
+package tests
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/leroysb/go_kubernetes/internal/api/handlers"
+	"github.com/leroysb/go_kubernetes/internal/database"
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"github.com/stretchr/testify/suite"
+)
+
+type ProductAdminTestSuite struct {
+	apiSuite
+	customer      *models.Customer
+	ordered, bare *models.Product
+}
+
+func (suite *ProductAdminTestSuite) SetupTest() {
+	database.ConnectDB()
+
+	suite.customer = createCustomer(suite.T(), "Admin", "+254700000037")
+
+	suite.ordered = &models.Product{Name: "Admin Ordered Chair", Price: kes(4000), Stock: 5}
+	suite.bare = &models.Product{Name: "Admin Bare Stool", Price: kes(900), Stock: 5}
+	createProducts(suite.T(), suite.ordered, suite.bare)
+
+	suite.app = fiber.New()
+	suite.app.Post("/products", handlers.CreateProduct)
+	suite.app.Delete("/products/:id", handlers.DeleteProduct)
+	suite.app.Post("/customers/orders", asCustomer(suite.customer, handlers.CreateOrder))
+	suite.app.Get("/admin/products/deleted", handlers.GetDeletedProducts)
+	suite.app.Post("/admin/products/:id/restore", handlers.RestoreProduct)
+	suite.app.Delete("/admin/products/:id", handlers.PurgeProduct)
+}
+
+func (suite *ProductAdminTestSuite) TearDownTest() {
+	deleteCustomer(suite.customer)
+	deleteProducts(suite.ordered, suite.bare)
+	database.DB.Db.Exec("DELETE FROM outbox_events")
+}
+
+// TestDeleteRestorePurge checks the life of a deleted product from deletion to restore or purge
+func (suite *ProductAdminTestSuite) TestDeleteRestorePurge() {
+	order := fmt.Sprintf(`{"product_id": %d, "quantity": 1}`, suite.ordered.ID)
+	suite.Equal(200, suite.request("POST", "/customers/orders", order, nil))
+
+	suite.Equal(204, suite.request("DELETE", fmt.Sprintf("/products/%d", suite.ordered.ID), "", nil))
+	suite.Equal(204, suite.request("DELETE", fmt.Sprintf("/products/%d", suite.bare.ID), "", nil))
+
+	var page struct {
+		Data []models.Product `json:"data"`
+	}
+	suite.Equal(200, suite.request("GET", "/admin/products/deleted", "", &page))
+	suite.Contains(names(page.Data), "Admin Ordered Chair")
+
+	// Deleted products cannot be ordered and keep their name reserved
+	suite.Equal(400, suite.request("POST", "/customers/orders", order, nil))
+	var conflict map[string]any
+	suite.Equal(409, suite.request("POST", "/products", `{"name": "Admin Bare Stool", "price": 900, "stock": 1}`, &conflict))
+	suite.EqualValues(suite.bare.ID, conflict["deleted_product_id"])
+
+	// A product with orders can only be restored
+	suite.Equal(409, suite.request("DELETE", fmt.Sprintf("/admin/products/%d", suite.ordered.ID), "", nil))
+	var restored models.Product
+	suite.Equal(200, suite.request("POST", fmt.Sprintf("/admin/products/%d/restore", suite.ordered.ID), "", &restored))
+	suite.False(restored.DeletedAt.Valid)
+	suite.Equal(404, suite.request("POST", fmt.Sprintf("/admin/products/%d/restore", suite.ordered.ID), "", nil))
+	suite.Equal(404, suite.request("DELETE", fmt.Sprintf("/admin/products/%d", suite.ordered.ID), "", nil))
+
+	suite.Equal(204, suite.request("DELETE", fmt.Sprintf("/admin/products/%d", suite.bare.ID), "", nil))
+	var count int64
+	database.DB.Db.Unscoped().Model(&models.Product{}).Where("id = ?", suite.bare.ID).Count(&count)
+	suite.Zero(count)
+}
+
+func TestProductAdminTestSuite(t *testing.T) {
+	suite.Run(t, new(ProductAdminTestSuite))
+}
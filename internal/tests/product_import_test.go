@@ -0,0 +1,164 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/leroysb/go_kubernetes/internal/api/handlers"
+	"github.com/leroysb/go_kubernetes/internal/api/routes"
+	"github.com/leroysb/go_kubernetes/internal/database"
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"github.com/stretchr/testify/suite"
+)
+
+type importReport struct {
+	DryRun  bool `json:"dry_run"`
+	Rows    int  `json:"rows"`
+	Created int  `json:"created"`
+	Updated int  `json:"updated"`
+	Errors  []struct {
+		Row   int    `json:"row"`
+		Error string `json:"error"`
+	} `json:"errors"`
+}
+
+type ProductImportTestSuite struct {
+	suite.Suite
+	app *fiber.App
+}
+
+func (suite *ProductImportTestSuite) SetupTest() {
+	database.ConnectDB()
+	suite.cleanup()
+
+	suite.app = fiber.New()
+	suite.app.Post("/products/import", handlers.ImportProducts)
+	suite.app.Get("/products/export", handlers.ExportProducts)
+}
+
+func (suite *ProductImportTestSuite) TearDownTest() {
+	suite.cleanup()
+}
+
+func (suite *ProductImportTestSuite) cleanup() {
+	var ids []uint
+	database.DB.Db.Unscoped().Model(&models.Product{}).Where("name LIKE ?", "Import %").Pluck("id", &ids)
+	if len(ids) > 0 {
+		database.DB.Db.Unscoped().Where("product_id IN ?", ids).Delete(&models.ProductVariant{})
+		database.DB.Db.Unscoped().Delete(&models.Product{}, ids)
+	}
+}
+
+func (suite *ProductImportTestSuite) importFile(query, contentType, body string) (int, importReport) {
+	req, _ := http.NewRequest("POST", "/products/import"+query, strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	resp, err := suite.app.Test(req)
+	suite.Require().NoError(err)
+
+	var report importReport
+	json.NewDecoder(resp.Body).Decode(&report)
+	return resp.StatusCode, report
+}
+
+func (suite *ProductImportTestSuite) product(name string) models.Product {
+	var product models.Product
+	database.DB.Db.Preload("Variants").Where("name = ?", name).First(&product)
+	return product
+}
+
+// TestImportCSV checks validation, dry runs and upserts by name and SKU
+func (suite *ProductImportTestSuite) TestImportCSV() {
+	invalid := "name,sku,price,stock\nImport Mug,,300,4\n,,100,1\nImport Bowl,,abc,2\n"
+	status, report := suite.importFile("?dry_run=true", "text/csv", invalid)
+	suite.Equal(200, status)
+	suite.Equal(1, report.Created)
+	suite.Require().Len(report.Errors, 2)
+	suite.Equal(4, report.Errors[0].Row)
+	suite.Equal(3, report.Errors[1].Row)
+	suite.Zero(suite.product("Import Mug").ID)
+
+	status, _ = suite.importFile("", "text/csv", invalid)
+	suite.Equal(422, status)
+	suite.Zero(suite.product("Import Mug").ID)
+
+	valid := "name,sku,price,stock,options\n" +
+		"Import Mug,,300,0,\n" +
+		"Import Tee,IMP-S,1000,2,\"{\"\"size\"\":\"\"S\"\"}\"\n" +
+		"Import Tee,IMP-L,1200,3,\"{\"\"size\"\":\"\"L\"\"}\"\n"
+	status, report = suite.importFile("", "text/csv", valid)
+	suite.Equal(200, status)
+	suite.Equal(3, report.Created)
+	suite.Empty(report.Errors)
+
+	tee := suite.product("Import Tee")
+	suite.Equal(5, tee.Stock)
+	suite.Require().Len(tee.Variants, 2)
+	suite.Nil(tee.Variants[0].Price)
+	suite.Equal(kes(1200), *tee.Variants[1].Price)
+	suite.Equal(0, suite.product("Import Mug").Stock)
+
+	// Importing again updates the existing rows in place
+	status, report = suite.importFile("", "application/x-ndjson", `{"name": "Import Mug", "price": 350, "stock": 9}`+"\n"+`{"name": "Import Tee", "sku": "IMP-S", "price": 1000, "stock": 7}`)
+	suite.Equal(200, status)
+	suite.Equal(2, report.Updated)
+	suite.Equal(kes(350), suite.product("Import Mug").Price)
+	suite.Equal(10, suite.product("Import Tee").Stock)
+}
+
+// TestExportRoundTrip checks that an export can be imported again without changes
+func (suite *ProductImportTestSuite) TestExportRoundTrip() {
+	lines := `{"name": "Import Lamp", "price": 2500, "stock": 3}` + "\n" + `{"name": "Import Sock", "sku": "IMP-SOCK", "price": 150, "stock": 12, "options": {"colour": "red"}}`
+	status, _ := suite.importFile("?format=jsonl", "text/plain", lines)
+	suite.Equal(200, status)
+
+	for _, format := range []string{"csv", "jsonl"} {
+		req, _ := http.NewRequest("GET", "/products/export?format="+format, nil)
+		resp, err := suite.app.Test(req)
+		suite.Require().NoError(err)
+		body, _ := io.ReadAll(resp.Body)
+		suite.Contains(resp.Header.Get("Content-Disposition"), "products."+format)
+		suite.Contains(string(body), "Import Lamp")
+		suite.Contains(string(body), "IMP-SOCK")
+
+		status, report := suite.importFile("?dry_run=true&format="+format, "text/plain", string(body))
+		suite.Equal(200, status)
+		suite.Empty(report.Errors)
+		suite.Zero(report.Created)
+	}
+}
+
+// TestImportNeedsAdmin checks products can neither be imported without a token nor with a customer's
+func (suite *ProductImportTestSuite) TestImportNeedsAdmin() {
+	hydra := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"active": true, "scope": "read"}`)
+	}))
+	defer hydra.Close()
+	suite.T().Setenv("hydraAdminUrl", hydra.URL)
+	suite.T().Setenv("ADMIN_SCOPE", "admin")
+
+	app := fiber.New()
+	routes.SetupRoutes(app)
+	for path, status := range map[string]int{
+		"/api/v1/products/import":       404,
+		"/api/v1/admin/products/import": 403,
+	} {
+		req, _ := http.NewRequest("POST", path, strings.NewReader("name,price,stock\nImport Admin,100,1\n"))
+		req.Header.Set("Content-Type", "text/csv")
+		req.Header.Set("Authorization", "Bearer customer-token")
+		resp, err := app.Test(req)
+		suite.Require().NoError(err)
+		suite.Equal(status, resp.StatusCode, path)
+	}
+	suite.Zero(suite.product("Import Admin").ID)
+}
+
+func TestProductImportTestSuite(t *testing.T) {
+	suite.Run(t, new(ProductImportTestSuite))
+}
@@ -0,0 +1,146 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/leroysb/go_kubernetes/internal/api/handlers"
+	"github.com/leroysb/go_kubernetes/internal/database"
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"github.com/stretchr/testify/suite"
+)
+
+type ProductPatchTestSuite struct {
+	suite.Suite
+	app     *fiber.App
+	product *models.Product
+}
+
+func (suite *ProductPatchTestSuite) SetupTest() {
+	database.ConnectDB()
+
+	suite.product = &models.Product{Name: "Patch Kettle", Price: kes(1800), Stock: 6}
+	createProducts(suite.T(), suite.product)
+
+	suite.app = fiber.New()
+	suite.app.Get("/products/:id", handlers.GetProduct)
+	suite.app.Put("/products/:id", handlers.UpdateProduct)
+	suite.app.Patch("/products/:id", handlers.PatchProduct)
+}
+
+func (suite *ProductPatchTestSuite) TearDownTest() {
+	database.DB.Db.Unscoped().Where("product_id = ?", suite.product.ID).Delete(&models.ProductVariant{})
+	deleteProducts(suite.product)
+}
+
+func (suite *ProductPatchTestSuite) request(method, url, body, ifMatch string, out any) (int, string) {
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	if ifMatch != "" {
+		req.Header.Set("If-Match", ifMatch)
+	}
+	resp, err := suite.app.Test(req)
+	suite.Require().NoError(err)
+	if out != nil {
+		json.NewDecoder(resp.Body).Decode(out)
+	}
+	return resp.StatusCode, resp.Header.Get("ETag")
+}
+
+// TestPatchProduct checks that a patch changes only the given fields and moves the ETag on
+func (suite *ProductPatchTestSuite) TestPatchProduct() {
+	url := fmt.Sprintf("/products/%d", suite.product.ID)
+	status, etag := suite.request("GET", url, "", "", nil)
+	suite.Equal(200, status)
+	suite.Equal(`"1"`, etag)
+
+	var product models.Product
+	status, next := suite.request("PATCH", url, `{"price": 1500}`, etag, &product)
+	suite.Equal(200, status)
+	suite.Equal(`"2"`, next)
+	suite.Equal(kes(1500), product.Price)
+	suite.Equal("Patch Kettle", product.Name)
+	suite.Equal(6, product.Stock)
+
+	// Marking a product out of stock is allowed through a patch
+	status, _ = suite.request("PATCH", url, `{"stock": 0}`, "", &product)
+	suite.Equal(200, status)
+	suite.Equal(0, product.Stock)
+
+	status, _ = suite.request("PATCH", url, `{"name": null}`, "", nil)
+	suite.Equal(400, status)
+	status, _ = suite.request("PATCH", url, `{"version": 9}`, "", nil)
+	suite.Equal(400, status)
+	status, _ = suite.request("PATCH", "/products/999999", `{"price": 10}`, "", nil)
+	suite.Equal(404, status)
+}
+
+// TestStaleIfMatch checks that writes based on an old version are refused
+func (suite *ProductPatchTestSuite) TestStaleIfMatch() {
+	url := fmt.Sprintf("/products/%d", suite.product.ID)
+	status, _ := suite.request("PATCH", url, `{"stock": 4}`, `"1"`, nil)
+	suite.Equal(200, status)
+
+	status, _ = suite.request("PATCH", url, `{"stock": 3}`, `"1"`, nil)
+	suite.Equal(412, status)
+	status, _ = suite.request("PUT", url, `{"name": "Patch Kettle", "price": 1800, "stock": 3}`, `"1"`, nil)
+	suite.Equal(412, status)
+	status, _ = suite.request("PUT", "/products/999999", `{"name": "Missing", "price": 1800, "stock": 3}`, "", nil)
+	suite.Equal(404, status)
+
+	var product models.Product
+	database.DB.Db.First(&product, suite.product.ID)
+	suite.Equal(4, product.Stock)
+	suite.Equal(2, product.Version)
+}
+
+// TestPatchDuplicateName checks that a product cannot be renamed to another product's name
+func (suite *ProductPatchTestSuite) TestPatchDuplicateName() {
+	other := &models.Product{Name: "Patch Teapot", Price: kes(900), Stock: 2}
+	createProducts(suite.T(), other)
+	defer deleteProducts(other)
+
+	url := fmt.Sprintf("/products/%d", suite.product.ID)
+	status, _ := suite.request("PATCH", url, `{"name": "Patch Teapot"}`, "", nil)
+	suite.Equal(400, status)
+	status, _ = suite.request("PATCH", url, `{"name": "Patch Kettle", "stock": 5}`, "", nil)
+	suite.Equal(200, status)
+
+	database.DB.Db.Delete(other)
+	status, _ = suite.request("PATCH", url, `{"name": "Patch Teapot"}`, "", nil)
+	suite.Equal(409, status)
+}
+
+// TestVariantStock checks the stock of a product with variants can be given as it is but not changed,
+// whether by a patch or by replacing the product
+func (suite *ProductPatchTestSuite) TestVariantStock() {
+	price := kes(1800)
+	variant := &models.ProductVariant{ProductID: suite.product.ID, SKU: "PK-RED", Price: &price, Stock: 6}
+	suite.Require().NoError(database.DB.Db.Create(variant).Error)
+	var movements int64
+	database.DB.Db.Model(&models.StockMovement{}).Where("product_id = ?", suite.product.ID).Count(&movements)
+
+	url := fmt.Sprintf("/products/%d", suite.product.ID)
+	status, _ := suite.request("PATCH", url, `{"stock": 9}`, "", nil)
+	suite.Equal(400, status)
+	status, _ = suite.request("PUT", url, `{"name": "Patch Kettle", "price": 1800, "stock": 9}`, "", nil)
+	suite.Equal(400, status)
+	status, _ = suite.request("PUT", url, `{"name": "Patch Kettle", "price": 1700, "stock": 6}`, "", nil)
+	suite.Equal(200, status)
+
+	var product models.Product
+	database.DB.Db.First(&product, suite.product.ID)
+	suite.Equal(6, product.Stock)
+	suite.Equal(kes(1700), product.Price)
+	var after int64
+	database.DB.Db.Model(&models.StockMovement{}).Where("product_id = ?", suite.product.ID).Count(&after)
+	suite.Equal(movements, after)
+}
+
+func TestProductPatchTestSuite(t *testing.T) {
+	suite.Run(t, new(ProductPatchTestSuite))
+}
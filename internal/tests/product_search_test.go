@@ -0,0 +1,136 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/leroysb/go_kubernetes/internal/api/handlers"
+	"github.com/leroysb/go_kubernetes/internal/database"
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"github.com/stretchr/testify/suite"
+)
+
+type productPage struct {
+	Data       []models.Product `json:"data"`
+	NextCursor *string          `json:"next_cursor"`
+	PrevCursor *string          `json:"prev_cursor"`
+	Total      int64            `json:"total"`
+}
+
+type ProductSearchTestSuite struct {
+	suite.Suite
+	app      *fiber.App
+	products []models.Product
+}
+
+func (suite *ProductSearchTestSuite) SetupTest() {
+	database.ConnectDB()
+	database.DB.Db.Unscoped().Where("name LIKE ?", "Search %").Delete(&models.Product{})
+
+	suite.products = []models.Product{
+		{Name: "Search Red Shirt", Price: kes(1500), Stock: 4},
+		{Name: "Search Blue Shirt", Price: kes(1200), Stock: 0},
+		{Name: "Search Green Mug", Price: kes(400), Stock: 10},
+		{Name: "Search 100% Cotton Towel", Price: kes(900), Stock: 2},
+	}
+	for i := range suite.products {
+		// A zero stock is written as NULL on create, so out of stock products are created in stock and then emptied
+		stock := suite.products[i].Stock
+		suite.products[i].Stock = 1
+		suite.Require().NoError(database.DB.Db.Create(&suite.products[i]).Error)
+		suite.Require().NoError(database.DB.Db.Model(&suite.products[i]).Update("stock", stock).Error)
+	}
+
+	suite.app = fiber.New()
+	suite.app.Get("/products", handlers.GetProducts)
+}
+
+func (suite *ProductSearchTestSuite) TearDownTest() {
+	for i := range suite.products {
+		database.DB.Db.Unscoped().Delete(&suite.products[i])
+	}
+}
+
+func (suite *ProductSearchTestSuite) get(query string) (int, productPage) {
+	req, _ := http.NewRequest("GET", "/products?"+query, nil)
+	resp, err := suite.app.Test(req)
+	suite.Require().NoError(err)
+
+	var page productPage
+	json.NewDecoder(resp.Body).Decode(&page)
+	return resp.StatusCode, page
+}
+
+func names(products []models.Product) []string {
+	var result []string
+	for _, p := range products {
+		result = append(result, p.Name)
+	}
+	return result
+}
+
+// TestSearchAndFilter checks name search combined with price and stock filters
+func (suite *ProductSearchTestSuite) TestSearchAndFilter() {
+	status, page := suite.get("q=shirt&sort=price")
+	suite.Equal(200, status)
+	suite.Equal(int64(2), page.Total)
+	suite.Equal([]string{"Search Blue Shirt", "Search Red Shirt"}, names(page.Data))
+
+	_, page = suite.get("q=shirt&in_stock=true")
+	suite.Equal([]string{"Search Red Shirt"}, names(page.Data))
+
+	_, page = suite.get("q=search&min_price=500&max_price=1300&sort=-price")
+	suite.Equal([]string{"Search Blue Shirt", "Search 100% Cotton Towel"}, names(page.Data))
+
+	// Wildcards in the search term are matched literally
+	_, page = suite.get("q=100%25")
+	suite.Equal([]string{"Search 100% Cotton Towel"}, names(page.Data))
+}
+
+// TestPaging checks that the legacy page number still works and invalid parameters are rejected
+func (suite *ProductSearchTestSuite) TestPaging() {
+	_, page := suite.get("q=search&sort=name&order=asc&page=2&page_size=3")
+	suite.Equal(int64(4), page.Total)
+	suite.Equal([]string{"Search Red Shirt"}, names(page.Data))
+	suite.Nil(page.NextCursor)
+	suite.NotNil(page.PrevCursor)
+
+	status, _ := suite.get("sort=stock")
+	suite.Equal(400, status)
+	status, _ = suite.get("min_price=10&max_price=5")
+	suite.Equal(400, status)
+	status, _ = suite.get("cursor=not-a-cursor")
+	suite.Equal(400, status)
+}
+
+// TestCursorPaging checks walking the list forward and back with cursors and Link headers
+func (suite *ProductSearchTestSuite) TestCursorPaging() {
+	_, page := suite.get("q=search&sort=-price&page_size=3")
+	suite.Equal([]string{"Search Red Shirt", "Search Blue Shirt", "Search 100% Cotton Towel"}, names(page.Data))
+	suite.Equal(int64(4), page.Total)
+	suite.Nil(page.PrevCursor)
+	suite.Require().NotNil(page.NextCursor)
+
+	req, _ := http.NewRequest("GET", "/products?q=search&sort=-price&page_size=3&cursor="+*page.NextCursor, nil)
+	resp, err := suite.app.Test(req)
+	suite.Require().NoError(err)
+	suite.Contains(resp.Header.Get("Link"), `rel="prev"`)
+	suite.NotContains(resp.Header.Get("Link"), `rel="next"`)
+
+	var second productPage
+	json.NewDecoder(resp.Body).Decode(&second)
+	suite.Equal([]string{"Search Green Mug"}, names(second.Data))
+	suite.Nil(second.NextCursor)
+	suite.Require().NotNil(second.PrevCursor)
+
+	_, back := suite.get("q=search&sort=-price&page_size=3&cursor=" + *second.PrevCursor)
+	suite.Equal(names(page.Data), names(back.Data))
+	suite.Nil(back.PrevCursor)
+	suite.NotNil(back.NextCursor)
+}
+
+func TestProductSearchTestSuite(t *testing.T) {
+	suite.Run(t, new(ProductSearchTestSuite))
+}
@@ -0,0 +1,187 @@
+package tests
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/leroysb/go_kubernetes/internal/api/handlers"
+	"github.com/leroysb/go_kubernetes/internal/database"
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"github.com/stretchr/testify/suite"
+)
+
+type PromotionTestSuite struct {
+	apiSuite
+	customer   *models.Customer
+	clothes    *models.Category
+	shirt, mug *models.Product
+}
+
+func (suite *PromotionTestSuite) SetupTest() {
+	database.ConnectDB()
+	database.DB.Db.Unscoped().Where("code LIKE ?", "PROMO%").Delete(&models.Promotion{})
+
+	suite.customer = createCustomer(suite.T(), "Bargain", "+254700000040")
+
+	suite.clothes = &models.Category{Name: "Promo Clothes"}
+	suite.Require().NoError(database.DB.Db.Create(suite.clothes).Error)
+
+	suite.shirt = &models.Product{Name: "Promo Shirt", Price: kes(1000), Stock: 10}
+	suite.mug = &models.Product{Name: "Promo Mug", Price: kes(300), Stock: 10}
+	createProducts(suite.T(), suite.shirt, suite.mug)
+	suite.Require().NoError(database.DB.Db.Model(suite.shirt).Association("Categories").Append(suite.clothes))
+
+	suite.app = fiber.New()
+	suite.app.Post("/admin/promotions", handlers.CreatePromotion)
+	suite.app.Put("/admin/promotions/:id", handlers.UpdatePromotion)
+	suite.app.Post("/customers/cart", asCustomer(suite.customer, handlers.AddCartItem))
+	suite.app.Post("/customers/cart/coupon", asCustomer(suite.customer, handlers.ApplyCoupon))
+	suite.app.Delete("/customers/cart/coupon", asCustomer(suite.customer, handlers.RemoveCoupon))
+	suite.app.Post("/customers/orders", asCustomer(suite.customer, handlers.CreateOrder))
+}
+
+func (suite *PromotionTestSuite) TearDownTest() {
+	deleteCustomer(suite.customer)
+	database.DB.Db.Model(suite.shirt).Association("Categories").Clear()
+	deleteProducts(suite.shirt, suite.mug)
+	database.DB.Db.Unscoped().Delete(suite.clothes)
+	database.DB.Db.Unscoped().Where("code LIKE ?", "PROMO%").Delete(&models.Promotion{})
+	database.DB.Db.Exec("DELETE FROM outbox_events")
+}
+
+func (suite *PromotionTestSuite) addToCart(product *models.Product, quantity int) {
+	suite.Require().Equal(200, suite.request("POST", "/customers/cart", fmt.Sprintf(`{"product_id": %d, "quantity": %d}`, product.ID, quantity), nil))
+}
+
+// TestCreatePromotion checks the validation of promotions
+func (suite *PromotionTestSuite) TestCreatePromotion() {
+	suite.Equal(400, suite.request("POST", "/admin/promotions", `{"code": "PROMO-BAD", "kind": "bogus"}`, nil))
+	suite.Equal(400, suite.request("POST", "/admin/promotions", `{"code": "PROMO-BAD", "kind": "percentage", "percent": 120}`, nil))
+	suite.Equal(400, suite.request("POST", "/admin/promotions", `{"code": "PROMO-BAD", "kind": "fixed"}`, nil))
+
+	var promotion models.Promotion
+	suite.Equal(201, suite.request("POST", "/admin/promotions", `{"code": "promo-fixed", "kind": "fixed", "amount": 500, "min_order": 5000}`, &promotion))
+	suite.Equal("PROMO-FIXED", promotion.Code)
+	suite.True(promotion.Active)
+	suite.Equal(409, suite.request("POST", "/admin/promotions", `{"code": "PROMO-FIXED", "kind": "percentage", "percent": 5}`, nil))
+
+	// Switching to a percentage drops the fixed amount
+	url := fmt.Sprintf("/admin/promotions/%d", promotion.ID)
+	suite.Equal(200, suite.request("PUT", url, `{"kind": "percentage", "percent": 15}`, &promotion))
+	var stored models.Promotion
+	database.DB.Db.First(&stored, promotion.ID)
+	suite.Nil(stored.Amount)
+	suite.Equal(15, stored.Percent)
+}
+
+// TestCouponAtCheckout checks that a coupon applies to the products it covers and respects its limits
+func (suite *PromotionTestSuite) TestCouponAtCheckout() {
+	body := fmt.Sprintf(`{"code": "PROMO-SHIRT", "kind": "percentage", "percent": 10, "category_ids": [%d], "per_customer_limit": 1}`, suite.clothes.ID)
+	suite.Equal(201, suite.request("POST", "/admin/promotions", body, nil))
+	suite.Equal(201, suite.request("POST", "/admin/promotions", `{"code": "PROMO-BIG", "kind": "fixed", "amount": 500, "min_order": 5000}`, nil))
+	suite.Equal(201, suite.request("POST", "/admin/promotions", `{"code": "PROMO-OLD", "kind": "percentage", "percent": 50, "ends_at": "2020-01-01T00:00:00Z"}`, nil))
+
+	suite.Equal(400, suite.request("POST", "/customers/cart/coupon", `{"code": "promo-shirt"}`, nil))
+	suite.addToCart(suite.shirt, 2)
+	suite.addToCart(suite.mug, 1)
+
+	suite.Equal(404, suite.request("POST", "/customers/cart/coupon", `{"code": "PROMO-NONE"}`, nil))
+	suite.Equal(400, suite.request("POST", "/customers/cart/coupon", `{"code": "PROMO-OLD"}`, nil))
+	var failure map[string]string
+	suite.Equal(400, suite.request("POST", "/customers/cart/coupon", `{"code": "PROMO-BIG"}`, &failure))
+	suite.Equal("Coupon needs an order of at least KES 5000.00", failure["error"])
+
+	var applied struct {
+		Discount models.Money `json:"discount"`
+	}
+	suite.Equal(200, suite.request("POST", "/customers/cart/coupon", `{"code": "promo-shirt"}`, &applied))
+	suite.Equal(kes(200), applied.Discount)
+
+	// The mug is not in the promotion and is charged in full
+	var order models.Order
+	suite.Equal(200, suite.request("POST", "/customers/orders", fmt.Sprintf(`{"product_id": %d, "quantity": 1}`, suite.mug.ID), &order))
+	suite.Nil(order.PromotionID)
+	suite.Equal(kes(300), order.Amount)
+
+	suite.Equal(200, suite.request("POST", "/customers/orders", fmt.Sprintf(`{"product_id": %d, "quantity": 2}`, suite.shirt.ID), &order))
+	suite.Require().NotNil(order.PromotionID)
+	suite.Equal(kes(200), order.Discount)
+	suite.Equal(kes(1800), order.Amount)
+	suite.Equal(models.NewMoney(24828), order.Tax)
+
+	var promotion models.Promotion
+	database.DB.Db.First(&promotion, *order.PromotionID)
+	suite.Equal(1, promotion.Uses)
+
+	// Redeeming the coupon takes it off the cart, so the next order is charged in full
+	order = models.Order{}
+	suite.Equal(200, suite.request("POST", "/customers/orders", fmt.Sprintf(`{"product_id": %d, "quantity": 1}`, suite.shirt.ID), &order))
+	suite.Nil(order.PromotionID)
+	suite.Equal(kes(1000), order.Amount)
+
+	// The customer may only use it once
+	suite.Equal(400, suite.request("POST", "/customers/cart/coupon", `{"code": "promo-shirt"}`, &failure))
+	suite.Equal("Coupon has already been used the maximum number of times", failure["error"])
+}
+
+// TestFixedCouponSplit checks the minimum is met by the cart as a whole, and that a fixed amount is
+// taken off once, shared out between the lines it covers
+func (suite *PromotionTestSuite) TestFixedCouponSplit() {
+	suite.Equal(201, suite.request("POST", "/admin/promotions", `{"code": "PROMO-SPLIT", "kind": "fixed", "amount": 500, "min_order": 3000}`, nil))
+	suite.addToCart(suite.shirt, 2)
+	suite.addToCart(suite.mug, 4)
+
+	var applied struct {
+		Discount models.Money `json:"discount"`
+		Lines    []struct {
+			Discount models.Money `json:"discount"`
+		} `json:"lines"`
+	}
+	suite.Equal(200, suite.request("POST", "/customers/cart/coupon", `{"code": "promo-split"}`, &applied))
+	suite.Equal(kes(500), applied.Discount)
+	suite.Require().Len(applied.Lines, 2)
+	suite.Equal(models.Money{Amount: 31250, Currency: "KES"}, applied.Lines[0].Discount)
+	suite.Equal(models.Money{Amount: 18750, Currency: "KES"}, applied.Lines[1].Discount)
+
+	// The shirts alone fall short of the minimum, but are ordered out of a cart that meets it
+	var order models.Order
+	suite.Equal(200, suite.request("POST", "/customers/orders", fmt.Sprintf(`{"product_id": %d, "quantity": 2}`, suite.shirt.ID), &order))
+	suite.Require().NotNil(order.PromotionID)
+	suite.Equal(models.Money{Amount: 31250, Currency: "KES"}, order.Discount)
+	suite.Equal(models.Money{Amount: 168750, Currency: "KES"}, order.Amount)
+}
+
+// TestConcurrentCheckouts checks a coupon the customer may use once gives its discount to one of
+// several checkouts made at once
+func (suite *PromotionTestSuite) TestConcurrentCheckouts() {
+	suite.Equal(201, suite.request("POST", "/admin/promotions", `{"code": "PROMO-ONCE", "kind": "percentage", "percent": 10, "per_customer_limit": 1}`, nil))
+	suite.addToCart(suite.shirt, 1)
+	suite.Equal(200, suite.request("POST", "/customers/cart/coupon", `{"code": "PROMO-ONCE"}`, nil))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest("POST", "/customers/orders", strings.NewReader(fmt.Sprintf(`{"product_id": %d, "quantity": 1}`, suite.shirt.ID)))
+			req.Header.Set("Content-Type", "application/json")
+			suite.app.Test(req, -1)
+		}()
+	}
+	wg.Wait()
+
+	var promotion models.Promotion
+	database.DB.Db.Where("code = ?", "PROMO-ONCE").First(&promotion)
+	var discounted int64
+	database.DB.Db.Model(&models.Order{}).Where("promotion_id = ? AND customer_id = ?", promotion.ID, suite.customer.ID).Count(&discounted)
+	suite.Equal(int64(1), discounted)
+	suite.Equal(1, promotion.Uses)
+}
+
+func TestPromotionTestSuite(t *testing.T) {
+	suite.Run(t, new(PromotionTestSuite))
+}
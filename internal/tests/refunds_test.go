@@ -0,0 +1,222 @@
+package tests
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/leroysb/go_kubernetes/internal/api/routes"
+	"github.com/leroysb/go_kubernetes/internal/database"
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"github.com/leroysb/go_kubernetes/internal/payments"
+	"github.com/leroysb/go_kubernetes/internal/webhooks"
+)
+
+// refund asks for a refund of the order, returning the status code and the refund made
+func (suite *PaymentTestSuite) refund(order *models.Order, body string) (int, models.Refund) {
+	var refund models.Refund
+	code := suite.request("POST", fmt.Sprintf("/admin/orders/%d/refunds", order.ID), body, &refund)
+	return code, refund
+}
+
+// b2cResult posts the result of a B2C payment to the result URL, or to the timeout URL
+func (suite *PaymentTestSuite) b2cResult(refund models.Refund, code int, transaction string, timedOut bool) int {
+	url := "/payments/mpesa/b2c/result?token=t0ken"
+	if timedOut {
+		url = "/payments/mpesa/b2c/timeout?token=t0ken"
+	}
+	body := fmt.Sprintf(`{"Result": {"ResultType": 0, "ResultCode": %d, "ResultDesc": "Result", "OriginatorConversationID": "origin", "ConversationID": %q, "TransactionID": %q}}`, code, refund.ProviderReference, transaction)
+	return suite.request("POST", url, body, nil)
+}
+
+func (suite *PaymentTestSuite) refundEvents(order *models.Order) int64 {
+	var events int64
+	database.DB.Db.Model(&models.OutboxEvent{}).Where("event_type = ? AND payload LIKE ?", webhooks.EventOrderRefunded, fmt.Sprintf(`%%"order_id":%d,%%`, order.ID)).Count(&events)
+	return events
+}
+
+// TestManualRefunds checks returned items are refunded at their share of the payment and restocked,
+// and that the order is refunded once all of it has been paid back
+func (suite *PaymentTestSuite) TestManualRefunds() {
+	order := suite.placeOrderOf(3)
+	code, _ := suite.refund(order, `{"quantity": 1}`)
+	suite.Equal(400, code)
+
+	payment := suite.pay(order, `{"provider": "manual"}`)
+	suite.Equal(200, suite.request("POST", fmt.Sprintf("/admin/payments/%d/confirm", payment.ID), "", nil))
+
+	code, refund := suite.refund(order, `{"quantity": 1, "restock": true, "reason": "Arrived broken"}`)
+	suite.Require().Equal(201, code)
+	suite.Equal(payments.RefundSucceeded, refund.Status)
+	suite.Equal(models.Money{Amount: 1999, Currency: "KES"}, refund.Amount)
+	suite.True(refund.Restocked)
+	suite.True(strings.HasPrefix(refund.ProviderReference, "COD-REFUND-"))
+	suite.Equal(payments.OrderPartiallyRefunded, suite.status(order))
+
+	var product models.Product
+	database.DB.Db.First(&product, suite.product.ID)
+	suite.Equal(11, product.Stock)
+
+	code, _ = suite.refund(order, `{"quantity": 3}`)
+	suite.Equal(400, code)
+	code, _ = suite.refund(order, `{"amount": 100}`)
+	suite.Equal(400, code)
+	code, _ = suite.refund(order, `{"amount": {"amount": 500, "currency": "USD"}}`)
+	suite.Equal(400, code)
+
+	// Returning the last items refunds whatever is left of the payment
+	code, refund = suite.refund(order, `{"quantity": 2}`)
+	suite.Require().Equal(201, code)
+	suite.Equal(models.Money{Amount: 3998, Currency: "KES"}, refund.Amount)
+	suite.Equal(payments.OrderRefunded, suite.status(order))
+	suite.Equal(int64(2), suite.refundEvents(order))
+
+	code, _ = suite.refund(order, `{"amount": 1}`)
+	suite.Equal(400, code)
+
+	var refunds []models.Refund
+	suite.Equal(200, suite.request("GET", fmt.Sprintf("/admin/orders/%d/refunds", order.ID), "", &refunds))
+	suite.Len(refunds, 2)
+}
+
+// TestMpesaRefunds checks an M-Pesa refund waits for the B2C result, and that one which fails can be tried again
+func (suite *PaymentTestSuite) TestMpesaRefunds() {
+	order := suite.placeOrder()
+	payment := suite.pay(order, "")
+	suite.Equal(200, suite.callback(payment, payments.ResultSuccess, 20, "TJK1A2B3C4"))
+
+	code, refund := suite.refund(order, `{"amount": 5}`)
+	suite.Require().Equal(201, code)
+	suite.Equal(payments.RefundPending, refund.Status)
+	suite.Equal("paid", suite.status(order))
+	suite.Require().Len(suite.daraja.payouts, 1)
+	suite.Equal("254700000041", suite.daraja.payouts[0]["PartyB"])
+	suite.Equal(float64(5), suite.daraja.payouts[0]["Amount"])
+
+	// Only KES 15 is left while the refund is pending
+	code, _ = suite.refund(order, `{"amount": 16}`)
+	suite.Equal(400, code)
+
+	suite.Equal(200, suite.b2cResult(refund, payments.ResultSuccess, "UJK1A2B3C4", false))
+	suite.Equal(payments.OrderPartiallyRefunded, suite.status(order))
+	var settled models.Refund
+	database.DB.Db.First(&settled, refund.ID)
+	suite.Equal(payments.RefundSucceeded, settled.Status)
+	suite.Equal("UJK1A2B3C4", *settled.Receipt)
+	suite.Equal(int64(1), suite.refundEvents(order))
+
+	code, refund = suite.refund(order, `{"quantity": 1}`)
+	suite.Require().Equal(201, code)
+	suite.Equal(kes(15), refund.Amount)
+	suite.Equal(200, suite.b2cResult(refund, 0, "", true))
+	var failed models.Refund
+	database.DB.Db.First(&failed, refund.ID)
+	suite.Equal(payments.RefundFailed, failed.Status)
+	suite.Equal(payments.OrderPartiallyRefunded, suite.status(order))
+
+	code, refund = suite.refund(order, `{"quantity": 1}`)
+	suite.Require().Equal(201, code)
+	suite.Equal(200, suite.b2cResult(refund, payments.ResultSuccess, "UJK5D6E7F8", false))
+	suite.Equal(payments.OrderRefunded, suite.status(order))
+
+	unknown := models.Refund{ProviderReference: "AG_unknown"}
+	suite.Equal(404, suite.b2cResult(unknown, payments.ResultSuccess, "UJK0000000", false))
+}
+
+// TestRejectedRefund checks a refund is recorded before it is paid out, and that one M-Pesa turns
+// down is failed, restocks nothing and can be tried again
+func (suite *PaymentTestSuite) TestRejectedRefund() {
+	order := suite.placeOrder()
+	payment := suite.pay(order, "")
+	suite.Equal(200, suite.callback(payment, payments.ResultSuccess, 20, "TJK1A2B3C4"))
+
+	suite.daraja.rejectPayouts = true
+	code, _ := suite.refund(order, `{"quantity": 1, "restock": true}`)
+	suite.Equal(502, code)
+	var refunds []models.Refund
+	database.DB.Db.Where("order_id = ?", order.ID).Find(&refunds)
+	suite.Require().Len(refunds, 1)
+	suite.Equal(payments.RefundFailed, refunds[0].Status)
+	suite.False(refunds[0].Restocked)
+	var product models.Product
+	database.DB.Db.First(&product, suite.product.ID)
+	suite.Equal(suite.product.Stock, product.Stock)
+
+	suite.daraja.rejectPayouts = false
+	code, refund := suite.refund(order, `{"quantity": 1, "restock": true}`)
+	suite.Require().Equal(201, code)
+	suite.Equal(payments.RefundPending, refund.Status)
+	suite.True(refund.Restock)
+	suite.False(refund.Restocked)
+	suite.NotEmpty(refund.ProviderReference)
+	database.DB.Db.First(&product, suite.product.ID)
+	suite.Equal(suite.product.Stock, product.Stock)
+}
+
+// TestFailedRefundRestock checks items are only restocked once a refund has been paid out, so a
+// B2C refund that fails and is made again puts them back once
+func (suite *PaymentTestSuite) TestFailedRefundRestock() {
+	order := suite.placeOrder()
+	payment := suite.pay(order, "")
+	suite.Equal(200, suite.callback(payment, payments.ResultSuccess, 20, "TJK1A2B3C4"))
+
+	code, refund := suite.refund(order, `{"quantity": 1, "restock": true}`)
+	suite.Require().Equal(201, code)
+	suite.Equal(200, suite.b2cResult(refund, 2001, "", false))
+	var failed models.Refund
+	database.DB.Db.First(&failed, refund.ID)
+	suite.Equal(payments.RefundFailed, failed.Status)
+	suite.False(failed.Restocked)
+	var product models.Product
+	database.DB.Db.First(&product, suite.product.ID)
+	suite.Equal(suite.product.Stock, product.Stock)
+
+	code, refund = suite.refund(order, `{"quantity": 1, "restock": true}`)
+	suite.Require().Equal(201, code)
+	suite.Equal(200, suite.b2cResult(refund, payments.ResultSuccess, "UJK1A2B3C4", false))
+	var settled models.Refund
+	database.DB.Db.First(&settled, refund.ID)
+	suite.Equal(payments.RefundSucceeded, settled.Status)
+	suite.True(settled.Restocked)
+	database.DB.Db.First(&product, suite.product.ID)
+	suite.Equal(suite.product.Stock+1, product.Stock)
+
+	var returns []models.StockMovement
+	database.DB.Db.Where("reference = ? AND reason = ?", fmt.Sprintf("order:%d", order.ID), models.StockReturn).Find(&returns)
+	suite.Len(returns, 1)
+}
+
+// TestRefundsNeedAdmin checks a customer's token can neither reach refunds where customers used to
+// find them nor under the admin API
+func (suite *PaymentTestSuite) TestRefundsNeedAdmin() {
+	hydra := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"active": true, "scope": "read"}`)
+	}))
+	defer hydra.Close()
+	suite.T().Setenv("hydraAdminUrl", hydra.URL)
+	suite.T().Setenv("ADMIN_SCOPE", "admin")
+
+	app := fiber.New()
+	routes.SetupRoutes(app)
+	order := suite.placeOrderOf(1)
+	for path, status := range map[string]int{
+		"/api/v1/orders/%d/refunds":       404,
+		"/api/v1/admin/orders/%d/refunds": 403,
+	} {
+		for _, method := range []string{"GET", "POST"} {
+			req, _ := http.NewRequest(method, fmt.Sprintf(path, order.ID), strings.NewReader(`{"quantity": 1}`))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer customer-token")
+			resp, err := app.Test(req)
+			suite.Require().NoError(err)
+			suite.Equal(status, resp.StatusCode, method+" "+path)
+		}
+	}
+
+	var refunds int64
+	database.DB.Db.Model(&models.Refund{}).Where("order_id = ?", order.ID).Count(&refunds)
+	suite.Zero(refunds)
+}
@@ -0,0 +1,129 @@
+package tests
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/leroysb/go_kubernetes/internal/api/handlers"
+	"github.com/leroysb/go_kubernetes/internal/database"
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"github.com/leroysb/go_kubernetes/internal/inventory"
+	"github.com/stretchr/testify/suite"
+)
+
+type StockTestSuite struct {
+	apiSuite
+	customer *models.Customer
+	stool    *models.Product
+}
+
+func (suite *StockTestSuite) SetupTest() {
+	database.ConnectDB()
+
+	suite.customer = createCustomer(suite.T(), "Stocktaker", "+254700000049")
+
+	suite.stool = &models.Product{Name: "Ledger Stool", Price: kes(1500), Stock: 5}
+	createProducts(suite.T(), suite.stool)
+
+	suite.app = fiber.New()
+	suite.app.Put("/products/:id", handlers.UpdateProduct)
+	suite.app.Get("/products/:id/stock-movements", handlers.GetStockMovements)
+	suite.app.Post("/customers/orders", asCustomer(suite.customer, handlers.CreateOrder))
+	suite.app.Put("/orders/:id/status", handlers.UpdateOrderStatus)
+}
+
+func (suite *StockTestSuite) TearDownTest() {
+	database.DB.Db.Unscoped().Where("product_id = ?", suite.stool.ID).Delete(&models.StockMovement{})
+	database.DB.Db.Unscoped().Where("aggregate_type = ? AND aggregate_id = ?", "product", suite.stool.ID).Delete(&models.OutboxEvent{})
+	deleteCustomer(suite.customer)
+	deleteProducts(suite.stool)
+}
+
+// mismatched reports whether reconciliation finds the stool's stock off its ledger
+func (suite *StockTestSuite) mismatched() bool {
+	mismatches, err := inventory.Reconcile()
+	suite.Require().NoError(err)
+	for _, m := range mismatches {
+		if m.ProductID == suite.stool.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// TestLedger checks every stock change is recorded with its reason and adds up to the stock
+func (suite *StockTestSuite) TestLedger() {
+	// Stock from before the ledger is opened on startup
+	suite.True(suite.mismatched())
+	database.ConnectDB()
+	suite.False(suite.mismatched())
+
+	product := fmt.Sprintf("/products/%d", suite.stool.ID)
+	suite.Equal(200, suite.request("PUT", product, `{"name": "Ledger Stool", "price": 1500, "stock": 8}`, nil))
+
+	var order models.Order
+	suite.Equal(200, suite.request("POST", "/customers/orders", fmt.Sprintf(`{"product_id": %d, "quantity": 3}`, suite.stool.ID), &order))
+	status := fmt.Sprintf("/orders/%d/status", order.ID)
+	suite.Equal(200, suite.request("PUT", status, `{"status": "cancelled"}`, nil))
+	suite.Equal(400, suite.request("PUT", status, `{"status": "paid"}`, nil))
+
+	var page struct {
+		Data  []models.StockMovement `json:"data"`
+		Total int64                  `json:"total"`
+	}
+	suite.Equal(200, suite.request("GET", product+"/stock-movements", "", &page))
+	suite.Require().Len(page.Data, 4)
+	reasons := []string{}
+	sum := 0
+	for _, movement := range page.Data {
+		reasons = append(reasons, movement.Reason)
+		sum += movement.Delta
+	}
+	suite.Equal([]string{models.StockCancellation, models.StockSale, models.StockRestock, models.StockAdjustment}, reasons)
+	suite.Equal(fmt.Sprintf("order:%d", order.ID), page.Data[1].Reference)
+	suite.Equal(fmt.Sprintf("customer:%d", suite.customer.ID), page.Data[1].Actor)
+	suite.Equal(-3, page.Data[1].Delta)
+	suite.Equal(8, sum)
+	suite.False(suite.mismatched())
+
+	// Stock changed behind the ledger's back is found
+	database.DB.Db.Model(suite.stool).Update("stock", 2)
+	suite.True(suite.mismatched())
+}
+
+// TestConcurrentCancel checks an order cancelled by several requests at once is restocked once
+func (suite *StockTestSuite) TestConcurrentCancel() {
+	var order models.Order
+	suite.Require().Equal(200, suite.request("POST", "/customers/orders", fmt.Sprintf(`{"product_id": %d, "quantity": 3}`, suite.stool.ID), &order))
+
+	var wg sync.WaitGroup
+	codes := make([]int, 5)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req, _ := http.NewRequest("PUT", fmt.Sprintf("/orders/%d/status", order.ID), strings.NewReader(`{"status": "cancelled"}`))
+			req.Header.Set("Content-Type", "application/json")
+			if resp, err := suite.app.Test(req, -1); err == nil {
+				codes[i] = resp.StatusCode
+			}
+		}(i)
+	}
+	wg.Wait()
+	suite.Contains(codes, 200)
+
+	var cancellations int64
+	database.DB.Db.Model(&models.StockMovement{}).Where("product_id = ? AND reason = ?", suite.stool.ID, models.StockCancellation).Count(&cancellations)
+	suite.Equal(int64(1), cancellations)
+	var stool models.Product
+	database.DB.Db.First(&stool, suite.stool.ID)
+	suite.Equal(5, stool.Stock)
+}
+
+func TestStockTestSuite(t *testing.T) {
+	suite.Run(t, new(StockTestSuite))
+}
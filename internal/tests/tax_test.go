@@ -0,0 +1,85 @@
+package tests
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/leroysb/go_kubernetes/internal/api/handlers"
+	"github.com/leroysb/go_kubernetes/internal/database"
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"github.com/leroysb/go_kubernetes/internal/tax"
+	"github.com/stretchr/testify/suite"
+)
+
+type TaxTestSuite struct {
+	apiSuite
+}
+
+// TestCalculate checks inclusive and exclusive pricing and the rounding of a line's tax
+func (suite *TaxTestSuite) TestCalculate() {
+	line := tax.Calculate(kes(100), 3, tax.Standard)
+	suite.Equal("16", line.Percent())
+	suite.Equal(kes(300), line.Total)
+	suite.Equal(models.NewMoney(4138), line.Tax)
+	suite.Equal(models.NewMoney(25862), line.Subtotal)
+
+	suite.T().Setenv("PRICES_INCLUDE_TAX", "false")
+	line = tax.Calculate(models.NewMoney(1999), 3, tax.Standard)
+	suite.Equal(models.NewMoney(5997), line.Subtotal)
+	suite.Equal(models.NewMoney(960), line.Tax)
+	suite.Equal(models.NewMoney(6957), line.Total)
+
+	// 5997 × 16% is 959.52
+	suite.T().Setenv("TAX_ROUNDING", "down")
+	suite.Equal(int64(959), tax.Calculate(models.NewMoney(1999), 3, tax.Standard).Tax.Amount)
+
+	// 20 × 12.5% is 2.5 and 28 × 12.5% is 3.5, which go to the even neighbour
+	suite.T().Setenv("TAX_STANDARD_RATE", "12.5")
+	suite.T().Setenv("TAX_ROUNDING", "half_even")
+	suite.Equal("12.5", tax.Calculate(models.NewMoney(20), 1, tax.Standard).Percent())
+	suite.Equal(int64(2), tax.Calculate(models.NewMoney(20), 1, tax.Standard).Tax.Amount)
+	suite.Equal(int64(4), tax.Calculate(models.NewMoney(28), 1, tax.Standard).Tax.Amount)
+
+	for _, class := range []string{tax.ZeroRated, tax.Exempt} {
+		line = tax.Calculate(kes(50), 2, class)
+		suite.Zero(line.Tax.Amount, class)
+		suite.Equal(kes(100), line.Total, class)
+	}
+}
+
+// TestOrderBreakdown checks that orders store and return their subtotal, tax and total
+func (suite *TaxTestSuite) TestOrderBreakdown() {
+	database.ConnectDB()
+	customer := createCustomer(suite.T(), "Taxed", "+254700000039")
+	defer deleteCustomer(customer)
+
+	suite.app = fiber.New()
+	suite.app.Post("/products", handlers.CreateProduct)
+	suite.app.Post("/customers/orders", asCustomer(customer, handlers.CreateOrder))
+
+	suite.Equal(400, suite.request("POST", "/products", `{"name": "Tax Bread", "price": 60, "stock": 5, "tax_class": "reduced"}`, nil))
+
+	bread := &models.Product{Name: "Tax Bread", Price: kes(60), Stock: 5, TaxClass: tax.ZeroRated}
+	kettle := &models.Product{Name: "Tax Kettle", Price: kes(2320), Stock: 5}
+	createProducts(suite.T(), bread, kettle)
+	defer deleteProducts(bread, kettle)
+
+	var order models.Order
+	suite.Equal(200, suite.request("POST", "/customers/orders", fmt.Sprintf(`{"product_id": %d, "quantity": 1}`, kettle.ID), &order))
+	suite.Equal(kes(2000), order.Subtotal)
+	suite.Equal(kes(320), order.Tax)
+	suite.Equal(kes(2320), order.Amount)
+	suite.Equal(tax.Standard, order.TaxClass)
+	suite.Equal("16", order.TaxRate)
+	suite.True(order.TaxInclusive)
+
+	suite.Equal(200, suite.request("POST", "/customers/orders", fmt.Sprintf(`{"product_id": %d, "quantity": 2}`, bread.ID), &order))
+	suite.Equal("zero_rated", order.TaxClass)
+	suite.Zero(order.Tax.Amount)
+	suite.Equal(kes(120), order.Subtotal)
+}
+
+func TestTaxTestSuite(t *testing.T) {
+	suite.Run(t, new(TaxTestSuite))
+}
@@ -0,0 +1,95 @@
+package tests
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/leroysb/go_kubernetes/internal/api/handlers"
+	"github.com/leroysb/go_kubernetes/internal/database"
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"github.com/stretchr/testify/suite"
+)
+
+type VariantTestSuite struct {
+	apiSuite
+	customer *models.Customer
+	product  *models.Product
+}
+
+func (suite *VariantTestSuite) SetupTest() {
+	database.ConnectDB()
+
+	suite.customer = createCustomer(suite.T(), "Variant", "+254700000033")
+
+	suite.product = &models.Product{Name: "Variant Tee", Price: kes(1000), Stock: 1}
+	database.DB.Db.Unscoped().Where("sku LIKE ?", "VT-%").Delete(&models.ProductVariant{})
+	createProducts(suite.T(), suite.product)
+
+	suite.app = fiber.New()
+	suite.app.Get("/products/:id", handlers.GetProduct)
+	suite.app.Post("/products/:id/variants", handlers.CreateProductVariant)
+	suite.app.Delete("/products/:id/variants/:variant_id", handlers.DeleteProductVariant)
+	suite.app.Post("/customers/orders", asCustomer(suite.customer, handlers.CreateOrder))
+}
+
+func (suite *VariantTestSuite) TearDownTest() {
+	deleteCustomer(suite.customer)
+	database.DB.Db.Unscoped().Where("product_id = ?", suite.product.ID).Delete(&models.ProductVariant{})
+	deleteProducts(suite.product)
+}
+
+// TestOrderVariant checks that variants carry their own stock and price, and the product stock follows them
+func (suite *VariantTestSuite) TestOrderVariant() {
+	variants := fmt.Sprintf("/products/%d/variants", suite.product.ID)
+	var small, large models.ProductVariant
+	suite.Equal(201, suite.request("POST", variants, `{"sku": "VT-S", "options": {"size": "S"}, "stock": 2}`, &small))
+	suite.Equal(201, suite.request("POST", variants, `{"sku": "VT-L", "options": {"size": "L"}, "price": 1200, "stock": 3}`, &large))
+	suite.Equal(409, suite.request("POST", variants, `{"sku": "VT-S", "stock": 1}`, nil))
+
+	var product models.Product
+	suite.Equal(200, suite.request("GET", fmt.Sprintf("/products/%d", suite.product.ID), "", &product))
+	suite.Equal(5, product.Stock)
+	suite.Len(product.Variants, 2)
+
+	// Products with variants must be ordered as one of them
+	body := fmt.Sprintf(`{"product_id": %d, "quantity": 1}`, suite.product.ID)
+	suite.Equal(400, suite.request("POST", "/customers/orders", body, nil))
+
+	body = fmt.Sprintf(`{"product_id": %d, "variant_id": %d, "quantity": 3}`, suite.product.ID, small.ID)
+	suite.Equal(400, suite.request("POST", "/customers/orders", body, nil))
+
+	var order models.Order
+	body = fmt.Sprintf(`{"product_id": %d, "variant_id": %d, "quantity": 2}`, suite.product.ID, large.ID)
+	suite.Equal(200, suite.request("POST", "/customers/orders", body, &order))
+	suite.Equal(kes(2400), order.Amount)
+
+	database.DB.Db.First(&large, large.ID)
+	database.DB.Db.First(&product, suite.product.ID)
+	suite.Equal(1, large.Stock)
+	suite.Equal(3, product.Stock)
+}
+
+// TestDeletedVariant checks a deleted variant cannot be ordered, and that a product whose last
+// variant was deleted is sold on its own again
+func (suite *VariantTestSuite) TestDeletedVariant() {
+	variants := fmt.Sprintf("/products/%d/variants", suite.product.ID)
+	var small, large models.ProductVariant
+	suite.Equal(201, suite.request("POST", variants, `{"sku": "VT-S", "options": {"size": "S"}, "stock": 2}`, &small))
+	suite.Equal(201, suite.request("POST", variants, `{"sku": "VT-L", "options": {"size": "L"}, "stock": 3}`, &large))
+
+	suite.Equal(204, suite.request("DELETE", fmt.Sprintf("%s/%d", variants, small.ID), "", nil))
+	var failure map[string]string
+	body := fmt.Sprintf(`{"product_id": %d, "variant_id": %d, "quantity": 1}`, suite.product.ID, small.ID)
+	suite.Equal(400, suite.request("POST", "/customers/orders", body, &failure))
+	suite.Equal("Variant not found", failure["error"])
+
+	suite.Equal(204, suite.request("DELETE", fmt.Sprintf("%s/%d", variants, large.ID), "", nil))
+	database.DB.Db.Model(suite.product).Update("stock", 2)
+	body = fmt.Sprintf(`{"product_id": %d, "quantity": 1}`, suite.product.ID)
+	suite.Equal(200, suite.request("POST", "/customers/orders", body, nil))
+}
+
+func TestVariantTestSuite(t *testing.T) {
+	suite.Run(t, new(VariantTestSuite))
+}
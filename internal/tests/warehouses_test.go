@@ -0,0 +1,123 @@
+package tests
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/leroysb/go_kubernetes/internal/api/handlers"
+	"github.com/leroysb/go_kubernetes/internal/database"
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"github.com/leroysb/go_kubernetes/internal/inventory"
+	"github.com/stretchr/testify/suite"
+)
+
+type WarehouseTestSuite struct {
+	apiSuite
+	customer *models.Customer
+	fan      *models.Product
+	nairobi  models.Warehouse
+	mombasa  models.Warehouse
+}
+
+func (suite *WarehouseTestSuite) SetupTest() {
+	database.ConnectDB()
+
+	suite.customer = createCustomer(suite.T(), "Shipper", "+254700000050")
+
+	suite.fan = &models.Product{Name: "Warehouse Fan", Price: kes(3200), Stock: 10}
+	createProducts(suite.T(), suite.fan)
+	database.DB.Db.Create(&models.StockMovement{ProductID: suite.fan.ID, Delta: 10, Reason: models.StockRestock})
+
+	database.DB.Db.Unscoped().Where("name IN ?", []string{"Test Nairobi", "Test Mombasa"}).Delete(&models.Warehouse{})
+
+	suite.app = fiber.New()
+	suite.app.Get("/products/:id", handlers.GetProduct)
+	suite.app.Post("/warehouses", handlers.CreateWarehouse)
+	suite.app.Put("/warehouses/:id/stock/:product_id", handlers.SetWarehouseStock)
+	suite.app.Post("/stock-transfers", handlers.CreateStockTransfer)
+	suite.app.Post("/customers/orders", asCustomer(suite.customer, handlers.CreateOrder))
+	suite.app.Put("/orders/:id/status", handlers.UpdateOrderStatus)
+}
+
+func (suite *WarehouseTestSuite) TearDownTest() {
+	var orderIDs []uint
+	database.DB.Db.Unscoped().Model(&models.Order{}).Where("customer_id = ?", suite.customer.ID).Pluck("id", &orderIDs)
+	database.DB.Db.Unscoped().Where("order_id IN ?", append(orderIDs, 0)).Delete(&models.OrderAllocation{})
+	deleteCustomer(suite.customer)
+	database.DB.Db.Unscoped().Where("product_id = ?", suite.fan.ID).Delete(&models.StockTransfer{})
+	database.DB.Db.Unscoped().Where("product_id = ?", suite.fan.ID).Delete(&models.StockLevel{})
+	database.DB.Db.Unscoped().Where("product_id = ?", suite.fan.ID).Delete(&models.StockMovement{})
+	database.DB.Db.Unscoped().Where("aggregate_type = ? AND aggregate_id = ?", "product", suite.fan.ID).Delete(&models.OutboxEvent{})
+	database.DB.Db.Unscoped().Where("name IN ?", []string{"Test Nairobi", "Test Mombasa"}).Delete(&models.Warehouse{})
+	deleteProducts(suite.fan)
+}
+
+// availability returns the fan's stock by location as GET /products/:id reports it, keyed by
+// warehouse, with unassigned stock under 0
+func (suite *WarehouseTestSuite) availability() map[uint]int {
+	var product models.Product
+	suite.Require().Equal(200, suite.request("GET", fmt.Sprintf("/products/%d", suite.fan.ID), "", &product))
+	suite.Require().NotNil(product.Availability)
+	stock := map[uint]int{0: product.Availability.Unassigned}
+	total := product.Availability.Unassigned
+	for _, warehouse := range product.Availability.Warehouses {
+		stock[warehouse.WarehouseID] = warehouse.Quantity
+		total += warehouse.Quantity
+	}
+	suite.Equal(product.Availability.Total, total)
+	return stock
+}
+
+// order places an order for the fan and returns what ships from each warehouse
+func (suite *WarehouseTestSuite) order(body string) (models.Order, map[uint]int) {
+	var order models.Order
+	suite.Require().Equal(200, suite.request("POST", "/customers/orders", body, &order))
+	shipped := map[uint]int{}
+	for _, allocation := range order.Allocations {
+		shipped[allocation.WarehouseID] = allocation.Quantity
+	}
+	return order, shipped
+}
+
+// TestWarehouses checks stock is placed, moved and allocated by location, and returned where it
+// came from
+func (suite *WarehouseTestSuite) TestWarehouses() {
+	suite.Equal(201, suite.request("POST", "/warehouses", `{"name": "Test Nairobi", "latitude": -1.2921, "longitude": 36.8219}`, &suite.nairobi))
+	suite.Equal(201, suite.request("POST", "/warehouses", `{"name": "Test Mombasa", "latitude": -4.0435, "longitude": 39.6682}`, &suite.mombasa))
+	suite.Equal(409, suite.request("POST", "/warehouses", `{"name": "Test Mombasa"}`, nil))
+	nairobi, mombasa := suite.nairobi.ID, suite.mombasa.ID
+
+	// Stock counted in Nairobi adds to the total, stock sent to Mombasa comes out of unassigned
+	suite.Equal(200, suite.request("PUT", fmt.Sprintf("/warehouses/%d/stock/%d", nairobi, suite.fan.ID), `{"quantity": 6}`, nil))
+	transfer := fmt.Sprintf(`{"product_id": %d, "to_warehouse_id": %d, "quantity": %%d}`, suite.fan.ID, mombasa)
+	suite.Equal(400, suite.request("POST", "/stock-transfers", fmt.Sprintf(transfer, 11), nil))
+	suite.Equal(201, suite.request("POST", "/stock-transfers", fmt.Sprintf(transfer, 4), nil))
+	suite.Equal(map[uint]int{0: 6, nairobi: 6, mombasa: 4}, suite.availability())
+
+	// Most stock first
+	suite.T().Setenv("WAREHOUSE_ALLOCATION", inventory.StrategyMostStock)
+	_, shipped := suite.order(fmt.Sprintf(`{"product_id": %d, "quantity": 8}`, suite.fan.ID))
+	suite.Equal(map[uint]int{nairobi: 6, mombasa: 2}, shipped)
+
+	// Nearest first, with unassigned stock making up the rest
+	suite.T().Setenv("WAREHOUSE_ALLOCATION", inventory.StrategyNearest)
+	suite.Equal(201, suite.request("POST", "/stock-transfers", fmt.Sprintf(`{"product_id": %d, "to_warehouse_id": %d, "quantity": 3}`, suite.fan.ID, nairobi), nil))
+	order, shipped := suite.order(fmt.Sprintf(`{"product_id": %d, "quantity": 4, "ship_to": {"latitude": -4.05, "longitude": 39.67}}`, suite.fan.ID))
+	suite.Equal(map[uint]int{mombasa: 2, nairobi: 2}, shipped)
+	suite.Equal(map[uint]int{0: 3, nairobi: 1}, suite.availability())
+
+	// Cancelling puts the items back where they shipped from
+	suite.Equal(200, suite.request("PUT", fmt.Sprintf("/orders/%d/status", order.ID), `{"status": "cancelled"}`, nil))
+	suite.Equal(map[uint]int{0: 3, nairobi: 3, mombasa: 2}, suite.availability())
+
+	mismatches, err := inventory.Reconcile()
+	suite.Require().NoError(err)
+	for _, m := range mismatches {
+		suite.NotEqual(suite.fan.ID, m.ProductID)
+	}
+}
+
+func TestWarehouseTestSuite(t *testing.T) {
+	suite.Run(t, new(WarehouseTestSuite))
+}
@@ -0,0 +1,207 @@
+package tests
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/leroysb/go_kubernetes/internal/api/handlers"
+	"github.com/leroysb/go_kubernetes/internal/database"
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"github.com/leroysb/go_kubernetes/internal/webhooks"
+	"github.com/stretchr/testify/suite"
+)
+
+type WebhookTestSuite struct {
+	apiSuite
+	server       *httptest.Server
+	subscription models.WebhookSubscription
+	mu           sync.Mutex
+	received     []*http.Request
+	bodies       [][]byte
+	failures     int
+}
+
+func (suite *WebhookTestSuite) SetupTest() {
+	database.ConnectDB()
+	webhooks.Backoff = 10 * time.Millisecond
+	suite.received, suite.bodies, suite.failures = nil, nil, 0
+
+	suite.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		suite.mu.Lock()
+		defer suite.mu.Unlock()
+		suite.received = append(suite.received, r)
+		suite.bodies = append(suite.bodies, body)
+		if suite.failures > 0 {
+			suite.failures--
+			w.WriteHeader(500)
+			return
+		}
+		w.WriteHeader(204)
+	}))
+
+	database.DB.Db.Model(&models.WebhookSubscription{}).Where("active = ?", true).Update("active", false)
+	suite.subscription = models.WebhookSubscription{
+		URL:    suite.server.URL,
+		Events: []string{webhooks.EventOrderCreated},
+		Secret: "test-secret",
+		Active: true,
+	}
+	suite.Require().NoError(database.DB.Db.Create(&suite.subscription).Error)
+}
+
+func (suite *WebhookTestSuite) TearDownTest() {
+	suite.server.Close()
+	database.DB.Db.Unscoped().Where("subscription_id = ?", suite.subscription.ID).Delete(&models.WebhookDelivery{})
+	database.DB.Db.Unscoped().Delete(&suite.subscription)
+}
+
+func (suite *WebhookTestSuite) deliveries() []models.WebhookDelivery {
+	var deliveries []models.WebhookDelivery
+	database.DB.Db.Where("subscription_id = ?", suite.subscription.ID).Order("id").Find(&deliveries)
+	return deliveries
+}
+
+func (suite *WebhookTestSuite) waitForStatus(status string, count int) []models.WebhookDelivery {
+	var deliveries []models.WebhookDelivery
+	suite.Eventually(func() bool {
+		deliveries = suite.deliveries()
+		done := 0
+		for _, d := range deliveries {
+			if d.Status == status {
+				done++
+			}
+		}
+		return done == count
+	}, 2*time.Second, 10*time.Millisecond)
+	return deliveries
+}
+
+// TestSignedDelivery checks that subscribers receive a payload they can verify with their secret
+func (suite *WebhookTestSuite) TestSignedDelivery() {
+	webhooks.Emit(webhooks.EventOrderCreated, map[string]any{"id": 1})
+	webhooks.Emit(webhooks.EventProductUpdated, map[string]any{"id": 1})
+
+	deliveries := suite.waitForStatus(webhooks.StatusSucceeded, 1)
+	suite.Require().Len(deliveries, 1)
+
+	suite.mu.Lock()
+	defer suite.mu.Unlock()
+	req := suite.received[0]
+	timestamp, _ := strconv.ParseInt(req.Header.Get("X-Webhook-Timestamp"), 10, 64)
+	suite.Equal(webhooks.EventOrderCreated, req.Header.Get("X-Webhook-Event"))
+	suite.Equal(webhooks.Sign("test-secret", timestamp, suite.bodies[0]), req.Header.Get("X-Webhook-Signature"))
+}
+
+// TestRetryAndReplay checks that failed attempts are retried and a logged delivery can be sent again
+func (suite *WebhookTestSuite) TestRetryAndReplay() {
+	suite.failures = 2
+	webhooks.Emit(webhooks.EventOrderCreated, map[string]any{"id": 2})
+
+	deliveries := suite.waitForStatus(webhooks.StatusSucceeded, 1)
+	suite.Require().Len(deliveries, 1)
+	suite.Equal(3, deliveries[0].Attempts)
+
+	replay, err := webhooks.Replay(deliveries[0].ID)
+	suite.Require().NoError(err)
+	suite.Equal(deliveries[0].ID, *replay.ReplayOf)
+
+	deliveries = suite.waitForStatus(webhooks.StatusSucceeded, 2)
+	suite.Require().Len(deliveries, 2)
+	suite.Equal(deliveries[0].Payload, deliveries[1].Payload)
+}
+
+// TestPublishOnce checks an event published again with the same key is delivered once, carrying
+// the key, and that replays keep it
+func (suite *WebhookTestSuite) TestPublishOnce() {
+	suite.Require().NoError(webhooks.Publish(webhooks.EventOrderCreated, map[string]any{"id": 3}, "order-3-created"))
+	suite.Require().NoError(webhooks.Publish(webhooks.EventOrderCreated, map[string]any{"id": 3}, "order-3-created"))
+
+	deliveries := suite.waitForStatus(webhooks.StatusSucceeded, 1)
+	suite.Require().Len(deliveries, 1)
+	replay, err := webhooks.Replay(deliveries[0].ID)
+	suite.Require().NoError(err)
+	suite.Equal("order-3-created", *replay.IdempotencyKey)
+	suite.waitForStatus(webhooks.StatusSucceeded, 2)
+
+	suite.mu.Lock()
+	defer suite.mu.Unlock()
+	suite.Require().Len(suite.received, 2)
+	for _, req := range suite.received {
+		suite.Equal("order-3-created", req.Header.Get("X-Webhook-Idempotency-Key"))
+	}
+}
+
+// TestSecretShownOnce checks the signing secret is returned when a subscription is created or its
+// secret rotated, and never when subscriptions are read or changed
+func (suite *WebhookTestSuite) TestSecretShownOnce() {
+	suite.app = fiber.New()
+	suite.app.Get("/webhooks", handlers.GetWebhooks)
+	suite.app.Post("/webhooks", handlers.CreateWebhook)
+	suite.app.Put("/webhooks/:id", handlers.UpdateWebhook)
+	suite.app.Post("/webhooks/:id/secret", handlers.RotateWebhookSecret)
+	request := func(method, url, body string) map[string]any {
+		var out map[string]any
+		suite.request(method, url, body, &out)
+		return out
+	}
+
+	created := request("POST", "/webhooks", fmt.Sprintf(`{"url": %q, "events": ["order.created"]}`, suite.server.URL))
+	suite.Require().NotEmpty(created["secret"])
+	url := fmt.Sprintf("/webhooks/%d", uint(created["ID"].(float64)))
+	defer database.DB.Db.Unscoped().Delete(&models.WebhookSubscription{}, uint(created["ID"].(float64)))
+
+	suite.NotContains(request("PUT", url, `{"active": false}`), "secret")
+	for _, subscription := range request("GET", "/webhooks?limit=100", "")["data"].([]any) {
+		suite.NotContains(subscription, "secret")
+	}
+
+	rotated := request("POST", url+"/secret", "")
+	suite.Require().NotEmpty(rotated["secret"])
+	suite.NotEqual(created["secret"], rotated["secret"])
+	var stored models.WebhookSubscription
+	database.DB.Db.First(&stored, uint(created["ID"].(float64)))
+	suite.Equal(rotated["secret"], stored.Secret)
+}
+
+// TestGoneSubscription checks deliveries of a subscription that was deactivated or deleted are
+// neither replayed nor resumed
+func (suite *WebhookTestSuite) TestGoneSubscription() {
+	suite.app = fiber.New()
+	suite.app.Post("/webhooks/deliveries/:id/replay", handlers.ReplayWebhookDelivery)
+
+	webhooks.Emit(webhooks.EventOrderCreated, map[string]any{"id": 4})
+	deliveries := suite.waitForStatus(webhooks.StatusSucceeded, 1)
+	suite.Require().Len(deliveries, 1)
+	url := fmt.Sprintf("/webhooks/deliveries/%d/replay", deliveries[0].ID)
+
+	database.DB.Db.Model(&suite.subscription).Update("active", false)
+	suite.Equal(409, suite.request("POST", url, "", nil))
+
+	pending := models.WebhookDelivery{SubscriptionID: suite.subscription.ID, Event: webhooks.EventOrderCreated, Payload: deliveries[0].Payload, Status: webhooks.StatusPending}
+	suite.Require().NoError(database.DB.Db.Omit("Subscription").Create(&pending).Error)
+	database.DB.Db.Delete(&suite.subscription)
+	suite.Equal(404, suite.request("POST", url, "", nil))
+
+	webhooks.Resume()
+	var resumed models.WebhookDelivery
+	database.DB.Db.First(&resumed, pending.ID)
+	suite.Equal(webhooks.StatusFailed, resumed.Status)
+	suite.Equal(webhooks.ErrSubscriptionDeleted.Error(), resumed.LastError)
+	suite.Zero(resumed.Attempts)
+
+	suite.mu.Lock()
+	defer suite.mu.Unlock()
+	suite.Len(suite.received, 1)
+}
+
+func TestWebhookTestSuite(t *testing.T) {
+	suite.Run(t, new(WebhookTestSuite))
+}
@@ -0,0 +1,114 @@
+package tests
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/leroysb/go_kubernetes/internal/api/handlers"
+	"github.com/leroysb/go_kubernetes/internal/database"
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"github.com/leroysb/go_kubernetes/internal/notifications"
+	"github.com/leroysb/go_kubernetes/internal/webhooks"
+	"github.com/stretchr/testify/suite"
+)
+
+// sentMessages records the notifications it is asked to send
+type sentMessages struct {
+	messages []notifications.Message
+}
+
+func (s *sentMessages) Name() string {
+	return notifications.ChannelSMS
+}
+
+func (s *sentMessages) Send(customer *models.Customer, msg notifications.Message) error {
+	s.messages = append(s.messages, msg)
+	return nil
+}
+
+type WishlistTestSuite struct {
+	apiSuite
+	customer *models.Customer
+	kettle   *models.Product
+}
+
+func (suite *WishlistTestSuite) SetupTest() {
+	database.ConnectDB()
+
+	suite.customer = createCustomer(suite.T(), "Saver", "+254700000048")
+
+	suite.kettle = &models.Product{Name: "Wishlist Kettle", Price: kes(2900), Stock: 3}
+	createProducts(suite.T(), suite.kettle)
+
+	suite.app = fiber.New()
+	suite.app.Get("/customers/wishlist", asCustomer(suite.customer, handlers.GetWishlist))
+	suite.app.Post("/customers/wishlist", asCustomer(suite.customer, handlers.AddWishlistItem))
+	suite.app.Delete("/customers/wishlist/:product_id", asCustomer(suite.customer, handlers.DeleteWishlistItem))
+	suite.app.Post("/customers/wishlist/:product_id/cart", asCustomer(suite.customer, handlers.MoveWishlistItem))
+	suite.app.Put("/products/:id", handlers.UpdateProduct)
+}
+
+func (suite *WishlistTestSuite) TearDownTest() {
+	notifications.SetChannels(notifications.SMSChannel{}, notifications.EmailChannel{})
+	database.DB.Db.Unscoped().Where("customer_id = ?", suite.customer.ID).Delete(&models.WishlistItem{})
+	database.DB.Db.Unscoped().Where("aggregate_type = ? AND aggregate_id = ?", "product", suite.kettle.ID).Delete(&models.OutboxEvent{})
+	deleteCustomer(suite.customer)
+	deleteProducts(suite.kettle)
+}
+
+// TestWishlist checks products are saved once, listed, removed and moved to the cart
+func (suite *WishlistTestSuite) TestWishlist() {
+	add := fmt.Sprintf(`{"product_id": %d}`, suite.kettle.ID)
+	suite.Equal(200, suite.request("POST", "/customers/wishlist", add, nil))
+	var items []models.WishlistItem
+	suite.Equal(200, suite.request("POST", "/customers/wishlist", add, &items))
+	suite.Require().Len(items, 1)
+	suite.Equal(suite.kettle.Name, items[0].Product.Name)
+	suite.Equal(400, suite.request("POST", "/customers/wishlist", `{"product_id": 999999}`, nil))
+
+	item := fmt.Sprintf("/customers/wishlist/%d", suite.kettle.ID)
+	suite.Equal(200, suite.request("DELETE", item, "", &items))
+	suite.Empty(items)
+	suite.Equal(404, suite.request("DELETE", item, "", nil))
+
+	suite.Equal(200, suite.request("POST", "/customers/wishlist", add, nil))
+	suite.Equal(400, suite.request("POST", item+"/cart", `{"quantity": 4}`, nil))
+	var cart cartView
+	suite.Equal(200, suite.request("POST", item+"/cart", `{"quantity": 2}`, &cart))
+	suite.Require().Len(cart.Items, 1)
+	suite.Equal(2, cart.Items[0].Quantity)
+
+	suite.Equal(200, suite.request("GET", "/customers/wishlist", "", &items))
+	suite.Empty(items)
+
+	// Products deleted since they were saved are left out
+	suite.Equal(200, suite.request("POST", "/customers/wishlist", add, nil))
+	database.DB.Db.Delete(suite.kettle)
+	suite.Equal(200, suite.request("GET", "/customers/wishlist", "", &items))
+	suite.Empty(items)
+}
+
+// TestBackInStock checks restocking a sold out product tells the customers who saved it
+func (suite *WishlistTestSuite) TestBackInStock() {
+	sent := &sentMessages{}
+	notifications.SetChannels(sent)
+	database.DB.Db.Model(suite.kettle).Update("stock", 0)
+	suite.Equal(200, suite.request("POST", "/customers/wishlist", fmt.Sprintf(`{"product_id": %d}`, suite.kettle.ID), nil))
+
+	body := fmt.Sprintf(`{"name": %q, "price": 2900, "stock": 4}`, suite.kettle.Name)
+	suite.Equal(200, suite.request("PUT", fmt.Sprintf("/products/%d", suite.kettle.ID), body, nil))
+	suite.Equal(200, suite.request("PUT", fmt.Sprintf("/products/%d", suite.kettle.ID), body, nil))
+
+	var events int64
+	database.DB.Db.Model(&models.OutboxEvent{}).Where("event_type = ? AND aggregate_id = ?", webhooks.EventProductRestocked, suite.kettle.ID).Count(&events)
+	suite.Equal(int64(1), events)
+
+	suite.Require().NoError(notifications.SendBackInStock(suite.kettle.ID))
+	suite.Require().Len(sent.messages, 1)
+	suite.Contains(sent.messages[0].Short, "Wishlist Kettle from your wishlist is back in stock")
+}
+
+func TestWishlistTestSuite(t *testing.T) {
+	suite.Run(t, new(WishlistTestSuite))
+}
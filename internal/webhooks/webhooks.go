@@ -0,0 +1,336 @@
+package webhooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/leroysb/go_kubernetes/internal/database"
+	"github.com/leroysb/go_kubernetes/internal/database/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Events that can be subscribed to
+const (
+	EventOrderCreated       = "order.created"
+	EventOrderStatusChanged = "order.status_changed"
+	EventOrderRefunded      = "order.refunded"
+	EventProductUpdated     = "product.updated"
+	EventProductStockLow    = "product.stock_low"
+	EventProductRestocked   = "product.restocked"
+)
+
+var Events = []string{EventOrderCreated, EventOrderStatusChanged, EventOrderRefunded, EventProductUpdated, EventProductStockLow, EventProductRestocked}
+
+// Delivery statuses
+const (
+	StatusPending   = "pending"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+)
+
+var (
+	ErrSubscriptionDeleted  = errors.New("Subscription of the delivery was deleted")
+	ErrSubscriptionInactive = errors.New("Subscription of the delivery is not active")
+)
+
+// MaxAttempts is the number of times a delivery is tried before it is marked failed
+var MaxAttempts = 6
+
+// Backoff is the delay before the first retry. Each further retry doubles it
+var Backoff = 30 * time.Second
+
+var client = &http.Client{Timeout: 10 * time.Second}
+
+// Envelope is the JSON body posted to subscribers
+type Envelope struct {
+	Event     string    `json:"event"`
+	CreatedAt time.Time `json:"created_at"`
+	Data      any       `json:"data"`
+}
+
+// IsEvent reports whether name is a known event
+func IsEvent(name string) bool {
+	for _, event := range Events {
+		if event == name {
+			return true
+		}
+	}
+	return false
+}
+
+// NewSecret generates a random signing secret for a subscription
+func NewSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
+
+// Sign returns the signature of a payload sent at the given unix timestamp
+func Sign(secret string, timestamp int64, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// LowStockThreshold is the stock level at or below which product.stock_low is emitted
+func LowStockThreshold() int {
+	threshold, err := strconv.Atoi(os.Getenv("LOW_STOCK_THRESHOLD"))
+	if err != nil {
+		return 5
+	}
+	return threshold
+}
+
+// LowStockCrossed reports whether a stock change crossed the low stock threshold, which triggers product.stock_low
+func LowStockCrossed(previousStock, stock int) bool {
+	threshold := LowStockThreshold()
+	return stock <= threshold && previousStock > threshold
+}
+
+// Restocked reports whether a stock change brought a sold out product back, which triggers product.restocked
+func Restocked(previousStock, stock int) bool {
+	return previousStock <= 0 && stock > 0
+}
+
+// Publish records a delivery for every active subscription to the event and dispatches them in the background.
+// An error means no delivery was recorded and the event should be published again. A non-empty key
+// is sent to subscribers to discard duplicates, and an event published again with the same key is
+// not recorded a second time for subscriptions that already have it
+func Publish(event string, data any, key string) error {
+	deliveries, err := enqueue(event, data, key)
+	if err != nil {
+		return err
+	}
+
+	for i := range deliveries {
+		go deliver(&deliveries[i])
+	}
+	return nil
+}
+
+// Emit publishes the event, logging instead of returning failures
+func Emit(event string, data any) {
+	if err := Publish(event, data, ""); err != nil {
+		log.Printf("Error enqueueing %s webhooks: %v", event, err)
+	}
+}
+
+func enqueue(event string, data any, key string) ([]models.WebhookDelivery, error) {
+	payload, err := json.Marshal(Envelope{Event: event, CreatedAt: time.Now().UTC(), Data: data})
+	if err != nil {
+		return nil, err
+	}
+
+	var subscriptions []models.WebhookSubscription
+	if err := database.DB.Db.Where("active = ?", true).Find(&subscriptions).Error; err != nil {
+		return nil, err
+	}
+
+	var idempotencyKey *string
+	if key != "" {
+		idempotencyKey = &key
+	}
+
+	// The deliveries are recorded together, so a failure leaves none behind to be duplicated when
+	// the event is published again
+	var deliveries []models.WebhookDelivery
+	err = database.DB.Db.Transaction(func(tx *gorm.DB) error {
+		for _, subscription := range subscriptions {
+			if !subscribed(subscription, event) {
+				continue
+			}
+
+			delivery := models.WebhookDelivery{
+				SubscriptionID: subscription.ID,
+				Subscription:   subscription,
+				Event:          event,
+				Payload:        string(payload),
+				Status:         StatusPending,
+				IdempotencyKey: idempotencyKey,
+			}
+			result := tx.Omit("Subscription").Clauses(clause.OnConflict{DoNothing: true}).Create(&delivery)
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				// Already recorded the last time the event was published
+				continue
+			}
+			deliveries = append(deliveries, delivery)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return deliveries, nil
+}
+
+func subscribed(subscription models.WebhookSubscription, event string) bool {
+	for _, e := range subscription.Events {
+		if e == event || e == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// loadSubscription loads the subscription of a delivery, deleted or not, and returns
+// ErrSubscriptionDeleted or ErrSubscriptionInactive when the delivery cannot be sent to it
+func loadSubscription(delivery *models.WebhookDelivery) error {
+	if err := database.DB.Db.Unscoped().First(&delivery.Subscription, delivery.SubscriptionID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrSubscriptionDeleted
+		}
+		return err
+	}
+	if delivery.Subscription.DeletedAt.Valid {
+		return ErrSubscriptionDeleted
+	}
+	if !delivery.Subscription.Active {
+		return ErrSubscriptionInactive
+	}
+	return nil
+}
+
+// Replay records a new delivery with the payload of an earlier one and dispatches it. A delivery
+// whose subscription was deleted or is not active is not replayed
+func Replay(deliveryID uint) (*models.WebhookDelivery, error) {
+	var original models.WebhookDelivery
+	if err := database.DB.Db.First(&original, deliveryID).Error; err != nil {
+		return nil, err
+	}
+	if err := loadSubscription(&original); err != nil {
+		return nil, err
+	}
+
+	replay := models.WebhookDelivery{
+		SubscriptionID: original.SubscriptionID,
+		Subscription:   original.Subscription,
+		Event:          original.Event,
+		Payload:        original.Payload,
+		Status:         StatusPending,
+		ReplayOf:       &original.ID,
+		IdempotencyKey: original.IdempotencyKey,
+	}
+	if err := database.DB.Db.Omit("Subscription").Create(&replay).Error; err != nil {
+		return nil, err
+	}
+
+	go deliver(&replay)
+
+	return &replay, nil
+}
+
+// Resume dispatches deliveries left pending, for example by a restart during backoff. Those whose
+// subscription was deleted or deactivated since are failed instead
+func Resume() {
+	var deliveries []models.WebhookDelivery
+	if err := database.DB.Db.Where("status = ?", StatusPending).Find(&deliveries).Error; err != nil {
+		log.Printf("Error loading pending webhook deliveries: %v", err)
+		return
+	}
+
+	for i := range deliveries {
+		delivery := &deliveries[i]
+		if err := loadSubscription(delivery); err != nil {
+			if !errors.Is(err, ErrSubscriptionDeleted) && !errors.Is(err, ErrSubscriptionInactive) {
+				log.Printf("Error loading the subscription of webhook delivery %d: %v", delivery.ID, err)
+				continue
+			}
+			delivery.Status, delivery.LastError, delivery.NextAttemptAt = StatusFailed, err.Error(), nil
+			if err := database.DB.Db.Omit("Subscription").Save(delivery).Error; err != nil {
+				log.Printf("Error saving webhook delivery %d: %v", delivery.ID, err)
+			}
+			continue
+		}
+		go deliver(delivery)
+	}
+}
+
+// deliver posts the payload until it is accepted or MaxAttempts is reached, doubling the delay between attempts
+func deliver(delivery *models.WebhookDelivery) {
+	for delivery.Attempts < MaxAttempts {
+		if delivery.NextAttemptAt != nil {
+			time.Sleep(time.Until(*delivery.NextAttemptAt))
+		}
+
+		status, err := post(delivery)
+		delivery.Attempts++
+		delivery.ResponseStatus = status
+
+		now := time.Now()
+		if err == nil {
+			delivery.Status = StatusSucceeded
+			delivery.LastError = ""
+			delivery.DeliveredAt = &now
+			delivery.NextAttemptAt = nil
+		} else {
+			delivery.LastError = err.Error()
+			if delivery.Attempts >= MaxAttempts {
+				delivery.Status = StatusFailed
+				delivery.NextAttemptAt = nil
+			} else {
+				next := now.Add(Backoff * time.Duration(1<<(delivery.Attempts-1)))
+				delivery.NextAttemptAt = &next
+			}
+		}
+
+		if err := database.DB.Db.Omit("Subscription").Save(delivery).Error; err != nil {
+			log.Printf("Error saving webhook delivery %d: %v", delivery.ID, err)
+		}
+
+		if delivery.Status != StatusPending {
+			return
+		}
+	}
+}
+
+func post(delivery *models.WebhookDelivery) (int, error) {
+	payload := []byte(delivery.Payload)
+	timestamp := time.Now().Unix()
+
+	req, err := http.NewRequest("POST", delivery.Subscription.URL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", delivery.Event)
+	req.Header.Set("X-Webhook-Delivery", strconv.FormatUint(uint64(delivery.ID), 10))
+	req.Header.Set("X-Webhook-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("X-Webhook-Signature", Sign(delivery.Subscription.Secret, timestamp, payload))
+	if delivery.IdempotencyKey != nil {
+		req.Header.Set("X-Webhook-Idempotency-Key", *delivery.IdempotencyKey)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	return resp.StatusCode, nil
+}